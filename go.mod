@@ -2,10 +2,11 @@ module github.com/mipt-kp-2024-go-beer/user-service
 
 go 1.23.1
 
-require github.com/lib/pq v1.10.9
-
 require (
-	github.com/jmoiron/sqlx v1.4.0 // indirect
-	golang.org/x/sync v0.9.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
+	github.com/lib/pq v1.10.9
+	golang.org/x/crypto v0.31.0
+	golang.org/x/sync v0.9.0
+	gopkg.in/yaml.v3 v3.0.1
 )
+
+require golang.org/x/sys v0.28.0 // indirect
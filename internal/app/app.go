@@ -8,8 +8,11 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 
 	users "github.com/mipt-kp-2024-go-beer/user-service/internal"
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/jwt"
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/mail"
 	database "github.com/mipt-kp-2024-go-beer/user-service/internal/storage/postgresql"
 	"golang.org/x/sync/errgroup"
 )
@@ -50,29 +53,133 @@ func (a *App) Setup(ctx context.Context, dsn string) error {
 
 	//store := fridgeStore.NewStorage(db)
 	// store := sqlite.NewStorage(db)
-	psqlInfo := fmt.Sprintf("host=%s port=%d user=%s "+
-		"password=%s dbname=%s sslmode=disable",
-		host, port, user, password, dbname)
-	store, err := database.NewStorage(psqlInfo)
-
+	store, err := a.openStore()
 	if err != nil {
 		return err
 	}
 
-	service := users.NewAppService(store)
-	handler := users.NewHandler(service, a.open, a.secret)
+	if a.config.Migrate {
+		if err := store.Migrate(ctx); err != nil {
+			return err
+		}
+	}
+
+	opts := []users.Option{users.WithTokenTTL(a.config.AccessTTL, a.config.RefreshTTL)}
+	switch a.config.TokenMode {
+	case "", TokenModeOpaque:
+	case TokenModeJWT:
+		signer, err := a.signer()
+		if err != nil {
+			return err
+		}
+		log.Println("issuing jwt access tokens with key", signer.KeyID())
+		opts = append(opts, users.WithSigner(signer))
+	default:
+		return fmt.Errorf("unknown token mode %q", a.config.TokenMode)
+	}
+
+	mailer, err := a.mailer()
+	if err != nil {
+		return err
+	}
+	opts = append(opts, users.WithAttempts(store, users.ThrottlePolicy{
+		Threshold: a.config.LockoutThreshold,
+		Lockout:   a.config.LockoutDuration,
+	}))
+	opts = append(opts, users.WithMailer(mailer), users.WithVerifyURL(a.config.VerifyURL), users.WithResetURL(a.config.ResetURL))
+	opts = append(opts, users.WithTOTPIssuer(a.config.TOTPIssuer), users.WithWebAuthn(a.config.WebAuthn))
+
+	service := users.NewAppService(store, opts...)
+	handler := users.NewHandler(service, a.open, a.secret, users.WithLegacyTokens(a.config.LegacyTokens))
 	handler.Register()
+	if err := handler.CheckSpec(); err != nil {
+		return err
+	}
+	a.public.Handler = handler.Wrap(a.open)
+	a.private.Handler = handler.Wrap(a.secret)
 
-	ID, err := service.NewUser(ctx, users.User{Login: a.config.Login, Password: a.config.Password, Permissions: 0x1111111})
-	println(ID)
+	ID, err := service.NewUser(ctx, users.User{Login: a.config.Login, Password: a.config.Password, Roles: []string{"admin"}})
 	if err != nil {
-		fmt.Errorf("%w", err)
+		log.Println("bootstrap admin:", err)
+	} else {
+		log.Println("bootstrap admin created with id", ID)
 	}
 	// shelfService := shelf.NewAppService(store)
 
 	return nil
 }
 
+// Migrate runs the migrate command: "up" applies all pending migrations,
+// "down [n]" reverts the last n (default 1) applied migrations.
+func (a *App) Migrate(ctx context.Context, args []string) error {
+	store, err := a.openStore()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	direction := "up"
+	if len(args) > 0 {
+		direction = args[0]
+	}
+
+	switch direction {
+	case "up":
+		return store.Migrate(ctx)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of steps %q", args[1])
+			}
+		}
+		return store.Rollback(ctx, steps)
+	default:
+		return fmt.Errorf("unknown migrate direction %q, expected up or down", direction)
+	}
+}
+
+func (a *App) signer() (*jwt.Signer, error) {
+	if a.config.SigningKey != "" {
+		return jwt.LoadSigner(a.config.SigningKey)
+	}
+
+	// tokens won't survive a restart and replicas won't trust each other
+	log.Println("no signing key configured, generating an ephemeral one")
+	return jwt.GenerateSigner()
+}
+
+func (a *App) mailer() (mail.Mailer, error) {
+	from := a.config.SMTP.From
+	if from == "" {
+		from = "user-service@localhost"
+	}
+
+	switch a.config.Mailer {
+	case "", MailerLog:
+		return mail.NewLog(nil), nil
+	case MailerDir:
+		if a.config.MailDir == "" {
+			return nil, fmt.Errorf("mailer %q requires maildir", MailerDir)
+		}
+		return mail.NewDir(a.config.MailDir, from)
+	case MailerSMTP:
+		if a.config.SMTP.Host == "" || a.config.SMTP.From == "" {
+			return nil, fmt.Errorf("mailer %q requires smtp host and from", MailerSMTP)
+		}
+		return mail.NewSMTP(a.config.SMTP), nil
+	default:
+		return nil, fmt.Errorf("unknown mailer %q", a.config.Mailer)
+	}
+}
+
+func (a *App) openStore() (*database.Storage, error) {
+	psqlInfo := fmt.Sprintf("host=%s port=%d user=%s "+
+		"password=%s dbname=%s sslmode=disable",
+		host, port, user, password, dbname)
+	return database.NewStorage(psqlInfo)
+}
+
 func (a *App) Start() error {
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer stop()
@@ -0,0 +1,76 @@
+package users
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/oops"
+)
+
+// Check modes of Authorize.
+const (
+	CheckAll = "all" // every required permission must be held
+	CheckAny = "any" // one of the required permissions is enough
+)
+
+// Check is one authorization question: does the caller hold the required permissions.
+// Required permissions are the union of Mask and the named Permissions.
+type Check struct {
+	ID          string   `json:"id,omitempty"` // echoed back to match batch results
+	Mask        uint     `json:"mask,omitempty"`
+	Permissions []string `json:"permissions,omitempty"`
+	Mode        string   `json:"mode,omitempty"` // CheckAll (default) or CheckAny
+}
+
+// Decision is the answer to a Check.
+type Decision struct {
+	ID      string   `json:"id,omitempty"`
+	Allow   bool     `json:"allow"`
+	Missing []string `json:"missing"` // required permissions the caller does not hold
+}
+
+// Authorize evaluates the checks against the effective permissions of the token owner,
+// resolving the token only once for the whole batch.
+// @param ctx context.Context for managing the scope of the operation.
+// @param access string representing the access token to authorize.
+// @param checks []Check questions to answer.
+// @return string subject ID, []Decision in the order of checks and an error if the token or a check is invalid.
+func (s *AppService) Authorize(ctx context.Context, access string, checks []Check) (string, []Decision, error) {
+	// validate the checks before touching the store
+	required := make([]uint, len(checks))
+	for i, check := range checks {
+		mask, err := Permissions.Mask(check.Permissions)
+		if err != nil {
+			return "", nil, err
+		}
+		if unknown := check.Mask &^ Permissions.All(); unknown != 0 {
+			return "", nil, fmt.Errorf("%w: bits %#x", oops.ErrUnknownPermission, unknown)
+		}
+		if check.Mode != "" && check.Mode != CheckAll && check.Mode != CheckAny {
+			return "", nil, fmt.Errorf("%w: unknown mode %q", oops.ErrInvalidCheck, check.Mode)
+		}
+		required[i] = mask | check.Mask
+	}
+
+	ID, permissions, err := s.caller(ctx, access)
+	if err != nil {
+		return "", nil, err
+	}
+
+	decisions := make([]Decision, len(checks))
+	for i, check := range checks {
+		missing := required[i] &^ permissions
+
+		allow := missing == 0
+		if check.Mode == CheckAny {
+			allow = required[i] == 0 || required[i]&permissions != 0
+		}
+		if allow {
+			missing = 0
+		}
+
+		decisions[i] = Decision{ID: check.ID, Allow: allow, Missing: Permissions.Names(missing)}
+	}
+
+	return ID, decisions, nil
+}
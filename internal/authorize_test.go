@@ -0,0 +1,119 @@
+package users_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+
+	users "github.com/mipt-kp-2024-go-beer/user-service/internal"
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/oops"
+)
+
+func TestAuthorize(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t)
+	ID, session := env.user(t, "alice", users.PermQueryUsers|users.PermLoanBooks)
+
+	for _, test := range []struct {
+		name    string
+		check   users.Check
+		allow   bool
+		missing []string
+	}{
+		{"held mask", users.Check{Mask: users.PermQueryUsers}, true, nil},
+		{"held names", users.Check{Permissions: []string{"query_users", "loan_books"}}, true, nil},
+		{"mask and names combined", users.Check{Mask: users.PermLoanBooks, Permissions: []string{"manage_users"}},
+			false, []string{"manage_users"}},
+		{"missing mask", users.Check{Mask: users.PermQueryUsers | users.PermManageBooks | users.PermManageUsers},
+			false, []string{"manage_books", "manage_users"}},
+		{"all by default", users.Check{Permissions: []string{"loan_books", "manage_books"}}, false, []string{"manage_books"}},
+		{"all", users.Check{Permissions: []string{"loan_books", "manage_books"}, Mode: users.CheckAll}, false, []string{"manage_books"}},
+		{"any held", users.Check{Permissions: []string{"loan_books", "manage_books"}, Mode: users.CheckAny}, true, nil},
+		{"any missing", users.Check{Mask: users.PermManageBooks | users.PermManageUsers, Mode: users.CheckAny},
+			false, []string{"manage_books", "manage_users"}},
+		{"nothing required", users.Check{}, true, nil},
+		{"nothing required of any", users.Check{Mode: users.CheckAny}, true, nil},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			subject, decisions, err := env.service.Authorize(ctx, session.Access, []users.Check{test.check})
+			if err != nil {
+				t.Fatalf("Authorize() error = %v", err)
+			}
+			if subject != ID {
+				t.Errorf("Authorize() subject = %q, want %q", subject, ID)
+			}
+			if got := decisions[0]; got.Allow != test.allow || len(got.Missing) != len(test.missing) ||
+				len(test.missing) != 0 && !reflect.DeepEqual(got.Missing, test.missing) {
+				t.Errorf("Authorize() = %+v, want allow %v missing %v", got, test.allow, test.missing)
+			}
+		})
+	}
+
+	for name, check := range map[string]users.Check{
+		"unknown name": {Permissions: []string{"fly"}},
+		"unknown bit":  {Mask: 1 << 30},
+		"unknown mode": {Mask: users.PermQueryUsers, Mode: "most"},
+	} {
+		if _, _, err := env.service.Authorize(ctx, session.Access, []users.Check{check}); err == nil {
+			t.Errorf("Authorize() of a check with an %s succeeded", name)
+		}
+	}
+	if _, _, err := env.service.Authorize(ctx, "unknown", []users.Check{{}}); !errors.Is(err, oops.ErrTokenExistance) {
+		t.Errorf("Authorize() with an unknown token error = %v, want ErrTokenExistance", err)
+	}
+}
+
+func TestAuthorizeBatch(t *testing.T) {
+	env := newTestEnv(t)
+	ID, session := env.user(t, "alice", users.PermQueryUsers|users.PermLoanBooks)
+
+	var single struct {
+		Subject string   `json:"sub"`
+		Allow   bool     `json:"allow"`
+		Missing []string `json:"missing"`
+	}
+	check := map[string]any{"permissions": []string{"loan_books", "manage_books"}}
+	if status := call(t, env.private, http.MethodPost, "/v1/authorize", session.Access, check, &single); status != http.StatusOK {
+		t.Fatalf("POST /v1/authorize = %d, want 200", status)
+	}
+	if single.Subject != ID || single.Allow || !reflect.DeepEqual(single.Missing, []string{"manage_books"}) {
+		t.Errorf("POST /v1/authorize = %+v, want %s denied missing manage_books", single, ID)
+	}
+
+	// the results keep the order and IDs of the checks
+	var batch struct {
+		Subject string           `json:"sub"`
+		Results []users.Decision `json:"results"`
+	}
+	checks := map[string]any{"checks": []users.Check{
+		{ID: "lend", Permissions: []string{"loan_books"}},
+		{ID: "stock", Mask: users.PermChangeTotalStock | users.PermQueryTotalStock},
+		{ID: "either", Mask: users.PermManageBooks | users.PermQueryUsers, Mode: users.CheckAny},
+	}}
+	if status := call(t, env.private, http.MethodPost, "/v1/authorize", session.Access, checks, &batch); status != http.StatusOK {
+		t.Fatalf("POST /v1/authorize with checks = %d, want 200", status)
+	}
+	want := []users.Decision{
+		{ID: "lend", Allow: true},
+		{ID: "stock", Allow: false, Missing: []string{"query_total_stock", "change_total_stock"}},
+		{ID: "either", Allow: true},
+	}
+	if batch.Subject != ID || len(batch.Results) != len(want) {
+		t.Fatalf("POST /v1/authorize with checks = %+v, want %d results for %s", batch, len(want), ID)
+	}
+	for i, got := range batch.Results {
+		if got.ID != want[i].ID || got.Allow != want[i].Allow || len(got.Missing) != len(want[i].Missing) ||
+			len(got.Missing) != 0 && !reflect.DeepEqual(got.Missing, want[i].Missing) {
+			t.Errorf("result %d = %+v, want %+v", i, got, want[i])
+		}
+	}
+
+	// one invalid check refuses the whole batch
+	var problem users.Problem
+	invalid := map[string]any{"checks": []users.Check{{ID: "lend", Mask: users.PermLoanBooks}, {ID: "fly", Permissions: []string{"fly"}}}}
+	if status := call(t, env.private, http.MethodPost, "/v1/authorize", session.Access, invalid, &problem); status != http.StatusBadRequest {
+		t.Errorf("POST /v1/authorize with an invalid check = %d %q, want 400", status, problem.Code)
+	}
+}
@@ -0,0 +1,57 @@
+package users
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBearerToken(t *testing.T) {
+	for header, want := range map[string]string{
+		"":                       "",
+		"Bearer abc":             "abc",
+		"bearer abc":             "abc",
+		"BEARER abc":             "abc",
+		"Bearer  abc ":           "abc",
+		"Bearer":                 "",
+		"Basic YWxpY2U6c2VjcmV0": "",
+		"Token abc":              "",
+		"abc":                    "",
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if header != "" {
+			r.Header.Set("Authorization", header)
+		}
+		if got := bearerToken(r); got != want {
+			t.Errorf("bearerToken(%q) = %q, want %q", header, got, want)
+		}
+	}
+}
+
+func TestAccessTokenLegacy(t *testing.T) {
+	for _, test := range []struct {
+		legacy bool
+		header string
+		body   string
+		want   string
+	}{
+		{false, "Bearer header", "", "header"},
+		{false, "", "body", ""},
+		{false, "Bearer header", "body", "header"},
+		{true, "Bearer header", "", "header"},
+		{true, "", "body", "body"},
+		// the header wins, a body token cannot override the authenticated caller
+		{true, "Bearer header", "body", "header"},
+		{true, "Basic YWxpY2U6c2VjcmV0", "body", "body"},
+	} {
+		h := NewHandler(nil, nil, nil, WithLegacyTokens(test.legacy))
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		if test.header != "" {
+			r.Header.Set("Authorization", test.header)
+		}
+		if got := h.accessToken(r, test.body); got != test.want {
+			t.Errorf("accessToken() with legacy tokens %v, header %q and body %q = %q, want %q",
+				test.legacy, test.header, test.body, got, test.want)
+		}
+	}
+}
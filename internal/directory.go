@@ -0,0 +1,217 @@
+package users
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/oops"
+)
+
+// Statuses of a user account.
+const (
+	StatusActive   = "active"
+	StatusDisabled = "disabled" // may not log in
+)
+
+// Sort orders of the user directory, a leading "-" sorts descending.
+const (
+	SortLogin     = "login"
+	SortLoginDesc = "-login"
+	SortID        = "id"
+	SortIDDesc    = "-id"
+)
+
+// DefaultPageSize and MaxPageSize bound the number of users returned per page.
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 200
+)
+
+// UserQuery selects one page of the user directory.
+type UserQuery struct {
+	Sort        string      // one of the Sort* orders
+	After       *UserCursor // position after which the page starts, nil for the first page
+	Limit       int         // number of users to return
+	LoginPrefix string      // logins starting with it
+	Permission  uint        // users holding every bit of it, roles included
+	Role        string      // users assigned the role
+	Status      string      // users with the status
+	Email       string      // users with the email, compared after normalization
+}
+
+// UserCursor is the position of the last user of a page in the sort order.
+type UserCursor struct {
+	Sort string `json:"s"`
+	Key  string `json:"k"` // value of the sort column
+	ID   string `json:"i"` // tie breaker
+}
+
+// UserPage is one page of the user directory.
+type UserPage struct {
+	Users      []UserView `json:"users"`
+	NextCursor string     `json:"next_cursor,omitempty"` // empty on the last page
+}
+
+// UserView is the representation of a user returned by the API, it never carries password material.
+type UserView struct {
+	ID            string            `json:"id"`
+	Login         string            `json:"login"`
+	Permissions   uint              `json:"permissions"`
+	Roles         []string          `json:"roles"`
+	Status        string            `json:"status"`
+	Version       int64             `json:"version"`
+	Email         string            `json:"email,omitempty"`
+	EmailVerified bool              `json:"email_verified"`
+	DisplayName   string            `json:"display_name,omitempty"`
+	Attributes    map[string]string `json:"attributes"`
+	CreatedAt     time.Time         `json:"created_at"`
+	UpdatedAt     time.Time         `json:"updated_at"`
+}
+
+// NewUserView strips the password and other internals from the user.
+func NewUserView(user User) UserView {
+	roles := user.Roles
+	if roles == nil {
+		roles = []string{}
+	}
+	attributes := user.Attributes
+	if attributes == nil {
+		attributes = map[string]string{}
+	}
+
+	return UserView{
+		ID:            user.ID,
+		Login:         user.Login,
+		Permissions:   user.Permissions,
+		Roles:         roles,
+		Status:        user.Status,
+		Version:       user.Version,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified,
+		DisplayName:   user.DisplayName,
+		Attributes:    attributes,
+		CreatedAt:     user.CreatedAt,
+		UpdatedAt:     user.UpdatedAt,
+	}
+}
+
+// EncodeCursor makes the opaque cursor string handed to clients.
+func EncodeCursor(cursor UserCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// DecodeCursor parses a cursor produced by EncodeCursor.
+func DecodeCursor(value string) (UserCursor, error) {
+	var cursor UserCursor
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return cursor, fmt.Errorf("%w: malformed cursor", oops.ErrInvalidQuery)
+	}
+
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return cursor, fmt.Errorf("%w: malformed cursor", oops.ErrInvalidQuery)
+	}
+
+	return cursor, nil
+}
+
+// ListUsers returns one page of the user directory, requires PermQueryUsers.
+// @param ctx context.Context for managing the scope of the operation.
+// @param token string containing the access token of the caller.
+// @param query UserQuery filters and order of the directory, After is ignored in favour of cursor.
+// @param cursor string returned as NextCursor of the previous page, empty for the first page.
+// @return UserPage with the users and the cursor of the next page, and an error if the operation fails.
+func (s *AppService) ListUsers(ctx context.Context, token string, query UserQuery, cursor string) (UserPage, error) {
+	_, permissions, err := s.caller(ctx, token)
+	if err != nil {
+		return UserPage{}, err
+	}
+
+	if permissions&PermQueryUsers == 0 {
+		return UserPage{}, &PermissionError{Err: oops.ErrWrongPermissions, Missing: PermQueryUsers,
+			Detail: "listing users requires query_users"}
+	}
+
+	if err := normalizeQuery(&query, cursor); err != nil {
+		return UserPage{}, err
+	}
+
+	// one extra row tells whether there is a next page
+	limit := query.Limit
+	query.Limit++
+
+	found, err := s.store.LoadUsers(ctx, query)
+	if err != nil {
+		return UserPage{}, err
+	}
+
+	page := UserPage{Users: make([]UserView, 0, limit)}
+	if len(found) > limit {
+		found = found[:limit]
+		last := found[limit-1]
+
+		next := UserCursor{Sort: query.Sort, Key: last.ID, ID: last.ID}
+		if strings.TrimPrefix(query.Sort, "-") == SortLogin {
+			next.Key = last.Login
+		}
+		page.NextCursor = EncodeCursor(next)
+	}
+
+	for _, user := range found {
+		page.Users = append(page.Users, NewUserView(user))
+	}
+
+	return page, nil
+}
+
+// normalizeQuery applies defaults and validates the query.
+// @param query *UserQuery to be checked and completed.
+// @param cursor string position to continue from, must belong to the same sort order.
+// @return error wrapping oops.ErrInvalidQuery describing the problem.
+func normalizeQuery(query *UserQuery, cursor string) error {
+	switch query.Sort {
+	case "":
+		query.Sort = SortLogin
+	case SortLogin, SortLoginDesc, SortID, SortIDDesc:
+	default:
+		return fmt.Errorf("%w: unknown sort order %q", oops.ErrInvalidQuery, query.Sort)
+	}
+
+	switch {
+	case query.Limit == 0:
+		query.Limit = DefaultPageSize
+	case query.Limit < 0 || query.Limit > MaxPageSize:
+		return fmt.Errorf("%w: limit must be between 1 and %d", oops.ErrInvalidQuery, MaxPageSize)
+	}
+
+	switch query.Status {
+	case "", StatusActive, StatusDisabled:
+	default:
+		return fmt.Errorf("%w: unknown status %q", oops.ErrInvalidQuery, query.Status)
+	}
+
+	query.Email = NormalizeEmail(query.Email)
+
+	if err := Permissions.Validate(query.Permission &^ Permissions.All()); err != nil {
+		return fmt.Errorf("%w: %v", oops.ErrInvalidQuery, err)
+	}
+
+	query.After = nil
+	if cursor != "" {
+		after, err := DecodeCursor(cursor)
+		if err != nil {
+			return err
+		}
+		if after.Sort != query.Sort {
+			return fmt.Errorf("%w: cursor belongs to sort order %q", oops.ErrInvalidQuery, after.Sort)
+		}
+		query.After = &after
+	}
+
+	return nil
+}
@@ -0,0 +1,181 @@
+package users_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	users "github.com/mipt-kp-2024-go-beer/user-service/internal"
+)
+
+// listUsers fetches one page of GET /v1/users with the query parameters.
+func listUsers(t *testing.T, env *testEnv, token string, params url.Values) (int, users.UserPage) {
+	t.Helper()
+
+	var page users.UserPage
+	status := call(t, env.public, http.MethodGet, "/v1/users?"+params.Encode(), token, nil, &page)
+	return status, page
+}
+
+// logins walks every page of the directory and returns the logins in the order they were listed.
+func logins(t *testing.T, env *testEnv, token string, params url.Values) []string {
+	t.Helper()
+
+	var listed []string
+	for pages := 0; ; pages++ {
+		if pages > 100 {
+			t.Fatal("GET /v1/users did not reach the last page")
+		}
+		status, page := listUsers(t, env, token, params)
+		if status != http.StatusOK {
+			t.Fatalf("GET /v1/users?%s = %d, want 200", params.Encode(), status)
+		}
+		for _, user := range page.Users {
+			listed = append(listed, user.Login)
+		}
+		if page.NextCursor == "" {
+			return listed
+		}
+		params.Set("cursor", page.NextCursor)
+	}
+}
+
+func TestListUsersPages(t *testing.T) {
+	env := newTestEnv(t)
+	_, admin := env.user(t, "admin", users.PermQueryUsers)
+
+	// created out of login order, so that the orders by ID and by login differ
+	created := []string{"admin"}
+	for _, login := range []string{"mallory", "bob", "zed", "alice", "carol", "dave", "erin"} {
+		env.user(t, login, 0)
+		created = append(created, login)
+	}
+	byLogin := slices.Sorted(slices.Values(created))
+
+	for _, test := range []struct {
+		sort string
+		want []string
+	}{
+		{"", byLogin},
+		{users.SortLogin, byLogin},
+		{users.SortLoginDesc, reversed(byLogin)},
+		{users.SortID, created},
+		{users.SortIDDesc, reversed(created)},
+	} {
+		for _, limit := range []int{1, 3, len(created), users.MaxPageSize} {
+			params := url.Values{"sort": {test.sort}, "limit": {strconv.Itoa(limit)}}
+			if got := logins(t, env, admin.Access, params); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("GET /v1/users sorted by %q in pages of %d = %v, want %v", test.sort, limit, got, test.want)
+			}
+		}
+	}
+
+	// a cursor continues the order it was made for only
+	_, first := listUsers(t, env, admin.Access, url.Values{"sort": {users.SortLogin}, "limit": {"2"}})
+	for name, params := range map[string]url.Values{
+		"a cursor of another order": {"sort": {users.SortID}, "cursor": {first.NextCursor}},
+		"a malformed cursor":        {"cursor": {"not a cursor"}},
+		"an unknown order":          {"sort": {"email"}},
+		"a limit out of range":      {"limit": {strconv.Itoa(users.MaxPageSize + 1)}},
+		"an unknown status":         {"status": {"banned"}},
+	} {
+		var problem users.Problem
+		status := call(t, env.public, http.MethodGet, "/v1/users?"+params.Encode(), admin.Access, nil, &problem)
+		if status != http.StatusBadRequest || problem.Code != "invalid_query" {
+			t.Errorf("GET /v1/users with %s = %d %q, want 400 invalid_query", name, status, problem.Code)
+		}
+	}
+
+	_, reader := env.user(t, "reader", 0)
+	if status, _ := listUsers(t, env, reader.Access, url.Values{}); status != http.StatusForbidden {
+		t.Errorf("GET /v1/users without query_users = %d, want 403", status)
+	}
+}
+
+func TestListUsersFilters(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t)
+	_, admin := env.user(t, "admin", users.PermQueryUsers|users.PermManageUsers)
+
+	for _, login := range []string{"a_b", "axb", "a%c", "abc"} {
+		env.user(t, login, 0)
+	}
+	env.user(t, "loaner", users.PermLoanBooks)
+	librarian, _ := env.user(t, "librarian", 0)
+	if err := env.store.AssignRole(ctx, librarian, "librarian"); err != nil {
+		t.Fatal(err)
+	}
+	disabled, _ := env.user(t, "disabled", 0)
+	status := users.StatusDisabled
+	if _, err := env.service.EditUser(ctx, admin.Access, disabled, users.UserPatch{Status: &status}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.service.NewUser(ctx, users.User{Login: "mailed", Password: "mailed-password", Email: "Mailed@Example.org"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		params url.Values
+		want   []string
+	}{
+		// wildcards of SQL LIKE are matched literally
+		{url.Values{"login_prefix": {"a_"}}, []string{"a_b"}},
+		{url.Values{"login_prefix": {"a%"}}, []string{"a%c"}},
+		{url.Values{"login_prefix": {"ab"}}, []string{"abc"}},
+		{url.Values{"status": {users.StatusDisabled}}, []string{"disabled"}},
+		{url.Values{"role": {"librarian"}}, []string{"librarian"}},
+		// roles count towards the permission filter
+		{url.Values{"permission": {"loan_books"}}, []string{"librarian", "loaner"}},
+		{url.Values{"permission": {strconv.Itoa(int(users.PermLoanBooks | users.PermManageBooks))}}, []string{"librarian"}},
+		{url.Values{"permission": {"loan_books,manage_books"}}, []string{"librarian"}},
+		{url.Values{"email": {" mailed@example.ORG "}}, []string{"mailed"}},
+		{url.Values{"login_prefix": {"l"}, "permission": {"manage_books"}}, []string{"librarian"}},
+		{url.Values{"login_prefix": {"nobody"}}, nil},
+	} {
+		if got := logins(t, env, admin.Access, test.params); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("GET /v1/users?%s = %v, want %v", test.params.Encode(), got, test.want)
+		}
+	}
+}
+
+func TestListUsersHidesPasswords(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t)
+	ID, admin := env.user(t, "admin", users.PermQueryUsers)
+	stored, err := env.store.User(ctx, ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/v1/users", "/v1/users/" + ID} {
+		resp, err := env.public.Client().Do(newRequest(t, env.public, http.MethodGet, path, admin.Access, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `"login":"admin"`) {
+			t.Fatalf("GET %s = %d %s, want 200 with the user", path, resp.StatusCode, body)
+		}
+		if strings.Contains(strings.ToLower(string(body)), "password") || strings.Contains(string(body), stored.Password) {
+			t.Errorf("GET %s = %s, want no password material", path, body)
+		}
+	}
+}
+
+// reversed returns a reversed copy of the logins.
+func reversed(logins []string) []string {
+	output := slices.Clone(logins)
+	slices.Reverse(output)
+	return output
+}
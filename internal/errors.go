@@ -0,0 +1,219 @@
+package users
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/oops"
+)
+
+// problemTypePrefix prefixes the error code to form the problem type URI.
+const problemTypePrefix = "urn:user-service:problem:"
+
+// Problem is the RFC 9457 problem details body returned for every failed request.
+// Code is stable and meant for programs, Title and Detail are meant for humans.
+type Problem struct {
+	Type      string   `json:"type"`
+	Title     string   `json:"title"`
+	Status    int      `json:"status"`
+	Code      string   `json:"code"`
+	Detail    string   `json:"detail,omitempty"`
+	Missing   []string `json:"missing,omitempty"`   // permissions lacking for the request, if any
+	Challenge string   `json:"challenge,omitempty"` // to answer at /v1/sessions/mfa when the login needs a second factor
+}
+
+// problemKind describes how an oops error is reported to the client.
+type problemKind struct {
+	err    error
+	status int
+	code   string
+	title  string
+}
+
+// problemKinds maps every oops error the handlers may see to its status and code.
+// Errors that are not listed are internal and reported as 500 without details.
+var problemKinds = []problemKind{
+	{oops.ErrInvalidRequest, http.StatusBadRequest, "invalid_request", "Request is malformed"},
+	{oops.ErrNotFound, http.StatusNotFound, "not_found", "Resource not found"},
+	{oops.ErrMethodNotAllowed, http.StatusMethodNotAllowed, "method_not_allowed", "Method is not allowed"},
+	{oops.ErrInvalidCredentials, http.StatusUnauthorized, "invalid_credentials", "Login or password is incorrect"},
+	{oops.ErrInvalidClient, http.StatusUnauthorized, "invalid_client", "Client authentication failed"},
+	{oops.ErrTokenExistance, http.StatusUnauthorized, "token_invalid", "Access token is not valid"},
+	{oops.ErrTokenExpired, http.StatusUnauthorized, "token_expired", "Access token has expired"},
+	{oops.ErrMFACode, http.StatusUnauthorized, "mfa_code_invalid", "Second factor code is not valid"},
+	{oops.ErrSignCount, http.StatusUnauthorized, "sign_count_invalid", "Passkey signature counter went back, the authenticator may be cloned"},
+	{oops.ErrNoRefresh, http.StatusUnauthorized, "refresh_invalid", "Refresh token is not valid"},
+	{oops.ErrRefreshExpired, http.StatusUnauthorized, "refresh_expired", "Refresh token has expired"},
+	{oops.ErrRefreshReused, http.StatusUnauthorized, "refresh_reused", "Refresh token was already used"},
+	{oops.ErrWrongPassword, http.StatusForbidden, "wrong_password", "Current password does not match"},
+	{oops.ErrAccountLocked, http.StatusLocked, "account_locked", "Login is locked after too many failed attempts"},
+	{oops.ErrTooManyAttempts, http.StatusTooManyRequests, "too_many_attempts", "Too many failed attempts, retry later"},
+	{oops.ErrMFARequired, http.StatusForbidden, "mfa_required", "Second factor required, answer the challenge"},
+	{oops.ErrPersonalToken, http.StatusForbidden, "personal_token_forbidden", "Personal access tokens cannot be used for this request"},
+	{oops.ErrUserDisabled, http.StatusForbidden, "user_disabled", "User is disabled"},
+	{oops.ErrWrongPermissions, http.StatusForbidden, "forbidden", "Not enough permissions"},
+	{oops.ErrGrantNotHeld, http.StatusForbidden, "grant_not_held", "Permission is not held by the granter"},
+	{oops.ErrNoUser, http.StatusNotFound, "user_not_found", "User does not exist"},
+	{oops.ErrNoRole, http.StatusNotFound, "role_not_found", "Role does not exist"},
+	{oops.ErrNoTOTP, http.StatusNotFound, "totp_not_found", "TOTP is not enrolled"},
+	{oops.ErrNoPasskey, http.StatusNotFound, "passkey_not_found", "Passkey does not exist"},
+	{oops.ErrNoPersonalToken, http.StatusNotFound, "personal_token_not_found", "Personal access token does not exist"},
+	{oops.ErrNoServiceAccount, http.StatusNotFound, "service_account_not_found", "Service account does not exist"},
+	{oops.ErrNoSession, http.StatusNotFound, "session_not_found", "Session does not exist"},
+	{oops.ErrOpaqueTokens, http.StatusNotFound, "jwks_unavailable", "Service issues opaque tokens"},
+	{oops.ErrWebAuthnDisabled, http.StatusNotFound, "webauthn_unavailable", "Passkeys are not configured"},
+	{oops.ErrDuplicateUser, http.StatusConflict, "user_exists", "Login is already taken"},
+	{oops.ErrDuplicateEmail, http.StatusConflict, "email_exists", "Email is already taken"},
+	{oops.ErrTOTPEnrolled, http.StatusConflict, "totp_enrolled", "TOTP is already enrolled"},
+	{oops.ErrDuplicatePasskey, http.StatusConflict, "passkey_exists", "Passkey is already registered"},
+	{oops.ErrDuplicateRole, http.StatusConflict, "role_exists", "Role already exists"},
+	{oops.ErrVersionMismatch, http.StatusPreconditionFailed, "version_mismatch", "User was changed since it was read"},
+	{oops.ErrWebAuthn, http.StatusBadRequest, "webauthn_invalid", "WebAuthn response is not valid"},
+	{oops.ErrUnknownPermission, http.StatusBadRequest, "unknown_permission", "Unknown permission"},
+	{oops.ErrMissingPrerequisite, http.StatusBadRequest, "missing_prerequisite", "Permission prerequisite is missing"},
+	{oops.ErrInvalidUser, http.StatusBadRequest, "invalid_user", "User is not valid"},
+	{oops.ErrActionToken, http.StatusBadRequest, "action_token_invalid", "Token is not valid or has expired"},
+	{oops.ErrNoEmail, http.StatusConflict, "email_missing", "User has no email"},
+	{oops.ErrInvalidPersonalToken, http.StatusBadRequest, "invalid_personal_token", "Personal access token is not valid"},
+	{oops.ErrInvalidServiceAccount, http.StatusBadRequest, "invalid_service_account", "Service account is not valid"},
+	{oops.ErrUnsupportedGrant, http.StatusBadRequest, "unsupported_grant_type", "Grant type is not supported"},
+	{oops.ErrInvalidScope, http.StatusBadRequest, "invalid_scope", "Scope is not valid"},
+	{oops.ErrInvalidRole, http.StatusBadRequest, "invalid_role", "Role is not valid"},
+	{oops.ErrInvalidCheck, http.StatusBadRequest, "invalid_check", "Authorization check is not valid"},
+	{oops.ErrInvalidQuery, http.StatusBadRequest, "invalid_query", "Query is not valid"},
+	{oops.ErrNoTokens, http.StatusServiceUnavailable, "token_unavailable", "Token cannot be generated"},
+}
+
+// NewProblem translates an error into the problem reported to the client.
+// @param err error returned by the service or the request decoding.
+// @return Problem with the status, code and details of the error.
+func NewProblem(err error) Problem {
+	for _, kind := range problemKinds {
+		if !errors.Is(err, kind.err) {
+			continue
+		}
+
+		problem := Problem{
+			Type:   problemTypePrefix + kind.code,
+			Title:  kind.title,
+			Status: kind.status,
+			Code:   kind.code,
+		}
+		// the sentinel text only repeats the title, wrapped errors carry details
+		if err != kind.err {
+			problem.Detail = err.Error()
+		}
+
+		var permErr *PermissionError
+		if errors.As(err, &permErr) {
+			problem.Detail = permErr.Detail
+			if names := Permissions.Names(permErr.Missing); len(names) > 0 {
+				problem.Missing = names
+			}
+		}
+
+		var mfaErr *MFARequiredError
+		if errors.As(err, &mfaErr) {
+			problem.Challenge = mfaErr.Challenge
+			problem.Detail = fmt.Sprintf("answer the challenge within %d minutes", int(MFAChallengeExpiration.Minutes()))
+		}
+
+		return problem
+	}
+
+	return Problem{
+		Type:   problemTypePrefix + "internal",
+		Title:  "Internal server error",
+		Status: http.StatusInternalServerError,
+		Code:   "internal",
+	}
+}
+
+// writeError writes the problem details of the error as the response.
+// @param w http.ResponseWriter for returning the response to the client.
+// @param err error returned by the service or the request decoding.
+func writeError(w http.ResponseWriter, err error) {
+	problem := NewProblem(err)
+	if problem.Status == http.StatusInternalServerError {
+		log.Printf("internal error: %v", err)
+	}
+
+	// RFC 6750 asks to challenge requests whose access token was rejected
+	if errors.Is(err, oops.ErrTokenExistance) || errors.Is(err, oops.ErrTokenExpired) {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Bearer error=%q, error_description=%q", "invalid_token", problem.Title))
+	}
+
+	var throttleErr *ThrottleError
+	if errors.As(err, &throttleErr) {
+		w.Header().Set("Retry-After", strconv.Itoa(throttleErr.Seconds()))
+	}
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(problem.Status)
+	json.NewEncoder(w).Encode(problem)
+}
+
+// oauthErrors are the problem codes that are also RFC 6749 token endpoint error codes.
+var oauthErrors = map[string]bool{
+	"invalid_request":        true,
+	"invalid_client":         true,
+	"unsupported_grant_type": true,
+	"invalid_scope":          true,
+}
+
+// OAuthError is the RFC 6749 section 5.2 body returned for every failed token request.
+type OAuthError struct {
+	Error       string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+// writeOAuthError reports a failed token request the way RFC 6749 section 5.2 asks, OAuth 2.0 clients
+// do not understand problem details.
+// @param w http.ResponseWriter for returning the response to the client.
+// @param err error that made the request fail.
+func writeOAuthError(w http.ResponseWriter, err error) {
+	problem := NewProblem(err)
+	body := OAuthError{Error: problem.Code, Description: problem.Detail}
+	if body.Description == "" {
+		body.Description = problem.Title
+	}
+
+	switch {
+	case oauthErrors[problem.Code]:
+	case problem.Status >= http.StatusInternalServerError:
+		log.Printf("internal error: %v", err)
+		body.Error = "server_error"
+	default:
+		// the section 5.2 codes are all there is, anything else is a request the endpoint refused
+		problem.Status = http.StatusBadRequest
+		body.Error = "invalid_request"
+	}
+
+	if errors.Is(err, oops.ErrInvalidClient) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="user-service"`)
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	writeJSON(w, problem.Status, body)
+}
+
+// writeBadRequest reports a request that cannot be decoded.
+// @param w http.ResponseWriter for returning the response to the client.
+// @param err error of the decoding.
+func writeBadRequest(w http.ResponseWriter, err error) {
+	writeError(w, fmt.Errorf("%w: %v", oops.ErrInvalidRequest, err))
+}
+
+// writeMethodNotAllowed reports a method the route does not serve.
+// @param w http.ResponseWriter for returning the response to the client.
+// @param allowed string methods accepted by the route, sent in the Allow header.
+func writeMethodNotAllowed(w http.ResponseWriter, allowed string) {
+	w.Header().Set("Allow", allowed)
+	writeError(w, oops.ErrMethodNotAllowed)
+}
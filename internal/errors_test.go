@@ -0,0 +1,171 @@
+package users
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/oops"
+)
+
+func TestProblemKinds(t *testing.T) {
+	// the codes clients rely on, a change here breaks them
+	for _, test := range []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{oops.ErrInvalidRequest, http.StatusBadRequest, "invalid_request"},
+		{oops.ErrInvalidCredentials, http.StatusUnauthorized, "invalid_credentials"},
+		{oops.ErrTokenExistance, http.StatusUnauthorized, "token_invalid"},
+		{oops.ErrTokenExpired, http.StatusUnauthorized, "token_expired"},
+		{oops.ErrRefreshReused, http.StatusUnauthorized, "refresh_reused"},
+		{oops.ErrWrongPermissions, http.StatusForbidden, "forbidden"},
+		{oops.ErrGrantNotHeld, http.StatusForbidden, "grant_not_held"},
+		{oops.ErrPersonalToken, http.StatusForbidden, "personal_token_forbidden"},
+		{oops.ErrMFARequired, http.StatusForbidden, "mfa_required"},
+		{oops.ErrUserDisabled, http.StatusForbidden, "user_disabled"},
+		{oops.ErrNoUser, http.StatusNotFound, "user_not_found"},
+		{oops.ErrNoSession, http.StatusNotFound, "session_not_found"},
+		{oops.ErrDuplicateUser, http.StatusConflict, "user_exists"},
+		{oops.ErrDuplicateEmail, http.StatusConflict, "email_exists"},
+		{oops.ErrVersionMismatch, http.StatusPreconditionFailed, "version_mismatch"},
+		{oops.ErrAccountLocked, http.StatusLocked, "account_locked"},
+		{oops.ErrTooManyAttempts, http.StatusTooManyRequests, "too_many_attempts"},
+		{oops.ErrUnknownPermission, http.StatusBadRequest, "unknown_permission"},
+		{oops.ErrMissingPrerequisite, http.StatusBadRequest, "missing_prerequisite"},
+		{oops.ErrInvalidQuery, http.StatusBadRequest, "invalid_query"},
+		{oops.ErrActionToken, http.StatusBadRequest, "action_token_invalid"},
+		{oops.ErrNoTokens, http.StatusServiceUnavailable, "token_unavailable"},
+	} {
+		problem := NewProblem(test.err)
+		if problem.Status != test.status || problem.Code != test.code || problem.Type != problemTypePrefix+test.code {
+			t.Errorf("NewProblem(%v) = %d %q %q, want %d %q", test.err, problem.Status, problem.Code, problem.Type, test.status, test.code)
+		}
+		if problem.Detail != "" {
+			t.Errorf("NewProblem(%v) detail = %q, want none for a bare sentinel", test.err, problem.Detail)
+		}
+	}
+
+	codes := make(map[string]error)
+	for _, kind := range problemKinds {
+		if other, ok := codes[kind.code]; ok {
+			t.Errorf("code %q is used by both %v and %v", kind.code, other, kind.err)
+		}
+		codes[kind.code] = kind.err
+		if kind.status < 400 || kind.title == "" {
+			t.Errorf("problem %q = status %d title %q, want an error status and a title", kind.code, kind.status, kind.title)
+		}
+		// a sentinel matched by an earlier kind would never reach its own
+		if got := NewProblem(kind.err).Code; got != kind.code {
+			t.Errorf("NewProblem(%v) = %q, want %q", kind.err, got, kind.code)
+		}
+	}
+}
+
+func TestNewProblemDetails(t *testing.T) {
+	err := fmt.Errorf("%w: no such id", oops.ErrNoUser)
+	if wrapped := NewProblem(err); wrapped.Code != "user_not_found" || wrapped.Detail != err.Error() {
+		t.Errorf("NewProblem() of a wrapped error = %+v, want user_not_found with the details", wrapped)
+	}
+
+	permission := NewProblem(&PermissionError{Err: oops.ErrWrongPermissions, Missing: PermManageUsers | PermQueryUsers, Detail: "managing"})
+	if permission.Code != "forbidden" || permission.Detail != "managing" ||
+		len(permission.Missing) != 2 || permission.Missing[0] != "query_users" || permission.Missing[1] != "manage_users" {
+		t.Errorf("NewProblem() of a permission error = %+v, want forbidden missing query_users and manage_users", permission)
+	}
+
+	mfa := NewProblem(&MFARequiredError{Challenge: "abc"})
+	if mfa.Code != "mfa_required" || mfa.Challenge != "abc" {
+		t.Errorf("NewProblem() of a second factor challenge = %+v, want mfa_required with the challenge", mfa)
+	}
+
+	// internal errors reveal nothing
+	internal := NewProblem(errors.New("pq: connection refused"))
+	if internal.Status != http.StatusInternalServerError || internal.Code != "internal" || internal.Detail != "" {
+		t.Errorf("NewProblem() of an internal error = %+v, want a bare 500", internal)
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	for _, test := range []struct {
+		err        error
+		status     int
+		challenge  bool
+		retryAfter string
+	}{
+		{oops.ErrTokenExpired, http.StatusUnauthorized, true, ""},
+		{fmt.Errorf("%w: revoked", oops.ErrTokenExistance), http.StatusUnauthorized, true, ""},
+		{oops.ErrInvalidCredentials, http.StatusUnauthorized, false, ""},
+		{&ThrottleError{Err: oops.ErrTooManyAttempts, RetryAfter: 1500 * time.Millisecond}, http.StatusTooManyRequests, false, "2"},
+		{&ThrottleError{Err: oops.ErrAccountLocked, RetryAfter: time.Minute}, http.StatusLocked, false, "60"},
+	} {
+		w := httptest.NewRecorder()
+		writeError(w, test.err)
+
+		var problem Problem
+		if err := json.NewDecoder(w.Body).Decode(&problem); err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != test.status || problem.Status != test.status {
+			t.Errorf("writeError(%v) = %d with body status %d, want %d", test.err, w.Code, problem.Status, test.status)
+		}
+		if got := w.Header().Get("Content-Type"); got != "application/problem+json" {
+			t.Errorf("writeError(%v) Content-Type = %q, want application/problem+json", test.err, got)
+		}
+		if got := w.Header().Get("WWW-Authenticate") != ""; got != test.challenge {
+			t.Errorf("writeError(%v) WWW-Authenticate = %q, want a challenge %v", test.err, w.Header().Get("WWW-Authenticate"), test.challenge)
+		}
+		if got := w.Header().Get("Retry-After"); got != test.retryAfter {
+			t.Errorf("writeError(%v) Retry-After = %q, want %q", test.err, got, test.retryAfter)
+		}
+	}
+}
+
+func TestWriteOAuthError(t *testing.T) {
+	for _, test := range []struct {
+		err         error
+		status      int
+		code        string
+		description string
+		challenge   bool
+	}{
+		{oops.ErrInvalidClient, http.StatusUnauthorized, "invalid_client", "Client authentication failed", true},
+		{fmt.Errorf("%w: grant_type is required", oops.ErrInvalidRequest), http.StatusBadRequest, "invalid_request", "", false},
+		{fmt.Errorf("%w: %q", oops.ErrUnsupportedGrant, "password"), http.StatusBadRequest, "unsupported_grant_type", "", false},
+		{fmt.Errorf("%w: not granted to the client: manage_users", oops.ErrInvalidScope), http.StatusBadRequest, "invalid_scope", "", false},
+		// RFC 6749 has no codes for the rest
+		{oops.ErrTooManyAttempts, http.StatusBadRequest, "invalid_request", "Too many failed attempts, retry later", false},
+		{errors.New("pq: connection refused"), http.StatusInternalServerError, "server_error", "Internal server error", false},
+	} {
+		w := httptest.NewRecorder()
+		writeOAuthError(w, test.err)
+
+		var body map[string]string
+		if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if test.description == "" {
+			test.description = test.err.Error()
+		}
+		if w.Code != test.status || body["error"] != test.code || body["error_description"] != test.description {
+			t.Errorf("writeOAuthError(%v) = %d %v, want %d %q %q", test.err, w.Code, body, test.status, test.code, test.description)
+		}
+		if len(body) != 2 {
+			t.Errorf("writeOAuthError(%v) body = %v, want only error and error_description", test.err, body)
+		}
+		if got := w.Header().Get("Content-Type"); got != "application/json" {
+			t.Errorf("writeOAuthError(%v) Content-Type = %q, want application/json", test.err, got)
+		}
+		if got := w.Header().Get("Cache-Control"); got != "no-store" {
+			t.Errorf("writeOAuthError(%v) Cache-Control = %q, want no-store", test.err, got)
+		}
+		if got := w.Header().Get("WWW-Authenticate") != ""; got != test.challenge {
+			t.Errorf("writeOAuthError(%v) WWW-Authenticate = %q, want a challenge %v", test.err, w.Header().Get("WWW-Authenticate"), test.challenge)
+		}
+	}
+}
@@ -1,26 +1,96 @@
 package users
 
 import (
-	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"strconv"
+	"strings"
+
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/oops"
 )
 
 // Handler is responsible for handling HTTP requests and routing them to the appropriate service.
 type Handler struct {
-	service Service        // Service interface to perform business logic
-	public  *http.ServeMux // ServeMux for public routes
-	private *http.ServeMux // ServeMux for private routes
+	service      Service                     // Service interface to perform business logic
+	public       *http.ServeMux              // ServeMux for public routes
+	private      *http.ServeMux              // ServeMux for private routes
+	legacyTokens bool                        // accept access tokens from the JSON body
+	routes       map[*http.ServeMux][]string // registered patterns of each mux, checked against the OpenAPI documents
+}
+
+// HandlerOption configures optional behaviour of the Handler.
+type HandlerOption func(*Handler)
+
+// WithLegacyTokens lets clients keep sending the access token in the JSON body
+// instead of the Authorization header.
+func WithLegacyTokens(enabled bool) HandlerOption {
+	return func(h *Handler) {
+		h.legacyTokens = enabled
+	}
 }
 
 // Handler constructor
-func NewHandler(service Service, public *http.ServeMux, private *http.ServeMux) *Handler {
-	return &Handler{
+func NewHandler(service Service, public *http.ServeMux, private *http.ServeMux, opts ...HandlerOption) *Handler {
+	h := &Handler{
 		service: service,
 		public:  public,
 		private: private,
+		routes:  make(map[*http.ServeMux][]string),
+	}
+
+	for _, opt := range opts {
+		opt(h)
+	}
+
+	return h
+}
+
+// Authenticate resolves the "Authorization: Bearer" token once per request and stores the caller
+// in the request context. Requests without a valid token pass through anonymously,
+// handlers that require a caller report the token error themselves.
+// @param next http.Handler serving the request, usually the public or private mux.
+// @return http.Handler wrapping next.
+func (h *Handler) Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token := bearerToken(r); token != "" {
+			if principal, err := h.service.Authenticate(r.Context(), token); err == nil {
+				r = r.WithContext(WithPrincipal(r.Context(), principal))
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// accessToken returns the access token the request is made with: the bearer token or,
+// if legacy tokens are enabled and there is no Authorization header, the token from the body.
+// @param r *http.Request of the caller.
+// @param legacy string token decoded from the JSON body.
+// @return string token or empty string if the request carries none.
+func (h *Handler) accessToken(r *http.Request, legacy string) string {
+	if token := bearerToken(r); token != "" || !h.legacyTokens {
+		return token
+	}
+
+	return legacy
+}
+
+// decodeBody decodes the JSON request body, an empty body leaves v unchanged
+// since requests authenticated with the Authorization header may have nothing else to send.
+// @param r *http.Request of the caller.
+// @param v any destination of the decoding.
+// @return error if the body is not valid JSON.
+func decodeBody(r *http.Request, v any) error {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if errors.Is(err, io.EOF) {
+		return nil
 	}
+
+	return err
 }
 
 // Register sets up the public and private routes for the handler.
@@ -34,21 +104,23 @@ func (h *Handler) Register() {
 // @param r *http.Request containing the user's login credentials in the request body.
 func (h *Handler) loginHandler(w http.ResponseWriter, r *http.Request) {
 	// user credentials to be checked
+	// device is an optional name of the session shown in the session list
 	var creds struct {
 		Login    string `json:"login"`
 		Password string `json:"password"`
+		Device   string `json:"device"`
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+	if err := decodeBody(r, &creds); err != nil {
+		writeBadRequest(w, err)
 		return
 	}
 
 	// Taking credentials, chcecking existance of user and generating access and refresh token
-	ctx := context.Background()
+	ctx := WithClientInfo(r.Context(), clientInfo(r, creds.Device))
 	token, err := h.service.CreateToken(ctx, creds.Login, creds.Password)
 	if err != nil {
-		http.Error(w, "Error getting token", http.StatusBadRequest)
+		writeError(w, err)
 		return
 	}
 
@@ -66,18 +138,17 @@ func (h *Handler) createUserHandler(w http.ResponseWriter, r *http.Request) {
 		Password string `json:"password"`
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+	if err := decodeBody(r, &creds); err != nil {
+		writeBadRequest(w, err)
 		return
 	}
 
 	// Appending new user to the storage also checking existance of user
-	ctx := context.Background()
-	id, err := h.service.NewUser(ctx, User{"", creds.Login, creds.Password, 0})
+	ctx := r.Context()
+	id, err := h.service.NewUser(ctx, User{Login: creds.Login, Password: creds.Password})
 
 	if err != nil {
-		w.WriteHeader(http.StatusConflict)
-		http.Error(w, "User exists", http.StatusBadRequest)
+		writeError(w, err)
 		return
 	}
 
@@ -87,54 +158,256 @@ func (h *Handler) createUserHandler(w http.ResponseWriter, r *http.Request) {
 
 // deleteUserHandler handles requests to delete a user.
 // @param w http.ResponseWriter for returning the response to the client.
-// @param r *http.Request containing the access token in the request body.
+// @param r *http.Request carrying the access token in the Authorization header.
 func (h *Handler) deleteUserHandler(w http.ResponseWriter, r *http.Request) {
 	// token of corresponding user
 	var token struct {
 		Access string `json:"token"`
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&token); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+	if err := decodeBody(r, &token); err != nil {
+		writeBadRequest(w, err)
 		return
 	}
 
-	ctx := context.Background()
-	ID, err := h.service.GetIDByToken(ctx, token.Access)
+	ctx := r.Context()
+	access := h.accessToken(r, token.Access)
+	ID, err := h.service.GetIDByToken(ctx, access)
 
 	// if token is not correct or token is expired quit
 	if err != nil {
-		http.Error(w, "Token incorrect", http.StatusBadRequest)
+		writeError(w, err)
+		return
+	}
+
+	// deleting through RemoveUser refuses tokens that may not delete the account
+	err = h.service.RemoveUser(ctx, access, ID)
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// logoutHandler revokes the presented access token and its refresh token.
+// @param w http.ResponseWriter for returning the response to the client.
+// @param r *http.Request carrying the access token in the Authorization header.
+func (h *Handler) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	var token struct {
+		Access string `json:"token"`
+	}
+
+	if err := decodeBody(r, &token); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+
+	ctx := r.Context()
+	if err := h.service.Logout(ctx, h.accessToken(r, token.Access)); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// logoutAllHandler revokes every token of the caller.
+// @param w http.ResponseWriter for returning the response to the client.
+// @param r *http.Request carrying the access token in the Authorization header.
+func (h *Handler) logoutAllHandler(w http.ResponseWriter, r *http.Request) {
+	var token struct {
+		Access string `json:"token"`
+	}
+
+	if err := decodeBody(r, &token); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+
+	ctx := r.Context()
+	if err := h.service.LogoutAll(ctx, h.accessToken(r, token.Access)); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// revokeSessionsHandler revokes every token of another user by user with corresponding permissions
+// @param w http.ResponseWriter for returning the response to the client.
+// @param r *http.Request carrying the access token in the Authorization header and user ID in the request body.
+func (h *Handler) revokeSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	// token is token of user with corresponding permissions, admin
+	// id - id of user whose sessions are revoked
+	var editor struct {
+		Access string `json:"token"`
+		ID     string `json:"id"`
+	}
+
+	if err := decodeBody(r, &editor); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+
+	ctx := r.Context()
+	if err := h.service.RevokeSessions(ctx, h.accessToken(r, editor.Access), editor.ID); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// sessionsHandler lists active sessions of the caller.
+// @param w http.ResponseWriter for returning the response to the client.
+// @param r *http.Request carrying the access token in the Authorization header.
+func (h *Handler) sessionsHandler(w http.ResponseWriter, r *http.Request) {
+	var token struct {
+		Access string `json:"token"`
+	}
+
+	if err := decodeBody(r, &token); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+
+	ctx := r.Context()
+	sessions, err := h.service.Sessions(ctx, h.accessToken(r, token.Access))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if sessions == nil {
+		sessions = []Session{}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string][]Session{"sessions": sessions})
+}
+
+// revokeSessionHandler ends one session of the caller.
+// @param w http.ResponseWriter for returning the response to the client.
+// @param r *http.Request carrying the access token in the Authorization header and session ID in the request body.
+func (h *Handler) revokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Access  string `json:"token"`
+		Session string `json:"session"`
 	}
 
-	err = h.service.DeleteUser(ctx, ID)
+	if err := decodeBody(r, &request); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
 
+	ctx := r.Context()
+	if err := h.service.RevokeSession(ctx, h.accessToken(r, request.Access), request.Session); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// listUsersHandler returns one page of the user directory by user with corresponding permissions.
+// Query parameters: cursor, limit, sort (login, -login, id, -id), login_prefix,
+// permission (name or mask), role, status and email.
+// @param w http.ResponseWriter for returning the response to the client.
+// @param r *http.Request carrying the access token in the Authorization header.
+func (h *Handler) listUsersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	params := r.URL.Query()
+	query := UserQuery{
+		Sort:        params.Get("sort"),
+		LoginPrefix: params.Get("login_prefix"),
+		Role:        params.Get("role"),
+		Status:      params.Get("status"),
+		Email:       params.Get("email"),
+	}
+
+	if limit := params.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil {
+			writeError(w, fmt.Errorf("%w: limit must be a number", oops.ErrInvalidQuery))
+			return
+		}
+		query.Limit = n
+	}
+
+	if permission := params.Get("permission"); permission != "" {
+		mask, err := strconv.ParseUint(permission, 0, 0)
+		if err != nil {
+			named, namedErr := Permissions.Mask(strings.Split(permission, ","))
+			if namedErr != nil {
+				writeError(w, namedErr)
+				return
+			}
+			mask = uint64(named)
+		}
+		query.Permission = uint(mask)
+	}
+
+	ctx := r.Context()
+	page, err := h.service.ListUsers(ctx, bearerToken(r), query, params.Get("cursor"))
 	if err != nil {
-		http.Error(w, "There is no user", http.StatusBadRequest)
+		writeError(w, err)
+		return
 	}
 
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(page)
+}
+
+// bearerToken extracts the access token from the "Authorization: Bearer" header.
+// @param r *http.Request of the caller.
+// @return string token or empty string if the header is missing.
+func bearerToken(r *http.Request) string {
+	scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+
+	return strings.TrimSpace(token)
+}
+
+// clientInfo collects the metadata recorded for a new session.
+// @param r *http.Request of the login.
+// @param device string optional device name supplied by the client.
+func clientInfo(r *http.Request, device string) ClientInfo {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	return ClientInfo{IP: ip, UserAgent: r.UserAgent(), Device: device}
 }
 
 // getting ID of user, private api
 // @param w http.ResponseWriter for returning the response to the client.
-// @param r *http.Request containing the access token in the request body.
+// @param r *http.Request carrying the access token in the Authorization header.
 func (h *Handler) getID(w http.ResponseWriter, r *http.Request) {
 	// token of corresponding user
 	var token struct {
 		Access string `json:"token"`
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&token); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+	if err := decodeBody(r, &token); err != nil {
+		writeBadRequest(w, err)
 		return
 	}
 
-	ctx := context.Background()
-	ID, err := h.service.GetIDByToken(ctx, token.Access)
+	ctx := r.Context()
+	ID, err := h.service.GetIDByToken(ctx, h.accessToken(r, token.Access))
 
 	if err != nil {
-		http.Error(w, "Token incorrect", http.StatusBadRequest)
+		writeError(w, err)
 		return
 	}
 
@@ -144,70 +417,179 @@ func (h *Handler) getID(w http.ResponseWriter, r *http.Request) {
 
 // getting Permissions of user, private api
 // @param w http.ResponseWriter for returning the response to the client.
-// @param r *http.Request containing the access token in the request body.
+// @param r *http.Request carrying the access token in the Authorization header.
 func (h *Handler) getPermissions(w http.ResponseWriter, r *http.Request) {
 	// token of corresponding user
 	var token struct {
 		Access string `json:"token"`
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&token); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+	if err := decodeBody(r, &token); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+
+	ctx := r.Context()
+	principal, err := h.service.Authenticate(ctx, h.accessToken(r, token.Access))
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"permissios": strconv.Itoa(int(principal.Permissions))})
+}
+
+// RFC 7662 token introspection, private api
+// @param w http.ResponseWriter for returning the response to the client.
+// @param r *http.Request containing the token as form field or JSON body member "token".
+func (h *Handler) introspectHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, http.MethodPost)
 		return
 	}
 
-	ctx := context.Background()
-	ID, err := h.service.GetIDByToken(ctx, token.Access)
+	var request struct {
+		Token     string `json:"token"`
+		TokenHint string `json:"token_type_hint"`
+	}
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := decodeBody(r, &request); err != nil {
+			writeBadRequest(w, err)
+			return
+		}
+	} else {
+		if err := r.ParseForm(); err != nil {
+			writeBadRequest(w, err)
+			return
+		}
+		request.Token = r.PostForm.Get("token")
+	}
+
+	if request.Token == "" {
+		writeBadRequest(w, errors.New("token is required"))
+		return
+	}
 
+	ctx := r.Context()
+	info, err := h.service.Introspect(ctx, request.Token)
 	if err != nil {
-		http.Error(w, "Token incorrect", http.StatusBadRequest)
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(info)
+}
+
+// authorizeHandler answers whether the token owner holds the required permissions, private api.
+// A single check is given inline, several checks are given in "checks" and answered in one round-trip.
+// @param w http.ResponseWriter for returning the response to the client.
+// @param r *http.Request carrying the access token in the Authorization header and the checks in the request body.
+func (h *Handler) authorizeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	var request struct {
+		Access string `json:"token"`
+		Check
+		Checks []Check `json:"checks"`
+	}
+
+	if err := decodeBody(r, &request); err != nil {
+		writeBadRequest(w, err)
 		return
 	}
 
-	Info, infoerr := h.service.UserInfo(ctx, ID)
+	batch := request.Checks != nil
+	checks := request.Checks
+	if !batch {
+		checks = []Check{request.Check}
+	}
 
-	if infoerr != nil {
-		http.Error(w, "User incorrect", http.StatusBadRequest)
+	ctx := r.Context()
+	ID, decisions, err := h.service.Authorize(ctx, h.accessToken(r, request.Access), checks)
+	if err != nil {
+		writeError(w, err)
 		return
 	}
 
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"permissios": strconv.Itoa(int(Info.Permissions))})
+	if batch {
+		json.NewEncoder(w).Encode(struct {
+			Subject string     `json:"sub"`
+			Results []Decision `json:"results"`
+		}{ID, decisions})
+		return
+	}
+
+	json.NewEncoder(w).Encode(struct {
+		Subject string `json:"sub"`
+		Decision
+	}{ID, decisions[0]})
 }
 
-// edit user information by user with corresponding permissions
+// edit user information by the user itself or by user with corresponding permissions
 // @param w http.ResponseWriter for returning the response to the client.
-// @param r *http.Request containing the access token in the request body.
+// @param r *http.Request carrying the access token in the Authorization header.
 func (h *Handler) editUserHandler(w http.ResponseWriter, r *http.Request) {
-	// token is token of user with corresponding permissions, admin
+	// token is token of the user itself or of user with corresponding permissions, admin
 	// id - id of user to be edited
-	// newLogin, newPassword - newData for editing
+	// newLogin, newPassword - newData for editing, omitted or empty fields are left untouched
+	// currentPassword - required to change one's own password
 	var editor struct {
-		Access   string `json:"token"`
-		ID       string `json:"id"`
-		Login    string `json:"newLogin"`
-		Password string `json:"newPassword"`
+		Access          string `json:"token"`
+		ID              string `json:"id"`
+		Login           string `json:"newLogin"`
+		Password        string `json:"newPassword"`
+		CurrentPassword string `json:"currentPassword"`
+	}
+
+	if err := decodeBody(r, &editor); err != nil {
+		writeBadRequest(w, err)
+		return
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&editor); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+	var patch UserPatch
+	if editor.Login != "" {
+		patch.Login = &editor.Login
+	}
+	if editor.Password != "" {
+		patch.Password = &editor.Password
+		patch.CurrentPassword = &editor.CurrentPassword
+	}
+
+	// an If-Match header protects against lost updates as on /v1
+	version, err := ifMatch(r)
+	if err != nil {
+		writeError(w, err)
 		return
 	}
+	patch.Version = version
 
 	// user editing with checking token and user to be edited
-	ctx := context.Background()
-	_, err := h.service.EditUser(ctx, editor.Access, User{Login: editor.Login, Password: editor.Password, ID: editor.ID, Permissions: 0})
+	ctx := r.Context()
+	user, err := h.service.EditUser(ctx, h.accessToken(r, editor.Access), editor.ID, patch)
 	if err != nil {
-		http.Error(w, "Error editing tiken", http.StatusBadRequest)
+		writeError(w, err)
 		return
 	}
 
+	w.Header().Set("ETag", etag(user.Version))
 	w.WriteHeader(http.StatusOK)
 }
 
 // give permissions to user by user with corresponding permissions
+// Like PUT /v1/users/{id}/permissions it requires PermGrantPermissions, PermManageUsers no longer suffices.
 // @param w http.ResponseWriter for returning the response to the client.
-// @param r *http.Request containing the access token in the request body.
+// @param r *http.Request carrying the access token in the Authorization header.
 func (h *Handler) givePermissionHandler(w http.ResponseWriter, r *http.Request) {
 	// token is token of user with corresponding permissions, admin
 	// id - id of user to be edited
@@ -218,16 +600,143 @@ func (h *Handler) givePermissionHandler(w http.ResponseWriter, r *http.Request)
 		Permission uint   `json:"permission"`
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&editor); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+	if err := decodeBody(r, &editor); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+
+	version, err := ifMatch(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	ctx := r.Context()
+	version, err = h.service.GivePermission(ctx, h.accessToken(r, editor.Access), editor.ID, editor.Permission, version)
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("ETag", etag(version))
+	w.WriteHeader(http.StatusOK)
+}
+
+// list roles by user with corresponding permissions
+// @param w http.ResponseWriter for returning the response to the client.
+// @param r *http.Request carrying the access token in the Authorization header.
+func (h *Handler) rolesHandler(w http.ResponseWriter, r *http.Request) {
+	var token struct {
+		Access string `json:"token"`
+	}
+
+	if err := decodeBody(r, &token); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+
+	ctx := r.Context()
+	roles, err := h.service.Roles(ctx, h.accessToken(r, token.Access))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if roles == nil {
+		roles = []Role{}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string][]Role{"roles": roles})
+}
+
+// create or edit role by user with corresponding permissions
+// @param w http.ResponseWriter for returning the response to the client.
+// @param r *http.Request carrying the access token in the Authorization header and the role in the request body.
+func (h *Handler) saveRoleHandler(w http.ResponseWriter, r *http.Request) {
+	var editor struct {
+		Access      string `json:"token"`
+		Name        string `json:"name"`
+		Description string `json:"description"`
+		Permissions uint   `json:"permissions"`
+	}
+
+	if err := decodeBody(r, &editor); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+
+	ctx := r.Context()
+	role := Role{Name: editor.Name, Description: editor.Description, Permissions: editor.Permissions}
+
+	var err error
+	status := http.StatusOK
+	if strings.HasSuffix(r.URL.Path, "/create") {
+		err = h.service.CreateRole(ctx, h.accessToken(r, editor.Access), role)
+		status = http.StatusCreated
+	} else {
+		err = h.service.EditRole(ctx, h.accessToken(r, editor.Access), role)
+	}
+
+	if err != nil {
+		writeError(w, err)
 		return
 	}
 
-	ctx := context.Background()
-	err := h.service.GivePermission(ctx, editor.Access, editor.ID, editor.Permission)
+	w.WriteHeader(status)
+}
+
+// delete role by user with corresponding permissions
+// @param w http.ResponseWriter for returning the response to the client.
+// @param r *http.Request carrying the access token in the Authorization header and the role name in the request body.
+func (h *Handler) deleteRoleHandler(w http.ResponseWriter, r *http.Request) {
+	var editor struct {
+		Access string `json:"token"`
+		Name   string `json:"name"`
+	}
+
+	if err := decodeBody(r, &editor); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
 
+	ctx := r.Context()
+	err := h.service.DeleteRole(ctx, h.accessToken(r, editor.Access), editor.Name)
 	if err != nil {
-		http.Error(w, "Cannot give permissions", http.StatusBadRequest)
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// assign role to user or take it away by user with corresponding permissions
+// @param w http.ResponseWriter for returning the response to the client.
+// @param r *http.Request carrying the access token in the Authorization header and user ID and role name in the request body.
+func (h *Handler) userRoleHandler(w http.ResponseWriter, r *http.Request) {
+	var editor struct {
+		Access string `json:"token"`
+		ID     string `json:"id"`
+		Role   string `json:"role"`
+	}
+
+	if err := decodeBody(r, &editor); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+
+	ctx := r.Context()
+
+	var err error
+	if strings.HasSuffix(r.URL.Path, "/assign") {
+		err = h.service.AssignRole(ctx, h.accessToken(r, editor.Access), editor.ID, editor.Role)
+	} else {
+		err = h.service.UnassignRole(ctx, h.accessToken(r, editor.Access), editor.ID, editor.Role)
+	}
+
+	if err != nil {
+		writeError(w, err)
 		return
 	}
 
@@ -243,35 +752,170 @@ func (h *Handler) RefreshHandler(w http.ResponseWriter, r *http.Request) {
 		Refresh string `json:"refresh"`
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&tokens); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+	if err := decodeBody(r, &tokens); err != nil {
+		writeBadRequest(w, err)
 		return
 	}
 
-	ctx := context.Background()
+	ctx := r.Context()
 	token, err := h.service.RefreshToken(ctx, tokens.Acess, tokens.Refresh)
 	if err != nil {
-		http.Error(w, "Error getting token", http.StatusBadRequest)
+		writeError(w, err)
+		return
 	}
 
 	w.WriteHeader(http.StatusFound)
 	json.NewEncoder(w).Encode(token)
 }
 
+// publish keys verifying JWT access tokens, available on both ports
+// @param w http.ResponseWriter for returning the response to the client.
+// @param r *http.Request without body.
+func (h *Handler) jwksHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	keys, err := h.service.JWKS(ctx)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(keys)
+}
+
+// legacyDeprecation is the RFC 9745 Deprecation header value of the routes preceding /v1.
+const legacyDeprecation = "@1792195200" // 2026-10-17
+
+// deprecated marks responses of a legacy route as deprecated and links the /v1 route replacing it.
+// @param successor string path of the replacing route.
+// @param next http.HandlerFunc serving the legacy route.
+// @return http.HandlerFunc wrapping next.
+func deprecated(successor string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", legacyDeprecation)
+		w.Header().Add("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", successor))
+		next(w, r)
+	}
+}
+
+// routeMethods are probed to fill the Allow header when a path is served with other methods only.
+var routeMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+
+// Wrap returns the mux with authentication, unmatched requests are answered with problem details
+// instead of the plain text responses of the mux.
+// @param m *http.ServeMux public or private mux with registered routes.
+// @return http.Handler serving the port.
+func (h *Handler) Wrap(m *http.ServeMux) http.Handler {
+	return h.Authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, pattern := m.Handler(r); pattern != "" {
+			m.ServeHTTP(w, r)
+			return
+		}
+
+		var allowed []string
+		for _, method := range routeMethods {
+			probe := r.Clone(r.Context())
+			probe.Method = method
+			if _, pattern := m.Handler(probe); pattern != "" {
+				allowed = append(allowed, method)
+			}
+		}
+
+		if len(allowed) == 0 {
+			writeError(w, oops.ErrNotFound)
+			return
+		}
+		writeMethodNotAllowed(w, strings.Join(allowed, ", "))
+	}))
+}
+
 // Initing public routing
 // @param m http.ServeMux public mux
 func (h *Handler) InitPublic(m *http.ServeMux) {
-	m.HandleFunc("/user/login", h.loginHandler)
-	m.HandleFunc("/user/create", h.createUserHandler)
-	m.HandleFunc("/user/delete", h.deleteUserHandler)
-	m.HandleFunc("/user/edit", h.editUserHandler)
-	m.HandleFunc("/user/give", h.givePermissionHandler)
-	m.HandleFunc("/user/refresh", h.RefreshHandler)
+	h.handle(m, "POST /v1/sessions", h.createSessionV1)
+	h.handle(m, "GET /v1/sessions", h.listSessionsV1)
+	h.handle(m, "DELETE /v1/sessions", h.deleteSessionsV1)
+	h.handle(m, "POST /v1/sessions/refresh", h.refreshSessionV1)
+	h.handle(m, "POST /v1/sessions/mfa", h.verifyMFAV1)
+	h.handle(m, "POST /v1/sessions/passkey/options", h.passkeyLoginOptionsV1)
+	h.handle(m, "POST /v1/sessions/passkey", h.passkeyLoginV1)
+	h.handle(m, "POST /v1/oauth/token", h.oauthTokenV1)
+	h.handle(m, "DELETE /v1/sessions/current", h.deleteCurrentSessionV1)
+	h.handle(m, "DELETE /v1/sessions/{id}", h.deleteSessionV1)
+	h.handle(m, "POST /v1/users", h.createUserV1)
+	h.handle(m, "GET /v1/users", h.listUsersHandler)
+	h.handle(m, "GET /v1/users/{id}", h.getUserV1)
+	h.handle(m, "PATCH /v1/users/{id}", h.patchUserV1)
+	h.handle(m, "DELETE /v1/users/{id}", h.deleteUserV1)
+	h.handle(m, "PUT /v1/users/{id}/permissions", h.putPermissionsV1)
+	h.handle(m, "DELETE /v1/users/{id}/sessions", h.deleteUserSessionsV1)
+	h.handle(m, "DELETE /v1/users/{id}/lockout", h.unlockUserV1)
+	h.handle(m, "POST /v1/users/{id}/email/verification", h.sendVerificationV1)
+	h.handle(m, "GET /v1/users/{id}/mfa", h.getMFAV1)
+	h.handle(m, "POST /v1/users/{id}/mfa/totp", h.enrollTOTPV1)
+	h.handle(m, "POST /v1/users/{id}/mfa/totp/confirm", h.confirmTOTPV1)
+	h.handle(m, "DELETE /v1/users/{id}/mfa/totp", h.deleteTOTPV1)
+	h.handle(m, "POST /v1/users/{id}/passkeys/options", h.passkeyOptionsV1)
+	h.handle(m, "GET /v1/users/{id}/passkeys", h.listPasskeysV1)
+	h.handle(m, "POST /v1/users/{id}/passkeys", h.createPasskeyV1)
+	h.handle(m, "DELETE /v1/users/{id}/passkeys/{passkey}", h.deletePasskeyV1)
+	h.handle(m, "GET /v1/users/{id}/tokens", h.listPersonalTokensV1)
+	h.handle(m, "POST /v1/users/{id}/tokens", h.createPersonalTokenV1)
+	h.handle(m, "DELETE /v1/users/{id}/tokens/{token}", h.deletePersonalTokenV1)
+	h.handle(m, "PUT /v1/users/{id}/roles/{role}", h.putUserRoleV1)
+	h.handle(m, "DELETE /v1/users/{id}/roles/{role}", h.deleteUserRoleV1)
+	h.handle(m, "GET /v1/roles", h.listRolesV1)
+	h.handle(m, "POST /v1/roles", h.createRoleV1)
+	h.handle(m, "PUT /v1/roles/{name}", h.putRoleV1)
+	h.handle(m, "DELETE /v1/roles/{name}", h.deleteRoleV1)
+	h.handle(m, "GET /v1/service-accounts", h.listServiceAccountsV1)
+	h.handle(m, "POST /v1/service-accounts", h.createServiceAccountV1)
+	h.handle(m, "GET /v1/service-accounts/{id}", h.getServiceAccountV1)
+	h.handle(m, "PATCH /v1/service-accounts/{id}", h.patchServiceAccountV1)
+	h.handle(m, "POST /v1/service-accounts/{id}/secret", h.rotateServiceSecretV1)
+	h.handle(m, "POST /v1/email/verify", h.verifyEmailV1)
+	h.handle(m, "POST /v1/password/forgot", h.forgotPasswordV1)
+	h.handle(m, "POST /v1/password/reset", h.resetPasswordV1)
+	h.handle(m, "GET /v1/mfa/policy", h.getMFAPolicyV1)
+	h.handle(m, "PUT /v1/mfa/policy", h.putMFAPolicyV1)
+	h.handle(m, "GET /.well-known/jwks.json", h.jwksHandler)
+	h.handle(m, "GET /openapi.json", specHandler(publicSpec))
+
+	// legacy routes, kept until clients move to /v1
+	h.handle(m, "/user/login", deprecated("/v1/sessions", h.loginHandler))
+	h.handle(m, "/user/create", deprecated("/v1/users", h.createUserHandler))
+	h.handle(m, "/user/delete", deprecated("/v1/users/{id}", h.deleteUserHandler))
+	h.handle(m, "/user/edit", deprecated("/v1/users/{id}", h.editUserHandler))
+	h.handle(m, "/user/give", deprecated("/v1/users/{id}/permissions", h.givePermissionHandler))
+	h.handle(m, "/user/refresh", deprecated("/v1/sessions/refresh", h.RefreshHandler))
+	h.handle(m, "/user/logout", deprecated("/v1/sessions/current", h.logoutHandler))
+	h.handle(m, "/user/logout-all", deprecated("/v1/sessions", h.logoutAllHandler))
+	h.handle(m, "/user/revoke", deprecated("/v1/users/{id}/sessions", h.revokeSessionsHandler))
+	h.handle(m, "/user/sessions", deprecated("/v1/sessions", h.sessionsHandler))
+	h.handle(m, "/user/sessions/revoke", deprecated("/v1/sessions/{id}", h.revokeSessionHandler))
+	h.handle(m, "/user/roles/assign", deprecated("/v1/users/{id}/roles/{role}", h.userRoleHandler))
+	h.handle(m, "/user/roles/unassign", deprecated("/v1/users/{id}/roles/{role}", h.userRoleHandler))
+	h.handle(m, "/users", deprecated("/v1/users", h.listUsersHandler))
+	h.handle(m, "/roles", deprecated("/v1/roles", h.rolesHandler))
+	h.handle(m, "/roles/create", deprecated("/v1/roles", h.saveRoleHandler))
+	h.handle(m, "/roles/edit", deprecated("/v1/roles/{name}", h.saveRoleHandler))
+	h.handle(m, "/roles/delete", deprecated("/v1/roles/{name}", h.deleteRoleHandler))
 }
 
-// Initing public routing
+// Initing private routing
 // @param m http.ServeMux private mux
 func (h *Handler) InitPrivate(m *http.ServeMux) {
-	m.HandleFunc("/user/id", h.getID)
-	m.HandleFunc("/user/permissions", h.getPermissions)
+	h.handle(m, "GET /v1/principal", h.principalV1)
+	h.handle(m, "POST /v1/introspect", h.introspectHandler)
+	h.handle(m, "POST /v1/authorize", h.authorizeHandler)
+	h.handle(m, "GET /.well-known/jwks.json", h.jwksHandler)
+	h.handle(m, "GET /openapi.json", specHandler(privateSpec))
+
+	// legacy routes, kept until clients move to /v1
+	h.handle(m, "/user/id", deprecated("/v1/principal", h.getID))
+	h.handle(m, "/user/permissions", deprecated("/v1/principal", h.getPermissions))
+	h.handle(m, "/introspect", deprecated("/v1/introspect", h.introspectHandler))
+	h.handle(m, "/authorize", deprecated("/v1/authorize", h.authorizeHandler))
 }
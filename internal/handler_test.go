@@ -0,0 +1,262 @@
+package users_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	users "github.com/mipt-kp-2024-go-beer/user-service/internal"
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/jwt"
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/mail"
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/storage/memory"
+)
+
+// testHasher is cheap enough to run many times, the cost parameters do not change the encoding.
+func testHasher() *users.Argon2Hasher {
+	return &users.Argon2Hasher{Time: 1, Memory: 8 * 1024, Threads: 1, SaltLen: 16, KeyLen: 32}
+}
+
+// testEnv is a service on the memory store served on both ports.
+type testEnv struct {
+	store   *memory.Storage
+	service *users.AppService
+	public  *httptest.Server
+	private *httptest.Server
+}
+
+func newTestEnv(t *testing.T, opts ...users.Option) *testEnv {
+	t.Helper()
+
+	store := memory.NewStorage()
+	opts = append([]users.Option{
+		users.WithHasher(testHasher()),
+		users.WithMailer(mail.NewLog(log.New(io.Discard, "", 0))),
+	}, opts...)
+	service := users.NewAppService(store, opts...)
+
+	public, private := http.NewServeMux(), http.NewServeMux()
+	h := users.NewHandler(service, public, private)
+	h.Register()
+
+	env := &testEnv{
+		store:   store,
+		service: service,
+		public:  httptest.NewServer(h.Wrap(public)),
+		private: httptest.NewServer(h.Wrap(private)),
+	}
+	t.Cleanup(env.public.Close)
+	t.Cleanup(env.private.Close)
+
+	return env
+}
+
+// user creates a user holding the permissions and logs it in.
+// @return string user ID and Token of a fresh session.
+func (e *testEnv) user(t *testing.T, login string, permissions uint) (string, users.Token) {
+	t.Helper()
+	ctx := context.Background()
+
+	ID, err := e.service.NewUser(ctx, users.User{Login: login, Password: login + "-password"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if permissions != 0 {
+		user, err := e.store.User(ctx, ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := e.store.SetPermission(ctx, ID, permissions, user.Version); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	token, err := e.service.CreateToken(ctx, login, login+"-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ID, token
+}
+
+// call sends a JSON request with a bearer token and decodes the JSON response into out, if not nil.
+// @return int status code of the response.
+func call(t *testing.T, server *httptest.Server, method string, path string, token string, body any, out any) int {
+	t.Helper()
+
+	resp, err := server.Client().Do(newRequest(t, server, method, path, token, body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("%s %s: decode response: %v", method, path, err)
+		}
+	}
+
+	return resp.StatusCode
+}
+
+// newRequest builds a request to the server with a JSON body and a bearer token, both optional.
+func newRequest(t *testing.T, server *httptest.Server, method string, path string, token string, body any) *http.Request {
+	t.Helper()
+
+	var reader io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(raw)
+	}
+
+	req, err := http.NewRequest(method, server.URL+path, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	return req
+}
+
+func TestJWKSEndpoint(t *testing.T) {
+	signer, err := jwt.GenerateSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := newTestEnv(t, users.WithSigner(signer))
+
+	for _, server := range []*httptest.Server{env.public, env.private} {
+		resp, err := server.Client().Get(server.URL + "/.well-known/jwks.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var set jwt.JWKS
+		err = json.NewDecoder(resp.Body).Decode(&set)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET /.well-known/jwks.json status = %d, want 200", resp.StatusCode)
+		}
+		if len(set.Keys) != 1 || set.Keys[0].KeyID != signer.KeyID() || set.Keys[0].Algorithm != jwt.Algorithm {
+			t.Errorf("GET /.well-known/jwks.json = %+v, want the active key %q", set, signer.KeyID())
+		}
+	}
+
+	// the published key verifies access tokens issued by the service
+	_, token := env.user(t, "alice", users.PermQueryUsers)
+	claims, err := signer.Verify(token.Access)
+	if err != nil {
+		t.Fatalf("Verify() of an issued access token error = %v", err)
+	}
+	if claims.Permissions != users.PermQueryUsers {
+		t.Errorf("access token perm = %d, want %d", claims.Permissions, users.PermQueryUsers)
+	}
+}
+
+func TestJWKSEndpointOpaque(t *testing.T) {
+	env := newTestEnv(t)
+
+	var problem users.Problem
+	status := call(t, env.public, http.MethodGet, "/.well-known/jwks.json", "", nil, &problem)
+	if status != http.StatusNotFound || problem.Code != "jwks_unavailable" {
+		t.Errorf("GET /.well-known/jwks.json with opaque tokens = %d %q, want 404 jwks_unavailable", status, problem.Code)
+	}
+}
+
+func TestIfMatch(t *testing.T) {
+	env := newTestEnv(t)
+	ID, _ := env.user(t, "alice", 0)
+	_, admin := env.user(t, "admin", users.Permissions.All())
+
+	read := func() string {
+		t.Helper()
+		resp, err := env.public.Client().Do(newRequest(t, env.public, http.MethodGet, "/v1/users/"+ID, admin.Access, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.Header.Get("ETag")
+	}
+	send := func(method string, path string, body any, tag string) *http.Response {
+		t.Helper()
+		req := newRequest(t, env.public, method, path, admin.Access, body)
+		req.Header.Set("If-Match", tag)
+		resp, err := env.public.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	stale := read()
+	if status := call(t, env.public, http.MethodPut, "/v1/users/"+ID+"/roles/reader", admin.Access, nil, nil); status != http.StatusNoContent {
+		t.Fatalf("PUT /v1/users/{id}/roles/reader = %d, want 204", status)
+	}
+	current := read()
+	if current == stale {
+		t.Fatalf("ETag %s did not change with the roles of the user", current)
+	}
+
+	for _, route := range []struct {
+		method, path string
+		body         any
+	}{
+		{http.MethodPatch, "/v1/users/" + ID, map[string]string{"display_name": "Alice"}},
+		{http.MethodPut, "/v1/users/" + ID + "/permissions", map[string]uint{"permissions": users.PermQueryUsers}},
+		{http.MethodPost, "/user/edit", map[string]string{"id": ID, "newLogin": "alice2"}},
+		{http.MethodPost, "/user/give", map[string]any{"id": ID, "permission": users.PermQueryUsers}},
+	} {
+		if resp := send(route.method, route.path, route.body, stale); resp.StatusCode != http.StatusPreconditionFailed {
+			t.Errorf("%s %s with a stale If-Match = %d, want 412", route.method, route.path, resp.StatusCode)
+		}
+		if read() != current {
+			t.Fatalf("%s %s with a stale If-Match changed the user", route.method, route.path)
+		}
+	}
+
+	// the legacy routes accept the current version and return the next one
+	resp := send(http.MethodPost, "/user/edit", map[string]string{"id": ID, "newLogin": "alice2"}, current)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") != read() || read() == current {
+		t.Errorf("POST /user/edit with the current If-Match = %d with ETag %q, want 200 with the new version",
+			resp.StatusCode, resp.Header.Get("ETag"))
+	}
+}
+
+func TestLegacyGiveRequiresGrant(t *testing.T) {
+	env := newTestEnv(t)
+	ID, _ := env.user(t, "alice", 0)
+	_, manager := env.user(t, "manager", users.PermQueryUsers|users.PermManageUsers)
+	_, granter := env.user(t, "granter", users.PermQueryUsers|users.PermGrantPermissions)
+
+	// manage_users alone used to be enough for the legacy route
+	give := map[string]any{"id": ID, "permission": users.PermQueryUsers}
+	var problem struct {
+		Code    string   `json:"code"`
+		Missing []string `json:"missing"`
+	}
+	if status := call(t, env.public, http.MethodPost, "/user/give", manager.Access, give, &problem); status != http.StatusForbidden ||
+		problem.Code != "forbidden" || len(problem.Missing) != 1 || problem.Missing[0] != "grant_permissions" {
+		t.Errorf("POST /user/give with manage_users = %d %+v, want 403 missing grant_permissions", status, problem)
+	}
+	if status := call(t, env.public, http.MethodPost, "/user/give", granter.Access, give, nil); status != http.StatusOK {
+		t.Errorf("POST /user/give with grant_permissions = %d, want 200", status)
+	}
+}
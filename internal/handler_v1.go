@@ -0,0 +1,925 @@
+package users
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/oops"
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/webauthn"
+)
+
+// The /v1 handlers are routed with method patterns and take the access token
+// from the Authorization header only.
+
+// createSessionV1 logs the user in, starting a new session.
+// @param w http.ResponseWriter for returning the response to the client.
+// @param r *http.Request containing the login, password and optional device name in the request body.
+func (h *Handler) createSessionV1(w http.ResponseWriter, r *http.Request) {
+	var creds struct {
+		Login    string `json:"login"`
+		Password string `json:"password"`
+		Device   string `json:"device"`
+	}
+
+	if err := decodeBody(r, &creds); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+
+	ctx := WithClientInfo(r.Context(), clientInfo(r, creds.Device))
+	token, err := h.service.CreateToken(ctx, creds.Login, creds.Password)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusCreated, token)
+}
+
+// refreshSessionV1 rotates the token pair of the session.
+// @param w http.ResponseWriter for returning the response to the client.
+// @param r *http.Request containing the refresh token in the request body, the access token is optional.
+func (h *Handler) refreshSessionV1(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Refresh string `json:"refresh"`
+	}
+
+	if err := decodeBody(r, &request); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+
+	token, err := h.service.RefreshToken(r.Context(), bearerToken(r), request.Refresh)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, token)
+}
+
+// listSessionsV1 lists active sessions of the caller.
+// @param w http.ResponseWriter for returning the response to the client.
+// @param r *http.Request carrying the access token in the Authorization header.
+func (h *Handler) listSessionsV1(w http.ResponseWriter, r *http.Request) {
+	sessions, err := h.service.Sessions(r.Context(), bearerToken(r))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if sessions == nil {
+		sessions = []Session{}
+	}
+
+	writeJSON(w, http.StatusOK, map[string][]Session{"sessions": sessions})
+}
+
+// deleteSessionsV1 ends every session of the caller.
+// @param w http.ResponseWriter for returning the response to the client.
+// @param r *http.Request carrying the access token in the Authorization header.
+func (h *Handler) deleteSessionsV1(w http.ResponseWriter, r *http.Request) {
+	if err := h.service.LogoutAll(r.Context(), bearerToken(r)); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteCurrentSessionV1 ends the session of the presented access token.
+// @param w http.ResponseWriter for returning the response to the client.
+// @param r *http.Request carrying the access token in the Authorization header.
+func (h *Handler) deleteCurrentSessionV1(w http.ResponseWriter, r *http.Request) {
+	if err := h.service.Logout(r.Context(), bearerToken(r)); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteSessionV1 ends one session of the caller.
+// @param w http.ResponseWriter for returning the response to the client.
+// @param r *http.Request carrying the access token in the Authorization header and the session ID in the path.
+func (h *Handler) deleteSessionV1(w http.ResponseWriter, r *http.Request) {
+	if err := h.service.RevokeSession(r.Context(), bearerToken(r), r.PathValue("id")); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// createUserV1 registers a new user.
+// @param w http.ResponseWriter for returning the response to the client.
+// @param r *http.Request containing the login, password and optional profile in the request body.
+func (h *Handler) createUserV1(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Login       string            `json:"login"`
+		Password    string            `json:"password"`
+		Email       string            `json:"email"`
+		DisplayName string            `json:"display_name"`
+		Attributes  map[string]string `json:"attributes"`
+	}
+
+	if err := decodeBody(r, &request); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+
+	ID, err := h.service.NewUser(r.Context(), User{Login: request.Login, Password: request.Password,
+		Email: request.Email, DisplayName: request.DisplayName, Attributes: request.Attributes})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Location", "/v1/users/"+ID)
+	writeJSON(w, http.StatusCreated, map[string]string{"id": ID})
+}
+
+// deleteUserV1 deletes the user, either the caller itself or by user with corresponding permissions.
+// @param w http.ResponseWriter for returning the response to the client.
+// @param r *http.Request carrying the access token in the Authorization header and the user ID in the path.
+func (h *Handler) deleteUserV1(w http.ResponseWriter, r *http.Request) {
+	if err := h.service.RemoveUser(r.Context(), bearerToken(r), r.PathValue("id")); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getUserV1 returns the user, the caller itself or by user with corresponding permissions.
+// The ETag of the response is the version of the user to send in If-Match of later changes.
+// @param w http.ResponseWriter for returning the response to the client.
+// @param r *http.Request carrying the access token in the Authorization header and the user ID in the path.
+func (h *Handler) getUserV1(w http.ResponseWriter, r *http.Request) {
+	user, err := h.service.GetUser(r.Context(), bearerToken(r), r.PathValue("id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("ETag", etag(user.Version))
+	writeJSON(w, http.StatusOK, NewUserView(user))
+}
+
+// patchUserV1 changes the fields present in the request body, by the user itself or by user with corresponding permissions.
+// @param w http.ResponseWriter for returning the response to the client.
+// @param r *http.Request carrying the access token in the Authorization header, optional If-Match and the UserPatch in the request body.
+func (h *Handler) patchUserV1(w http.ResponseWriter, r *http.Request) {
+	var patch UserPatch
+	if err := decodeBody(r, &patch); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+
+	version, err := ifMatch(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	patch.Version = version
+
+	user, err := h.service.EditUser(r.Context(), bearerToken(r), r.PathValue("id"), patch)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("ETag", etag(user.Version))
+	writeJSON(w, http.StatusOK, NewUserView(user))
+}
+
+// putPermissionsV1 sets the direct permissions of the user by user with corresponding permissions.
+// @param w http.ResponseWriter for returning the response to the client.
+// @param r *http.Request carrying the access token in the Authorization header, optional If-Match and the permission mask in the request body.
+func (h *Handler) putPermissionsV1(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Permissions uint `json:"permissions"`
+	}
+
+	if err := decodeBody(r, &request); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+
+	version, err := ifMatch(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	version, err = h.service.GivePermission(r.Context(), bearerToken(r), r.PathValue("id"), request.Permissions, version)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("ETag", etag(version))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteUserSessionsV1 revokes every session of the user by user with corresponding permissions.
+// @param w http.ResponseWriter for returning the response to the client.
+// @param r *http.Request carrying the access token in the Authorization header and the user ID in the path.
+func (h *Handler) deleteUserSessionsV1(w http.ResponseWriter, r *http.Request) {
+	if err := h.service.RevokeSessions(r.Context(), bearerToken(r), r.PathValue("id")); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// unlockUserV1 lifts the lockout of the user after failed logins by user with corresponding permissions.
+// @param w http.ResponseWriter for returning the response to the client.
+// @param r *http.Request carrying the access token in the Authorization header and the user ID in the path.
+func (h *Handler) unlockUserV1(w http.ResponseWriter, r *http.Request) {
+	if err := h.service.Unlock(r.Context(), bearerToken(r), r.PathValue("id")); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sendVerificationV1 mails a new verification token to the email of the user,
+// by the user itself or by user with corresponding permissions.
+// @param w http.ResponseWriter for returning the response to the client.
+// @param r *http.Request carrying the access token in the Authorization header and the user ID in the path.
+func (h *Handler) sendVerificationV1(w http.ResponseWriter, r *http.Request) {
+	if err := h.service.SendVerification(r.Context(), bearerToken(r), r.PathValue("id")); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// verifyEmailV1 consumes the token mailed to the user and marks the email as verified, no access token is needed.
+// @param w http.ResponseWriter for returning the response to the client.
+// @param r *http.Request containing the verification token in the request body.
+func (h *Handler) verifyEmailV1(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Token string `json:"token"`
+	}
+
+	if err := decodeBody(r, &request); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+
+	if err := h.service.VerifyEmail(r.Context(), request.Token); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// forgotPasswordV1 mails a password reset token to the user, the response is the same whether the login exists or not.
+// @param w http.ResponseWriter for returning the response to the client.
+// @param r *http.Request containing the login in the request body.
+func (h *Handler) forgotPasswordV1(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Login string `json:"login"`
+	}
+
+	if err := decodeBody(r, &request); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+
+	if err := h.service.ForgotPassword(r.Context(), request.Login); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// resetPasswordV1 sets a new password with the token mailed to the user and ends every session of the user.
+// @param w http.ResponseWriter for returning the response to the client.
+// @param r *http.Request containing the reset token and the new password in the request body.
+func (h *Handler) resetPasswordV1(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+
+	if err := decodeBody(r, &request); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+
+	if err := h.service.ResetPassword(r.Context(), request.Token, request.Password); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// verifyMFAV1 answers the challenge of a login with a second factor, starting the session.
+// @param w http.ResponseWriter for returning the response to the client.
+// @param r *http.Request containing the challenge, the TOTP or recovery code and optional device name in the request body.
+func (h *Handler) verifyMFAV1(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Challenge string `json:"challenge"`
+		Code      string `json:"code"`
+		Device    string `json:"device"`
+	}
+
+	if err := decodeBody(r, &request); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+
+	ctx := WithClientInfo(r.Context(), clientInfo(r, request.Device))
+	token, err := h.service.VerifyMFA(ctx, request.Challenge, request.Code)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusCreated, token)
+}
+
+// getMFAV1 describes the second factors of the user, to the user itself or to user with corresponding permissions.
+// @param w http.ResponseWriter for returning the response to the client.
+// @param r *http.Request carrying the access token in the Authorization header and the user ID in the path.
+func (h *Handler) getMFAV1(w http.ResponseWriter, r *http.Request) {
+	status, err := h.service.MFAStatus(r.Context(), bearerToken(r), r.PathValue("id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, status)
+}
+
+// enrollTOTPV1 generates a TOTP secret for the user itself, to be confirmed with a code.
+// @param w http.ResponseWriter for returning the response to the client.
+// @param r *http.Request carrying the access token in the Authorization header and the user ID in the path.
+func (h *Handler) enrollTOTPV1(w http.ResponseWriter, r *http.Request) {
+	setup, err := h.service.EnrollTOTP(r.Context(), bearerToken(r), r.PathValue("id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusCreated, setup)
+}
+
+// confirmTOTPV1 confirms the TOTP enrollment with a code and returns the recovery codes.
+// @param w http.ResponseWriter for returning the response to the client.
+// @param r *http.Request carrying the access token in the Authorization header, the user ID in the path and the code in the body.
+func (h *Handler) confirmTOTPV1(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Code string `json:"code"`
+	}
+
+	if err := decodeBody(r, &request); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+
+	codes, err := h.service.ConfirmTOTP(r.Context(), bearerToken(r), r.PathValue("id"), request.Code)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string][]string{"recovery_codes": codes})
+}
+
+// deleteTOTPV1 removes the second factor of the user, the user itself must send a code in the body.
+// @param w http.ResponseWriter for returning the response to the client.
+// @param r *http.Request carrying the access token in the Authorization header, the user ID in the path and the optional code in the body.
+func (h *Handler) deleteTOTPV1(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Code string `json:"code"`
+	}
+
+	if err := decodeBody(r, &request); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+
+	if err := h.service.DisableTOTP(r.Context(), bearerToken(r), r.PathValue("id"), request.Code); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getMFAPolicyV1 returns the permissions only granted to sessions confirmed with a second factor.
+// @param w http.ResponseWriter for returning the response to the client.
+// @param r *http.Request carrying the access token in the Authorization header.
+func (h *Handler) getMFAPolicyV1(w http.ResponseWriter, r *http.Request) {
+	mask, err := h.service.MFAPolicy(r.Context(), bearerToken(r))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]uint{"permissions": mask})
+}
+
+// putMFAPolicyV1 replaces the permissions only granted to sessions confirmed with a second factor.
+// @param w http.ResponseWriter for returning the response to the client.
+// @param r *http.Request carrying the access token in the Authorization header and the permission mask in the body.
+func (h *Handler) putMFAPolicyV1(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Permissions uint `json:"permissions"`
+	}
+
+	if err := decodeBody(r, &request); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+
+	if err := h.service.SetMFAPolicy(r.Context(), bearerToken(r), request.Permissions); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// passkeyOptionsV1 starts the registration of a passkey for the user itself.
+// @param w http.ResponseWriter for returning the response to the client.
+// @param r *http.Request carrying the access token in the Authorization header and the user ID in the path.
+func (h *Handler) passkeyOptionsV1(w http.ResponseWriter, r *http.Request) {
+	options, err := h.service.BeginRegistration(r.Context(), bearerToken(r), r.PathValue("id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, options)
+}
+
+// createPasskeyV1 stores the passkey created by the authenticator of the user itself.
+// @param w http.ResponseWriter for returning the response to the client.
+// @param r *http.Request carrying the access token in the Authorization header, the user ID in the path,
+// the optional name and the credential returned by the browser in the request body.
+func (h *Handler) createPasskeyV1(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Name       string                        `json:"name"`
+		Credential webauthn.RegistrationResponse `json:"credential"`
+	}
+
+	if err := decodeBody(r, &request); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+
+	ID := r.PathValue("id")
+	passkey, err := h.service.FinishRegistration(r.Context(), bearerToken(r), ID, request.Name, request.Credential)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Location", "/v1/users/"+ID+"/passkeys/"+passkey.ID)
+	writeJSON(w, http.StatusCreated, passkey)
+}
+
+// listPasskeysV1 lists the passkeys of the user, to the user itself or to user with corresponding permissions.
+// @param w http.ResponseWriter for returning the response to the client.
+// @param r *http.Request carrying the access token in the Authorization header and the user ID in the path.
+func (h *Handler) listPasskeysV1(w http.ResponseWriter, r *http.Request) {
+	passkeys, err := h.service.Passkeys(r.Context(), bearerToken(r), r.PathValue("id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string][]Passkey{"passkeys": passkeys})
+}
+
+// deletePasskeyV1 removes a passkey of the user, by the user itself or by user with corresponding permissions.
+// @param w http.ResponseWriter for returning the response to the client.
+// @param r *http.Request carrying the access token in the Authorization header, the user ID and passkey ID in the path.
+func (h *Handler) deletePasskeyV1(w http.ResponseWriter, r *http.Request) {
+	if err := h.service.DeletePasskey(r.Context(), bearerToken(r), r.PathValue("id"), r.PathValue("passkey")); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// createPersonalTokenV1 creates a personal access token for the user itself, its secret is only returned here.
+// @param w http.ResponseWriter for returning the response to the client.
+// @param r *http.Request carrying the access token of a session in the Authorization header, the user ID in the path,
+// the name, permission mask and optional expiry of the token in the request body.
+func (h *Handler) createPersonalTokenV1(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Name        string    `json:"name"`
+		Permissions uint      `json:"permissions"`
+		ExpiresAt   time.Time `json:"expires_at"`
+	}
+
+	if err := decodeBody(r, &request); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+
+	ID := r.PathValue("id")
+	token, secret, err := h.service.CreatePersonalToken(r.Context(), bearerToken(r), ID,
+		PersonalToken{Name: request.Name, Permissions: request.Permissions, ExpiresAt: request.ExpiresAt})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Location", "/v1/users/"+ID+"/tokens/"+token.ID)
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusCreated, struct {
+		PersonalToken
+		Token string `json:"token"`
+	}{token, secret})
+}
+
+// listPersonalTokensV1 lists the personal access tokens of the user, to the user itself or to user with corresponding permissions.
+// @param w http.ResponseWriter for returning the response to the client.
+// @param r *http.Request carrying the access token in the Authorization header and the user ID in the path.
+func (h *Handler) listPersonalTokensV1(w http.ResponseWriter, r *http.Request) {
+	tokens, err := h.service.PersonalTokens(r.Context(), bearerToken(r), r.PathValue("id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string][]PersonalToken{"tokens": tokens})
+}
+
+// deletePersonalTokenV1 revokes a personal access token of the user, by the user itself or by user with corresponding permissions.
+// @param w http.ResponseWriter for returning the response to the client.
+// @param r *http.Request carrying the access token in the Authorization header, the user ID and token ID in the path.
+func (h *Handler) deletePersonalTokenV1(w http.ResponseWriter, r *http.Request) {
+	if err := h.service.RevokePersonalToken(r.Context(), bearerToken(r), r.PathValue("id"), r.PathValue("token")); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// oauthTokenV1 is the OAuth 2.0 token endpoint, it serves the client credentials grant to service accounts.
+// Errors are RFC 6749 error responses rather than problem details.
+// @param w http.ResponseWriter for returning the response to the client.
+// @param r *http.Request containing the form encoded grant_type and optional scope, the client authenticates
+// with HTTP Basic or with client_id and client_secret in the form.
+func (h *Handler) oauthTokenV1(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, fmt.Errorf("%w: %v", oops.ErrInvalidRequest, err))
+		return
+	}
+
+	clientID, secret, basic := r.BasicAuth()
+	if basic {
+		// RFC 6749 form encodes the credentials before the Basic encoding
+		var errID, errSecret error
+		clientID, errID = url.QueryUnescape(clientID)
+		secret, errSecret = url.QueryUnescape(secret)
+		if errID != nil || errSecret != nil || r.PostForm.Has("client_secret") {
+			writeOAuthError(w, fmt.Errorf("%w: client credentials are malformed or sent twice", oops.ErrInvalidRequest))
+			return
+		}
+	} else {
+		clientID, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+
+	switch grant := r.PostForm.Get("grant_type"); grant {
+	case "client_credentials":
+	case "":
+		writeOAuthError(w, fmt.Errorf("%w: grant_type is required", oops.ErrInvalidRequest))
+		return
+	default:
+		writeOAuthError(w, fmt.Errorf("%w: %q", oops.ErrUnsupportedGrant, grant))
+		return
+	}
+
+	token, err := h.service.ClientCredentials(r.Context(), clientID, secret, r.PostForm.Get("scope"))
+	if err != nil {
+		writeOAuthError(w, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, token)
+}
+
+// listServiceAccountsV1 lists the service accounts to user with corresponding permissions.
+// @param w http.ResponseWriter for returning the response to the client.
+// @param r *http.Request carrying the access token in the Authorization header.
+func (h *Handler) listServiceAccountsV1(w http.ResponseWriter, r *http.Request) {
+	accounts, err := h.service.ServiceAccounts(r.Context(), bearerToken(r))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string][]ServiceAccount{"service_accounts": accounts})
+}
+
+// createServiceAccountV1 creates a service account by user with corresponding permissions,
+// its client secret is only returned here.
+// @param w http.ResponseWriter for returning the response to the client.
+// @param r *http.Request carrying the access token in the Authorization header, the name and permission mask in the request body.
+func (h *Handler) createServiceAccountV1(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Name        string `json:"name"`
+		Permissions uint   `json:"permissions"`
+	}
+
+	if err := decodeBody(r, &request); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+
+	account, secret, err := h.service.CreateServiceAccount(r.Context(), bearerToken(r),
+		ServiceAccount{Name: request.Name, Permissions: request.Permissions})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Location", "/v1/service-accounts/"+account.ClientID)
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusCreated, struct {
+		ServiceAccount
+		ClientSecret string `json:"client_secret"`
+	}{account, secret})
+}
+
+// getServiceAccountV1 returns a service account to user with corresponding permissions.
+// @param w http.ResponseWriter for returning the response to the client.
+// @param r *http.Request carrying the access token in the Authorization header and the client ID in the path.
+func (h *Handler) getServiceAccountV1(w http.ResponseWriter, r *http.Request) {
+	account, err := h.service.ServiceAccount(r.Context(), bearerToken(r), r.PathValue("id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, account)
+}
+
+// patchServiceAccountV1 changes the fields present in the request body by user with corresponding permissions.
+// @param w http.ResponseWriter for returning the response to the client.
+// @param r *http.Request carrying the access token in the Authorization header, the client ID in the path
+// and the ServiceAccountPatch in the request body.
+func (h *Handler) patchServiceAccountV1(w http.ResponseWriter, r *http.Request) {
+	var patch ServiceAccountPatch
+	if err := decodeBody(r, &patch); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+
+	account, err := h.service.EditServiceAccount(r.Context(), bearerToken(r), r.PathValue("id"), patch)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, account)
+}
+
+// rotateServiceSecretV1 replaces the client secret of a service account by user with corresponding permissions.
+// @param w http.ResponseWriter for returning the response to the client.
+// @param r *http.Request carrying the access token in the Authorization header and the client ID in the path.
+func (h *Handler) rotateServiceSecretV1(w http.ResponseWriter, r *http.Request) {
+	clientID := r.PathValue("id")
+	secret, err := h.service.RotateServiceSecret(r.Context(), bearerToken(r), clientID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]string{"client_id": clientID, "client_secret": secret})
+}
+
+// passkeyLoginOptionsV1 starts a passkey login, no access token is needed.
+// @param w http.ResponseWriter for returning the response to the client.
+// @param r *http.Request containing the login in the request body.
+func (h *Handler) passkeyLoginOptionsV1(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Login string `json:"login"`
+	}
+
+	if err := decodeBody(r, &request); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+
+	options, err := h.service.BeginPasskeyLogin(r.Context(), request.Login)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, options)
+}
+
+// passkeyLoginV1 logs the user in with the assertion of its passkey, starting a new session.
+// @param w http.ResponseWriter for returning the response to the client.
+// @param r *http.Request containing the credential returned by the browser and optional device name in the request body.
+func (h *Handler) passkeyLoginV1(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Credential webauthn.AssertionResponse `json:"credential"`
+		Device     string                     `json:"device"`
+	}
+
+	if err := decodeBody(r, &request); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+
+	ctx := WithClientInfo(r.Context(), clientInfo(r, request.Device))
+	token, err := h.service.FinishPasskeyLogin(ctx, request.Credential)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusCreated, token)
+}
+
+// putUserRoleV1 assigns the role to the user by user with corresponding permissions.
+// @param w http.ResponseWriter for returning the response to the client.
+// @param r *http.Request carrying the access token in the Authorization header, user ID and role name in the path.
+func (h *Handler) putUserRoleV1(w http.ResponseWriter, r *http.Request) {
+	if err := h.service.AssignRole(r.Context(), bearerToken(r), r.PathValue("id"), r.PathValue("role")); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteUserRoleV1 takes the role away from the user by user with corresponding permissions.
+// @param w http.ResponseWriter for returning the response to the client.
+// @param r *http.Request carrying the access token in the Authorization header, user ID and role name in the path.
+func (h *Handler) deleteUserRoleV1(w http.ResponseWriter, r *http.Request) {
+	if err := h.service.UnassignRole(r.Context(), bearerToken(r), r.PathValue("id"), r.PathValue("role")); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listRolesV1 lists roles by user with corresponding permissions.
+// @param w http.ResponseWriter for returning the response to the client.
+// @param r *http.Request carrying the access token in the Authorization header.
+func (h *Handler) listRolesV1(w http.ResponseWriter, r *http.Request) {
+	roles, err := h.service.Roles(r.Context(), bearerToken(r))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if roles == nil {
+		roles = []Role{}
+	}
+
+	writeJSON(w, http.StatusOK, map[string][]Role{"roles": roles})
+}
+
+// createRoleV1 creates a role by user with corresponding permissions.
+// @param w http.ResponseWriter for returning the response to the client.
+// @param r *http.Request carrying the access token in the Authorization header and the role in the request body.
+func (h *Handler) createRoleV1(w http.ResponseWriter, r *http.Request) {
+	var role Role
+	if err := decodeBody(r, &role); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+
+	if err := h.service.CreateRole(r.Context(), bearerToken(r), role); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Location", "/v1/roles/"+role.Name)
+	writeJSON(w, http.StatusCreated, role)
+}
+
+// putRoleV1 replaces description and permissions of a role by user with corresponding permissions.
+// @param w http.ResponseWriter for returning the response to the client.
+// @param r *http.Request carrying the access token in the Authorization header, the role name in the path and the role in the request body.
+func (h *Handler) putRoleV1(w http.ResponseWriter, r *http.Request) {
+	var role Role
+	if err := decodeBody(r, &role); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+	role.Name = r.PathValue("name")
+
+	if err := h.service.EditRole(r.Context(), bearerToken(r), role); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, role)
+}
+
+// deleteRoleV1 deletes a role by user with corresponding permissions.
+// @param w http.ResponseWriter for returning the response to the client.
+// @param r *http.Request carrying the access token in the Authorization header and the role name in the path.
+func (h *Handler) deleteRoleV1(w http.ResponseWriter, r *http.Request) {
+	if err := h.service.DeleteRole(r.Context(), bearerToken(r), r.PathValue("name")); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// principalV1 returns ID and effective permissions of the token owner, private api.
+// @param w http.ResponseWriter for returning the response to the client.
+// @param r *http.Request carrying the access token in the Authorization header.
+func (h *Handler) principalV1(w http.ResponseWriter, r *http.Request) {
+	principal, ok := PrincipalFrom(r.Context())
+	if !ok {
+		// report why the middleware could not authenticate the request
+		var err error
+		if principal, err = h.service.Authenticate(r.Context(), bearerToken(r)); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		ID          string `json:"id"`
+		Permissions uint   `json:"permissions"`
+		Service     bool   `json:"service"`
+	}{principal.ID, principal.Permissions, principal.Service})
+}
+
+// etag formats the version of a user as a strong entity tag.
+// @param version int64 version of the user.
+// @return string ETag header value.
+func etag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// ifMatch reads the version a change is based on from the If-Match header.
+// @param r *http.Request of the caller.
+// @return int64 expected version, 0 if the header is absent or "*", and oops.ErrVersionMismatch
+// if the header does not name a single version since such a precondition can never hold.
+func ifMatch(r *http.Request) (int64, error) {
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+	if header == "" || header == "*" {
+		return 0, nil
+	}
+
+	// weak tags never match under the strong comparison required for If-Match
+	tag, ok := strings.CutPrefix(header, `"`)
+	if !ok {
+		return 0, oops.ErrVersionMismatch
+	}
+	tag, ok = strings.CutSuffix(tag, `"`)
+	if !ok {
+		return 0, oops.ErrVersionMismatch
+	}
+
+	version, err := strconv.ParseInt(tag, 10, 64)
+	if err != nil || version <= 0 {
+		return 0, oops.ErrVersionMismatch
+	}
+
+	return version, nil
+}
+
+// writeJSON writes v as the JSON response body.
+// @param w http.ResponseWriter for returning the response to the client.
+// @param status int HTTP status of the response.
+// @param v any response body.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,111 @@
+package users
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// PasswordHasher turns plaintext passwords into encoded hashes and verifies them.
+type PasswordHasher interface {
+	// Hash returns the encoded hash of the password.
+	Hash(password string) (string, error)
+	// Verify reports whether the password matches the encoded hash and whether
+	// the hash should be replaced because it is legacy or uses outdated parameters.
+	Verify(encoded string, password string) (ok bool, rehash bool, err error)
+}
+
+// argon2idPrefix marks hashes produced by Argon2Hasher.
+const argon2idPrefix = "$argon2id$"
+
+// Argon2Hasher hashes passwords with argon2id and encodes them in the PHC string format:
+// $argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<salt>$<key>
+type Argon2Hasher struct {
+	Time    uint32 // number of passes over the memory
+	Memory  uint32 // memory size in KiB
+	Threads uint8  // degree of parallelism
+	SaltLen uint32 // salt length in bytes
+	KeyLen  uint32 // derived key length in bytes
+}
+
+// NewArgon2Hasher returns a hasher with the parameters recommended by RFC 9106 for memory-constrained environments.
+func NewArgon2Hasher() *Argon2Hasher {
+	return &Argon2Hasher{
+		Time:    3,
+		Memory:  64 * 1024,
+		Threads: 4,
+		SaltLen: 16,
+		KeyLen:  32,
+	}
+}
+
+// Hash derives a key from the password with a fresh random salt.
+// @param password string plaintext password.
+// @return string encoded hash and an error if the salt cannot be generated.
+func (h *Argon2Hasher) Hash(password string) (string, error) {
+	salt := make([]byte, h.SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, h.Time, h.Memory, h.Threads, h.KeyLen)
+
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2idPrefix, argon2.Version,
+		h.Memory, h.Time, h.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// Verify compares the password against the encoded hash.
+// Anything that is not an argon2id hash is treated as a legacy plaintext password.
+// @param encoded string stored password.
+// @param password string plaintext password to check.
+// @return bool whether the password matches, bool whether the stored value should be rehashed and an error for malformed hashes.
+func (h *Argon2Hasher) Verify(encoded string, password string) (bool, bool, error) {
+	if !strings.HasPrefix(encoded, argon2idPrefix) {
+		// legacy rows were stored in plaintext before hashing was introduced
+		ok := subtle.ConstantTimeCompare([]byte(encoded), []byte(password)) == 1
+		return ok, ok, nil
+	}
+
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return false, false, fmt.Errorf("malformed argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return false, false, fmt.Errorf("malformed argon2id version: %w", err)
+	}
+
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false, false, fmt.Errorf("malformed argon2id parameters: %w", err)
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, false, fmt.Errorf("malformed argon2id salt: %w", err)
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, false, fmt.Errorf("malformed argon2id key: %w", err)
+	}
+
+	derived := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(key)))
+	if subtle.ConstantTimeCompare(derived, key) != 1 {
+		return false, false, nil
+	}
+
+	outdated := version != argon2.Version ||
+		memory != h.Memory || time != h.Time || threads != h.Threads ||
+		uint32(len(salt)) != h.SaltLen || uint32(len(key)) != h.KeyLen
+
+	return true, outdated, nil
+}
@@ -0,0 +1,167 @@
+package users_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	users "github.com/mipt-kp-2024-go-beer/user-service/internal"
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/storage/memory"
+)
+
+func TestArgon2HasherVerify(t *testing.T) {
+	h := testHasher()
+	weak := &users.Argon2Hasher{Time: 1, Memory: 4 * 1024, Threads: 1, SaltLen: 8, KeyLen: 16}
+
+	current, err := h.Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	outdated, err := weak.Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		encoded  string
+		password string
+		ok       bool
+		rehash   bool
+	}{
+		{"round trip", current, "secret", true, false},
+		{"wrong password", current, "Secret", false, false},
+		{"empty password", current, "", false, false},
+		{"weaker parameters", outdated, "secret", true, true},
+		{"weaker parameters wrong password", outdated, "other", false, false},
+		{"legacy plaintext", "secret", "secret", true, true},
+		{"legacy plaintext wrong password", "secret", "other", false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, rehash, err := h.Verify(tt.encoded, tt.password)
+			if err != nil {
+				t.Fatalf("Verify() error = %v", err)
+			}
+			if ok != tt.ok || rehash != tt.rehash {
+				t.Errorf("Verify() = %v, %v, want %v, %v", ok, rehash, tt.ok, tt.rehash)
+			}
+		})
+	}
+}
+
+func TestArgon2HasherHashFormat(t *testing.T) {
+	h := testHasher()
+
+	first, err := h.Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := h.Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(first, "$argon2id$v=19$m=8192,t=1,p=1$") {
+		t.Errorf("Hash() = %q, want PHC string with the hasher parameters", first)
+	}
+	if first == second {
+		t.Error("Hash() returned the same string twice, salt is not random")
+	}
+}
+
+func TestArgon2HasherMalformed(t *testing.T) {
+	h := testHasher()
+
+	tests := []struct {
+		name    string
+		encoded string
+	}{
+		{"missing key", "$argon2id$v=19$m=8192,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA"},
+		{"extra field", "$argon2id$v=19$m=8192,t=1,p=1$c2FsdA$a2V5$more"},
+		{"bad version", "$argon2id$v=x$m=8192,t=1,p=1$c2FsdA$a2V5"},
+		{"bad parameters", "$argon2id$v=19$m=8192;t=1;p=1$c2FsdA$a2V5"},
+		{"bad salt", "$argon2id$v=19$m=8192,t=1,p=1$!!!$a2V5"},
+		{"bad key", "$argon2id$v=19$m=8192,t=1,p=1$c2FsdA$!!!"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, rehash, err := h.Verify(tt.encoded, "secret")
+			if err == nil {
+				t.Fatal("Verify() error = nil, want malformed hash error")
+			}
+			if ok || rehash {
+				t.Errorf("Verify() = %v, %v, want false, false", ok, rehash)
+			}
+		})
+	}
+}
+
+func TestCheckUserRehash(t *testing.T) {
+	ctx := context.Background()
+	store := memory.NewStorage()
+	h := testHasher()
+	svc := users.NewAppService(store, users.WithHasher(h))
+
+	weak := &users.Argon2Hasher{Time: 1, Memory: 4 * 1024, Threads: 1, SaltLen: 16, KeyLen: 32}
+	outdated, err := weak.Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ID, err := store.SaveUser(ctx, users.User{Login: "alice", Password: outdated, Status: users.StatusActive})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, _, err := svc.CheckUser(ctx, users.User{Login: "alice", Password: "wrong"}); ok || err == nil {
+		t.Fatalf("CheckUser() with wrong password = %v, %v, want failure", ok, err)
+	}
+	if stored, _ := store.User(ctx, ID); stored.Password != outdated {
+		t.Fatal("failed login replaced the stored hash")
+	}
+
+	ok, gotID, err := svc.CheckUser(ctx, users.User{Login: "alice", Password: "secret"})
+	if err != nil || !ok || gotID != ID {
+		t.Fatalf("CheckUser() = %v, %q, %v, want true, %q, nil", ok, gotID, err, ID)
+	}
+
+	stored, err := store.User(ctx, ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Password == outdated {
+		t.Fatal("login did not replace the outdated hash")
+	}
+	if ok, rehash, err := h.Verify(stored.Password, "secret"); !ok || rehash || err != nil {
+		t.Errorf("Verify(rehashed) = %v, %v, %v, want true, false, nil", ok, rehash, err)
+	}
+}
+
+// countingHasher records the verifications made through it.
+type countingHasher struct {
+	users.PasswordHasher
+	verified int
+}
+
+func (h *countingHasher) Verify(encoded string, password string) (bool, bool, error) {
+	h.verified++
+	return h.PasswordHasher.Verify(encoded, password)
+}
+
+func TestCheckUserUnknownLogin(t *testing.T) {
+	ctx := context.Background()
+	h := &countingHasher{PasswordHasher: testHasher()}
+	svc := users.NewAppService(memory.NewStorage(), users.WithHasher(h))
+
+	for i := 1; i <= 2; i++ {
+		if ok, _, err := svc.CheckUser(ctx, users.User{Login: "nobody", Password: "secret"}); ok || err == nil {
+			t.Fatalf("CheckUser() = %v, %v, want failure", ok, err)
+		}
+		// the unknown login must cost a verification like a known one
+		if h.verified != i {
+			t.Fatalf("CheckUser() made %d verifications after %d calls, want %d", h.verified, i, i)
+		}
+	}
+}
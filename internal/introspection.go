@@ -0,0 +1,126 @@
+package users
+
+import (
+	"context"
+	"time"
+
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/jwt"
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/oops"
+)
+
+// Introspection is the token introspection response defined by RFC 7662.
+// Inactive tokens carry no other members.
+type Introspection struct {
+	Active      bool   `json:"active"`
+	Subject     string `json:"sub,omitempty"`
+	Username    string `json:"username,omitempty"`
+	Scope       string `json:"scope,omitempty"`
+	Permissions uint   `json:"permissions,omitempty"`
+	ClientID    string `json:"client_id,omitempty"` // set for tokens of service accounts
+	TokenType   string `json:"token_type,omitempty"`
+	IssuedAt    int64  `json:"iat,omitempty"`
+	Expiration  int64  `json:"exp,omitempty"`
+}
+
+// Introspect describes the access token and its owner with a single store lookup.
+// Unknown, expired and rotated tokens are reported as inactive rather than as errors.
+// Personal access tokens and tokens of service accounts report the permissions of their scope.
+// @param ctx context.Context for managing the scope of the operation.
+// @param access string representing the access token to describe.
+// @return Introspection of the token and an error if the store fails.
+func (s *AppService) Introspect(ctx context.Context, access string) (Introspection, error) {
+	if isPersonalToken(access) {
+		return s.introspectPersonal(ctx, access)
+	}
+
+	if s.isServiceToken(access) {
+		return s.introspectService(ctx, access)
+	}
+
+	if s.signer != nil && jwt.IsJWT(access) {
+		if _, err := s.signer.Verify(access); err != nil {
+			return Introspection{Active: false}, nil
+		}
+	}
+
+	token, user, err := s.store.Introspect(ctx, access)
+	if err == oops.ErrTokenExistance || err == oops.ErrNoUser {
+		return Introspection{Active: false}, nil
+	} else if err != nil {
+		return Introspection{}, err
+	}
+
+	if token.Consumed || time.Now().After(token.Expiration) {
+		return Introspection{Active: false}, nil
+	}
+
+	permissions, err := s.mfaPermissions(ctx, token.Family, user.Permissions)
+	if err != nil {
+		return Introspection{}, err
+	}
+
+	return Introspection{
+		Active:      true,
+		Subject:     user.ID,
+		Username:    user.Login,
+		Scope:       Scope(permissions),
+		Permissions: permissions,
+		TokenType:   "Bearer",
+		IssuedAt:    token.IssuedAt.Unix(),
+		Expiration:  token.Expiration.Unix(),
+	}, nil
+}
+
+// introspectPersonal describes a personal access token with the permissions of its scope.
+// @param ctx context.Context for managing the scope of the operation.
+// @param access string personal access token to describe.
+// @return Introspection of the token and an error if the store fails.
+func (s *AppService) introspectPersonal(ctx context.Context, access string) (Introspection, error) {
+	token, user, err := s.personalToken(ctx, access)
+	if err == oops.ErrTokenExistance || err == oops.ErrTokenExpired || err == oops.ErrUserDisabled {
+		return Introspection{Active: false}, nil
+	} else if err != nil {
+		return Introspection{}, err
+	}
+
+	permissions, err := s.personalPermissions(ctx, token)
+	if err != nil {
+		return Introspection{}, err
+	}
+
+	return Introspection{
+		Active:      true,
+		Subject:     user.ID,
+		Username:    user.Login,
+		Scope:       Scope(permissions),
+		Permissions: permissions,
+		TokenType:   "Bearer",
+		IssuedAt:    token.CreatedAt.Unix(),
+		Expiration:  token.ExpiresAt.Unix(),
+	}, nil
+}
+
+// introspectService describes an access token of a service account, it has no username.
+// @param ctx context.Context for managing the scope of the operation.
+// @param access string access token to describe.
+// @return Introspection of the token and an error if the store fails.
+func (s *AppService) introspectService(ctx context.Context, access string) (Introspection, error) {
+	token, account, err := s.serviceToken(ctx, access)
+	if err == oops.ErrTokenExistance || err == oops.ErrTokenExpired {
+		return Introspection{Active: false}, nil
+	} else if err != nil {
+		return Introspection{}, err
+	}
+
+	permissions := token.Permissions & account.Permissions
+	return Introspection{
+		Active:      true,
+		Subject:     account.ClientID,
+		ClientID:    account.ClientID,
+		Scope:       Scope(permissions),
+		Permissions: permissions,
+		TokenType:   "Bearer",
+		IssuedAt:    token.IssuedAt.Unix(),
+		Expiration:  token.ExpiresAt.Unix(),
+	}, nil
+}
@@ -0,0 +1,219 @@
+package users_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	users "github.com/mipt-kp-2024-go-beer/user-service/internal"
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/jwt"
+)
+
+// introspect posts the token to the private introspection endpoint and returns the raw members of the answer.
+func introspect(t *testing.T, env *testEnv, token string) map[string]any {
+	t.Helper()
+
+	var members map[string]any
+	if status := call(t, env.private, http.MethodPost, "/v1/introspect", "", map[string]string{"token": token}, &members); status != http.StatusOK {
+		t.Fatalf("POST /v1/introspect = %d, want 200", status)
+	}
+
+	return members
+}
+
+// inactive asserts that the token is reported inactive without any other member, as RFC 7662 requires.
+func inactive(t *testing.T, env *testEnv, what string, token string) {
+	t.Helper()
+
+	if members := introspect(t, env, token); len(members) != 1 || members["active"] != false {
+		t.Errorf("introspection of %s = %v, want only active false", what, members)
+	}
+}
+
+func TestIntrospectActive(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t)
+	ID, session := env.user(t, "alice", users.PermQueryUsers|users.PermLoanBooks)
+	before := time.Now().Unix()
+
+	members := introspect(t, env, session.Access)
+	for member, want := range map[string]any{
+		"active":      true,
+		"sub":         ID,
+		"username":    "alice",
+		"scope":       "query_users loan_books",
+		"permissions": float64(users.PermQueryUsers | users.PermLoanBooks),
+		"token_type":  "Bearer",
+	} {
+		if members[member] != want {
+			t.Errorf("introspection member %s = %v, want %v", member, members[member], want)
+		}
+	}
+	if _, ok := members["client_id"]; ok {
+		t.Errorf("introspection of a user token has client_id %v", members["client_id"])
+	}
+	iat, _ := members["iat"].(float64)
+	exp, _ := members["exp"].(float64)
+	if int64(iat) > before+1 || int64(exp) <= before {
+		t.Errorf("introspection iat = %v, exp = %v, want issued before %d and expiring after it", iat, exp, before+1)
+	}
+
+	// the endpoint accepts the form encoding of RFC 7662 too
+	resp, err := env.private.Client().PostForm(env.private.URL+"/v1/introspect", url.Values{"token": {session.Access}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var form users.Introspection
+	if err := json.NewDecoder(resp.Body).Decode(&form); err != nil || !form.Active || form.Subject != ID {
+		t.Errorf("form encoded introspection = %+v, %v, want the active token of %s", form, err, ID)
+	}
+
+	// personal tokens report their own scope and lifetime
+	expiresAt := time.Now().Add(time.Hour).Truncate(time.Second)
+	_, secret, err := env.service.CreatePersonalToken(ctx, session.Access, ID,
+		users.PersonalToken{Name: "script", Permissions: users.PermLoanBooks, ExpiresAt: expiresAt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	personal := introspect(t, env, secret)
+	if personal["active"] != true || personal["sub"] != ID || personal["username"] != "alice" ||
+		personal["scope"] != "loan_books" || personal["exp"] != float64(expiresAt.Unix()) {
+		t.Errorf("introspection of a personal token = %v, want active loan_books of %s until %d", personal, ID, expiresAt.Unix())
+	}
+}
+
+func TestIntrospectServiceToken(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t)
+	_, admin := env.user(t, "admin", users.PermQueryUsers|users.PermManageUsers|users.PermGrantPermissions)
+
+	account, secret, err := env.service.CreateServiceAccount(ctx, admin.Access,
+		users.ServiceAccount{Name: "catalog", Permissions: users.PermQueryUsers | users.PermManageUsers})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := env.service.ClientCredentials(ctx, account.ClientID, secret, "query_users")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a service has a client ID but no username
+	members := introspect(t, env, token.AccessToken)
+	if members["active"] != true || members["sub"] != account.ClientID || members["client_id"] != account.ClientID ||
+		members["scope"] != "query_users" {
+		t.Errorf("introspection of a service token = %v, want active query_users of %s", members, account.ClientID)
+	}
+	if _, ok := members["username"]; ok {
+		t.Errorf("introspection of a service token has username %v", members["username"])
+	}
+
+	if _, err := env.service.RotateServiceSecret(ctx, admin.Access, account.ClientID); err != nil {
+		t.Fatal(err)
+	}
+	inactive(t, env, "a service token revoked by a secret rotation", token.AccessToken)
+	inactive(t, env, "an unknown service token", users.ServiceTokenPrefix+"unknown")
+}
+
+func TestIntrospectInactive(t *testing.T) {
+	signer, err := jwt.GenerateSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mode := range []struct {
+		name string
+		opts []users.Option
+	}{
+		{"opaque", nil},
+		{"jwt", []users.Option{users.WithSigner(signer)}},
+	} {
+		t.Run(mode.name, func(t *testing.T) {
+			ctx := context.Background()
+			env := newTestEnv(t, mode.opts...)
+			ID, session := env.user(t, "alice", users.PermQueryUsers)
+			_, admin := env.user(t, "admin", users.PermQueryUsers|users.PermManageUsers|users.PermGrantPermissions)
+
+			inactive(t, env, "an unknown token", "unknown")
+			inactive(t, env, "an unknown personal token", users.PersonalTokenPrefix+"unknown")
+			if mode.name == "jwt" {
+				inactive(t, env, "a forged token", session.Access[:strings.LastIndexByte(session.Access, '.')+1]+"forged")
+			}
+
+			refreshed, err := env.service.RefreshToken(ctx, session.Access, session.Refresh)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mode.name == "opaque" {
+				inactive(t, env, "a rotated access token", session.Access)
+			}
+			if err := env.service.Logout(ctx, refreshed.Access); err != nil {
+				t.Fatal(err)
+			}
+			inactive(t, env, "the access token of a logged out session", refreshed.Access)
+
+			personal, secret, err := env.service.CreatePersonalToken(ctx, admin.Access, mustID(t, env, admin.Access),
+				users.PersonalToken{Name: "script", Permissions: users.PermQueryUsers})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := env.service.RevokePersonalToken(ctx, admin.Access, personal.UserID, personal.ID); err != nil {
+				t.Fatal(err)
+			}
+			inactive(t, env, "a revoked personal token", secret)
+
+			// the user itself is gone for the tokens of a deleted user
+			other, err := env.service.CreateToken(ctx, "alice", "alice-password")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := env.service.RemoveUser(ctx, admin.Access, ID); err != nil {
+				t.Fatal(err)
+			}
+			inactive(t, env, "the token of a deleted user", other.Access)
+		})
+	}
+}
+
+func TestIntrospectExpired(t *testing.T) {
+	ctx := context.Background()
+	ttl := 200 * time.Millisecond
+	env := newTestEnv(t, users.WithTokenTTL(ttl, 0))
+	ID, session := env.user(t, "alice", users.PermQueryUsers)
+	_, personal, err := env.service.CreatePersonalToken(ctx, session.Access, ID,
+		users.PersonalToken{Name: "script", Permissions: users.PermQueryUsers, ExpiresAt: time.Now().Add(ttl)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, admin := env.user(t, "admin", users.PermQueryUsers|users.PermManageUsers|users.PermGrantPermissions)
+	account, secret, err := env.service.CreateServiceAccount(ctx, admin.Access, users.ServiceAccount{Name: "catalog", Permissions: users.PermQueryUsers})
+	if err != nil {
+		t.Fatal(err)
+	}
+	service, err := env.service.ClientCredentials(ctx, account.ClientID, secret, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(2 * ttl)
+	inactive(t, env, "an expired access token", session.Access)
+	inactive(t, env, "an expired service token", service.AccessToken)
+	inactive(t, env, "an expired personal token", personal)
+}
+
+// mustID resolves the user of a session.
+func mustID(t *testing.T, env *testEnv, access string) string {
+	t.Helper()
+
+	ID, err := env.service.GetIDByToken(context.Background(), access)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ID
+}
@@ -0,0 +1,231 @@
+// Package jwt issues and verifies EdDSA (Ed25519) signed JSON Web Tokens
+// and publishes the verification keys as a JSON Web Key Set.
+package jwt
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Algorithm is the JWS algorithm used for every token.
+const Algorithm = "EdDSA"
+
+var ErrMalformed = errors.New("malformed jwt")
+var ErrSignature = errors.New("invalid jwt signature")
+var ErrUnknownKey = errors.New("unknown jwt key id")
+var ErrExpired = errors.New("jwt has expired")
+
+// Claims is the payload of access tokens issued by the service.
+type Claims struct {
+	Subject     string `json:"sub"`
+	Permissions uint   `json:"perm"`
+	IssuedAt    int64  `json:"iat"`
+	ExpiresAt   int64  `json:"exp"`
+	ID          string `json:"jti,omitempty"`
+	Issuer      string `json:"iss,omitempty"`
+	ClientID    string `json:"client_id,omitempty"` // set on tokens issued to service accounts
+}
+
+type header struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyID     string `json:"kid"`
+}
+
+// JWK is a public Ed25519 key in the OKP JSON Web Key format (RFC 8037).
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Curve     string `json:"crv"`
+	X         string `json:"x"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+}
+
+// JWKS is the document served at /.well-known/jwks.json.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// Signer signs tokens with its active key and verifies tokens signed by any of its keys.
+type Signer struct {
+	active ed25519.PrivateKey
+	kid    string
+	keys   map[string]ed25519.PublicKey
+}
+
+// NewSigner creates a signer using key for new tokens.
+// Retired public keys are still published and accepted during verification, which allows key rotation.
+func NewSigner(key ed25519.PrivateKey, retired ...ed25519.PublicKey) *Signer {
+	public := key.Public().(ed25519.PublicKey)
+	s := &Signer{
+		active: key,
+		kid:    Thumbprint(public),
+		keys:   map[string]ed25519.PublicKey{},
+	}
+
+	s.keys[s.kid] = public
+	for _, k := range retired {
+		s.keys[Thumbprint(k)] = k
+	}
+
+	return s
+}
+
+// GenerateSigner creates a signer with a fresh random key.
+func GenerateSigner() (*Signer, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewSigner(key), nil
+}
+
+// LoadSigner reads a PEM encoded PKCS #8 Ed25519 private key, as produced by
+// `openssl genpkey -algorithm ed25519`.
+func LoadSigner(path string) (*Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing key: %w", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("signing key %s is not PEM encoded", path)
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signing key: %w", err)
+	}
+
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("signing key %s is not an Ed25519 key", path)
+	}
+
+	return NewSigner(key), nil
+}
+
+// Thumbprint computes the RFC 7638 JWK thumbprint used as key ID.
+func Thumbprint(key ed25519.PublicKey) string {
+	// members in lexicographic order, no whitespace
+	canonical := fmt.Sprintf(`{"crv":"Ed25519","kty":"OKP","x":"%s"}`, base64.RawURLEncoding.EncodeToString(key))
+	sum := sha256.Sum256([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// KeyID returns the ID of the active key.
+func (s *Signer) KeyID() string {
+	return s.kid
+}
+
+// Sign encodes and signs the claims.
+func (s *Signer) Sign(claims Claims) (string, error) {
+	h, err := json.Marshal(header{Algorithm: Algorithm, Type: "JWT", KeyID: s.kid})
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	signature := ed25519.Sign(s.active, []byte(signingInput))
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// Verify checks the signature and expiration of the token and returns its claims.
+func (s *Signer) Verify(token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Claims{}, ErrMalformed
+	}
+
+	rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return Claims{}, ErrMalformed
+	}
+
+	var h header
+	if err := json.Unmarshal(rawHeader, &h); err != nil {
+		return Claims{}, ErrMalformed
+	}
+	if h.Algorithm != Algorithm {
+		return Claims{}, ErrSignature
+	}
+
+	key, ok := s.keys[h.KeyID]
+	if !ok {
+		return Claims{}, ErrUnknownKey
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Claims{}, ErrMalformed
+	}
+	if !ed25519.Verify(key, []byte(parts[0]+"."+parts[1]), signature) {
+		return Claims{}, ErrSignature
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return Claims{}, ErrMalformed
+	}
+
+	var claims Claims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return Claims{}, ErrMalformed
+	}
+
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return claims, ErrExpired
+	}
+
+	return claims, nil
+}
+
+// JWKS returns every key accepted by Verify.
+func (s *Signer) JWKS() JWKS {
+	set := JWKS{Keys: make([]JWK, 0, len(s.keys))}
+
+	// the active key goes first so naive clients pick it up
+	set.Keys = append(set.Keys, jwk(s.kid, s.keys[s.kid]))
+	for kid, key := range s.keys {
+		if kid != s.kid {
+			set.Keys = append(set.Keys, jwk(kid, key))
+		}
+	}
+
+	return set
+}
+
+// IsJWT reports whether the token looks like a compact JWS rather than an opaque token.
+func IsJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+func jwk(kid string, key ed25519.PublicKey) JWK {
+	return JWK{
+		KeyType:   "OKP",
+		Curve:     "Ed25519",
+		X:         base64.RawURLEncoding.EncodeToString(key),
+		KeyID:     kid,
+		Use:       "sig",
+		Algorithm: Algorithm,
+	}
+}
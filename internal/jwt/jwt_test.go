@@ -0,0 +1,229 @@
+package jwt
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testSigner(t *testing.T) *Signer {
+	t.Helper()
+	signer, err := GenerateSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func validClaims() Claims {
+	now := time.Now()
+	return Claims{
+		Subject:     "42",
+		Permissions: 8,
+		IssuedAt:    now.Unix(),
+		ExpiresAt:   now.Add(time.Minute).Unix(),
+		ID:          "abc",
+	}
+}
+
+// forge signs an arbitrary header and payload with key.
+func forge(key ed25519.PrivateKey, h any, claims any) string {
+	rawHeader, _ := json.Marshal(h)
+	payload, _ := json.Marshal(claims)
+	input := base64.RawURLEncoding.EncodeToString(rawHeader) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return input + "." + base64.RawURLEncoding.EncodeToString(ed25519.Sign(key, []byte(input)))
+}
+
+func TestSignVerify(t *testing.T) {
+	signer := testSigner(t)
+	claims := validClaims()
+
+	token, err := signer.Sign(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsJWT(token) {
+		t.Errorf("IsJWT(%q) = false", token)
+	}
+
+	got, err := signer.Verify(token)
+	if err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+	if got != claims {
+		t.Errorf("Verify() = %+v, want %+v", got, claims)
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	signer := testSigner(t)
+	other := testSigner(t)
+
+	token, err := signer.Sign(validClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token, ".")
+
+	escalated := validClaims()
+	escalated.Permissions = 511
+	payload, _ := json.Marshal(escalated)
+	tampered := parts[0] + "." + base64.RawURLEncoding.EncodeToString(payload) + "." + parts[2]
+
+	foreign, err := other.Sign(validClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expiredClaims := validClaims()
+	expiredClaims.IssuedAt = time.Now().Add(-time.Hour).Unix()
+	expiredClaims.ExpiresAt = time.Now().Add(-time.Minute).Unix()
+	expired, err := signer.Sign(expiredClaims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unsigned := parts[0] + "." + parts[1] + "."
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT","kid":"`+signer.KeyID()+`"}`)) +
+		"." + parts[1] + "."
+
+	tests := []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{"tampered payload", tampered, ErrSignature},
+		{"tampered signature", parts[0] + "." + parts[1] + "." + parts[2][:len(parts[2])-4] + "AAAA", ErrSignature},
+		{"missing signature", unsigned, ErrSignature},
+		{"alg none", none, ErrSignature},
+		{"alg HS256", forge(signer.active, header{Algorithm: "HS256", Type: "JWT", KeyID: signer.KeyID()}, validClaims()), ErrSignature},
+		{"unknown kid", foreign, ErrUnknownKey},
+		{"kid of another key", forge(other.active, header{Algorithm: Algorithm, Type: "JWT", KeyID: signer.KeyID()}, validClaims()), ErrSignature},
+		{"expired", expired, ErrExpired},
+		{"two parts", parts[0] + "." + parts[1], ErrMalformed},
+		{"bad header encoding", "!!!." + parts[1] + "." + parts[2], ErrMalformed},
+		{"header not json", base64.RawURLEncoding.EncodeToString([]byte("header")) + "." + parts[1] + "." + parts[2], ErrMalformed},
+		{"payload not json", forge(signer.active, header{Algorithm: Algorithm, Type: "JWT", KeyID: signer.KeyID()}, "claims"), ErrMalformed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := signer.Verify(tt.token)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("Verify() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyExpiredReturnsClaims(t *testing.T) {
+	signer := testSigner(t)
+	claims := validClaims()
+	claims.ExpiresAt = time.Now().Add(-time.Second).Unix()
+
+	token, err := signer.Sign(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// expired tokens are still recognised, e.g. to answer introspection of a service token
+	got, err := signer.Verify(token)
+	if err != ErrExpired || got.Subject != claims.Subject {
+		t.Errorf("Verify() = %+v, %v, want claims and ErrExpired", got, err)
+	}
+}
+
+func TestRetiredKey(t *testing.T) {
+	old := testSigner(t)
+	token, err := old.Sign(validClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated := NewSigner(key, old.active.Public().(ed25519.PublicKey))
+
+	if _, err := rotated.Verify(token); err != nil {
+		t.Errorf("Verify() of a token signed by a retired key error = %v", err)
+	}
+
+	fresh, err := rotated.Sign(validClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := old.Verify(fresh); err != ErrUnknownKey {
+		t.Errorf("Verify() by the old signer error = %v, want ErrUnknownKey", err)
+	}
+}
+
+func TestThumbprint(t *testing.T) {
+	// RFC 8037 appendix A.3
+	x, err := base64.RawURLEncoding.DecodeString("11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := Thumbprint(ed25519.PublicKey(x)), "kPrK_qmxVWaYVA9wwBF6Iuo3vVzz7TxHCTwXBygrS4k"; got != want {
+		t.Errorf("Thumbprint() = %q, want %q", got, want)
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	old := testSigner(t)
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := NewSigner(key, old.active.Public().(ed25519.PublicKey))
+
+	raw, err := json.Marshal(signer.JWKS())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var set struct {
+		Keys []map[string]string `json:"keys"`
+	}
+	if err := json.Unmarshal(raw, &set); err != nil {
+		t.Fatal(err)
+	}
+	if len(set.Keys) != 2 {
+		t.Fatalf("JWKS() has %d keys, want the active and the retired key", len(set.Keys))
+	}
+	if set.Keys[0]["kid"] != signer.KeyID() {
+		t.Errorf("first key is %q, want the active key %q", set.Keys[0]["kid"], signer.KeyID())
+	}
+
+	token, err := signer.Sign(validClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token, ".")
+	signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+
+	for _, k := range set.Keys {
+		if k["kty"] != "OKP" || k["crv"] != "Ed25519" || k["alg"] != Algorithm || k["use"] != "sig" {
+			t.Errorf("key %v does not describe an Ed25519 signing key", k)
+		}
+
+		x, err := base64.RawURLEncoding.DecodeString(k["x"])
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			t.Fatalf("key %q has invalid x %q", k["kid"], k["x"])
+		}
+		if Thumbprint(x) != k["kid"] {
+			t.Errorf("key id %q is not the thumbprint of its key", k["kid"])
+		}
+
+		// a client verifying offline with the published active key must accept the token
+		if k["kid"] == signer.KeyID() && !ed25519.Verify(x, []byte(parts[0]+"."+parts[1]), signature) {
+			t.Error("published active key does not verify a signed token")
+		}
+	}
+}
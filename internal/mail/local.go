@@ -0,0 +1,61 @@
+package mail
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Log writes messages to a logger instead of delivering them, for local development.
+type Log struct {
+	logger *log.Logger
+}
+
+// NewLog creates a mailer printing to the logger, the standard logger if nil.
+func NewLog(logger *log.Logger) *Log {
+	if logger == nil {
+		logger = log.Default()
+	}
+	return &Log{logger: logger}
+}
+
+// Send prints the message.
+func (l *Log) Send(ctx context.Context, msg Message) error {
+	l.logger.Printf("mail to %s: %s\n%s", msg.To, msg.Subject, msg.Body)
+	return nil
+}
+
+// Dir writes every message into its own .eml file, so that tests and developers can pick up the links offline.
+type Dir struct {
+	path string
+	from string
+}
+
+// NewDir creates a mailer writing into the directory, which is created if missing.
+func NewDir(path string, from string) (*Dir, error) {
+	if err := os.MkdirAll(path, 0o700); err != nil {
+		return nil, err
+	}
+	return &Dir{path: path, from: from}, nil
+}
+
+// Send writes the message to a file named after the time of sending.
+func (d *Dir) Send(ctx context.Context, msg Message) error {
+	data, err := msg.Format(d.from)
+	if err != nil {
+		return err
+	}
+
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405.000000000"), hex.EncodeToString(suffix))
+
+	return os.WriteFile(filepath.Join(d.path, name), data, 0o600)
+}
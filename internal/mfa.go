@@ -0,0 +1,430 @@
+package users
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/oops"
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/totp"
+)
+
+// MFA parameters.
+const (
+	MFAChallengeExpiration = 5 * time.Minute // lifetime of the challenge returned by a login with an enrolled second factor
+	RecoveryCodeCount      = 10
+	DefaultTOTPIssuer      = "user-service"
+	totpSkew               = 1 // steps accepted around the current one to tolerate clock drift
+)
+
+// recoveryEncoding spells recovery codes in lowercase base32 without padding.
+var recoveryEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// TOTPSetup is a pending TOTP enrollment, shown once to be scanned or typed into an authenticator app.
+type TOTPSetup struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"` // otpauth:// URI for QR codes
+}
+
+// MFAStatus describes the second factors of a user.
+type MFAStatus struct {
+	TOTP          bool `json:"totp"` // a confirmed TOTP enrollment
+	RecoveryCodes int  `json:"recovery_codes"`
+}
+
+// MFARequiredError answers a correct password of a user with an enrolled second factor.
+type MFARequiredError struct {
+	Challenge string // to be answered at /v1/sessions/mfa with a code
+	ExpiresAt time.Time
+}
+
+func (e *MFARequiredError) Error() string {
+	return oops.ErrMFARequired.Error()
+}
+
+func (e *MFARequiredError) Unwrap() error {
+	return oops.ErrMFARequired
+}
+
+// WithTOTPIssuer sets the service name shown by authenticator apps next to the login.
+func WithTOTPIssuer(issuer string) Option {
+	return func(s *AppService) {
+		if issuer != "" {
+			s.totpIssuer = issuer
+		}
+	}
+}
+
+// newRecoveryCode generates a recovery code grouped for readability, e.g. "abcd-efgh-ijkl-mnop".
+func newRecoveryCode() (string, error) {
+	raw := make([]byte, 10)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+
+	code := recoveryEncoding.EncodeToString(raw)
+	return code[0:4] + "-" + code[4:8] + "-" + code[8:12] + "-" + code[12:16], nil
+}
+
+// hashRecoveryCode hashes a recovery code ignoring case, spaces and dashes as typed by users.
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	return hashActionSecret(code)
+}
+
+// totpEnrolled tells whether the user has a confirmed TOTP enrollment.
+// @param ctx context.Context for managing the scope of the operation.
+// @param ID string representing the user ID.
+// @return bool and an error if the store fails.
+func (s *AppService) totpEnrolled(ctx context.Context, ID string) (bool, error) {
+	enrollment, err := s.store.TOTP(ctx, ID)
+	if errors.Is(err, oops.ErrNoTOTP) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return enrollment.Confirmed, nil
+}
+
+// checkSecondFactor accepts a current TOTP code or an unused recovery code of the user, both only once.
+// @param ctx context.Context for managing the scope of the operation.
+// @param ID string representing the user ID.
+// @param code string TOTP code or recovery code.
+// @return error oops.ErrMFACode if the code is not valid.
+func (s *AppService) checkSecondFactor(ctx context.Context, ID string, code string) error {
+	enrollment, err := s.store.TOTP(ctx, ID)
+	if errors.Is(err, oops.ErrNoTOTP) {
+		return oops.ErrMFACode
+	}
+	if err != nil {
+		return err
+	}
+	if !enrollment.Confirmed {
+		return oops.ErrMFACode
+	}
+
+	if code = strings.TrimSpace(code); len(code) != totp.Digits {
+		return s.store.UseRecoveryCode(ctx, ID, hashRecoveryCode(code))
+	}
+
+	step, ok, err := totp.Validate(enrollment.Secret, code, time.Now(), totpSkew)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return oops.ErrMFACode
+	}
+
+	// the store refuses steps not newer than the last accepted one
+	return s.store.UseTOTPStep(ctx, ID, step)
+}
+
+// challenge answers a correct password of a user with an enrolled second factor.
+// @param ctx context.Context for managing the scope of the operation.
+// @param ID string representing the user ID.
+// @return error *MFARequiredError carrying the challenge or an error if it cannot be saved.
+func (s *AppService) challenge(ctx context.Context, ID string) error {
+	user, err := s.store.User(ctx, ID)
+	if err != nil {
+		return err
+	}
+
+	secret, err := s.issueAction(ctx, user, PurposeMFAChallenge, MFAChallengeExpiration)
+	if err != nil {
+		return err
+	}
+
+	return &MFARequiredError{Challenge: secret, ExpiresAt: time.Now().Add(MFAChallengeExpiration)}
+}
+
+// VerifyMFA completes a login answered with a challenge: a valid TOTP or recovery code starts the session.
+// Wrong codes count as failed logins of the user, so the challenge cannot be brute-forced.
+// @param ctx context.Context for managing the scope of the operation.
+// @param challenge string returned by CreateToken.
+// @param code string TOTP code or recovery code.
+// @return Token of the new session and oops.ErrActionToken if the challenge is unknown, expired or answered.
+func (s *AppService) VerifyMFA(ctx context.Context, challenge string, code string) (Token, error) {
+	hash := hashActionSecret(challenge)
+	pending, err := s.store.ActionToken(ctx, hash, PurposeMFAChallenge)
+	if err != nil {
+		return Token{}, err
+	}
+	if time.Now().After(pending.ExpiresAt) {
+		return Token{}, oops.ErrActionToken
+	}
+
+	user, err := s.store.User(ctx, pending.UserID)
+	if errors.Is(err, oops.ErrNoUser) {
+		return Token{}, oops.ErrActionToken
+	}
+	if err != nil {
+		return Token{}, err
+	}
+
+	if err := s.reserveLogin(ctx, user.Login); err != nil {
+		return Token{}, err
+	}
+
+	if err := s.checkSecondFactor(ctx, user.ID, code); err != nil {
+		return Token{}, err
+	}
+
+	// a concurrent answer may have used the challenge in the meantime
+	if _, err := s.store.ConsumeActionToken(ctx, hash, PurposeMFAChallenge); err != nil {
+		return Token{}, err
+	}
+
+	if err := s.releaseLogin(ctx, user.Login, true); err != nil {
+		return Token{}, err
+	}
+
+	client := ClientInfoFrom(ctx)
+	client.MFA = true
+	return s.issue(WithClientInfo(ctx, client), user.ID, "")
+}
+
+// selfOnly resolves the caller and rejects requests about other users and requests made with personal access tokens.
+// @param ctx context.Context for managing the scope of the operation.
+// @param token string containing the access token of the caller.
+// @param ID string representing the user ID the request is about.
+// @return error if the token is not valid, is a personal access token or belongs to another user.
+func (s *AppService) selfOnly(ctx context.Context, token string, ID string) error {
+	if isPersonalToken(token) {
+		return fmt.Errorf("%w: second factors are enrolled by a session", oops.ErrPersonalToken)
+	}
+
+	callerID, _, err := s.caller(ctx, token)
+	if err != nil {
+		return err
+	}
+
+	if callerID != ID {
+		return fmt.Errorf("%w: second factors are enrolled by the user itself", oops.ErrWrongPermissions)
+	}
+
+	return nil
+}
+
+// MFAStatus describes the second factors of the user, by the user itself or by user with corresponding permissions.
+// @param ctx context.Context for managing the scope of the operation.
+// @param token string containing the access token of the caller.
+// @param ID string representing the user ID.
+// @return MFAStatus and an error if the caller may not read the user.
+func (s *AppService) MFAStatus(ctx context.Context, token string, ID string) (MFAStatus, error) {
+	callerID, permissions, err := s.caller(ctx, token)
+	if err != nil {
+		return MFAStatus{}, err
+	}
+
+	if callerID != ID && permissions&PermQueryUsers == 0 {
+		return MFAStatus{}, oops.ErrWrongPermissions
+	}
+
+	if _, err := s.store.User(ctx, ID); err != nil {
+		return MFAStatus{}, err
+	}
+
+	enrolled, err := s.totpEnrolled(ctx, ID)
+	if err != nil {
+		return MFAStatus{}, err
+	}
+
+	codes, err := s.store.CountRecoveryCodes(ctx, ID)
+	if err != nil {
+		return MFAStatus{}, err
+	}
+
+	return MFAStatus{TOTP: enrolled, RecoveryCodes: codes}, nil
+}
+
+// EnrollTOTP generates a new TOTP secret for the user, replacing an unconfirmed one.
+// The secret is not required at login until it is confirmed with ConfirmTOTP.
+// @param ctx context.Context for managing the scope of the operation.
+// @param token string containing the access token of the user itself.
+// @param ID string representing the user ID.
+// @return TOTPSetup to be shown to the user and oops.ErrTOTPEnrolled if TOTP is already confirmed.
+func (s *AppService) EnrollTOTP(ctx context.Context, token string, ID string) (TOTPSetup, error) {
+	if err := s.selfOnly(ctx, token, ID); err != nil {
+		return TOTPSetup{}, err
+	}
+
+	user, err := s.store.User(ctx, ID)
+	if err != nil {
+		return TOTPSetup{}, err
+	}
+
+	if enrolled, err := s.totpEnrolled(ctx, ID); err != nil {
+		return TOTPSetup{}, err
+	} else if enrolled {
+		return TOTPSetup{}, oops.ErrTOTPEnrolled
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return TOTPSetup{}, err
+	}
+
+	if err := s.store.SaveTOTP(ctx, ID, secret); err != nil {
+		return TOTPSetup{}, err
+	}
+
+	return TOTPSetup{Secret: secret, URI: totp.URI(s.totpIssuer, user.Login, secret)}, nil
+}
+
+// ConfirmTOTP completes the enrollment with a code from the app and generates the recovery codes.
+// @param ctx context.Context for managing the scope of the operation.
+// @param token string containing the access token of the user itself.
+// @param ID string representing the user ID.
+// @param code string current TOTP code.
+// @return []string recovery codes, shown only this once, and oops.ErrMFACode if the code is not valid.
+func (s *AppService) ConfirmTOTP(ctx context.Context, token string, ID string, code string) ([]string, error) {
+	if err := s.selfOnly(ctx, token, ID); err != nil {
+		return nil, err
+	}
+
+	enrollment, err := s.store.TOTP(ctx, ID)
+	if err != nil {
+		return nil, err
+	}
+	if enrollment.Confirmed {
+		return nil, oops.ErrTOTPEnrolled
+	}
+
+	step, ok, err := totp.Validate(enrollment.Secret, code, time.Now(), totpSkew)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, oops.ErrMFACode
+	}
+
+	codes := make([]string, RecoveryCodeCount)
+	hashes := make([]string, RecoveryCodeCount)
+	for i := range codes {
+		if codes[i], err = newRecoveryCode(); err != nil {
+			return nil, err
+		}
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+
+	if err := s.store.SaveRecoveryCodes(ctx, ID, hashes); err != nil {
+		return nil, err
+	}
+
+	if err := s.store.ConfirmTOTP(ctx, ID, step); err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// DisableTOTP removes the TOTP enrollment and the recovery codes of the user.
+// The user itself must prove possession with a code, user with PermManageUsers may reset a lost second factor.
+// @param ctx context.Context for managing the scope of the operation.
+// @param token string containing the access token of the caller.
+// @param ID string representing the user ID.
+// @param code string TOTP code or recovery code, ignored for administrators acting on others.
+// @return error oops.ErrNoTOTP if nothing is enrolled and oops.ErrMFACode if the code is not valid.
+func (s *AppService) DisableTOTP(ctx context.Context, token string, ID string, code string) error {
+	callerID, permissions, err := s.caller(ctx, token)
+	if err != nil {
+		return err
+	}
+
+	if callerID != ID && permissions&PermManageUsers == 0 {
+		return &PermissionError{Err: oops.ErrWrongPermissions, Missing: PermManageUsers,
+			Detail: "resetting the second factor of others requires manage_users"}
+	}
+
+	if _, err := s.store.TOTP(ctx, ID); err != nil {
+		return err
+	}
+
+	if callerID == ID {
+		if enrolled, err := s.totpEnrolled(ctx, ID); err != nil {
+			return err
+		} else if enrolled {
+			if err := s.checkSecondFactor(ctx, ID, code); err != nil {
+				return err
+			}
+		}
+	}
+
+	return s.store.PopTOTP(ctx, ID)
+}
+
+// MFAPolicy returns the permissions that are only granted to sessions confirmed with a second factor,
+// requires PermManageUsers.
+// @param ctx context.Context for managing the scope of the operation.
+// @param token string containing the access token of the caller.
+// @return uint permission mask and an error if the caller may not read the policy.
+func (s *AppService) MFAPolicy(ctx context.Context, token string) (uint, error) {
+	_, permissions, err := s.caller(ctx, token)
+	if err != nil {
+		return 0, err
+	}
+
+	if permissions&PermManageUsers == 0 {
+		return 0, &PermissionError{Err: oops.ErrWrongPermissions, Missing: PermManageUsers,
+			Detail: "reading the mfa policy requires manage_users"}
+	}
+
+	return s.store.MFAPolicy(ctx)
+}
+
+// SetMFAPolicy replaces the permissions that are only granted to sessions confirmed with a second factor,
+// requires PermManageUsers. Users holding them keep the other permissions without a second factor.
+// @param ctx context.Context for managing the scope of the operation.
+// @param token string containing the access token of the caller.
+// @param mask uint permissions requiring a second factor, zero disables the policy.
+// @return error if the caller may not change the policy or the mask has unknown bits.
+func (s *AppService) SetMFAPolicy(ctx context.Context, token string, mask uint) error {
+	if unknown := mask &^ Permissions.All(); unknown != 0 {
+		return fmt.Errorf("%w: bits %#x", oops.ErrUnknownPermission, unknown)
+	}
+
+	_, permissions, err := s.caller(ctx, token)
+	if err != nil {
+		return err
+	}
+
+	if permissions&PermManageUsers == 0 {
+		return &PermissionError{Err: oops.ErrWrongPermissions, Missing: PermManageUsers,
+			Detail: "changing the mfa policy requires manage_users"}
+	}
+
+	return s.store.SetMFAPolicy(ctx, mask)
+}
+
+// mfaPermissions withholds the permissions of the MFA policy from sessions not confirmed with a second factor.
+// @param ctx context.Context carrying the ClientInfo of a session being started.
+// @param family string representing the session, empty for a session being started.
+// @param permissions uint effective permissions of the user.
+// @return uint permissions granted to the session and an error if the store fails.
+func (s *AppService) mfaPermissions(ctx context.Context, family string, permissions uint) (uint, error) {
+	policy, err := s.store.MFAPolicy(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if permissions&policy == 0 {
+		return permissions, nil
+	}
+
+	confirmed := ClientInfoFrom(ctx).MFA
+	if family != "" {
+		if confirmed, err = s.store.FamilyMFA(ctx, family); err != nil {
+			return 0, err
+		}
+	}
+
+	if confirmed {
+		return permissions, nil
+	}
+	return permissions &^ policy, nil
+}
@@ -0,0 +1,226 @@
+package users_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	users "github.com/mipt-kp-2024-go-beer/user-service/internal"
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/oops"
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/totp"
+)
+
+// challenge logs in with the password and returns the challenge of the second factor.
+func challenge(t *testing.T, env *testEnv, login string) string {
+	t.Helper()
+
+	_, err := env.service.CreateToken(context.Background(), login, login+"-password")
+	var required *users.MFARequiredError
+	if !errors.As(err, &required) {
+		t.Fatalf("CreateToken() error = %v, want *MFARequiredError", err)
+	}
+
+	return required.Challenge
+}
+
+func TestMFAChallenge(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t)
+	ID, session := env.user(t, "alice", 0)
+
+	setup, err := env.service.EnrollTOTP(ctx, session.Access, ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	code := func(delta int) string {
+		c, err := totp.Code(setup.Secret, now.Add(time.Duration(delta)*totp.Period))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	// an enrollment that is not confirmed does not change the login
+	if _, err := env.service.CreateToken(ctx, "alice", "alice-password"); err != nil {
+		t.Fatalf("CreateToken() before confirmation error = %v", err)
+	}
+
+	if _, err := env.service.ConfirmTOTP(ctx, session.Access, ID, code(5)); !errors.Is(err, oops.ErrMFACode) {
+		t.Fatalf("ConfirmTOTP() with a code outside the skew error = %v, want ErrMFACode", err)
+	}
+	recovery, err := env.service.ConfirmTOTP(ctx, session.Access, ID, code(0))
+	if err != nil {
+		t.Fatalf("ConfirmTOTP() error = %v", err)
+	}
+	if len(recovery) != users.RecoveryCodeCount {
+		t.Fatalf("ConfirmTOTP() returned %d recovery codes, want %d", len(recovery), users.RecoveryCodeCount)
+	}
+
+	t.Run("password alone is not enough", func(t *testing.T) {
+		pending := challenge(t, env, "alice")
+		if _, err := env.service.VerifyMFA(ctx, pending, ""); !errors.Is(err, oops.ErrMFACode) {
+			t.Errorf("VerifyMFA() without a code error = %v, want ErrMFACode", err)
+		}
+		if _, err := env.service.VerifyMFA(ctx, "unknown", code(0)); err == nil {
+			t.Error("VerifyMFA() with an unknown challenge succeeded")
+		}
+	})
+
+	t.Run("totp code", func(t *testing.T) {
+		// the step that confirmed the enrollment was used already
+		pending := challenge(t, env, "alice")
+		if _, err := env.service.VerifyMFA(ctx, pending, code(0)); !errors.Is(err, oops.ErrMFACode) {
+			t.Fatalf("VerifyMFA() replaying the confirmation code error = %v, want ErrMFACode", err)
+		}
+
+		token, err := env.service.VerifyMFA(ctx, pending, code(1))
+		if err != nil {
+			t.Fatalf("VerifyMFA() with the code of the next step error = %v", err)
+		}
+		if got, err := env.service.GetIDByToken(ctx, token.Access); err != nil || got != ID {
+			t.Errorf("GetIDByToken() of the session = %q, %v, want %q", got, err, ID)
+		}
+
+		// the challenge is answered once
+		if _, err := env.service.VerifyMFA(ctx, pending, code(1)); err == nil {
+			t.Error("VerifyMFA() answered the same challenge twice")
+		}
+
+		// and the code is accepted once, even for another challenge
+		again := challenge(t, env, "alice")
+		if _, err := env.service.VerifyMFA(ctx, again, code(1)); !errors.Is(err, oops.ErrMFACode) {
+			t.Errorf("VerifyMFA() replaying a used code error = %v, want ErrMFACode", err)
+		}
+		if _, err := env.service.VerifyMFA(ctx, again, code(-1)); !errors.Is(err, oops.ErrMFACode) {
+			t.Errorf("VerifyMFA() with a code older than the used one error = %v, want ErrMFACode", err)
+		}
+	})
+
+	t.Run("recovery code", func(t *testing.T) {
+		pending := challenge(t, env, "alice")
+		if _, err := env.service.VerifyMFA(ctx, pending, recovery[0]); err != nil {
+			t.Fatalf("VerifyMFA() with a recovery code error = %v", err)
+		}
+
+		status, err := env.service.MFAStatus(ctx, session.Access, ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.RecoveryCodes != users.RecoveryCodeCount-1 {
+			t.Errorf("MFAStatus() recovery codes = %d, want %d", status.RecoveryCodes, users.RecoveryCodeCount-1)
+		}
+
+		again := challenge(t, env, "alice")
+		if _, err := env.service.VerifyMFA(ctx, again, recovery[0]); !errors.Is(err, oops.ErrMFACode) {
+			t.Errorf("VerifyMFA() reusing a recovery code error = %v, want ErrMFACode", err)
+		}
+
+		// recovery codes are typed loosely
+		if _, err := env.service.VerifyMFA(ctx, again, " "+recovery[1]+" "); err != nil {
+			t.Errorf("VerifyMFA() with another recovery code error = %v", err)
+		}
+	})
+}
+
+func TestMFAPolicy(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t)
+	_, admin := env.user(t, "admin", users.Permissions.All())
+	_, reader := env.user(t, "reader", users.PermQueryUsers)
+	ID, session := env.user(t, "alice", users.PermQueryUsers|users.PermManageBooks)
+
+	permissions := func(access string) uint {
+		t.Helper()
+		principal, err := env.service.Authenticate(ctx, access)
+		if err != nil {
+			t.Fatalf("Authenticate() error = %v", err)
+		}
+		return principal.Permissions
+	}
+
+	// a token created before the policy is narrowed by it all the same
+	_, early, err := env.service.CreatePersonalToken(ctx, session.Access, ID,
+		users.PersonalToken{Name: "early", Permissions: users.PermQueryUsers | users.PermManageBooks})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	policy := map[string]uint{"permissions": users.PermManageBooks}
+	if status := call(t, env.public, http.MethodPut, "/v1/mfa/policy", reader.Access, policy, nil); status != http.StatusForbidden {
+		t.Errorf("PUT /v1/mfa/policy without manage_users = %d, want 403", status)
+	}
+	unknown := map[string]uint{"permissions": 1 << 30}
+	if status := call(t, env.public, http.MethodPut, "/v1/mfa/policy", admin.Access, unknown, nil); status != http.StatusBadRequest {
+		t.Errorf("PUT /v1/mfa/policy with an unknown bit = %d, want 400", status)
+	}
+	if status := call(t, env.public, http.MethodPut, "/v1/mfa/policy", admin.Access, policy, nil); status != http.StatusNoContent {
+		t.Fatalf("PUT /v1/mfa/policy = %d, want 204", status)
+	}
+	var stored map[string]uint
+	if status := call(t, env.public, http.MethodGet, "/v1/mfa/policy", admin.Access, nil, &stored); status != http.StatusOK || stored["permissions"] != users.PermManageBooks {
+		t.Errorf("GET /v1/mfa/policy = %d %v, want 200 %v", status, stored, policy)
+	}
+
+	// without a second factor the user keeps the other permissions
+	if got := permissions(session.Access); got != users.PermQueryUsers {
+		t.Errorf("permissions of a session without a second factor = %#x, want %#x", got, users.PermQueryUsers)
+	}
+	if got := permissions(early); got != users.PermQueryUsers {
+		t.Errorf("permissions of a token created without a second factor = %#x, want %#x", got, users.PermQueryUsers)
+	}
+	if _, _, err := env.service.CreatePersonalToken(ctx, session.Access, ID,
+		users.PersonalToken{Name: "escalate", Permissions: users.PermManageBooks}); !errors.Is(err, oops.ErrGrantNotHeld) {
+		t.Errorf("CreatePersonalToken() with a withheld permission error = %v, want ErrGrantNotHeld", err)
+	}
+
+	setup, err := env.service.EnrollTOTP(ctx, session.Access, ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := totp.Code(setup.Secret, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.service.ConfirmTOTP(ctx, session.Access, ID, code); err != nil {
+		t.Fatal(err)
+	}
+
+	// the code confirming the enrollment is used up, the login takes the next one
+	code, err = totp.Code(setup.Secret, time.Now().Add(totp.Period))
+	if err != nil {
+		t.Fatal(err)
+	}
+	confirmed, err := env.service.VerifyMFA(ctx, challenge(t, env, "alice"), code)
+	if err != nil {
+		t.Fatalf("VerifyMFA() error = %v", err)
+	}
+	if got := permissions(confirmed.Access); got != users.PermQueryUsers|users.PermManageBooks {
+		t.Errorf("permissions of a session confirmed with a second factor = %#x, want %#x",
+			got, users.PermQueryUsers|users.PermManageBooks)
+	}
+	_, late, err := env.service.CreatePersonalToken(ctx, confirmed.Access, ID,
+		users.PersonalToken{Name: "late", Permissions: users.PermManageBooks})
+	if err != nil {
+		t.Fatalf("CreatePersonalToken() by a confirmed session error = %v", err)
+	}
+	if got := permissions(late); got != users.PermManageBooks {
+		t.Errorf("permissions of a token created with a second factor = %#x, want %#x", got, users.PermManageBooks)
+	}
+
+	// enrolling does not confirm the sessions started before
+	if got := permissions(session.Access); got != users.PermQueryUsers {
+		t.Errorf("permissions of the earlier session after enrolling = %#x, want %#x", got, users.PermQueryUsers)
+	}
+
+	// an empty policy gives the permissions back
+	if err := env.service.SetMFAPolicy(ctx, admin.Access, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := permissions(early); got != users.PermQueryUsers|users.PermManageBooks {
+		t.Errorf("permissions without a policy = %#x, want %#x", got, users.PermQueryUsers|users.PermManageBooks)
+	}
+}
@@ -3,6 +3,7 @@ package oops
 import "errors"
 
 var ErrDuplicateUser = errors.New("login duplication")
+var ErrDuplicateEmail = errors.New("email duplication")
 var ErrNoUser = errors.New("no user")
 var ErrDupAccess = errors.New("not unique acess token")
 var ErrDupRefresh = errors.New("not unique refresh token")
@@ -11,3 +12,44 @@ var ErrTokenExpired = errors.New("access token has expired")
 var ErrTokenExistance = errors.New("token does not exists")
 var ErrWrongPermissions = errors.New("user have not enough permissions")
 var ErrNoRefresh = errors.New("refresh token does not match")
+var ErrOpaqueTokens = errors.New("service issues opaque tokens")
+var ErrRefreshExpired = errors.New("refresh token has expired")
+var ErrRefreshReused = errors.New("refresh token was already used")
+var ErrNoSession = errors.New("session does not exist")
+var ErrUnknownPermission = errors.New("unknown permission")
+var ErrMissingPrerequisite = errors.New("missing prerequisite permission")
+var ErrGrantNotHeld = errors.New("permission is not held by the granter")
+var ErrNoRole = errors.New("role does not exist")
+var ErrDuplicateRole = errors.New("role already exists")
+var ErrInvalidRole = errors.New("invalid role")
+var ErrInvalidCheck = errors.New("invalid authorization check")
+var ErrInvalidQuery = errors.New("invalid query")
+var ErrUserDisabled = errors.New("user is disabled")
+var ErrInvalidCredentials = errors.New("login or password is incorrect")
+var ErrInvalidRequest = errors.New("invalid request")
+var ErrMethodNotAllowed = errors.New("method not allowed")
+var ErrNotFound = errors.New("resource not found")
+var ErrInvalidUser = errors.New("invalid user")
+var ErrActionToken = errors.New("action token is not valid")
+var ErrNoEmail = errors.New("user has no email")
+var ErrTooManyAttempts = errors.New("too many failed login attempts")
+var ErrAccountLocked = errors.New("login is locked")
+var ErrMFARequired = errors.New("second factor required")
+var ErrMFACode = errors.New("second factor code is not valid")
+var ErrNoTOTP = errors.New("no totp enrollment")
+var ErrNoPasskey = errors.New("no such passkey")
+var ErrDuplicatePasskey = errors.New("passkey is already registered")
+var ErrSignCount = errors.New("passkey sign count did not increase")
+var ErrWebAuthn = errors.New("webauthn response is not valid")
+var ErrWebAuthnDisabled = errors.New("webauthn is not configured")
+var ErrNoPersonalToken = errors.New("no such personal access token")
+var ErrPersonalToken = errors.New("personal access tokens cannot be used for this request")
+var ErrInvalidPersonalToken = errors.New("invalid personal access token")
+var ErrNoServiceAccount = errors.New("no such service account")
+var ErrInvalidServiceAccount = errors.New("invalid service account")
+var ErrInvalidClient = errors.New("client authentication failed")
+var ErrUnsupportedGrant = errors.New("unsupported grant type")
+var ErrInvalidScope = errors.New("invalid scope")
+var ErrTOTPEnrolled = errors.New("totp is already enrolled")
+var ErrWrongPassword = errors.New("current password does not match")
+var ErrVersionMismatch = errors.New("user was changed since the given version")
@@ -0,0 +1,122 @@
+package users
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+//go:embed openapi/public.json
+var publicSpec []byte
+
+//go:embed openapi/private.json
+var privateSpec []byte
+
+// handle registers the route on the mux and remembers its pattern for CheckSpec.
+// @param m *http.ServeMux public or private mux.
+// @param pattern string route pattern, with or without a method.
+// @param handler http.HandlerFunc serving the route.
+func (h *Handler) handle(m *http.ServeMux, pattern string, handler http.HandlerFunc) {
+	m.HandleFunc(pattern, handler)
+	h.routes[m] = append(h.routes[m], pattern)
+}
+
+// specHandler serves the OpenAPI document of the port.
+// @param spec []byte OpenAPI document.
+// @return http.HandlerFunc serving the document.
+func specHandler(spec []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		w.WriteHeader(http.StatusOK)
+		w.Write(spec)
+	}
+}
+
+// CheckSpec compares the registered routes with the OpenAPI documents served on each port,
+// so a route cannot be added or removed without documenting it.
+// TestSpecMatchesRoutes runs the same comparison in CI, the check at startup only guards builds that skipped it.
+// @return error listing undocumented routes and documented routes that are not served.
+func (h *Handler) CheckSpec() error {
+	var problems []string
+	for _, port := range []struct {
+		name string
+		mux  *http.ServeMux
+		spec []byte
+	}{
+		{"public", h.public, publicSpec},
+		{"private", h.private, privateSpec},
+	} {
+		mismatches, err := compareSpec(h.routes[port.mux], port.spec)
+		if err != nil {
+			return fmt.Errorf("%s openapi document: %w", port.name, err)
+		}
+		for _, mismatch := range mismatches {
+			problems = append(problems, port.name+": "+mismatch)
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New("openapi documents are out of date:\n\t" + strings.Join(problems, "\n\t"))
+	}
+
+	return nil
+}
+
+// compareSpec matches route patterns against the operations of the OpenAPI document.
+// Patterns without a method are satisfied by any operation on their path.
+// @param patterns []string registered route patterns.
+// @param spec []byte OpenAPI document.
+// @return []string descriptions of mismatches and an error if the document cannot be parsed.
+func compareSpec(patterns []string, spec []byte) ([]string, error) {
+	var doc struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(spec, &doc); err != nil {
+		return nil, err
+	}
+
+	documented := make(map[string]bool)
+	for path, item := range doc.Paths {
+		for key := range item {
+			switch key {
+			case "get", "put", "post", "delete", "options", "head", "patch", "trace":
+				documented[strings.ToUpper(key)+" "+path] = true
+			}
+		}
+	}
+
+	var mismatches []string
+	served := make(map[string]bool)
+	for _, pattern := range patterns {
+		method, path, found := strings.Cut(pattern, " ")
+		if !found {
+			path, method = pattern, ""
+		}
+
+		matched := false
+		for operation := range documented {
+			opMethod, opPath, _ := strings.Cut(operation, " ")
+			if opPath == path && (method == "" || method == opMethod) {
+				served[operation] = true
+				matched = true
+			}
+		}
+		if !matched {
+			mismatches = append(mismatches, "route "+pattern+" is not documented")
+		}
+	}
+
+	for operation := range documented {
+		if !served[operation] {
+			mismatches = append(mismatches, "operation "+operation+" is not served")
+		}
+	}
+
+	sort.Strings(mismatches)
+	return mismatches, nil
+}
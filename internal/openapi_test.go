@@ -0,0 +1,94 @@
+package users
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+// TestSpecMatchesRoutes fails when a route is registered without being documented in
+// openapi/public.json or openapi/private.json, or a documented operation is not served.
+func TestSpecMatchesRoutes(t *testing.T) {
+	h := NewHandler(nil, http.NewServeMux(), http.NewServeMux())
+	h.Register()
+
+	for _, port := range []struct {
+		name string
+		mux  *http.ServeMux
+		spec []byte
+	}{
+		{"public", h.public, publicSpec},
+		{"private", h.private, privateSpec},
+	} {
+		t.Run(port.name, func(t *testing.T) {
+			if len(h.routes[port.mux]) == 0 {
+				t.Fatal("no routes registered")
+			}
+
+			mismatches, err := compareSpec(h.routes[port.mux], port.spec)
+			if err != nil {
+				t.Fatalf("openapi/%s.json: %v", port.name, err)
+			}
+			for _, mismatch := range mismatches {
+				t.Errorf("openapi/%s.json: %s", port.name, mismatch)
+			}
+		})
+	}
+
+	if err := h.CheckSpec(); err != nil {
+		t.Errorf("CheckSpec() error = %v", err)
+	}
+}
+
+func TestCompareSpec(t *testing.T) {
+	spec := []byte(`{"paths": {
+		"/v1/users": {"get": {}, "post": {}, "parameters": []},
+		"/v1/users/{id}": {"delete": {}}
+	}}`)
+
+	tests := []struct {
+		name     string
+		patterns []string
+		want     []string
+	}{
+		{
+			name:     "every operation served",
+			patterns: []string{"GET /v1/users", "POST /v1/users", "DELETE /v1/users/{id}"},
+		},
+		{
+			name:     "pattern without method serves every operation of the path",
+			patterns: []string{"/v1/users", "DELETE /v1/users/{id}"},
+		},
+		{
+			name:     "undocumented route",
+			patterns: []string{"GET /v1/users", "POST /v1/users", "DELETE /v1/users/{id}", "PATCH /v1/users/{id}"},
+			want:     []string{"route PATCH /v1/users/{id} is not documented"},
+		},
+		{
+			name:     "unserved operation",
+			patterns: []string{"GET /v1/users", "DELETE /v1/users/{id}"},
+			want:     []string{"operation POST /v1/users is not served"},
+		},
+		{
+			name:     "undocumented path",
+			patterns: []string{"/v1/users", "DELETE /v1/users/{id}", "GET /v1/roles"},
+			want:     []string{"route GET /v1/roles is not documented"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := compareSpec(tt.patterns, spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("compareSpec() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := compareSpec(nil, []byte("{")); err == nil {
+		t.Error("compareSpec() of a malformed document error = nil")
+	}
+}
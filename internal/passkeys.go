@@ -0,0 +1,376 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/oops"
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/webauthn"
+)
+
+// Passkey parameters.
+const (
+	PasskeyTimeout       = 5 * time.Minute // lifetime of the challenge of a ceremony
+	MaxPasskeyNameLength = 64
+	defaultPasskeyName   = "passkey"
+)
+
+// WithWebAuthn enables passkeys for the relying party, an empty RPID leaves them disabled.
+func WithWebAuthn(config webauthn.Config) Option {
+	return func(s *AppService) {
+		if config.RPID == "" {
+			return
+		}
+		if config.RPName == "" {
+			config.RPName = config.RPID
+		}
+		s.webauthn = &config
+	}
+}
+
+// userHandle is the user handle of the passkeys of the user, returned by the authenticator at login.
+func userHandle(ID string) string {
+	return webauthn.EncodeID([]byte(ID))
+}
+
+// ceremonyChallenge decodes the client data of a response and returns the challenge it was signed for.
+// @param clientDataJSON string base64url client data of the response.
+// @return []byte client data, string challenge and an error wrapping oops.ErrWebAuthn.
+func ceremonyChallenge(clientDataJSON string) ([]byte, string, error) {
+	raw, err := webauthn.DecodeID(clientDataJSON)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", oops.ErrWebAuthn, err)
+	}
+
+	data, err := webauthn.ParseClientData(raw)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", oops.ErrWebAuthn, err)
+	}
+
+	return raw, data.Challenge, nil
+}
+
+// consumeChallenge consumes the challenge of a ceremony, the challenge is the secret of an action token.
+// @param ctx context.Context for managing the scope of the operation.
+// @param challenge string from the client data.
+// @param purpose string PurposePasskeyCreate or PurposePasskeyLogin.
+// @return ActionToken of the challenge and oops.ErrActionToken if it is unknown, expired or used.
+func (s *AppService) consumeChallenge(ctx context.Context, challenge string, purpose string) (ActionToken, error) {
+	token, err := s.store.ConsumeActionToken(ctx, hashActionSecret(challenge), purpose)
+	if err != nil {
+		return ActionToken{}, err
+	}
+
+	if time.Now().After(token.ExpiresAt) {
+		return ActionToken{}, oops.ErrActionToken
+	}
+
+	return token, nil
+}
+
+// passkeyIDs lists the credential IDs of the passkeys of the user.
+func (s *AppService) passkeyIDs(ctx context.Context, ID string) ([]string, error) {
+	passkeys, err := s.store.Passkeys(ctx, ID)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, len(passkeys))
+	for i, passkey := range passkeys {
+		ids[i] = passkey.ID
+	}
+	return ids, nil
+}
+
+// BeginRegistration starts the registration of a passkey for the user itself.
+// @param ctx context.Context for managing the scope of the operation.
+// @param token string containing the access token of the user itself.
+// @param ID string representing the user ID.
+// @return webauthn.CreationOptions for navigator.credentials.create() and oops.ErrWebAuthnDisabled without a relying party.
+func (s *AppService) BeginRegistration(ctx context.Context, token string, ID string) (webauthn.CreationOptions, error) {
+	if s.webauthn == nil {
+		return webauthn.CreationOptions{}, oops.ErrWebAuthnDisabled
+	}
+
+	if err := s.selfOnly(ctx, token, ID); err != nil {
+		return webauthn.CreationOptions{}, err
+	}
+
+	user, err := s.store.User(ctx, ID)
+	if err != nil {
+		return webauthn.CreationOptions{}, err
+	}
+
+	exclude, err := s.passkeyIDs(ctx, ID)
+	if err != nil {
+		return webauthn.CreationOptions{}, err
+	}
+
+	challenge, err := s.issueAction(ctx, user, PurposePasskeyCreate, PasskeyTimeout)
+	if err != nil {
+		return webauthn.CreationOptions{}, err
+	}
+
+	display := user.DisplayName
+	if display == "" {
+		display = user.Login
+	}
+
+	entity := webauthn.UserEntity{ID: userHandle(user.ID), Name: user.Login, DisplayName: display}
+	return s.webauthn.CreationOptions(challenge, entity, exclude, PasskeyTimeout), nil
+}
+
+// FinishRegistration verifies the response of the authenticator and stores the new passkey.
+// @param ctx context.Context for managing the scope of the operation.
+// @param token string containing the access token of the user itself.
+// @param ID string representing the user ID.
+// @param name string shown in the passkey list, "passkey" if empty.
+// @param response webauthn.RegistrationResponse of navigator.credentials.create().
+// @return Passkey stored and an error wrapping oops.ErrWebAuthn if the response is not valid.
+func (s *AppService) FinishRegistration(ctx context.Context, token string, ID string, name string, response webauthn.RegistrationResponse) (Passkey, error) {
+	if s.webauthn == nil {
+		return Passkey{}, oops.ErrWebAuthnDisabled
+	}
+
+	if err := s.selfOnly(ctx, token, ID); err != nil {
+		return Passkey{}, err
+	}
+
+	if name = strings.TrimSpace(name); name == "" {
+		name = defaultPasskeyName
+	}
+	if !utf8.ValidString(name) || utf8.RuneCountInString(name) > MaxPasskeyNameLength {
+		return Passkey{}, fmt.Errorf("%w: name must be valid text of at most %d characters", oops.ErrWebAuthn, MaxPasskeyNameLength)
+	}
+
+	clientData, challenge, err := ceremonyChallenge(response.Response.ClientDataJSON)
+	if err != nil {
+		return Passkey{}, err
+	}
+
+	pending, err := s.consumeChallenge(ctx, challenge, PurposePasskeyCreate)
+	if err != nil {
+		return Passkey{}, err
+	}
+	if pending.UserID != ID {
+		return Passkey{}, oops.ErrActionToken
+	}
+
+	attestation, err := webauthn.DecodeID(response.Response.AttestationObject)
+	if err != nil {
+		return Passkey{}, fmt.Errorf("%w: %v", oops.ErrWebAuthn, err)
+	}
+
+	credential, err := s.webauthn.VerifyRegistration(challenge, clientData, attestation)
+	if err != nil {
+		return Passkey{}, fmt.Errorf("%w: %v", oops.ErrWebAuthn, err)
+	}
+
+	now := time.Now()
+	passkey := Passkey{
+		ID:         webauthn.EncodeID(credential.ID),
+		UserID:     ID,
+		Name:       name,
+		PublicKey:  credential.PublicKey,
+		SignCount:  credential.SignCount,
+		CreatedAt:  now,
+		LastUsedAt: now,
+	}
+
+	if err := s.store.SavePasskey(ctx, passkey); err != nil {
+		return Passkey{}, err
+	}
+
+	return passkey, nil
+}
+
+// Passkeys lists the passkeys of the user, to the user itself or to user with corresponding permissions.
+// @param ctx context.Context for managing the scope of the operation.
+// @param token string containing the access token of the caller.
+// @param ID string representing the user ID.
+// @return []Passkey of the user and an error if the caller may not read the user.
+func (s *AppService) Passkeys(ctx context.Context, token string, ID string) ([]Passkey, error) {
+	callerID, permissions, err := s.caller(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	if callerID != ID && permissions&PermQueryUsers == 0 {
+		return nil, oops.ErrWrongPermissions
+	}
+
+	if _, err := s.store.User(ctx, ID); err != nil {
+		return nil, err
+	}
+
+	return s.store.Passkeys(ctx, ID)
+}
+
+// DeletePasskey removes a passkey of the user, by the user itself or by user with corresponding permissions.
+// @param ctx context.Context for managing the scope of the operation.
+// @param token string containing the access token of the caller.
+// @param ID string representing the user ID.
+// @param passkey string credential ID of the passkey.
+// @return error oops.ErrNoPasskey if the user has no such passkey.
+func (s *AppService) DeletePasskey(ctx context.Context, token string, ID string, passkey string) error {
+	callerID, permissions, err := s.caller(ctx, token)
+	if err != nil {
+		return err
+	}
+
+	if callerID != ID && permissions&PermManageUsers == 0 {
+		return &PermissionError{Err: oops.ErrWrongPermissions, Missing: PermManageUsers,
+			Detail: "removing passkeys of others requires manage_users"}
+	}
+
+	return s.store.PopPasskey(ctx, ID, passkey)
+}
+
+// BeginPasskeyLogin starts a passkey login of the user.
+// Unknown logins and users without passkeys get a challenge that no response can answer.
+// @param ctx context.Context for managing the scope of the operation.
+// @param login string of the user logging in.
+// @return webauthn.RequestOptions for navigator.credentials.get() and oops.ErrWebAuthnDisabled without a relying party.
+func (s *AppService) BeginPasskeyLogin(ctx context.Context, login string) (webauthn.RequestOptions, error) {
+	if s.webauthn == nil {
+		return webauthn.RequestOptions{}, oops.ErrWebAuthnDisabled
+	}
+
+	user, err := s.store.UserByLogin(ctx, login)
+	if err != nil && !errors.Is(err, oops.ErrNoUser) {
+		return webauthn.RequestOptions{}, err
+	}
+
+	var allow []string
+	if err == nil {
+		if allow, err = s.passkeyIDs(ctx, user.ID); err != nil {
+			return webauthn.RequestOptions{}, err
+		}
+	}
+
+	if len(allow) == 0 {
+		challenge, _, err := newActionSecret()
+		if err != nil {
+			return webauthn.RequestOptions{}, err
+		}
+		return s.webauthn.RequestOptions(challenge, nil, PasskeyTimeout), nil
+	}
+
+	challenge, err := s.issueAction(ctx, user, PurposePasskeyLogin, PasskeyTimeout)
+	if err != nil {
+		return webauthn.RequestOptions{}, err
+	}
+
+	return s.webauthn.RequestOptions(challenge, allow, PasskeyTimeout), nil
+}
+
+// FinishPasskeyLogin verifies the assertion of the authenticator and starts a new session.
+// A session is confirmed with a second factor when the authenticator verified the user,
+// otherwise users with TOTP get an MFA challenge as after a password.
+// @param ctx context.Context for managing the scope of the operation.
+// @param response webauthn.AssertionResponse of navigator.credentials.get().
+// @return Token of the new session, oops.ErrInvalidCredentials if the assertion is not valid
+// and oops.ErrSignCount if the passkey may be cloned.
+func (s *AppService) FinishPasskeyLogin(ctx context.Context, response webauthn.AssertionResponse) (Token, error) {
+	if s.webauthn == nil {
+		return Token{}, oops.ErrWebAuthnDisabled
+	}
+
+	clientData, challenge, err := ceremonyChallenge(response.Response.ClientDataJSON)
+	if err != nil {
+		return Token{}, err
+	}
+
+	pending, err := s.consumeChallenge(ctx, challenge, PurposePasskeyLogin)
+	if err != nil {
+		return Token{}, err
+	}
+
+	user, err := s.store.User(ctx, pending.UserID)
+	if errors.Is(err, oops.ErrNoUser) {
+		return Token{}, oops.ErrActionToken
+	}
+	if err != nil {
+		return Token{}, err
+	}
+
+	if err := s.reserveLogin(ctx, user.Login); err != nil {
+		return Token{}, err
+	}
+
+	assertion, passkey, err := s.verifyAssertion(ctx, user.ID, challenge, clientData, response)
+	if err != nil {
+		return Token{}, err
+	}
+
+	// the store refuses a counter that does not grow, two authenticators share the key
+	if err := s.store.UsePasskey(ctx, passkey.ID, assertion.SignCount); err != nil {
+		return Token{}, err
+	}
+
+	if user.Status == StatusDisabled {
+		return Token{}, oops.ErrUserDisabled
+	}
+
+	enrolled := false
+	if !assertion.UserVerified {
+		if enrolled, err = s.totpEnrolled(ctx, user.ID); err != nil {
+			return Token{}, err
+		}
+	}
+	if err := s.releaseLogin(ctx, user.Login, !enrolled); err != nil {
+		return Token{}, err
+	}
+	if enrolled {
+		return Token{}, s.challenge(ctx, user.ID)
+	}
+
+	client := ClientInfoFrom(ctx)
+	client.MFA = assertion.UserVerified
+	return s.issue(WithClientInfo(ctx, client), user.ID, "")
+}
+
+// verifyAssertion checks the assertion against the passkey it names, which must belong to the user.
+// @param ctx context.Context for managing the scope of the operation.
+// @param ID string representing the user the challenge was issued to.
+// @param challenge string from the client data.
+// @param clientData []byte decoded client data.
+// @param response webauthn.AssertionResponse to be checked.
+// @return webauthn.Assertion, Passkey used and oops.ErrInvalidCredentials if the assertion is not valid.
+func (s *AppService) verifyAssertion(ctx context.Context, ID string, challenge string, clientData []byte,
+	response webauthn.AssertionResponse) (webauthn.Assertion, Passkey, error) {
+	passkey, err := s.store.Passkey(ctx, response.ID)
+	if errors.Is(err, oops.ErrNoPasskey) {
+		return webauthn.Assertion{}, Passkey{}, oops.ErrInvalidCredentials
+	}
+	if err != nil {
+		return webauthn.Assertion{}, Passkey{}, err
+	}
+
+	if passkey.UserID != ID {
+		return webauthn.Assertion{}, Passkey{}, oops.ErrInvalidCredentials
+	}
+	if handle := response.Response.UserHandle; handle != "" && handle != userHandle(ID) {
+		return webauthn.Assertion{}, Passkey{}, oops.ErrInvalidCredentials
+	}
+
+	authData, err := webauthn.DecodeID(response.Response.AuthenticatorData)
+	if err != nil {
+		return webauthn.Assertion{}, Passkey{}, fmt.Errorf("%w: %v", oops.ErrWebAuthn, err)
+	}
+	signature, err := webauthn.DecodeID(response.Response.Signature)
+	if err != nil {
+		return webauthn.Assertion{}, Passkey{}, fmt.Errorf("%w: %v", oops.ErrWebAuthn, err)
+	}
+
+	assertion, err := s.webauthn.VerifyAssertion(challenge, passkey.PublicKey, clientData, authData, signature)
+	if err != nil {
+		return webauthn.Assertion{}, Passkey{}, fmt.Errorf("%w: %v", oops.ErrInvalidCredentials, err)
+	}
+
+	return assertion, passkey, nil
+}
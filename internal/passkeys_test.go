@@ -0,0 +1,168 @@
+package users_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	users "github.com/mipt-kp-2024-go-beer/user-service/internal"
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/oops"
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/webauthn"
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/webauthn/webauthntest"
+)
+
+const passkeyOrigin = "https://library.example.org"
+
+var passkeyConfig = webauthn.Config{RPID: "library.example.org", RPName: "Library", Origins: []string{passkeyOrigin}}
+
+// passkeyEnv has a user with a passkey registered on the returned authenticator.
+func passkeyEnv(t *testing.T) (*testEnv, *webauthntest.Authenticator, string, users.Passkey) {
+	t.Helper()
+	ctx := context.Background()
+	env := newTestEnv(t, users.WithWebAuthn(passkeyConfig))
+	ID, session := env.user(t, "alice", 0)
+	authenticator := webauthntest.New(passkeyOrigin)
+
+	options, err := env.service.BeginRegistration(ctx, session.Access, ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options.Attestation != "none" || options.RP.ID != passkeyConfig.RPID {
+		t.Fatalf("BeginRegistration() = %+v, want attestation none for %s", options, passkeyConfig.RPID)
+	}
+
+	response, err := authenticator.Register(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	passkey, err := env.service.FinishRegistration(ctx, session.Access, ID, "laptop", response)
+	if err != nil {
+		t.Fatalf("FinishRegistration() error = %v", err)
+	}
+	if passkey.ID != response.ID || passkey.Name != "laptop" {
+		t.Fatalf("FinishRegistration() = %+v, want passkey %s named laptop", passkey, response.ID)
+	}
+
+	// the challenge of the ceremony is accepted once
+	if _, err := env.service.FinishRegistration(ctx, session.Access, ID, "again", response); !errors.Is(err, oops.ErrActionToken) {
+		t.Fatalf("FinishRegistration() replaying the response error = %v, want ErrActionToken", err)
+	}
+
+	return env, authenticator, ID, passkey
+}
+
+// passkeyLogin runs an assertion ceremony of the user on the authenticator.
+func passkeyLogin(t *testing.T, env *testEnv, authenticator *webauthntest.Authenticator) (webauthn.RequestOptions, webauthn.AssertionResponse) {
+	t.Helper()
+
+	options, err := env.service.BeginPasskeyLogin(context.Background(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := authenticator.Login(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return options, response
+}
+
+func TestPasskeyLogin(t *testing.T) {
+	ctx := context.Background()
+	env, authenticator, ID, _ := passkeyEnv(t)
+
+	_, response := passkeyLogin(t, env, authenticator)
+	token, err := env.service.FinishPasskeyLogin(ctx, response)
+	if err != nil {
+		t.Fatalf("FinishPasskeyLogin() error = %v", err)
+	}
+	if got, err := env.service.GetIDByToken(ctx, token.Access); err != nil || got != ID {
+		t.Errorf("GetIDByToken() of the session = %q, %v, want %q", got, err, ID)
+	}
+
+	passkeys, err := env.service.Passkeys(ctx, token.Access, ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(passkeys) != 1 || passkeys[0].SignCount != 1 {
+		t.Errorf("Passkeys() = %+v, want one passkey with sign count 1", passkeys)
+	}
+}
+
+func TestPasskeyLoginRejects(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("reused challenge", func(t *testing.T) {
+		env, authenticator, _, _ := passkeyEnv(t)
+		options, response := passkeyLogin(t, env, authenticator)
+		if _, err := env.service.FinishPasskeyLogin(ctx, response); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := env.service.FinishPasskeyLogin(ctx, response); !errors.Is(err, oops.ErrActionToken) {
+			t.Errorf("FinishPasskeyLogin() replaying the response error = %v, want ErrActionToken", err)
+		}
+
+		// a fresh signature over the used challenge is refused as well
+		again, err := authenticator.Login(options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := env.service.FinishPasskeyLogin(ctx, again); !errors.Is(err, oops.ErrActionToken) {
+			t.Errorf("FinishPasskeyLogin() with a used challenge error = %v, want ErrActionToken", err)
+		}
+	})
+
+	t.Run("wrong origin", func(t *testing.T) {
+		env, authenticator, _, _ := passkeyEnv(t)
+		authenticator.Origin = "https://evil.example"
+
+		_, response := passkeyLogin(t, env, authenticator)
+		if _, err := env.service.FinishPasskeyLogin(ctx, response); !errors.Is(err, oops.ErrInvalidCredentials) {
+			t.Errorf("FinishPasskeyLogin() from another origin error = %v, want ErrInvalidCredentials", err)
+		}
+	})
+
+	t.Run("wrong rpIdHash", func(t *testing.T) {
+		env := newTestEnv(t, users.WithWebAuthn(passkeyConfig))
+		ID, session := env.user(t, "alice", 0)
+
+		options, err := env.service.BeginRegistration(ctx, session.Access, ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		options.RP.ID = "evil.example"
+		response, err := webauthntest.New(passkeyOrigin).Register(options)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := env.service.FinishRegistration(ctx, session.Access, ID, "", response); !errors.Is(err, oops.ErrWebAuthn) {
+			t.Errorf("FinishRegistration() for another relying party error = %v, want ErrWebAuthn", err)
+		}
+	})
+
+	t.Run("sign count regression", func(t *testing.T) {
+		env, authenticator, _, passkey := passkeyEnv(t)
+		for i := 0; i < 3; i++ {
+			_, response := passkeyLogin(t, env, authenticator)
+			if _, err := env.service.FinishPasskeyLogin(ctx, response); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// a clone of the authenticator taken after the first login
+		authenticator.SetSignCount(passkey.ID, 1)
+		_, response := passkeyLogin(t, env, authenticator)
+		if _, err := env.service.FinishPasskeyLogin(ctx, response); !errors.Is(err, oops.ErrSignCount) {
+			t.Errorf("FinishPasskeyLogin() with a lower sign count error = %v, want ErrSignCount", err)
+		}
+
+		// the same count as the last login is refused too
+		authenticator.SetSignCount(passkey.ID, 2)
+		_, response = passkeyLogin(t, env, authenticator)
+		if _, err := env.service.FinishPasskeyLogin(ctx, response); !errors.Is(err, oops.ErrSignCount) {
+			t.Errorf("FinishPasskeyLogin() with a repeated sign count error = %v, want ErrSignCount", err)
+		}
+	})
+}
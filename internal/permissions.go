@@ -0,0 +1,156 @@
+package users
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/oops"
+)
+
+// PermissionSpec declares a permission flag, its name and the flags it requires.
+type PermissionSpec struct {
+	Bit      uint
+	Name     string
+	Requires uint
+}
+
+// PermissionRegistry knows every permission flag and enforces the rules between them.
+type PermissionRegistry struct {
+	specs []PermissionSpec
+	all   uint
+}
+
+// Permissions is the registry of the Perm* flags, mirroring the rules stated on them.
+var Permissions = NewPermissionRegistry(
+	PermissionSpec{Bit: PermManageBooks, Name: "manage_books"},
+	PermissionSpec{Bit: PermQueryTotalStock, Name: "query_total_stock"},
+	PermissionSpec{Bit: PermChangeTotalStock, Name: "change_total_stock", Requires: PermQueryTotalStock},
+	PermissionSpec{Bit: PermQueryUsers, Name: "query_users"},
+	PermissionSpec{Bit: PermManageUsers, Name: "manage_users", Requires: PermQueryUsers},
+	PermissionSpec{Bit: PermGrantPermissions, Name: "grant_permissions", Requires: PermQueryUsers},
+	PermissionSpec{Bit: PermLoanBooks, Name: "loan_books"},
+	PermissionSpec{Bit: PermQueryAvailableStock, Name: "query_available_stock"},
+	PermissionSpec{Bit: PermQueryReservations, Name: "query_reservations"},
+)
+
+// NewPermissionRegistry creates a registry of the given flags.
+func NewPermissionRegistry(specs ...PermissionSpec) *PermissionRegistry {
+	r := &PermissionRegistry{specs: specs}
+	for _, spec := range specs {
+		r.all |= spec.Bit
+	}
+
+	return r
+}
+
+// All returns the union of every registered flag.
+func (r *PermissionRegistry) All() uint {
+	return r.all
+}
+
+// Names returns the names of the flags set in the mask, unknown bits are skipped.
+func (r *PermissionRegistry) Names(mask uint) []string {
+	names := make([]string, 0, len(r.specs))
+	for _, spec := range r.specs {
+		if mask&spec.Bit != 0 {
+			names = append(names, spec.Name)
+		}
+	}
+
+	return names
+}
+
+// Mask converts permission names to the flag mask.
+func (r *PermissionRegistry) Mask(names []string) (uint, error) {
+	var mask uint
+	for _, name := range names {
+		spec, ok := r.lookup(name)
+		if !ok {
+			return 0, fmt.Errorf("%w: %q", oops.ErrUnknownPermission, name)
+		}
+		mask |= spec.Bit
+	}
+
+	return mask, nil
+}
+
+// Validate checks that the mask has no unknown bits and holds the prerequisites of every flag.
+func (r *PermissionRegistry) Validate(mask uint) error {
+	if unknown := mask &^ r.all; unknown != 0 {
+		return &PermissionError{Err: oops.ErrUnknownPermission, Missing: unknown,
+			Detail: fmt.Sprintf("unknown permission bits %#x", unknown)}
+	}
+
+	var missing uint
+	var reasons []string
+	for _, spec := range r.specs {
+		if mask&spec.Bit == 0 {
+			continue
+		}
+		if lacking := spec.Requires &^ mask; lacking != 0 {
+			missing |= lacking
+			reasons = append(reasons, fmt.Sprintf("%s requires %s", spec.Name, strings.Join(r.Names(lacking), ", ")))
+		}
+	}
+
+	if missing != 0 {
+		return &PermissionError{Err: oops.ErrMissingPrerequisite, Missing: missing, Detail: strings.Join(reasons, "; ")}
+	}
+
+	return nil
+}
+
+// ValidateGrant checks that the granter may change the direct permissions of a user from current to requested.
+// The granter needs PermGrantPermissions and may only add or remove flags it holds itself,
+// and the requested mask together with the inherited role permissions must satisfy every prerequisite.
+func (r *PermissionRegistry) ValidateGrant(granter uint, current uint, requested uint, inherited uint) error {
+	if granter&PermGrantPermissions == 0 {
+		return &PermissionError{Err: oops.ErrWrongPermissions, Missing: PermGrantPermissions,
+			Detail: "granting permissions requires grant_permissions"}
+	}
+
+	if unknown := requested &^ r.all; unknown != 0 {
+		return r.Validate(unknown)
+	}
+
+	if err := r.Validate(requested | inherited); err != nil {
+		return err
+	}
+
+	if notHeld := (current ^ requested) &^ granter; notHeld != 0 {
+		return &PermissionError{Err: oops.ErrGrantNotHeld, Missing: notHeld,
+			Detail: "only own permissions may be granted or revoked, missing " + strings.Join(r.Names(notHeld), ", ")}
+	}
+
+	return nil
+}
+
+func (r *PermissionRegistry) lookup(name string) (PermissionSpec, bool) {
+	for _, spec := range r.specs {
+		if spec.Name == name {
+			return spec, true
+		}
+	}
+
+	return PermissionSpec{}, false
+}
+
+// PermissionError reports which permission bits made a check fail.
+type PermissionError struct {
+	Err     error // one of the oops permission errors
+	Missing uint  // offending bits
+	Detail  string
+}
+
+func (e *PermissionError) Error() string {
+	return e.Err.Error() + ": " + e.Detail
+}
+
+func (e *PermissionError) Unwrap() error {
+	return e.Err
+}
+
+// Scope formats the permission mask as a space separated list of permission names.
+func Scope(permissions uint) string {
+	return strings.Join(Permissions.Names(permissions), " ")
+}
@@ -0,0 +1,217 @@
+package users
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/oops"
+)
+
+// Personal access token parameters.
+const (
+	PersonalTokenPrefix        = "pat_"               // marks personal access tokens, they are resolved without the session store
+	PersonalTokenExpiration    = 30 * 24 * time.Hour  // lifetime of tokens created without an expiry
+	MaxPersonalTokenExpiration = 365 * 24 * time.Hour // longest lifetime a token may be created with
+	MaxPersonalTokenNameLength = 64
+)
+
+// isPersonalToken tells whether the access token is a personal access token rather than a session token.
+func isPersonalToken(access string) bool {
+	return strings.HasPrefix(access, PersonalTokenPrefix)
+}
+
+// personalToken resolves a personal access token and records its use.
+// @param ctx context.Context for managing the scope of the operation.
+// @param secret string personal access token presented by the caller.
+// @return PersonalToken, User owning it and oops.ErrTokenExistance, oops.ErrTokenExpired or oops.ErrUserDisabled.
+func (s *AppService) personalToken(ctx context.Context, secret string) (PersonalToken, User, error) {
+	token, err := s.store.UsePersonalToken(ctx, hashActionSecret(secret))
+	if err == oops.ErrNoPersonalToken {
+		return PersonalToken{}, User{}, oops.ErrTokenExistance
+	} else if err != nil {
+		return PersonalToken{}, User{}, err
+	}
+
+	if time.Now().After(token.ExpiresAt) {
+		return PersonalToken{}, User{}, oops.ErrTokenExpired
+	}
+
+	user, err := s.store.User(ctx, token.UserID)
+	if err == oops.ErrNoUser {
+		return PersonalToken{}, User{}, oops.ErrTokenExistance
+	} else if err != nil {
+		return PersonalToken{}, User{}, err
+	}
+
+	// tokens are kept while the owner is disabled and work again once it is enabled
+	if user.Status == StatusDisabled {
+		return PersonalToken{}, User{}, oops.ErrUserDisabled
+	}
+
+	return token, user, nil
+}
+
+// personalPermissions narrows the current permissions of the owner to the scope of the token.
+// Permissions of the MFA policy are withheld unless the token was created by a session confirmed with a second factor.
+// @param ctx context.Context for managing the scope of the operation.
+// @param token PersonalToken resolved by personalToken.
+// @return uint permissions granted to the token and an error if the store fails.
+func (s *AppService) personalPermissions(ctx context.Context, token PersonalToken) (uint, error) {
+	permissions, err := s.store.EffectivePermissions(ctx, token.UserID)
+	if err != nil {
+		return 0, oops.ErrNoUser
+	}
+	permissions &= token.Permissions
+
+	if token.MFA {
+		return permissions, nil
+	}
+
+	policy, err := s.store.MFAPolicy(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return permissions &^ policy, nil
+}
+
+// sessionMFA tells whether the session of the access token was confirmed with a second factor.
+func (s *AppService) sessionMFA(ctx context.Context, access string) (bool, error) {
+	token, err := s.store.CheckToken(ctx, access)
+	if err != oops.ErrDupAccess {
+		return false, oops.ErrTokenExistance
+	}
+
+	return s.store.FamilyMFA(ctx, token.Family)
+}
+
+// CreatePersonalToken creates a personal access token for the user itself.
+// The scope must be a subset of the permissions of the session creating it, so that a token
+// cannot hold permissions of the MFA policy unless the session was confirmed with a second factor.
+// @param ctx context.Context for managing the scope of the operation.
+// @param token string containing the access token of a session of the user itself.
+// @param ID string representing the user ID.
+// @param request PersonalToken with the Name, Permissions and ExpiresAt of the token, zero ExpiresAt is 30 days from now.
+// @return PersonalToken stored, string secret shown only once and an error if the request is not valid.
+func (s *AppService) CreatePersonalToken(ctx context.Context, token string, ID string, request PersonalToken) (PersonalToken, string, error) {
+	// a leaked token must not be able to outlive its own revocation
+	if isPersonalToken(token) {
+		return PersonalToken{}, "", fmt.Errorf("%w: personal access tokens are created by a session", oops.ErrPersonalToken)
+	}
+
+	callerID, held, err := s.caller(ctx, token)
+	if err != nil {
+		return PersonalToken{}, "", err
+	}
+
+	if callerID != ID {
+		return PersonalToken{}, "", fmt.Errorf("%w: personal access tokens are created by the user itself", oops.ErrWrongPermissions)
+	}
+
+	name := strings.TrimSpace(request.Name)
+	if name == "" {
+		return PersonalToken{}, "", fmt.Errorf("%w: name must not be empty", oops.ErrInvalidPersonalToken)
+	}
+	if utf8.RuneCountInString(name) > MaxPersonalTokenNameLength {
+		return PersonalToken{}, "", fmt.Errorf("%w: name is longer than %d characters", oops.ErrInvalidPersonalToken, MaxPersonalTokenNameLength)
+	}
+
+	now := time.Now()
+	expiresAt := request.ExpiresAt
+	if expiresAt.IsZero() {
+		expiresAt = now.Add(PersonalTokenExpiration)
+	}
+	if !expiresAt.After(now) {
+		return PersonalToken{}, "", fmt.Errorf("%w: expiry is in the past", oops.ErrInvalidPersonalToken)
+	}
+	if expiresAt.After(now.Add(MaxPersonalTokenExpiration)) {
+		return PersonalToken{}, "", fmt.Errorf("%w: expiry is more than %d days away", oops.ErrInvalidPersonalToken, MaxPersonalTokenExpiration/(24*time.Hour))
+	}
+
+	if err := Permissions.Validate(request.Permissions); err != nil {
+		return PersonalToken{}, "", err
+	}
+	if notHeld := request.Permissions &^ held; notHeld != 0 {
+		return PersonalToken{}, "", &PermissionError{Err: oops.ErrGrantNotHeld, Missing: notHeld,
+			Detail: "tokens are limited to own permissions, missing " + strings.Join(Permissions.Names(notHeld), ", ")}
+	}
+
+	mfa, err := s.sessionMFA(ctx, token)
+	if err != nil {
+		return PersonalToken{}, "", err
+	}
+
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return PersonalToken{}, "", err
+	}
+	secret, _, err := newActionSecret()
+	if err != nil {
+		return PersonalToken{}, "", err
+	}
+	secret = PersonalTokenPrefix + secret
+
+	created := PersonalToken{
+		ID:          hex.EncodeToString(raw),
+		UserID:      ID,
+		Name:        name,
+		Hash:        hashActionSecret(secret),
+		Permissions: request.Permissions,
+		MFA:         mfa,
+		CreatedAt:   now,
+		ExpiresAt:   expiresAt,
+		LastUsedAt:  now,
+	}
+
+	if err := s.store.SavePersonalToken(ctx, created); err != nil {
+		return PersonalToken{}, "", err
+	}
+
+	return created, secret, nil
+}
+
+// PersonalTokens lists the personal access tokens of the user, by the user itself or by user with corresponding permissions.
+// @param ctx context.Context for managing the scope of the operation.
+// @param token string containing the access token of the caller.
+// @param ID string representing the user ID.
+// @return []PersonalToken of the user without their secrets and an error if the caller may not read the user.
+func (s *AppService) PersonalTokens(ctx context.Context, token string, ID string) ([]PersonalToken, error) {
+	callerID, permissions, err := s.caller(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	if callerID != ID && permissions&PermQueryUsers == 0 {
+		return nil, oops.ErrWrongPermissions
+	}
+
+	if _, err := s.store.User(ctx, ID); err != nil {
+		return nil, err
+	}
+
+	return s.store.PersonalTokens(ctx, ID)
+}
+
+// RevokePersonalToken deletes a personal access token of the user, by the user itself or by user with corresponding permissions.
+// @param ctx context.Context for managing the scope of the operation.
+// @param token string containing the access token of the caller.
+// @param ID string representing the user ID.
+// @param personal string ID of the personal access token.
+// @return error oops.ErrNoPersonalToken if the user has no such token.
+func (s *AppService) RevokePersonalToken(ctx context.Context, token string, ID string, personal string) error {
+	callerID, permissions, err := s.caller(ctx, token)
+	if err != nil {
+		return err
+	}
+
+	if callerID != ID && permissions&PermManageUsers == 0 {
+		return &PermissionError{Err: oops.ErrWrongPermissions, Missing: PermManageUsers,
+			Detail: "revoking tokens of others requires manage_users"}
+	}
+
+	return s.store.PopPersonalToken(ctx, ID, personal)
+}
@@ -0,0 +1,42 @@
+package users
+
+import (
+	"context"
+	"strings"
+)
+
+type principalKey struct{}
+
+// WithPrincipal stores the authenticated caller, tokens of the caller are not resolved again.
+func WithPrincipal(ctx context.Context, principal Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// PrincipalFrom returns the authenticated caller of the context.
+func PrincipalFrom(ctx context.Context) (Principal, bool) {
+	principal, ok := ctx.Value(principalKey{}).(Principal)
+	return principal, ok
+}
+
+// principalOf returns the caller stored in the context if it was authenticated with the access token.
+func principalOf(ctx context.Context, access string) (Principal, bool) {
+	principal, ok := PrincipalFrom(ctx)
+	if !ok || access == "" || principal.Token != access {
+		return Principal{}, false
+	}
+
+	return principal, true
+}
+
+// Authenticate resolves the access token to the caller and its effective permissions.
+// @param ctx context.Context for managing the scope of the operation.
+// @param access string representing the access token of the caller.
+// @return Principal of the caller and an error if the token is not valid.
+func (s *AppService) Authenticate(ctx context.Context, access string) (Principal, error) {
+	ID, permissions, err := s.caller(ctx, access)
+	if err != nil {
+		return Principal{}, err
+	}
+
+	return Principal{ID: ID, Permissions: permissions, Token: access, Service: strings.HasPrefix(ID, ClientIDPrefix)}, nil
+}
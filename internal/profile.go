@@ -0,0 +1,91 @@
+package users
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/oops"
+)
+
+// Limits of the profile fields of a user.
+const (
+	MaxEmailLength       = 254 // RFC 5321 path limit
+	MaxDisplayNameLength = 128
+	MaxAttributes        = 32
+	MaxAttributeKey      = 64
+	MaxAttributeValue    = 1024
+)
+
+// NormalizeEmail trims and lowercases the address so that uniqueness does not depend on case.
+// @param email string address as entered.
+// @return string address as stored and compared.
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// validateProfile checks the profile fields of a user before it is saved.
+// Email must already be normalized, an empty email means the user has none.
+// @param user User to be checked.
+// @return error wrapping oops.ErrInvalidUser describing the first problem found.
+func validateProfile(user User) error {
+	if user.Email != "" {
+		if len(user.Email) > MaxEmailLength {
+			return fmt.Errorf("%w: email is longer than %d bytes", oops.ErrInvalidUser, MaxEmailLength)
+		}
+		// a bare address only, "Name <address>" forms are not accepted
+		address, err := mail.ParseAddress(user.Email)
+		if err != nil || address.Address != user.Email {
+			return fmt.Errorf("%w: email %q is not a valid address", oops.ErrInvalidUser, user.Email)
+		}
+	}
+
+	if !utf8.ValidString(user.DisplayName) || utf8.RuneCountInString(user.DisplayName) > MaxDisplayNameLength {
+		return fmt.Errorf("%w: display name must be valid text of at most %d characters", oops.ErrInvalidUser, MaxDisplayNameLength)
+	}
+
+	if len(user.Attributes) > MaxAttributes {
+		return fmt.Errorf("%w: at most %d attributes are allowed", oops.ErrInvalidUser, MaxAttributes)
+	}
+	for key, value := range user.Attributes {
+		if key == "" || len(key) > MaxAttributeKey || !utf8.ValidString(key) {
+			return fmt.Errorf("%w: attribute key %q must be 1 to %d bytes", oops.ErrInvalidUser, key, MaxAttributeKey)
+		}
+		if len(value) > MaxAttributeValue || !utf8.ValidString(value) {
+			return fmt.Errorf("%w: attribute %q must be valid text of at most %d bytes", oops.ErrInvalidUser, key, MaxAttributeValue)
+		}
+	}
+
+	return nil
+}
+
+// applyProfile changes the profile fields present in the patch, a null attribute removes the key.
+// A new email is not verified.
+// @param user *User to be changed.
+// @param patch UserPatch with the fields to change.
+func applyProfile(user *User, patch UserPatch) {
+	if email := patch.Email; email != nil && NormalizeEmail(*email) != user.Email {
+		user.Email = NormalizeEmail(*email)
+		user.EmailVerified = false
+	}
+	if patch.DisplayName != nil {
+		user.DisplayName = strings.TrimSpace(*patch.DisplayName)
+	}
+
+	if len(patch.Attributes) == 0 {
+		return
+	}
+	attributes := make(map[string]string, len(user.Attributes)+len(patch.Attributes))
+	for key, value := range user.Attributes {
+		attributes[key] = value
+	}
+	for key, value := range patch.Attributes {
+		if value == nil {
+			delete(attributes, key)
+			continue
+		}
+		attributes[key] = *value
+	}
+	user.Attributes = attributes
+}
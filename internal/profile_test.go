@@ -0,0 +1,176 @@
+package users_test
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+
+	users "github.com/mipt-kp-2024-go-beer/user-service/internal"
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/oops"
+)
+
+// attributes makes n distinct attributes.
+func attributes(n int) map[string]string {
+	output := make(map[string]string, n)
+	for i := 0; i < n; i++ {
+		output["key"+strconv.Itoa(i)] = "value"
+	}
+	return output
+}
+
+func TestProfileValidation(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t)
+
+	local := strings.Repeat("a", 64)
+	longest := local + "@" + strings.Repeat("b", users.MaxEmailLength-len(local)-len("@.org")) + ".org"
+
+	for _, test := range []struct {
+		name  string
+		user  users.User
+		valid bool
+	}{
+		{"no profile", users.User{}, true},
+		{"email", users.User{Email: "alice@example.org"}, true},
+		{"longest email", users.User{Email: longest}, true},
+		{"too long email", users.User{Email: "a" + longest}, false},
+		{"malformed email", users.User{Email: "alice.example.org"}, false},
+		{"named email", users.User{Email: "Alice <alice@example.org>"}, false},
+		{"longest display name", users.User{DisplayName: strings.Repeat("ё", users.MaxDisplayNameLength)}, true},
+		{"too long display name", users.User{DisplayName: strings.Repeat("ё", users.MaxDisplayNameLength+1)}, false},
+		{"invalid display name", users.User{DisplayName: "\xff"}, false},
+		{"most attributes", users.User{Attributes: attributes(users.MaxAttributes)}, true},
+		{"too many attributes", users.User{Attributes: attributes(users.MaxAttributes + 1)}, false},
+		{"empty attribute key", users.User{Attributes: map[string]string{"": "value"}}, false},
+		{"longest attribute key", users.User{Attributes: map[string]string{strings.Repeat("k", users.MaxAttributeKey): "value"}}, true},
+		{"too long attribute key", users.User{Attributes: map[string]string{strings.Repeat("k", users.MaxAttributeKey+1): "value"}}, false},
+		{"longest attribute value", users.User{Attributes: map[string]string{"key": strings.Repeat("v", users.MaxAttributeValue)}}, true},
+		{"too long attribute value", users.User{Attributes: map[string]string{"key": strings.Repeat("v", users.MaxAttributeValue+1)}}, false},
+	} {
+		user := test.user
+		user.Login = strings.ReplaceAll(test.name, " ", "-")
+		user.Password = "password"
+
+		_, err := env.service.NewUser(ctx, user)
+		if test.valid && err != nil {
+			t.Errorf("NewUser() with %s error = %v", test.name, err)
+		}
+		if !test.valid && !errors.Is(err, oops.ErrInvalidUser) {
+			t.Errorf("NewUser() with %s error = %v, want ErrInvalidUser", test.name, err)
+		}
+	}
+
+	// the limits hold for changes too
+	ID, session := env.user(t, "alice", 0)
+	tooLong := strings.Repeat("x", users.MaxDisplayNameLength+1)
+	if _, err := env.service.EditUser(ctx, session.Access, ID, users.UserPatch{DisplayName: &tooLong}); !errors.Is(err, oops.ErrInvalidUser) {
+		t.Errorf("EditUser() with a too long display name error = %v, want ErrInvalidUser", err)
+	}
+}
+
+func TestProfileEmail(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t)
+
+	ID, err := env.service.NewUser(ctx, users.User{Login: "alice", Password: "alice-password", Email: " Alice@Example.ORG "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := env.service.CreateToken(ctx, "alice", "alice-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := func() users.User {
+		t.Helper()
+		user, err := env.store.User(ctx, ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return user
+	}
+	if email := read().Email; email != "alice@example.org" {
+		t.Fatalf("stored email = %q, want it normalized", email)
+	}
+
+	// emails are unique regardless of case
+	if _, err := env.service.NewUser(ctx, users.User{Login: "mallory", Password: "password", Email: "ALICE@example.org"}); !errors.Is(err, oops.ErrDuplicateEmail) {
+		t.Errorf("NewUser() with the email of another user error = %v, want ErrDuplicateEmail", err)
+	}
+
+	if err := env.store.VerifyEmail(ctx, ID, "alice@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	edit := func(patch users.UserPatch) users.User {
+		t.Helper()
+		if _, err := env.service.EditUser(ctx, session.Access, ID, patch); err != nil {
+			t.Fatalf("EditUser() error = %v", err)
+		}
+		return read()
+	}
+
+	same := "ALICE@example.org"
+	if user := edit(users.UserPatch{Email: &same}); !user.EmailVerified {
+		t.Error("EditUser() to the same email in another case reset the verification")
+	}
+	name := "Alice"
+	if user := edit(users.UserPatch{DisplayName: &name}); !user.EmailVerified {
+		t.Error("EditUser() of the display name reset the verification")
+	}
+
+	changed := "alice@example.net"
+	if user := edit(users.UserPatch{Email: &changed}); user.Email != changed || user.EmailVerified {
+		t.Errorf("user after an email change = %q verified %v, want %q not verified", user.Email, user.EmailVerified, changed)
+	}
+
+	none := ""
+	if user := edit(users.UserPatch{Email: &none}); user.Email != "" || user.EmailVerified {
+		t.Errorf("user after removing the email = %q verified %v, want no email", user.Email, user.EmailVerified)
+	}
+}
+
+func TestProfileAttributes(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t)
+	ID, session := env.user(t, "alice", 0)
+
+	value := func(s string) *string { return &s }
+	patches := []struct {
+		attributes map[string]*string
+		want       map[string]string
+	}{
+		{map[string]*string{"team": value("loans"), "floor": value("2")}, map[string]string{"team": "loans", "floor": "2"}},
+		// keys not in the patch are kept, null removes a key
+		{map[string]*string{"floor": nil, "desk": value("12")}, map[string]string{"team": "loans", "desk": "12"}},
+		{map[string]*string{"missing": nil}, map[string]string{"team": "loans", "desk": "12"}},
+	}
+	for _, patch := range patches {
+		if _, err := env.service.EditUser(ctx, session.Access, ID, users.UserPatch{Attributes: patch.attributes}); err != nil {
+			t.Fatalf("EditUser() error = %v", err)
+		}
+		user, err := env.store.User(ctx, ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(user.Attributes) != len(patch.want) {
+			t.Errorf("attributes = %v, want %v", user.Attributes, patch.want)
+			continue
+		}
+		for key, want := range patch.want {
+			if user.Attributes[key] != want {
+				t.Errorf("attributes = %v, want %v", user.Attributes, patch.want)
+				break
+			}
+		}
+	}
+
+	// the merged attributes are validated, not only the patch
+	many := make(map[string]*string)
+	for key := range attributes(users.MaxAttributes - 1) {
+		many[key] = value("value")
+	}
+	if _, err := env.service.EditUser(ctx, session.Access, ID, users.UserPatch{Attributes: many}); !errors.Is(err, oops.ErrInvalidUser) {
+		t.Errorf("EditUser() growing the attributes beyond %d error = %v, want ErrInvalidUser", users.MaxAttributes, err)
+	}
+}
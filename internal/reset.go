@@ -0,0 +1,118 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/mail"
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/oops"
+)
+
+// ResetExpiration is the lifetime of password reset tokens.
+const ResetExpiration = 30 * time.Minute
+
+// resetMailTimeout bounds the delivery of a reset message, which outlives the request.
+const resetMailTimeout = time.Minute
+
+// ForgotPassword mails a password reset token to the verified email of the user.
+// The outcome is not reported so that callers cannot learn which logins exist or have an email,
+// the message is sent in the background for the same reason.
+// @param ctx context.Context for managing the scope of the operation.
+// @param login string login of the user who forgot the password.
+// @return error only if the store fails.
+func (s *AppService) ForgotPassword(ctx context.Context, login string) error {
+	user, err := s.store.UserByLogin(ctx, login)
+	if errors.Is(err, oops.ErrNoUser) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// an unverified email may belong to someone else
+	if user.Email == "" || !user.EmailVerified || user.Status == StatusDisabled {
+		return nil
+	}
+
+	secret, err := s.issueAction(ctx, user, PurposeResetPassword, ResetExpiration)
+	if err != nil {
+		return err
+	}
+
+	link, err := actionLink(s.resetURL, secret)
+	if err != nil {
+		return err
+	}
+
+	msg := mail.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("A new password was requested for your account %q:\n\n%s\n\n"+
+			"The link expires in %d minutes and can be used once. "+
+			"If you did not ask for it, ignore this message, your password stays the same.",
+			user.Login, link, int(ResetExpiration.Minutes())),
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), resetMailTimeout)
+		defer cancel()
+		if err := s.mailer.Send(ctx, msg); err != nil {
+			log.Printf("password reset of user %s: %v", user.ID, err)
+		}
+	}()
+
+	return nil
+}
+
+// ResetPassword consumes a reset token, sets the new password and ends every session of the user.
+// Personal access tokens are revoked too, since whoever took over the account may have created them.
+// @param ctx context.Context for managing the scope of the operation.
+// @param secret string token from the reset message.
+// @param password string new password.
+// @return error oops.ErrActionToken if the token is unknown, expired, used or the email has changed since.
+func (s *AppService) ResetPassword(ctx context.Context, secret string, password string) error {
+	if password == "" {
+		return fmt.Errorf("%w: password must not be empty", oops.ErrInvalidUser)
+	}
+
+	token, err := s.store.ConsumeActionToken(ctx, hashActionSecret(secret), PurposeResetPassword)
+	if err != nil {
+		return err
+	}
+
+	if time.Now().After(token.ExpiresAt) {
+		return oops.ErrActionToken
+	}
+
+	user, err := s.store.User(ctx, token.UserID)
+	if errors.Is(err, oops.ErrNoUser) {
+		return oops.ErrActionToken
+	}
+	if err != nil {
+		return err
+	}
+
+	if user.Email != token.Email {
+		return oops.ErrActionToken
+	}
+
+	hash, err := s.hasher.Hash(password)
+	if err != nil {
+		return err
+	}
+	user.Password = hash
+
+	if _, err := s.store.ChangeUser(ctx, user); err != nil {
+		return err
+	}
+
+	// whoever knew the old password must not stay logged in
+	if err := s.store.RevokeUserTokens(ctx, user.ID); err != nil {
+		return err
+	}
+
+	return s.store.PopPersonalTokens(ctx, user.ID)
+}
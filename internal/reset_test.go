@@ -0,0 +1,153 @@
+package users_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+
+	users "github.com/mipt-kp-2024-go-beer/user-service/internal"
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/oops"
+)
+
+// verifiedUser creates a user whose email is verified and logs it in.
+func verifiedUser(t *testing.T, env *testEnv, sent outbox, login string, email string) (string, users.Token) {
+	t.Helper()
+	ctx := context.Background()
+
+	ID, err := env.service.NewUser(ctx, users.User{Login: login, Password: login + "-password", Email: email})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := env.service.VerifyEmail(ctx, sent.receive(t, email)); err != nil {
+		t.Fatal(err)
+	}
+	session, err := env.service.CreateToken(ctx, login, login+"-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ID, session
+}
+
+func TestResetPassword(t *testing.T) {
+	ctx := context.Background()
+	env, sent := mailEnv(t)
+	ID, session := verifiedUser(t, env, sent, "alice", "alice@example.org")
+	other, err := env.service.CreateToken(ctx, "alice", "alice-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, personal, err := env.service.CreatePersonalToken(ctx, session.Access, ID, users.PersonalToken{Name: "script"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := env.service.ForgotPassword(ctx, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	replaced := sent.receive(t, "alice@example.org")
+	if err := env.service.ForgotPassword(ctx, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	secret := sent.receive(t, "alice@example.org")
+
+	for name, token := range map[string]string{
+		"a replaced token":     replaced,
+		"an expired token":     expiredAction(t, env, ID, "alice@example.org", users.PurposeResetPassword),
+		"an unknown token":     "unknown",
+		"a verification token": expiredAction(t, env, ID, "alice@example.org", users.PurposeVerifyEmail),
+		"an empty token":       "",
+	} {
+		if err := env.service.ResetPassword(ctx, token, "new-password"); !errors.Is(err, oops.ErrActionToken) {
+			t.Errorf("ResetPassword() with %s error = %v, want ErrActionToken", name, err)
+		}
+	}
+	if err := env.service.ResetPassword(ctx, secret, ""); !errors.Is(err, oops.ErrInvalidUser) {
+		t.Errorf("ResetPassword() with an empty password error = %v, want ErrInvalidUser", err)
+	}
+	alive(t, env, "a session before the reset", session, true)
+
+	if err := env.service.ResetPassword(ctx, secret, "new-password"); err != nil {
+		t.Fatalf("ResetPassword() error = %v", err)
+	}
+	if err := env.service.ResetPassword(ctx, secret, "another-password"); !errors.Is(err, oops.ErrActionToken) {
+		t.Errorf("ResetPassword() with a used token error = %v, want ErrActionToken", err)
+	}
+
+	// whoever knew the old password is locked out
+	alive(t, env, "a session after the reset", session, false)
+	alive(t, env, "another session after the reset", other, false)
+	if _, err := env.service.Authenticate(ctx, personal); err == nil {
+		t.Error("Authenticate() with a personal token created before the reset succeeded")
+	}
+	if _, err := env.service.CreateToken(ctx, "alice", "alice-password"); !errors.Is(err, oops.ErrInvalidCredentials) {
+		t.Errorf("CreateToken() with the old password error = %v, want ErrInvalidCredentials", err)
+	}
+	if _, err := env.service.CreateToken(ctx, "alice", "new-password"); err != nil {
+		t.Errorf("CreateToken() with the new password error = %v", err)
+	}
+}
+
+func TestResetPasswordChangedEmail(t *testing.T) {
+	ctx := context.Background()
+	env, sent := mailEnv(t)
+	ID, session := verifiedUser(t, env, sent, "alice", "alice@example.org")
+
+	if err := env.service.ForgotPassword(ctx, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	secret := sent.receive(t, "alice@example.org")
+
+	// the mailbox the token was sent to no longer belongs to the account
+	email := "alice@example.net"
+	if _, err := env.service.EditUser(ctx, session.Access, ID, users.UserPatch{Email: &email}); err != nil {
+		t.Fatal(err)
+	}
+	sent.receive(t, email)
+	if err := env.service.ResetPassword(ctx, secret, "new-password"); !errors.Is(err, oops.ErrActionToken) {
+		t.Errorf("ResetPassword() after an email change error = %v, want ErrActionToken", err)
+	}
+
+	// an unverified email gets no reset
+	if err := env.service.ForgotPassword(ctx, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	sent.empty(t, "to an unverified email")
+}
+
+func TestForgotPasswordReveals(t *testing.T) {
+	env, sent := mailEnv(t)
+	verifiedUser(t, env, sent, "alice", "alice@example.org")
+	env.user(t, "bob", 0)
+
+	forgot := func(login string) (int, []byte) {
+		t.Helper()
+		resp, err := env.public.Client().Do(newRequest(t, env.public, http.MethodPost, "/v1/password/forgot", "", map[string]string{"login": login}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, body
+	}
+
+	status, body := forgot("alice")
+	if status != http.StatusAccepted {
+		t.Fatalf("POST /v1/password/forgot = %d, want 202", status)
+	}
+	sent.receive(t, "alice@example.org")
+
+	// unknown logins and logins without an email look the same from outside
+	for _, login := range []string{"ghost", "bob"} {
+		if got, gotBody := forgot(login); got != status || !bytes.Equal(gotBody, body) {
+			t.Errorf("POST /v1/password/forgot for %s = %d %q, want %d %q as for a known login", login, got, gotBody, status, body)
+		}
+	}
+	sent.empty(t, "for a login without a verified email")
+}
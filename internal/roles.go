@@ -0,0 +1,266 @@
+package users
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/oops"
+)
+
+// roleName restricts role names to lowercase words joined by dashes, e.g. "stock-keeper".
+var roleName = regexp.MustCompile(`^[a-z][a-z0-9]*(-[a-z0-9]+)*$`)
+
+// DefaultRoles are created together with the schema, the roles migration seeds the same masks.
+var DefaultRoles = []Role{
+	{Name: "reader", Description: "Looks up books and reservations",
+		Permissions: PermQueryAvailableStock | PermQueryReservations},
+	{Name: "librarian", Description: "Manages the catalogue and registers loans",
+		Permissions: PermManageBooks | PermQueryTotalStock | PermLoanBooks | PermQueryAvailableStock | PermQueryReservations},
+	{Name: "stock-keeper", Description: "Keeps track of the total stock",
+		Permissions: PermQueryTotalStock | PermChangeTotalStock | PermQueryAvailableStock},
+	{Name: "admin", Description: "Every permission",
+		Permissions: Permissions.All()},
+}
+
+// Roles lists every role, requires PermGrantPermissions.
+// @param ctx context.Context for managing the scope of the operation.
+// @param token string containing the access token of the caller.
+// @return []Role ordered by name and an error if the operation fails.
+func (s *AppService) Roles(ctx context.Context, token string) ([]Role, error) {
+	if _, err := s.roleManager(ctx, token); err != nil {
+		return nil, err
+	}
+
+	return s.store.LoadRoles(ctx)
+}
+
+// CreateRole defines a new role, requires PermGrantPermissions and every permission of the role.
+// @param ctx context.Context for managing the scope of the operation.
+// @param token string containing the access token of the caller.
+// @param role Role to be created.
+// @return error indicating if the operation was successful or if an error occurred.
+func (s *AppService) CreateRole(ctx context.Context, token string, role Role) error {
+	granter, err := s.roleManager(ctx, token)
+	if err != nil {
+		return err
+	}
+
+	if !roleName.MatchString(role.Name) {
+		return fmt.Errorf("%w: invalid role name %q", oops.ErrInvalidRole, role.Name)
+	}
+
+	if err := Permissions.ValidateGrant(granter, 0, role.Permissions, 0); err != nil {
+		return err
+	}
+
+	return s.store.SaveRole(ctx, role)
+}
+
+// EditRole changes the description and permissions of a role,
+// requires PermGrantPermissions and every permission added or removed.
+// Shrinking the role is refused if a user assigned it would keep a permission without its prerequisite.
+// @param ctx context.Context for managing the scope of the operation.
+// @param token string containing the access token of the caller.
+// @param role Role with the new description and permissions.
+// @return error indicating if the operation was successful or if an error occurred.
+func (s *AppService) EditRole(ctx context.Context, token string, role Role) error {
+	granter, err := s.roleManager(ctx, token)
+	if err != nil {
+		return err
+	}
+
+	current, err := s.store.Role(ctx, role.Name)
+	if err != nil {
+		return err
+	}
+
+	if err := Permissions.ValidateGrant(granter, current.Permissions, role.Permissions, 0); err != nil {
+		return err
+	}
+
+	if current.Permissions&^role.Permissions != 0 {
+		if err := s.checkRoleMembers(ctx, role.Name, role.Permissions); err != nil {
+			return err
+		}
+	}
+
+	return s.store.ChangeRole(ctx, role)
+}
+
+// DeleteRole removes a role and unassigns it from every user,
+// requires PermGrantPermissions and every permission of the role.
+// It is refused if a user assigned the role would keep a permission without its prerequisite.
+// @param ctx context.Context for managing the scope of the operation.
+// @param token string containing the access token of the caller.
+// @param name string representing the role to delete.
+// @return error indicating if the operation was successful or if an error occurred.
+func (s *AppService) DeleteRole(ctx context.Context, token string, name string) error {
+	granter, err := s.roleManager(ctx, token)
+	if err != nil {
+		return err
+	}
+
+	current, err := s.store.Role(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	if err := Permissions.ValidateGrant(granter, current.Permissions, 0, 0); err != nil {
+		return err
+	}
+
+	if err := s.checkRoleMembers(ctx, name, 0); err != nil {
+		return err
+	}
+
+	return s.store.PopRole(ctx, name)
+}
+
+// AssignRole gives a role to a user, requires PermGrantPermissions and every permission of the role.
+// @param ctx context.Context for managing the scope of the operation.
+// @param token string containing the access token of the caller.
+// @param ID string representing the user receiving the role.
+// @param role string representing the role name.
+// @return error indicating if the operation was successful or if an error occurred.
+func (s *AppService) AssignRole(ctx context.Context, token string, ID string, role string) error {
+	if err := s.checkRoleGrant(ctx, token, role); err != nil {
+		return err
+	}
+
+	return s.store.AssignRole(ctx, ID, role)
+}
+
+// UnassignRole takes a role from a user, requires PermGrantPermissions and every permission of the role.
+// It is refused if the user would keep a permission without its prerequisite, e.g. a direct manage_users
+// whose query_users came from the role.
+// @param ctx context.Context for managing the scope of the operation.
+// @param token string containing the access token of the caller.
+// @param ID string representing the user losing the role.
+// @param role string representing the role name.
+// @return error indicating if the operation was successful or if an error occurred.
+func (s *AppService) UnassignRole(ctx context.Context, token string, ID string, role string) error {
+	if err := s.checkRoleGrant(ctx, token, role); err != nil {
+		return err
+	}
+
+	user, err := s.store.User(ctx, ID)
+	if err != nil {
+		return err
+	}
+	if err := s.checkRemaining(ctx, user, role, 0); err != nil {
+		return err
+	}
+
+	return s.store.UnassignRole(ctx, ID, role)
+}
+
+// roleManager resolves the caller and checks it holds PermGrantPermissions.
+// @param ctx context.Context for managing the scope of the operation.
+// @param token string containing the access token of the caller.
+// @return uint effective permissions of the caller and an error if it may not manage roles.
+func (s *AppService) roleManager(ctx context.Context, token string) (uint, error) {
+	_, permissions, err := s.caller(ctx, token)
+	if err != nil {
+		return 0, err
+	}
+
+	if permissions&PermGrantPermissions == 0 {
+		return 0, &PermissionError{Err: oops.ErrWrongPermissions, Missing: PermGrantPermissions,
+			Detail: "managing roles requires grant_permissions"}
+	}
+
+	return permissions, nil
+}
+
+// checkRoleGrant checks the caller may hand out or take away the role.
+// @param ctx context.Context for managing the scope of the operation.
+// @param token string containing the access token of the caller.
+// @param role string representing the role name.
+// @return error a *PermissionError naming the permissions the caller lacks.
+func (s *AppService) checkRoleGrant(ctx context.Context, token string, role string) error {
+	granter, err := s.roleManager(ctx, token)
+	if err != nil {
+		return err
+	}
+
+	info, err := s.store.Role(ctx, role)
+	if err != nil {
+		return err
+	}
+
+	return Permissions.ValidateGrant(granter, 0, info.Permissions, 0)
+}
+
+// checkRoleMembers checks every user assigned the role still satisfies the prerequisites
+// once the role grants only the given permissions.
+// @param ctx context.Context for managing the scope of the operation.
+// @param role string representing the role name.
+// @param permissions uint new permissions of the role, 0 when it is removed.
+// @return error a *PermissionError naming the first user left with a missing prerequisite.
+func (s *AppService) checkRoleMembers(ctx context.Context, role string, permissions uint) error {
+	query := UserQuery{Sort: SortID, Role: role, Limit: MaxPageSize}
+	for {
+		members, err := s.store.LoadUsers(ctx, query)
+		if err != nil {
+			return err
+		}
+
+		for _, user := range members {
+			if err := s.checkRemaining(ctx, user, role, permissions); err != nil {
+				return err
+			}
+		}
+
+		if len(members) < query.Limit {
+			return nil
+		}
+		last := members[len(members)-1]
+		query.After = &UserCursor{Sort: SortID, Key: last.ID, ID: last.ID}
+	}
+}
+
+// checkRemaining checks the user satisfies the prerequisites once the role grants only the given permissions.
+// @param ctx context.Context for managing the scope of the operation.
+// @param user User as loaded from the store, with its direct permissions and roles.
+// @param role string representing the role being changed.
+// @param permissions uint new permissions of the role, 0 when it is taken away.
+// @return error a *PermissionError wrapping oops.ErrMissingPrerequisite if a permission would be orphaned.
+func (s *AppService) checkRemaining(ctx context.Context, user User, role string, permissions uint) error {
+	others := make([]string, 0, len(user.Roles))
+	for _, name := range user.Roles {
+		if name != role {
+			others = append(others, name)
+		}
+	}
+
+	inherited, err := s.rolePermissions(ctx, others)
+	if err != nil {
+		return err
+	}
+
+	err = Permissions.Validate(user.Permissions | inherited | permissions)
+	if perr, ok := err.(*PermissionError); ok {
+		return &PermissionError{Err: perr.Err, Missing: perr.Missing,
+			Detail: fmt.Sprintf("user %s would be left with %s", user.ID, perr.Detail)}
+	}
+
+	return err
+}
+
+// rolePermissions combines the permissions of the named roles.
+// @param ctx context.Context for managing the scope of the operation.
+// @param roles []string role names.
+// @return uint permission mask and an error if a role cannot be loaded.
+func (s *AppService) rolePermissions(ctx context.Context, roles []string) (uint, error) {
+	var permissions uint
+	for _, name := range roles {
+		role, err := s.store.Role(ctx, name)
+		if err != nil {
+			return 0, err
+		}
+		permissions |= role.Permissions
+	}
+
+	return permissions, nil
+}
@@ -0,0 +1,101 @@
+package users_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	users "github.com/mipt-kp-2024-go-beer/user-service/internal"
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/oops"
+)
+
+func TestDefaultRolesValid(t *testing.T) {
+	for _, role := range users.DefaultRoles {
+		if err := users.Permissions.Validate(role.Permissions); err != nil {
+			t.Errorf("default role %q: %v", role.Name, err)
+		}
+	}
+}
+
+// roleEnv has an admin, and a user holding a direct manage_users whose query_users comes from the "auditor" role.
+func roleEnv(t *testing.T) (*testEnv, string, string) {
+	t.Helper()
+	ctx := context.Background()
+	env := newTestEnv(t)
+	_, admin := env.user(t, "admin", users.Permissions.All())
+
+	err := env.service.CreateRole(ctx, admin.Access, users.Role{Name: "auditor", Permissions: users.PermQueryUsers | users.PermQueryReservations})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ID, _ := env.user(t, "alice", 0)
+	if err := env.service.AssignRole(ctx, admin.Access, ID, "auditor"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.service.GivePermission(ctx, admin.Access, ID, users.PermManageUsers, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	return env, admin.Access, ID
+}
+
+func TestRoleChangesKeepPrerequisites(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("unassign", func(t *testing.T) {
+		env, admin, ID := roleEnv(t)
+
+		err := env.service.UnassignRole(ctx, admin, ID, "auditor")
+		if !errors.Is(err, oops.ErrMissingPrerequisite) {
+			t.Fatalf("UnassignRole() error = %v, want ErrMissingPrerequisite", err)
+		}
+		if got, _ := env.service.EffectivePermissions(ctx, ID); got&users.PermQueryUsers == 0 {
+			t.Error("refused UnassignRole() still took the role")
+		}
+	})
+
+	t.Run("shrink", func(t *testing.T) {
+		env, admin, ID := roleEnv(t)
+
+		err := env.service.EditRole(ctx, admin, users.Role{Name: "auditor", Permissions: users.PermQueryReservations})
+		if !errors.Is(err, oops.ErrMissingPrerequisite) {
+			t.Fatalf("EditRole() error = %v, want ErrMissingPrerequisite", err)
+		}
+		if got, _ := env.service.EffectivePermissions(ctx, ID); got&users.PermQueryUsers == 0 {
+			t.Error("refused EditRole() still shrank the role")
+		}
+
+		// removing a bit nobody depends on is fine
+		err = env.service.EditRole(ctx, admin, users.Role{Name: "auditor", Permissions: users.PermQueryUsers})
+		if err != nil {
+			t.Fatalf("EditRole() without orphaned permissions error = %v", err)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		env, admin, _ := roleEnv(t)
+
+		err := env.service.DeleteRole(ctx, admin, "auditor")
+		if !errors.Is(err, oops.ErrMissingPrerequisite) {
+			t.Fatalf("DeleteRole() error = %v, want ErrMissingPrerequisite", err)
+		}
+		if _, err := env.store.Role(ctx, "auditor"); err != nil {
+			t.Errorf("refused DeleteRole() still removed the role: %v", err)
+		}
+	})
+
+	t.Run("prerequisite held directly", func(t *testing.T) {
+		env, admin, ID := roleEnv(t)
+
+		if _, err := env.service.GivePermission(ctx, admin, ID, users.PermManageUsers|users.PermQueryUsers, 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := env.service.UnassignRole(ctx, admin, ID, "auditor"); err != nil {
+			t.Fatalf("UnassignRole() error = %v", err)
+		}
+		if err := env.service.DeleteRole(ctx, admin, "auditor"); err != nil {
+			t.Fatalf("DeleteRole() error = %v", err)
+		}
+	})
+}
@@ -4,15 +4,28 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/jwt"
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/mail"
 	"github.com/mipt-kp-2024-go-beer/user-service/internal/oops"
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/webauthn"
 )
 
 const TokenLen int = 64
 const GenerateRetries int = 5
 const ExpirationDuartion int = 10
 
+// AccessExpiration is the default lifetime of access tokens.
+const AccessExpiration = time.Duration(ExpirationDuartion) * time.Minute
+
+// RefreshExpiration is the default lifetime of refresh tokens, after which the user has to log in again.
+const RefreshExpiration = 30 * 24 * time.Hour
+
 // Permission is the flag enum for the permissions a user might have
 type Permission uint
 
@@ -44,65 +57,289 @@ const (
 )
 
 type AppService struct {
-	store Store
+	store      Store
+	hasher     PasswordHasher
+	signer     *jwt.Signer // nil means opaque access tokens
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+	mailer     mail.Mailer
+	verifyURL  string       // page the verification token is appended to, the bare token is mailed if empty
+	resetURL   string       // page the password reset token is appended to, the bare token is mailed if empty
+	attempts   AttemptStore // nil disables login throttling
+	throttle   ThrottlePolicy
+	totpIssuer string           // service name shown by authenticator apps
+	webauthn   *webauthn.Config // nil disables passkeys
+
+	dummyOnce sync.Once
+	dummyHash string // verified against for unknown logins, so that they take as long as known ones
+}
+
+// Option configures optional dependencies of AppService.
+type Option func(*AppService)
+
+// WithHasher replaces the default argon2id password hasher.
+func WithHasher(h PasswordHasher) Option {
+	return func(s *AppService) {
+		s.hasher = h
+	}
+}
+
+// WithSigner makes the service issue signed JWT access tokens instead of opaque ones.
+func WithSigner(signer *jwt.Signer) Option {
+	return func(s *AppService) {
+		s.signer = signer
+	}
+}
+
+// WithTokenTTL overrides the lifetimes of access and refresh tokens, zero keeps the default.
+func WithTokenTTL(access time.Duration, refresh time.Duration) Option {
+	return func(s *AppService) {
+		if access > 0 {
+			s.accessTTL = access
+		}
+		if refresh > 0 {
+			s.refreshTTL = refresh
+		}
+	}
+}
+
+// WithMailer replaces the default mailer, which only logs the messages.
+func WithMailer(m mail.Mailer) Option {
+	return func(s *AppService) {
+		s.mailer = m
+	}
+}
+
+// WithVerifyURL sets the page of the frontend that confirms an email, the token is passed in its "token" query parameter.
+func WithVerifyURL(url string) Option {
+	return func(s *AppService) {
+		s.verifyURL = url
+	}
+}
+
+// WithResetURL sets the page of the frontend that sets a new password, the token is passed in its "token" query parameter.
+func WithResetURL(url string) Option {
+	return func(s *AppService) {
+		s.resetURL = url
+	}
 }
 
 // Service constructor
-func NewAppService(s Store) *AppService {
-	return &AppService{
-		store: s,
+func NewAppService(s Store, opts ...Option) *AppService {
+	service := &AppService{
+		store:      s,
+		hasher:     NewArgon2Hasher(),
+		accessTTL:  AccessExpiration,
+		refreshTTL: RefreshExpiration,
+		mailer:     mail.NewLog(nil),
+		totpIssuer: DefaultTOTPIssuer,
 	}
+
+	for _, opt := range opts {
+		opt(service)
+	}
+
+	return service
 }
 
-// CheckUser checks if the provided user exists in the store.
+// CheckUser checks if the provided user exists in the store and the password matches.
+// Legacy plaintext or outdated hashes are transparently replaced with a fresh hash.
 // @param ctx context.Context for managing the scope of the operation.
 // @param user User representing the user credentials to check.
 // @return bool indicating whether the user exists, string containing user ID (if found), and error (if any).
 func (s *AppService) CheckUser(ctx context.Context, user User) (bool, string, error) {
-	ID, err := s.store.CheckUser(ctx, user)
-	return err == nil, ID, err
+	stored, err := s.store.UserByLogin(ctx, user.Login)
+	if err == oops.ErrNoUser {
+		s.verifyDummy(user.Password)
+		return false, "", err
+	} else if err != nil {
+		return false, "", err
+	}
+
+	ok, rehash, err := s.hasher.Verify(stored.Password, user.Password)
+	if err != nil {
+		return false, "", err
+	}
+	if !ok {
+		return false, "", oops.ErrNoUser
+	}
+
+	if stored.Status == StatusDisabled {
+		return false, "", oops.ErrUserDisabled
+	}
+
+	if rehash {
+		// a failed upgrade must not block the login, the next one will retry
+		if hash, err := s.hasher.Hash(user.Password); err == nil {
+			if err := s.store.SetPassword(ctx, stored.ID, hash); err != nil {
+				log.Printf("rehash password of user %s: %v", stored.ID, err)
+			}
+		}
+	}
+
+	return true, stored.ID, nil
 }
 
-// NewUser creates a new user in the store.
+// verifyDummy spends the time of a password check on a hash with the current parameters,
+// so that the response time does not reveal whether a login exists.
+// @param password string plaintext password presented for the unknown login.
+func (s *AppService) verifyDummy(password string) {
+	s.dummyOnce.Do(func() {
+		hash, err := s.hasher.Hash("")
+		if err != nil {
+			log.Printf("hash dummy password: %v", err)
+			return
+		}
+		s.dummyHash = hash
+	})
+
+	if s.dummyHash != "" {
+		s.hasher.Verify(s.dummyHash, password)
+	}
+}
+
+// NewUser creates a new user in the store with a hashed password and a validated profile, assigns its roles
+// and mails a verification token to its email.
 // @param ctx context.Context for managing the scope of the operation.
-// @param user User containing the new user credentials.
+// @param user User containing the new user credentials and profile.
 // @return string containing the new user ID or an error if user already exists.
 func (s *AppService) NewUser(ctx context.Context, user User) (string, error) {
-	_, err := s.store.CheckUser(ctx, user)
-	if err == oops.ErrNoUser {
-		return s.store.SaveUser(ctx, user)
+	user.Email = NormalizeEmail(user.Email)
+	user.DisplayName = strings.TrimSpace(user.DisplayName)
+	if err := validateProfile(user); err != nil {
+		return "", err
 	}
 
-	return "", oops.ErrNoUser
+	hash, err := s.hasher.Hash(user.Password)
+	if err != nil {
+		return "", err
+	}
+	user.Password = hash
+
+	if user.Status == "" {
+		user.Status = StatusActive
+	}
+
+	ID, err := s.store.SaveUser(ctx, user)
+	if err != nil {
+		return ID, err
+	}
+
+	for _, role := range user.Roles {
+		if err := s.store.AssignRole(ctx, ID, role); err != nil {
+			return ID, err
+		}
+	}
+
+	if user.Email != "" {
+		user.ID = ID
+		s.logVerification(ctx, user)
+	}
+
+	return ID, nil
 }
 
 // CreateToken creates a new authentication token for the user based on their credentials.
+// Every login starts a new session, the token family that all of its refreshed tokens belong to.
+// Users with an enrolled second factor get a challenge to answer with VerifyMFA instead.
 // @param ctx context.Context for managing the scope of the operation.
 // @param login string for the user's login name.
 // @param password string for the user's password.
-// @return Token representing the created token and an error (if any).
+// @return Token representing the created token and an error (if any), *MFARequiredError for a challenge.
 func (s *AppService) CreateToken(ctx context.Context, login string, password string) (Token, error) {
 	// Check credentials of user, exit if there is no user with such credentials
-	checked, ID, err := s.CheckUser(ctx, User{"", login, password, 0})
-	if err != nil || !checked {
-		return Token{}, oops.ErrNoUser
+	// unknown logins and wrong passwords are reported alike not to reveal which logins exist
+	if err := s.reserveLogin(ctx, login); err != nil {
+		return Token{}, err
 	}
 
-	token, err := s.GetUniqueToken(ctx)
+	checked, ID, err := s.CheckUser(ctx, User{Login: login, Password: password})
+	if err == oops.ErrNoUser || (err == nil && !checked) {
+		return Token{}, oops.ErrInvalidCredentials
+	}
+	if err != nil {
+		return Token{}, err
+	}
 
+	// the failures are only forgotten once the second factor is correct too
+	enrolled, err := s.totpEnrolled(ctx, ID)
 	if err != nil {
 		return Token{}, err
 	}
+	if err := s.releaseLogin(ctx, login, !enrolled); err != nil {
+		return Token{}, err
+	}
+	if enrolled {
+		return Token{}, s.challenge(ctx, ID)
+	}
+
+	return s.issue(ctx, ID, "")
+}
+
+// issue generates a token pair for the user in the given family and binds it,
+// an empty family starts a new session.
+// In JWT mode the access token is a signed JWT carrying the permissions granted to the session.
+// @param ctx context.Context for managing the scope of the operation.
+// @param ID string representing the user ID the token is issued to.
+// @param family string representing the token family the pair belongs to.
+// @return Token containing the bound token pair and an error if the operation fails.
+func (s *AppService) issue(ctx context.Context, ID string, family string) (Token, error) {
+	token, err := s.GetUniqueToken(ctx)
+	if err != nil {
+		return Token{}, err
+	}
+	token.Family = family
+
+	if s.signer != nil {
+		permissions, err := s.store.EffectivePermissions(ctx, ID)
+		if err != nil {
+			return Token{}, err
+		}
+		if permissions, err = s.mfaPermissions(ctx, family, permissions); err != nil {
+			return Token{}, err
+		}
+
+		token.Access, err = s.signer.Sign(jwt.Claims{
+			Subject:     ID,
+			Permissions: permissions,
+			IssuedAt:    time.Now().Unix(),
+			ExpiresAt:   token.Expiration.Unix(),
+			ID:          token.Access,
+		})
+		if err != nil {
+			return Token{}, err
+		}
+	}
 
 	return token, s.Bind(ctx, token, ID)
 }
 
+// JWKS returns the public keys that verify access tokens issued by the service.
+// @param ctx context.Context for managing the scope of the operation.
+// @return jwt.JWKS key set and oops.ErrOpaqueTokens if the service issues opaque tokens.
+func (s *AppService) JWKS(ctx context.Context) (jwt.JWKS, error) {
+	if s.signer == nil {
+		return jwt.JWKS{}, oops.ErrOpaqueTokens
+	}
+
+	return s.signer.JWKS(), nil
+}
+
 // Bind associates a token with a user ID by saving it in the store.
+// A token without a family starts a new session recording the client found in the context.
 // @param ctx context.Context for managing the scope of the operation.
 // @param token Token to be bound to the user ID.
 // @param ID string representing the user ID to which the token will be associated.
 // @return error indicating if the operation was successful or if an error occurred.
 func (s *AppService) Bind(ctx context.Context, token Token, ID string) error {
+	if token.Family == "" {
+		family, err := s.store.CreateFamily(ctx, ID, ClientInfoFrom(ctx))
+		if err != nil {
+			return err
+		}
+		token.Family = family
+	}
+
 	return s.store.SaveToken(ctx, token, ID)
 }
 
@@ -110,83 +347,120 @@ func (s *AppService) Bind(ctx context.Context, token Token, ID string) error {
 // @param ctx context.Context for managing the scope of the operation.
 // @return Token containing generated access and refresh tokens, and an error if the generation fails.
 func (s *AppService) GetUniqueToken(ctx context.Context) (Token, error) {
+	buf := make([]byte, TokenLen)
 	token := Token{}
-	access := make([]byte, TokenLen)
 	got := false
 
 	// Generate unique access token
 	for i := 0; i < GenerateRetries; i++ {
-		_, err := rand.Read(access)
-		token.Access = string(access)
-		if err == nil || err == oops.ErrDupAccess {
-			_, err := s.store.CheckToken(ctx, token.Access)
-			if err == nil {
-				got = true
-				break
-			}
+		if _, err := rand.Read(buf); err != nil {
+			continue
 		}
-	}
 
-	println("err1")
+		token.Access = hex.EncodeToString(buf)
+		if _, err := s.store.CheckToken(ctx, token.Access); err == nil {
+			got = true
+			break
+		}
+	}
 
 	// error of getting unique access token
 	if !got {
 		return Token{}, oops.ErrNoTokens
 	}
 
-	refresh := make([]byte, TokenLen)
 	got = false
 
 	// Generate unique refresh token
 	for i := 0; i < GenerateRetries; i++ {
-		_, err := rand.Read(refresh)
-		token.Refresh = string(refresh)
-		if err == nil {
-			_, err := s.store.CheckToken(ctx, token.Refresh)
-			if err == nil {
-				got = true
-				break
-			}
+		if _, err := rand.Read(buf); err != nil {
+			continue
 		}
-	}
 
-	println("err2")
+		token.Refresh = hex.EncodeToString(buf)
+		if _, _, err := s.store.TokenByRefresh(ctx, token.Refresh); err == oops.ErrNoRefresh {
+			got = true
+			break
+		}
+	}
 
 	// error of getting unique refresh token
 	if !got {
-		return Token{}, nil
+		return Token{}, oops.ErrNoTokens
 	}
 
-	println("err3")
+	now := time.Now()
+	token.IssuedAt = now
+	token.Expiration = now.Add(s.accessTTL)
+	token.RefreshExpiration = now.Add(s.refreshTTL)
 
-	return Token{
-		Access:     hex.EncodeToString(access),
-		Refresh:    hex.EncodeToString(refresh),
-		Expiration: time.Now().Add(time.Minute * 10),
-	}, nil
+	return token, nil
 }
 
 // GetIDByToken retrieves the user ID associated with the access token.
+// The token the request was already authenticated with is not resolved again.
+// Service accounts are not users, their tokens are refused so a client ID never reaches the users table.
 // @param ctx context.Context for managing the scope of the operation.
 // @param access string representing the user's access token.
-// @return string representing the user ID and an error if retrieval fails.
+// @return string representing the user ID and an error if retrieval fails, oops.ErrWrongPermissions for service tokens.
 func (s *AppService) GetIDByToken(ctx context.Context, access string) (string, error) {
+	if principal, ok := principalOf(ctx, access); ok {
+		if principal.Service {
+			return "", oops.ErrWrongPermissions
+		}
+		return principal.ID, nil
+	}
 
-	_, err := s.store.CheckToken(ctx, access)
+	if isPersonalToken(access) {
+		token, _, err := s.personalToken(ctx, access)
+		return token.UserID, err
+	}
+
+	if s.isServiceToken(access) {
+		if _, _, err := s.serviceToken(ctx, access); err != nil {
+			return "", err
+		}
+		return "", oops.ErrWrongPermissions
+	}
+
+	ID, _, err := s.resolve(ctx, access)
+	return ID, err
+}
+
+// resolve validates the access token and returns its owner and session.
+// @param ctx context.Context for managing the scope of the operation.
+// @param access string representing the user's access token.
+// @return string user ID, string token family and an error if the token is not valid.
+func (s *AppService) resolve(ctx context.Context, access string) (string, string, error) {
+	// reject forged or expired JWTs before touching the store
+	if s.signer != nil && jwt.IsJWT(access) {
+		if _, err := s.signer.Verify(access); err == jwt.ErrExpired {
+			return "", "", oops.ErrTokenExpired
+		} else if err != nil {
+			return "", "", oops.ErrTokenExistance
+		}
+	}
+
+	token, err := s.store.CheckToken(ctx, access)
 
 	if err == nil {
-		return "", oops.ErrTokenExistance
+		return "", "", oops.ErrTokenExistance
 	}
 
 	flag, err := s.IsExpired(ctx, access)
 	if err != nil {
-		return "", oops.ErrTokenExpired
+		return "", "", oops.ErrTokenExpired
 	}
 	if flag {
-		return "", oops.ErrTokenExpired
+		return "", "", oops.ErrTokenExpired
 	}
 
-	return s.store.GetSessionID(ctx, access)
+	if err := s.store.TouchFamily(ctx, token.Family); err != nil {
+		log.Printf("touch session %s: %v", token.Family, err)
+	}
+
+	ID, err := s.store.GetSessionID(ctx, access)
+	return ID, token.Family, err
 }
 
 // IsExpired checks if the provided access token has expired.
@@ -213,93 +487,340 @@ func (s *AppService) UserInfo(ctx context.Context, ID string) (User, error) {
 	return s.store.User(ctx, ID)
 }
 
-// DeleteUser removes a user from the store based on their ID.
+// GetUser retrieves the user on behalf of the caller, users may read themselves,
+// reading others requires PermQueryUsers.
+// @param ctx context.Context for managing the scope of the operation.
+// @param token string containing the access token of the user making the request.
+// @param ID string representing the user ID to retrieve.
+// @return User containing the details of the requested user and an error if retrieval fails.
+func (s *AppService) GetUser(ctx context.Context, token string, ID string) (User, error) {
+	callerID, permissions, err := s.caller(ctx, token)
+	if err != nil {
+		return User{}, err
+	}
+
+	if callerID != ID && permissions&PermQueryUsers == 0 {
+		return User{}, oops.ErrWrongPermissions
+	}
+
+	return s.store.User(ctx, ID)
+}
+
+// EffectivePermissions returns the permissions of the user: direct grants combined with the permissions of its roles.
+// @param ctx context.Context for managing the scope of the operation.
+// @param ID string representing the user ID.
+// @return uint permission mask and an error if retrieval fails.
+func (s *AppService) EffectivePermissions(ctx context.Context, ID string) (uint, error) {
+	return s.store.EffectivePermissions(ctx, ID)
+}
+
+// caller resolves the access token of the user making the request.
+// @param ctx context.Context for managing the scope of the operation.
+// @param token string containing the access token of the caller.
+// @return string caller ID or client ID, uint permissions granted to the token of the caller and an error if the token is not valid.
+func (s *AppService) caller(ctx context.Context, token string) (string, uint, error) {
+	if principal, ok := principalOf(ctx, token); ok {
+		return principal.ID, principal.Permissions, nil
+	}
+
+	if isPersonalToken(token) {
+		personal, _, err := s.personalToken(ctx, token)
+		if err != nil {
+			return "", 0, err
+		}
+
+		permissions, err := s.personalPermissions(ctx, personal)
+		if err != nil {
+			return "", 0, err
+		}
+		return personal.UserID, permissions, nil
+	}
+
+	if s.isServiceToken(token) {
+		issued, account, err := s.serviceToken(ctx, token)
+		if err != nil {
+			return "", 0, err
+		}
+		return account.ClientID, issued.Permissions & account.Permissions, nil
+	}
+
+	ID, family, err := s.resolve(ctx, token)
+	if err != nil {
+		return "", 0, err
+	}
+
+	permissions, err := s.store.EffectivePermissions(ctx, ID)
+	if err != nil {
+		return "", 0, oops.ErrNoUser
+	}
+
+	permissions, err = s.mfaPermissions(ctx, family, permissions)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return ID, permissions, nil
+}
+
+// DeleteUser removes a user from the store based on their ID and revokes all of their tokens.
 // @param ctx context.Context for managing the scope of the operation.
 // @param ID string representing the user ID to delete.
 // @return error indicating if the operation was successful or if an error occurred.
 func (s *AppService) DeleteUser(ctx context.Context, ID string) error {
+	if err := s.store.RevokeUserTokens(ctx, ID); err != nil {
+		return err
+	}
+
 	return s.store.PopUser(ctx, ID)
 }
 
-// EditUser modifies an existing user's information.
+// RemoveUser deletes a user on behalf of the caller, users may delete themselves with a session,
+// deleting others requires PermManageUsers and that the caller outranks them, see checkOutranks.
 // @param ctx context.Context for managing the scope of the operation.
 // @param token string containing the access token of the user making the request.
-// @param user User containing the updated user details.
-// @return User with the updated information and an error if the operation fails.
-func (s *AppService) EditUser(ctx context.Context, token string, user User) (User, error) {
-	// get permission of user with token
-	ID, err := s.GetIDByToken(ctx, token)
+// @param ID string representing the user ID to delete.
+// @return error indicating if the operation was successful or if an error occurred.
+func (s *AppService) RemoveUser(ctx context.Context, token string, ID string) error {
+	callerID, permissions, err := s.caller(ctx, token)
 	if err != nil {
-		return User{}, oops.ErrTokenExistance
+		return err
+	}
+
+	if callerID != ID {
+		if permissions&PermManageUsers == 0 {
+			return oops.ErrWrongPermissions
+		}
+		if err := s.checkOutranks(ctx, permissions, ID); err != nil {
+			return err
+		}
+	} else if isPersonalToken(token) {
+		// a leaked script token must not be enough to destroy the account
+		return fmt.Errorf("%w: accounts are deleted by a session", oops.ErrPersonalToken)
 	}
 
-	info, errinfo := s.UserInfo(ctx, ID)
-	if errinfo != nil {
-		return User{}, oops.ErrNoUser
+	return s.DeleteUser(ctx, ID)
+}
+
+// checkOutranks checks the caller may manage another user: either the user holds no permission the caller lacks,
+// or the caller holds PermGrantPermissions and could grant them anyway. Otherwise resetting the password of
+// an admin would let a user manager log in with permissions it could never be granted.
+// @param ctx context.Context for managing the scope of the operation.
+// @param permissions uint effective permissions of the caller.
+// @param ID string representing the managed user.
+// @return error a *PermissionError naming the permissions of the user the caller lacks.
+func (s *AppService) checkOutranks(ctx context.Context, permissions uint, ID string) error {
+	if permissions&PermGrantPermissions != 0 {
+		return nil
+	}
+
+	target, err := s.store.EffectivePermissions(ctx, ID)
+	if err != nil {
+		return err
+	}
+
+	if lacking := target &^ permissions; lacking != 0 {
+		return &PermissionError{Err: oops.ErrWrongPermissions, Missing: lacking,
+			Detail: "managing users with more permissions requires grant_permissions, user also holds " +
+				strings.Join(Permissions.Names(lacking), ", ")}
+	}
+
+	return nil
+}
+
+// EditUser applies the patch to the user, absent fields are left untouched.
+// Users may change their own login and password, changing the password requires the current one.
+// Editing other users and changing the status requires PermManageUsers, disabling a user ends its sessions.
+// Other users must not hold permissions the caller lacks, see checkOutranks.
+// A non-zero patch.Version must match the current version of the user.
+// @param ctx context.Context for managing the scope of the operation.
+// @param token string containing the access token of the user making the request.
+// @param ID string representing the user ID to edit.
+// @param patch UserPatch containing the fields to change.
+// @return User with the updated information and an error if the operation fails.
+func (s *AppService) EditUser(ctx context.Context, token string, ID string, patch UserPatch) (User, error) {
+	callerID, permissions, err := s.caller(ctx, token)
+	if err != nil {
+		return User{}, err
 	}
 
-	if (info.Permissions & PermManageUsers) == 0 {
+	self := callerID == ID
+	if (!self || patch.Status != nil) && permissions&PermManageUsers == 0 {
 		return User{}, oops.ErrWrongPermissions
 	}
+	if !self {
+		if err := s.checkOutranks(ctx, permissions, ID); err != nil {
+			return User{}, err
+		}
+	}
+
+	// the password and the email recover the account, scripts have no business changing them
+	if self && isPersonalToken(token) && (patch.Password != nil || patch.Email != nil) {
+		return User{}, fmt.Errorf("%w: password and email are changed by a session", oops.ErrPersonalToken)
+	}
+
+	user, err := s.store.User(ctx, ID)
+	if err != nil {
+		return User{}, err
+	}
+
+	if patch.Version != 0 && patch.Version != user.Version {
+		return User{}, oops.ErrVersionMismatch
+	}
+
+	if patch.Login != nil {
+		if *patch.Login == "" {
+			return User{}, fmt.Errorf("%w: login must not be empty", oops.ErrInvalidUser)
+		}
+		user.Login = *patch.Login
+	}
+
+	disabled := false
+	if patch.Status != nil {
+		if *patch.Status != StatusActive && *patch.Status != StatusDisabled {
+			return User{}, fmt.Errorf("%w: unknown status %q", oops.ErrInvalidUser, *patch.Status)
+		}
+		disabled = *patch.Status == StatusDisabled && user.Status != StatusDisabled
+		user.Status = *patch.Status
+	}
+
+	if patch.Password != nil {
+		if *patch.Password == "" {
+			return User{}, fmt.Errorf("%w: password must not be empty", oops.ErrInvalidUser)
+		}
+
+		// a stolen access token alone must not be enough to take the account over
+		if self {
+			var current string
+			if patch.CurrentPassword != nil {
+				current = *patch.CurrentPassword
+			}
+			ok, _, err := s.hasher.Verify(user.Password, current)
+			if err != nil {
+				return User{}, err
+			}
+			if !ok {
+				return User{}, oops.ErrWrongPassword
+			}
+		}
+
+		hash, err := s.hasher.Hash(*patch.Password)
+		if err != nil {
+			return User{}, err
+		}
+		user.Password = hash
+	}
+
+	email := user.Email
+	applyProfile(&user, patch)
+	if err := validateProfile(user); err != nil {
+		return User{}, err
+	}
 
-	return s.store.ChangeUser(ctx, user)
+	// the store rejects the change if the user was changed after it was read
+	user, err = s.store.ChangeUser(ctx, user)
+	if err != nil {
+		return User{}, err
+	}
+
+	if disabled {
+		if err := s.store.RevokeUserTokens(ctx, ID); err != nil {
+			return User{}, err
+		}
+	}
+
+	if user.Email != email {
+		s.logVerification(ctx, user)
+	}
+
+	return user, nil
 }
 
-// GivePermission grants permissions to a specified user.
+// GivePermission sets the permissions of a specified user.
+// The grant is validated against the permission registry and the admin's own permissions.
 // @param ctx context.Context for managing the scope of the operation.
 // @param token string containing the access token of the admin user.
 // @param ID string representing the user ID to which permissions will be given.
-// @param Permissions uint representing the permission bits to set.
-// @return error indicating if the operation was successful or if an error occurred.
-func (s *AppService) GivePermission(ctx context.Context, token string, ID string, Permissions uint) error {
-	adminID, err := s.GetIDByToken(ctx, token)
+// @param mask uint representing the permission bits to set.
+// @param version int64 expected version of the user, 0 skips the check.
+// @return int64 new version of the user and an error, a *PermissionError naming the offending bits if the grant is not allowed.
+func (s *AppService) GivePermission(ctx context.Context, token string, ID string, mask uint, version int64) (int64, error) {
+	_, granter, err := s.caller(ctx, token)
+	if err != nil {
+		return 0, err
+	}
+
+	target, err := s.UserInfo(ctx, ID)
 	if err != nil {
-		return oops.ErrTokenExistance
+		return 0, err
 	}
 
-	info, errinfo := s.UserInfo(ctx, adminID)
-	if errinfo != nil {
-		return oops.ErrNoUser
+	if version != 0 && version != target.Version {
+		return 0, oops.ErrVersionMismatch
+	}
+
+	inherited, err := s.rolePermissions(ctx, target.Roles)
+	if err != nil {
+		return 0, err
 	}
 
-	if (info.Permissions & PermManageUsers) == 0 {
-		return oops.ErrWrongPermissions
+	if err := Permissions.ValidateGrant(granter, target.Permissions, mask, inherited); err != nil {
+		return 0, err
 	}
 
-	return s.store.SetPermission(ctx, ID, Permissions)
+	// the grant was validated against this version, a concurrent change invalidates it
+	return s.store.SetPermission(ctx, ID, mask, target.Version)
 }
 
-// RefreshToken handles the token refresh operation by validating the provided access and refresh tokens,
-// and generating a new token if valid.
+// RefreshToken rotates the token pair: the presented refresh token is consumed and a new pair
+// is issued in the same family. Presenting an already consumed refresh token means it was
+// stolen or replayed, so the whole family is revoked.
 // @param ctx context.Context for managing the scope of the operation.
-// @param access string representing the user's existing access token.
+// @param access string representing the user's existing access token, may be empty.
 // @param refresh string representing the user's refresh token.
 // @return Token containing the newly generated tokens and an error, if any occurs during the process.
 func (s *AppService) RefreshToken(ctx context.Context, access string, refresh string) (Token, error) {
-	token, err := s.store.CheckToken(ctx, access)
-	if err == nil {
-		return Token{}, err
+	token, ID, err := s.store.TokenByRefresh(ctx, refresh)
+	if err != nil {
+		return Token{}, oops.ErrNoRefresh
 	}
 
-	if token.Refresh != refresh {
+	if access != "" && token.Access != access {
 		return Token{}, oops.ErrNoRefresh
 	}
 
-	ID, UserError := s.GetIDByToken(ctx, access)
+	if token.Consumed {
+		return Token{}, s.revokeReused(ctx, token.Family)
+	}
 
-	if UserError != nil {
-		return Token{}, oops.ErrNoUser
+	if time.Now().After(token.RefreshExpiration) {
+		return Token{}, oops.ErrRefreshExpired
 	}
 
-	s.store.PopToken(ctx, access)
+	// lost race against a concurrent refresh with the same token is a reuse as well
+	if err := s.store.ConsumeRefresh(ctx, refresh); err == oops.ErrRefreshReused {
+		return Token{}, s.revokeReused(ctx, token.Family)
+	} else if err != nil {
+		return Token{}, err
+	}
 
-	newToken, newErr := s.GetUniqueToken(ctx)
+	newToken, newErr := s.issue(ctx, ID, token.Family)
 
 	if newErr != nil {
 		return Token{}, oops.ErrNoTokens
 	}
 
-	s.store.SaveToken(ctx, newToken, ID)
-
 	return newToken, nil
 }
+
+// revokeReused revokes the token family after refresh token reuse was detected.
+// @param ctx context.Context for managing the scope of the operation.
+// @param family string representing the compromised token family.
+// @return error oops.ErrRefreshReused or the error of the revocation.
+func (s *AppService) revokeReused(ctx context.Context, family string) error {
+	log.Printf("refresh token reuse detected, revoking token family %s", family)
+	if err := s.store.RevokeFamily(ctx, family); err != nil {
+		return err
+	}
+
+	return oops.ErrRefreshReused
+}
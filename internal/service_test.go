@@ -0,0 +1,194 @@
+package users_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	users "github.com/mipt-kp-2024-go-beer/user-service/internal"
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/jwt"
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/oops"
+)
+
+func TestRefreshReuseRevokesFamily(t *testing.T) {
+	signer, err := jwt.GenerateSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mode := range []struct {
+		name string
+		opts []users.Option
+	}{
+		{"opaque", nil},
+		{"jwt", []users.Option{users.WithSigner(signer)}},
+	} {
+		t.Run(mode.name, func(t *testing.T) {
+			ctx := context.Background()
+			env := newTestEnv(t, mode.opts...)
+			ID, first := env.user(t, "alice", 0)
+			other, err := env.service.CreateToken(ctx, "alice", "alice-password")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			second, err := env.service.RefreshToken(ctx, first.Access, first.Refresh)
+			if err != nil {
+				t.Fatalf("RefreshToken() error = %v", err)
+			}
+			if second.Refresh == first.Refresh {
+				t.Fatal("RefreshToken() returned the presented refresh token")
+			}
+			third, err := env.service.RefreshToken(ctx, second.Access, second.Refresh)
+			if err != nil {
+				t.Fatalf("RefreshToken() of the rotated pair error = %v", err)
+			}
+			if third.Family != second.Family {
+				t.Fatalf("RefreshToken() = family %q, want the family %q of the session", third.Family, second.Family)
+			}
+			if got, err := env.service.GetIDByToken(ctx, third.Access); err != nil || got != ID {
+				t.Fatalf("GetIDByToken() of the rotated access token = %q, %v, want %q", got, err, ID)
+			}
+
+			// the consumed refresh token shows up again, e.g. stolen before the client used it
+			if _, err := env.service.RefreshToken(ctx, first.Access, first.Refresh); err != oops.ErrRefreshReused {
+				t.Fatalf("RefreshToken() with a consumed refresh token error = %v, want ErrRefreshReused", err)
+			}
+
+			for name, token := range map[string]users.Token{"first": first, "second": second, "third": third} {
+				if _, err := env.service.GetIDByToken(ctx, token.Access); err == nil {
+					t.Errorf("GetIDByToken() of the %s access token of the revoked family succeeded", name)
+				}
+			}
+			if _, err := env.service.RefreshToken(ctx, third.Access, third.Refresh); err == nil {
+				t.Error("RefreshToken() with the latest refresh token of the revoked family succeeded")
+			}
+
+			// other sessions of the user are not affected
+			if got, err := env.service.GetIDByToken(ctx, other.Access); err != nil || got != ID {
+				t.Errorf("GetIDByToken() of another session = %q, %v, want %q", got, err, ID)
+			}
+			if _, err := env.service.RefreshToken(ctx, other.Access, other.Refresh); err != nil {
+				t.Errorf("RefreshToken() of another session error = %v", err)
+			}
+		})
+	}
+}
+
+func TestManageUsersRequiresOutranking(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t)
+	_, manager := env.user(t, "manager", users.PermQueryUsers|users.PermManageUsers)
+	_, granter := env.user(t, "granter", users.PermQueryUsers|users.PermManageUsers|users.PermGrantPermissions)
+	adminID, _ := env.user(t, "admin", users.Permissions.All())
+	peerID, _ := env.user(t, "peer", users.PermQueryUsers)
+	password := "taken-over"
+
+	_, err := env.service.EditUser(ctx, manager.Access, adminID, users.UserPatch{Password: &password})
+	if !errors.Is(err, oops.ErrWrongPermissions) {
+		t.Fatalf("EditUser() of a user with more permissions error = %v, want ErrWrongPermissions", err)
+	}
+	if _, err := env.service.CreateToken(ctx, "admin", password); err == nil {
+		t.Fatal("refused password reset still changed the password")
+	}
+	if err := env.service.RemoveUser(ctx, manager.Access, adminID); !errors.Is(err, oops.ErrWrongPermissions) {
+		t.Fatalf("RemoveUser() of a user with more permissions error = %v, want ErrWrongPermissions", err)
+	}
+	if _, err := env.store.User(ctx, adminID); err != nil {
+		t.Fatalf("refused RemoveUser() still deleted the user: %v", err)
+	}
+
+	// a user holding a subset of the permissions of the caller is fine
+	if _, err := env.service.EditUser(ctx, manager.Access, peerID, users.UserPatch{Password: &password}); err != nil {
+		t.Fatalf("EditUser() of a user with fewer permissions error = %v", err)
+	}
+	if err := env.service.RemoveUser(ctx, manager.Access, peerID); err != nil {
+		t.Fatalf("RemoveUser() of a user with fewer permissions error = %v", err)
+	}
+
+	// grant_permissions could hand out the missing permissions anyway
+	status := users.StatusDisabled
+	if _, err := env.service.EditUser(ctx, granter.Access, adminID, users.UserPatch{Status: &status}); err != nil {
+		t.Fatalf("EditUser() by a granter error = %v", err)
+	}
+	if err := env.service.RemoveUser(ctx, granter.Access, adminID); err != nil {
+		t.Fatalf("RemoveUser() by a granter error = %v", err)
+	}
+}
+
+func TestPersonalTokenCannotDeleteAccount(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t)
+	ID, session := env.user(t, "alice", users.PermQueryUsers)
+
+	_, secret, err := env.service.CreatePersonalToken(ctx, session.Access, ID, users.PersonalToken{Name: "script", Permissions: users.PermQueryUsers})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := env.service.RemoveUser(ctx, secret, ID); !errors.Is(err, oops.ErrPersonalToken) {
+		t.Errorf("RemoveUser() of the owner with a personal token error = %v, want ErrPersonalToken", err)
+	}
+
+	var problem users.Problem
+	for _, route := range []struct{ method, path string }{
+		{http.MethodDelete, "/v1/users/" + ID},
+		{http.MethodPost, "/user/delete"},
+	} {
+		status := call(t, env.public, route.method, route.path, secret, nil, &problem)
+		if status != http.StatusForbidden || problem.Code != "personal_token_forbidden" {
+			t.Errorf("%s %s with a personal token = %d %q, want 403 personal_token_forbidden", route.method, route.path, status, problem.Code)
+		}
+	}
+
+	if _, err := env.service.GetIDByToken(ctx, session.Access); err != nil {
+		t.Fatalf("GetIDByToken() after refused deletes error = %v", err)
+	}
+	if err := env.service.RemoveUser(ctx, session.Access, ID); err != nil {
+		t.Errorf("RemoveUser() of the owner with a session error = %v", err)
+	}
+}
+
+func TestServiceTokenIsNotAUser(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t)
+	_, admin := env.user(t, "admin", users.PermQueryUsers|users.PermManageUsers|users.PermGrantPermissions)
+
+	account, secret, err := env.service.CreateServiceAccount(ctx, admin.Access, users.ServiceAccount{Name: "catalog", Permissions: users.PermQueryUsers})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := env.service.ClientCredentials(ctx, account.ClientID, secret, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ID, err := env.service.GetIDByToken(ctx, token.AccessToken); !errors.Is(err, oops.ErrWrongPermissions) {
+		t.Errorf("GetIDByToken() of a service token = %q, %v, want ErrWrongPermissions", ID, err)
+	}
+	if _, err := env.service.GetIDByToken(ctx, token.AccessToken+"x"); errors.Is(err, oops.ErrWrongPermissions) || err == nil {
+		t.Errorf("GetIDByToken() of a forged service token error = %v, want the token refused", err)
+	}
+
+	var problem users.Problem
+	for _, route := range []struct {
+		server *httptest.Server
+		path   string
+	}{
+		{env.private, "/user/id"},
+		{env.public, "/user/delete"},
+	} {
+		status := call(t, route.server, http.MethodPost, route.path, token.AccessToken, nil, &problem)
+		if status != http.StatusForbidden || problem.Code != "forbidden" {
+			t.Errorf("POST %s with a service token = %d %q, want 403 forbidden", route.path, status, problem.Code)
+		}
+	}
+
+	// the principal still describes the service
+	principal, err := env.service.Authenticate(ctx, token.AccessToken)
+	if err != nil || principal.ID != account.ClientID || !principal.Service {
+		t.Errorf("Authenticate() = %+v, %v, want the service %s", principal, err, account.ClientID)
+	}
+}
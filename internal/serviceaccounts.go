@@ -0,0 +1,347 @@
+package users
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/jwt"
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/oops"
+)
+
+// Service account parameters.
+const (
+	ClientIDPrefix              = "svc_" // marks client IDs, user IDs never start with it
+	ServiceTokenPrefix          = "sat_" // marks opaque access tokens of service accounts
+	MaxServiceAccountNameLength = 64
+)
+
+// OAuthToken is the RFC 6749 access token response of the client credentials grant.
+// No refresh token is issued, the service asks for a new token with its credentials.
+type OAuthToken struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"` // seconds
+	Scope       string `json:"scope"`
+}
+
+// isServiceToken tells whether the access token was issued to a service account.
+// Signed tokens carry the client ID, expired ones are recognized too so that they are reported as expired.
+func (s *AppService) isServiceToken(access string) bool {
+	if strings.HasPrefix(access, ServiceTokenPrefix) {
+		return true
+	}
+	if s.signer == nil || !jwt.IsJWT(access) {
+		return false
+	}
+
+	claims, err := s.signer.Verify(access)
+	return (err == nil || err == jwt.ErrExpired) && claims.ClientID != ""
+}
+
+// serviceToken resolves an access token of a service account.
+// @param ctx context.Context for managing the scope of the operation.
+// @param access string access token presented by the caller.
+// @return ServiceToken, ServiceAccount it was issued to and oops.ErrTokenExistance or oops.ErrTokenExpired.
+func (s *AppService) serviceToken(ctx context.Context, access string) (ServiceToken, ServiceAccount, error) {
+	if s.signer != nil && jwt.IsJWT(access) {
+		if _, err := s.signer.Verify(access); err == jwt.ErrExpired {
+			return ServiceToken{}, ServiceAccount{}, oops.ErrTokenExpired
+		} else if err != nil {
+			return ServiceToken{}, ServiceAccount{}, oops.ErrTokenExistance
+		}
+	}
+
+	token, err := s.store.ServiceToken(ctx, hashActionSecret(access))
+	if err != nil {
+		return ServiceToken{}, ServiceAccount{}, err
+	}
+
+	if time.Now().After(token.ExpiresAt) {
+		return ServiceToken{}, ServiceAccount{}, oops.ErrTokenExpired
+	}
+
+	// tokens are revoked when the account is disabled, a token issued concurrently is caught here
+	account, err := s.store.ServiceAccount(ctx, token.ClientID)
+	if err == oops.ErrNoServiceAccount || (err == nil && account.Status == StatusDisabled) {
+		return ServiceToken{}, ServiceAccount{}, oops.ErrTokenExistance
+	} else if err != nil {
+		return ServiceToken{}, ServiceAccount{}, err
+	}
+
+	return token, account, nil
+}
+
+// ClientCredentials authenticates a service account and issues an access token carrying its permissions,
+// the client credentials grant of RFC 6749 section 4.4.
+// In JWT mode the access token is a signed JWT with the client_id claim.
+// @param ctx context.Context for managing the scope of the operation.
+// @param clientID string client ID of the service account.
+// @param secret string client secret of the service account.
+// @param scope string space separated permission names to narrow the token to, empty for every permission of the account.
+// @return OAuthToken and oops.ErrInvalidClient if the credentials are wrong or the account is disabled.
+func (s *AppService) ClientCredentials(ctx context.Context, clientID string, secret string, scope string) (OAuthToken, error) {
+	account, err := s.store.ServiceAccount(ctx, clientID)
+	if err == oops.ErrNoServiceAccount {
+		return OAuthToken{}, oops.ErrInvalidClient
+	} else if err != nil {
+		return OAuthToken{}, err
+	}
+
+	// unknown clients, wrong secrets and disabled accounts are reported alike
+	if subtle.ConstantTimeCompare([]byte(hashActionSecret(secret)), []byte(account.SecretHash)) != 1 ||
+		account.Status == StatusDisabled {
+		return OAuthToken{}, oops.ErrInvalidClient
+	}
+
+	permissions := account.Permissions
+	if scope != "" {
+		requested, err := Permissions.Mask(strings.Fields(scope))
+		if err != nil {
+			return OAuthToken{}, fmt.Errorf("%w: %v", oops.ErrInvalidScope, err)
+		}
+		if notHeld := requested &^ account.Permissions; notHeld != 0 {
+			return OAuthToken{}, fmt.Errorf("%w: not granted to the client: %s", oops.ErrInvalidScope, Scope(notHeld))
+		}
+		permissions = requested
+	}
+
+	random, _, err := newActionSecret()
+	if err != nil {
+		return OAuthToken{}, err
+	}
+
+	now := time.Now()
+	token := ServiceToken{
+		ClientID:    clientID,
+		Permissions: permissions,
+		IssuedAt:    now,
+		ExpiresAt:   now.Add(s.accessTTL),
+	}
+
+	access := ServiceTokenPrefix + random
+	if s.signer != nil {
+		access, err = s.signer.Sign(jwt.Claims{
+			Subject:     clientID,
+			Permissions: permissions,
+			IssuedAt:    now.Unix(),
+			ExpiresAt:   token.ExpiresAt.Unix(),
+			ID:          random,
+			ClientID:    clientID,
+		})
+		if err != nil {
+			return OAuthToken{}, err
+		}
+	}
+	token.Hash = hashActionSecret(access)
+
+	if err := s.store.SaveServiceToken(ctx, token); err != nil {
+		return OAuthToken{}, err
+	}
+
+	return OAuthToken{
+		AccessToken: access,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(s.accessTTL / time.Second),
+		Scope:       Scope(permissions),
+	}, nil
+}
+
+// serviceAdmin resolves the caller managing service accounts.
+// @param ctx context.Context for managing the scope of the operation.
+// @param token string containing the access token of the caller.
+// @param required uint PermQueryUsers to read service accounts, PermManageUsers to change them.
+// @return uint permissions of the caller and an error if it lacks the required one.
+func (s *AppService) serviceAdmin(ctx context.Context, token string, required uint) (uint, error) {
+	_, permissions, err := s.caller(ctx, token)
+	if err != nil {
+		return 0, err
+	}
+
+	if missing := required &^ permissions; missing != 0 {
+		return 0, &PermissionError{Err: oops.ErrWrongPermissions, Missing: missing,
+			Detail: "service accounts require " + Scope(missing)}
+	}
+
+	return permissions, nil
+}
+
+// validateServiceName trims the name of a service account and checks its length.
+func validateServiceName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", fmt.Errorf("%w: name must not be empty", oops.ErrInvalidServiceAccount)
+	}
+	if utf8.RuneCountInString(name) > MaxServiceAccountNameLength {
+		return "", fmt.Errorf("%w: name is longer than %d characters", oops.ErrInvalidServiceAccount, MaxServiceAccountNameLength)
+	}
+
+	return name, nil
+}
+
+// CreateServiceAccount creates a service account, requires PermManageUsers.
+// Its permissions are granted like the permissions of users, by a caller holding them and PermGrantPermissions.
+// @param ctx context.Context for managing the scope of the operation.
+// @param token string containing the access token of the admin user.
+// @param account ServiceAccount with the Name and Permissions of the account.
+// @return ServiceAccount stored, string client secret shown only once and an error if the request is not valid.
+func (s *AppService) CreateServiceAccount(ctx context.Context, token string, account ServiceAccount) (ServiceAccount, string, error) {
+	granter, err := s.serviceAdmin(ctx, token, PermManageUsers)
+	if err != nil {
+		return ServiceAccount{}, "", err
+	}
+
+	name, err := validateServiceName(account.Name)
+	if err != nil {
+		return ServiceAccount{}, "", err
+	}
+
+	if account.Permissions != 0 {
+		if err := Permissions.ValidateGrant(granter, 0, account.Permissions, 0); err != nil {
+			return ServiceAccount{}, "", err
+		}
+	}
+
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return ServiceAccount{}, "", err
+	}
+	secret, hash, err := newActionSecret()
+	if err != nil {
+		return ServiceAccount{}, "", err
+	}
+
+	now := time.Now()
+	created := ServiceAccount{
+		ClientID:    ClientIDPrefix + hex.EncodeToString(raw),
+		Name:        name,
+		SecretHash:  hash,
+		Permissions: account.Permissions,
+		Status:      StatusActive,
+		CreatedAt:   now,
+		RotatedAt:   now,
+	}
+
+	if err := s.store.SaveServiceAccount(ctx, created); err != nil {
+		return ServiceAccount{}, "", err
+	}
+
+	return created, secret, nil
+}
+
+// ServiceAccounts lists the service accounts, requires PermQueryUsers.
+// @param ctx context.Context for managing the scope of the operation.
+// @param token string containing the access token of the caller.
+// @return []ServiceAccount ordered by creation and an error if the caller may not read them.
+func (s *AppService) ServiceAccounts(ctx context.Context, token string) ([]ServiceAccount, error) {
+	if _, err := s.serviceAdmin(ctx, token, PermQueryUsers); err != nil {
+		return nil, err
+	}
+
+	return s.store.ServiceAccounts(ctx)
+}
+
+// ServiceAccount returns a service account, requires PermQueryUsers.
+// @param ctx context.Context for managing the scope of the operation.
+// @param token string containing the access token of the caller.
+// @param clientID string client ID of the service account.
+// @return ServiceAccount and oops.ErrNoServiceAccount if there is no such account.
+func (s *AppService) ServiceAccount(ctx context.Context, token string, clientID string) (ServiceAccount, error) {
+	if _, err := s.serviceAdmin(ctx, token, PermQueryUsers); err != nil {
+		return ServiceAccount{}, err
+	}
+
+	return s.store.ServiceAccount(ctx, clientID)
+}
+
+// EditServiceAccount renames, regrants, disables or enables a service account, requires PermManageUsers.
+// Disabling revokes the tokens issued to the account.
+// @param ctx context.Context for managing the scope of the operation.
+// @param token string containing the access token of the admin user.
+// @param clientID string client ID of the service account.
+// @param patch ServiceAccountPatch containing the fields to change.
+// @return ServiceAccount with the changes and an error if the operation fails.
+func (s *AppService) EditServiceAccount(ctx context.Context, token string, clientID string, patch ServiceAccountPatch) (ServiceAccount, error) {
+	granter, err := s.serviceAdmin(ctx, token, PermManageUsers)
+	if err != nil {
+		return ServiceAccount{}, err
+	}
+
+	account, err := s.store.ServiceAccount(ctx, clientID)
+	if err != nil {
+		return ServiceAccount{}, err
+	}
+
+	if patch.Name != nil {
+		if account.Name, err = validateServiceName(*patch.Name); err != nil {
+			return ServiceAccount{}, err
+		}
+	}
+
+	if patch.Permissions != nil && *patch.Permissions != account.Permissions {
+		if err := Permissions.ValidateGrant(granter, account.Permissions, *patch.Permissions, 0); err != nil {
+			return ServiceAccount{}, err
+		}
+		account.Permissions = *patch.Permissions
+	}
+
+	disabled := false
+	if patch.Status != nil {
+		if *patch.Status != StatusActive && *patch.Status != StatusDisabled {
+			return ServiceAccount{}, fmt.Errorf("%w: unknown status %q", oops.ErrInvalidServiceAccount, *patch.Status)
+		}
+		disabled = *patch.Status == StatusDisabled && account.Status != StatusDisabled
+		account.Status = *patch.Status
+	}
+
+	if err := s.store.ChangeServiceAccount(ctx, account); err != nil {
+		return ServiceAccount{}, err
+	}
+
+	if disabled {
+		if err := s.store.PopServiceTokens(ctx, clientID); err != nil {
+			return ServiceAccount{}, err
+		}
+	}
+
+	return account, nil
+}
+
+// RotateServiceSecret replaces the client secret of a service account, requires PermManageUsers.
+// The old secret stops working at once and the tokens issued with it are revoked.
+// @param ctx context.Context for managing the scope of the operation.
+// @param token string containing the access token of the admin user.
+// @param clientID string client ID of the service account.
+// @return string new client secret shown only once and oops.ErrNoServiceAccount if there is no such account.
+func (s *AppService) RotateServiceSecret(ctx context.Context, token string, clientID string) (string, error) {
+	if _, err := s.serviceAdmin(ctx, token, PermManageUsers); err != nil {
+		return "", err
+	}
+
+	account, err := s.store.ServiceAccount(ctx, clientID)
+	if err != nil {
+		return "", err
+	}
+
+	secret, hash, err := newActionSecret()
+	if err != nil {
+		return "", err
+	}
+	account.SecretHash = hash
+	account.RotatedAt = time.Now()
+
+	if err := s.store.ChangeServiceAccount(ctx, account); err != nil {
+		return "", err
+	}
+
+	if err := s.store.PopServiceTokens(ctx, clientID); err != nil {
+		return "", err
+	}
+
+	return secret, nil
+}
@@ -0,0 +1,117 @@
+package users
+
+import (
+	"context"
+
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/oops"
+)
+
+type clientInfoKey struct{}
+
+// WithClientInfo stores the client metadata recorded by Bind for new sessions.
+func WithClientInfo(ctx context.Context, client ClientInfo) context.Context {
+	return context.WithValue(ctx, clientInfoKey{}, client)
+}
+
+// ClientInfoFrom returns the client metadata of the context, empty if there is none.
+func ClientInfoFrom(ctx context.Context) ClientInfo {
+	client, _ := ctx.Value(clientInfoKey{}).(ClientInfo)
+	return client
+}
+
+// Logout revokes the presented access token together with its refresh token
+// and every other token of the same login.
+// @param ctx context.Context for managing the scope of the operation.
+// @param access string representing the access token of the session to end.
+// @return error indicating if the operation was successful or if an error occurred.
+func (s *AppService) Logout(ctx context.Context, access string) error {
+	if _, err := s.GetIDByToken(ctx, access); err != nil {
+		return err
+	}
+
+	token, err := s.store.CheckToken(ctx, access)
+	if err != oops.ErrDupAccess {
+		return oops.ErrTokenExistance
+	}
+
+	return s.store.RevokeFamily(ctx, token.Family)
+}
+
+// LogoutAll revokes every token bound to the owner of the access token.
+// @param ctx context.Context for managing the scope of the operation.
+// @param access string representing the access token of the user.
+// @return error indicating if the operation was successful or if an error occurred.
+func (s *AppService) LogoutAll(ctx context.Context, access string) error {
+	ID, err := s.GetIDByToken(ctx, access)
+	if err != nil {
+		return err
+	}
+
+	return s.store.RevokeUserTokens(ctx, ID)
+}
+
+// RevokeSessions revokes every token of another user, requires PermManageUsers.
+// @param ctx context.Context for managing the scope of the operation.
+// @param token string containing the access token of the admin user.
+// @param ID string representing the user whose sessions are revoked.
+// @return error indicating if the operation was successful or if an error occurred.
+func (s *AppService) RevokeSessions(ctx context.Context, token string, ID string) error {
+	adminID, permissions, err := s.caller(ctx, token)
+	if err != nil {
+		return err
+	}
+
+	if adminID != ID && (permissions&PermManageUsers) == 0 {
+		return oops.ErrWrongPermissions
+	}
+
+	if _, err := s.UserInfo(ctx, ID); err != nil {
+		return err
+	}
+
+	return s.store.RevokeUserTokens(ctx, ID)
+}
+
+// Sessions lists the active sessions of the owner of the access token.
+// @param ctx context.Context for managing the scope of the operation.
+// @param access string representing the access token of the user.
+// @return []Session ordered by last usage and an error if the operation fails.
+func (s *AppService) Sessions(ctx context.Context, access string) ([]Session, error) {
+	ID, err := s.GetIDByToken(ctx, access)
+	if err != nil {
+		return nil, err
+	}
+
+	token, _ := s.store.CheckToken(ctx, access)
+
+	sessions, err := s.store.Sessions(ctx, ID)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == token.Family
+	}
+
+	return sessions, nil
+}
+
+// RevokeSession ends one session of the owner of the access token.
+// @param ctx context.Context for managing the scope of the operation.
+// @param access string representing the access token of the user.
+// @param session string representing the ID of the session to revoke.
+// @return error oops.ErrNoSession if the user has no such session.
+func (s *AppService) RevokeSession(ctx context.Context, access string, session string) error {
+	sessions, err := s.Sessions(ctx, access)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range sessions {
+		if v.ID == session {
+			return s.store.RevokeFamily(ctx, session)
+		}
+	}
+
+	return oops.ErrNoSession
+}
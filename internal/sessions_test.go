@@ -0,0 +1,164 @@
+package users_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	users "github.com/mipt-kp-2024-go-beer/user-service/internal"
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/oops"
+)
+
+// login starts another session of the user from the client.
+func login(t *testing.T, env *testEnv, name string, client users.ClientInfo) users.Token {
+	t.Helper()
+
+	token, err := env.service.CreateToken(users.WithClientInfo(context.Background(), client), name, name+"-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token
+}
+
+// alive asserts whether the access and refresh tokens of the session still work.
+func alive(t *testing.T, env *testEnv, what string, token users.Token, want bool) {
+	t.Helper()
+	ctx := context.Background()
+
+	if _, err := env.service.GetIDByToken(ctx, token.Access); (err == nil) != want {
+		t.Errorf("GetIDByToken() of %s error = %v, want the session alive %v", what, err, want)
+	}
+	if want {
+		return
+	}
+	// a revoked session cannot be refreshed back to life
+	if _, err := env.service.RefreshToken(ctx, token.Access, token.Refresh); err == nil {
+		t.Errorf("RefreshToken() of %s succeeded", what)
+	}
+}
+
+func TestLogout(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t)
+	env.user(t, "alice", 0)
+	_, bob := env.user(t, "bob", 0)
+	laptop := login(t, env, "alice", users.ClientInfo{Device: "laptop"})
+	phone := login(t, env, "alice", users.ClientInfo{Device: "phone"})
+
+	if err := env.service.Logout(ctx, laptop.Access); err != nil {
+		t.Fatalf("Logout() error = %v", err)
+	}
+	alive(t, env, "the logged out session", laptop, false)
+	alive(t, env, "another session of the user", phone, true)
+	if err := env.service.Logout(ctx, laptop.Access); err == nil {
+		t.Error("Logout() of a logged out session succeeded")
+	}
+
+	tablet := login(t, env, "alice", users.ClientInfo{Device: "tablet"})
+	if status := call(t, env.public, http.MethodDelete, "/v1/sessions", phone.Access, nil, nil); status != http.StatusNoContent {
+		t.Fatalf("DELETE /v1/sessions = %d, want 204", status)
+	}
+	alive(t, env, "the session logging out everywhere", phone, false)
+	alive(t, env, "another session of the user logged out everywhere", tablet, false)
+	alive(t, env, "a session of another user", bob, true)
+}
+
+func TestRevokeSessions(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t)
+	ID, alice := env.user(t, "alice", 0)
+	_, reader := env.user(t, "reader", users.PermQueryUsers)
+	_, manager := env.user(t, "manager", users.PermQueryUsers|users.PermManageUsers)
+
+	if err := env.service.RevokeSessions(ctx, reader.Access, ID); !errors.Is(err, oops.ErrWrongPermissions) {
+		t.Errorf("RevokeSessions() without manage_users error = %v, want ErrWrongPermissions", err)
+	}
+	alive(t, env, "a session after a refused revocation", alice, true)
+
+	if status := call(t, env.public, http.MethodDelete, "/v1/users/"+ID+"/sessions", manager.Access, nil, nil); status != http.StatusNoContent {
+		t.Fatalf("DELETE /v1/users/{id}/sessions = %d, want 204", status)
+	}
+	alive(t, env, "a session revoked by an admin", alice, false)
+	alive(t, env, "the session of the admin", manager, true)
+
+	if err := env.service.RevokeSessions(ctx, manager.Access, "missing"); !errors.Is(err, oops.ErrNoUser) {
+		t.Errorf("RevokeSessions() of a missing user error = %v, want ErrNoUser", err)
+	}
+
+	// users may end their own sessions without manage_users
+	if err := env.service.RevokeSessions(ctx, reader.Access, mustID(t, env, reader.Access)); err != nil {
+		t.Errorf("RevokeSessions() of the caller itself error = %v", err)
+	}
+	alive(t, env, "a session revoked by its user", reader, false)
+}
+
+func TestSessionList(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t)
+	env.user(t, "alice", 0)
+	_, bob := env.user(t, "bob", 0)
+	laptop := login(t, env, "alice", users.ClientInfo{IP: "198.51.100.1", UserAgent: "Firefox", Device: "laptop"})
+	phone := login(t, env, "alice", users.ClientInfo{IP: "203.0.113.7", UserAgent: "Safari", Device: "phone"})
+
+	list := func(token users.Token) map[string]users.Session {
+		t.Helper()
+		var body struct {
+			Sessions []users.Session `json:"sessions"`
+		}
+		if status := call(t, env.public, http.MethodGet, "/v1/sessions", token.Access, nil, &body); status != http.StatusOK {
+			t.Fatalf("GET /v1/sessions = %d, want 200", status)
+		}
+		sessions := make(map[string]users.Session)
+		for _, session := range body.Sessions {
+			sessions[session.Device] = session
+		}
+		return sessions
+	}
+
+	// env.user started a session of its own before
+	sessions := list(phone)
+	if len(sessions) != 3 {
+		t.Fatalf("GET /v1/sessions listed %d sessions, want 3: %+v", len(sessions), sessions)
+	}
+	if got := sessions["phone"]; got.IP != "203.0.113.7" || got.UserAgent != "Safari" || !got.Current {
+		t.Errorf("listed current session = %+v, want the phone session from 203.0.113.7 with Safari", got)
+	}
+	if got := sessions["laptop"]; got.IP != "198.51.100.1" || got.UserAgent != "Firefox" || got.Current {
+		t.Errorf("listed other session = %+v, want the laptop session from 198.51.100.1 with Firefox, not current", got)
+	}
+	if got := sessions["phone"]; got.CreatedAt.IsZero() || got.LastUsedAt.Before(got.CreatedAt) {
+		t.Errorf("listed session created at %v, last used at %v, want both set", got.CreatedAt, got.LastUsedAt)
+	}
+
+	// the last usage is recorded once per interval, not on every request
+	for i := 0; i < 3; i++ {
+		mustID(t, env, laptop.Access)
+	}
+	if got := list(phone)["laptop"].LastUsedAt; !got.Equal(sessions["laptop"].LastUsedAt) {
+		t.Errorf("last usage of a session used within %v = %v, want it kept at %v",
+			users.SessionTouchInterval, got, sessions["laptop"].LastUsedAt)
+	}
+
+	// sessions of other users cannot be ended through their ID
+	family := sessions["laptop"].ID
+	if err := env.service.RevokeSession(ctx, bob.Access, family); !errors.Is(err, oops.ErrNoSession) {
+		t.Errorf("RevokeSession() of a session of another user error = %v, want ErrNoSession", err)
+	}
+	alive(t, env, "a session another user tried to end", laptop, true)
+
+	if status := call(t, env.public, http.MethodDelete, "/v1/sessions/"+family, phone.Access, nil, nil); status != http.StatusNoContent {
+		t.Fatalf("DELETE /v1/sessions/{id} = %d, want 204", status)
+	}
+	alive(t, env, "the ended session", laptop, false)
+	alive(t, env, "the session ending it", phone, true)
+	if _, ok := list(phone)["laptop"]; ok {
+		t.Error("GET /v1/sessions still lists the ended session")
+	}
+
+	if status := call(t, env.public, http.MethodDelete, "/v1/sessions/current", phone.Access, nil, nil); status != http.StatusNoContent {
+		t.Fatalf("DELETE /v1/sessions/current = %d, want 204", status)
+	}
+	alive(t, env, "the current session after ending it", phone, false)
+}
@@ -3,19 +3,154 @@ package users
 import (
 	"context"
 	"time"
+
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/jwt"
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/webauthn"
 )
 
 type User struct {
-	ID          string
-	Login       string
-	Password    string
-	Permissions uint
+	ID            string
+	Login         string
+	Password      string
+	Permissions   uint     // direct grants, roles add to them
+	Roles         []string // names of assigned roles
+	Status        string   // StatusActive or StatusDisabled
+	Version       int64    // incremented by every change, a change based on an older version is rejected
+	Email         string   // normalized address, unique when not empty
+	EmailVerified bool     // the owner of Email confirmed it, reset whenever Email changes
+	DisplayName   string
+	Attributes    map[string]string // free-form profile data, bounded by MaxAttributes
+	CreatedAt     time.Time
+	UpdatedAt     time.Time // time of the last change, set by the store
+}
+
+// UserPatch lists the fields of a user to change, nil fields are left untouched.
+type UserPatch struct {
+	Login           *string            `json:"login,omitempty"`
+	Password        *string            `json:"password,omitempty"`
+	CurrentPassword *string            `json:"current_password,omitempty"` // required to change one's own password
+	Status          *string            `json:"status,omitempty"`           // StatusActive or StatusDisabled, admins only
+	Email           *string            `json:"email,omitempty"`            // empty string removes the email
+	DisplayName     *string            `json:"display_name,omitempty"`
+	Attributes      map[string]*string `json:"attributes,omitempty"` // merged into the attributes, null removes the key
+	Version         int64              `json:"-"`                    // expected version of the user, 0 skips the check
+}
+
+// ActionToken is a single-use token mailed to a user to confirm an action, only its hash is stored.
+type ActionToken struct {
+	Hash      string
+	UserID    string
+	Purpose   string // one of the Purpose* constants
+	Email     string // address the token was sent to
+	ExpiresAt time.Time
+}
+
+// Passkey is a WebAuthn credential of a user, only its public key is stored.
+type Passkey struct {
+	ID         string    `json:"id"` // base64url credential ID
+	UserID     string    `json:"-"`
+	Name       string    `json:"name"`
+	PublicKey  []byte    `json:"-"` // COSE key
+	SignCount  uint32    `json:"sign_count"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+}
+
+// PersonalToken is a long-lived access token a user creates for scripts, only the hash of its secret is stored.
+type PersonalToken struct {
+	ID          string    `json:"id"`
+	UserID      string    `json:"-"`
+	Name        string    `json:"name"`
+	Hash        string    `json:"-"`
+	Permissions uint      `json:"permissions"` // scope of the token, bounded by the current permissions of the owner
+	MFA         bool      `json:"mfa"`         // created by a session confirmed with a second factor
+	CreatedAt   time.Time `json:"created_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	LastUsedAt  time.Time `json:"last_used_at"`
+}
+
+// ServiceAccount is the identity of another service, authenticated by its client ID and secret.
+// Only the hash of the secret is stored.
+type ServiceAccount struct {
+	ClientID    string    `json:"client_id"` // starts with ClientIDPrefix, never equal to a user ID
+	Name        string    `json:"name"`
+	SecretHash  string    `json:"-"`
+	Permissions uint      `json:"permissions"`
+	Status      string    `json:"status"` // StatusActive or StatusDisabled
+	CreatedAt   time.Time `json:"created_at"`
+	RotatedAt   time.Time `json:"rotated_at"` // time the current secret was set
+}
+
+// ServiceAccountPatch lists the fields of a service account to change, nil fields are left untouched.
+type ServiceAccountPatch struct {
+	Name        *string `json:"name,omitempty"`
+	Permissions *uint   `json:"permissions,omitempty"`
+	Status      *string `json:"status,omitempty"` // disabling revokes the issued tokens
+}
+
+// ServiceToken is an access token issued to a service account, only its hash is stored.
+type ServiceToken struct {
+	Hash        string
+	ClientID    string
+	Permissions uint // scope granted at issuance, bounded by the current permissions of the account
+	IssuedAt    time.Time
+	ExpiresAt   time.Time
+}
+
+// Role is a named bundle of permission flags.
+type Role struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Permissions uint   `json:"permissions"`
 }
 
 type Token struct {
-	Access     string
-	Refresh    string
-	Expiration time.Time
+	Access            string
+	Refresh           string
+	IssuedAt          time.Time `json:"-"`
+	Expiration        time.Time
+	RefreshExpiration time.Time
+	Family            string `json:"-"` // token family started by the login, shared by every rotation
+	Consumed          bool   `json:"-"` // refresh token was already exchanged for a new pair
+}
+
+// SessionTouchInterval is how often the last usage of a session is recorded at most,
+// so that a busy session does not write to the store on every request.
+const SessionTouchInterval = time.Minute
+
+// Session is a token family as seen by its owner: one login on one device.
+type Session struct {
+	ID         string    `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+	Device     string    `json:"device,omitempty"`
+	MFA        bool      `json:"mfa"`     // the login was confirmed with a second factor
+	Current    bool      `json:"current"` // session of the token used for the request
+}
+
+// ClientInfo describes the client a session is created for.
+type ClientInfo struct {
+	IP        string
+	UserAgent string
+	Device    string // optional name supplied by the client
+	MFA       bool   // the login was confirmed with a second factor
+}
+
+// TOTPEnrollment is the TOTP secret of a user, unconfirmed until the user proves its app generates the codes.
+type TOTPEnrollment struct {
+	Secret    string // base32
+	Confirmed bool
+	LastStep  int64 // time step of the last accepted code, codes are single-use
+}
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	ID          string
+	Permissions uint   // effective permissions of the caller
+	Token       string // access token the caller was authenticated with
+	Service     bool   // the caller is a service account and ID is its client ID
 }
 
 type Service interface {
@@ -24,30 +159,132 @@ type Service interface {
 	IsExpired(ctx context.Context, access string) (bool, error)
 	DeleteToken(ctx context.Context, access string) error
 	DeleteUser(ctx context.Context, ID string) error
+	RemoveUser(ctx context.Context, token string, ID string) error
 	NewUser(ctx context.Context, user User) (string, error)
 	GetIDByToken(ctx context.Context, access string) (string, error)
 	CreateToken(ctx context.Context, login string, password string) (Token, error)
 	Bind(ctx context.Context, token Token, ID string) error
 	UserInfo(ctx context.Context, ID string) (User, error)
-	EditUser(ctx context.Context, token string, user User) (User, error)
-	GivePermission(ctx context.Context, token string, ID string, Permissions uint) error
+	GetUser(ctx context.Context, token string, ID string) (User, error)
+	EditUser(ctx context.Context, token string, ID string, patch UserPatch) (User, error)
+	GivePermission(ctx context.Context, token string, ID string, Permissions uint, version int64) (int64, error)
 	RefreshToken(ctx context.Context, access string, refresh string) (Token, error)
+	JWKS(ctx context.Context) (jwt.JWKS, error)
+	Introspect(ctx context.Context, access string) (Introspection, error)
+	Logout(ctx context.Context, access string) error
+	LogoutAll(ctx context.Context, access string) error
+	RevokeSessions(ctx context.Context, token string, ID string) error
+	Sessions(ctx context.Context, access string) ([]Session, error)
+	RevokeSession(ctx context.Context, access string, session string) error
+	EffectivePermissions(ctx context.Context, ID string) (uint, error)
+	Roles(ctx context.Context, token string) ([]Role, error)
+	CreateRole(ctx context.Context, token string, role Role) error
+	EditRole(ctx context.Context, token string, role Role) error
+	DeleteRole(ctx context.Context, token string, name string) error
+	AssignRole(ctx context.Context, token string, ID string, role string) error
+	UnassignRole(ctx context.Context, token string, ID string, role string) error
+	Authorize(ctx context.Context, access string, checks []Check) (string, []Decision, error)
+	ListUsers(ctx context.Context, token string, query UserQuery, cursor string) (UserPage, error)
+	SendVerification(ctx context.Context, token string, ID string) error
+	VerifyEmail(ctx context.Context, secret string) error
+	ForgotPassword(ctx context.Context, login string) error
+	ResetPassword(ctx context.Context, secret string, password string) error
+	Unlock(ctx context.Context, token string, ID string) error
+	MFAStatus(ctx context.Context, token string, ID string) (MFAStatus, error)
+	EnrollTOTP(ctx context.Context, token string, ID string) (TOTPSetup, error)
+	ConfirmTOTP(ctx context.Context, token string, ID string, code string) ([]string, error)
+	DisableTOTP(ctx context.Context, token string, ID string, code string) error
+	VerifyMFA(ctx context.Context, challenge string, code string) (Token, error)
+	MFAPolicy(ctx context.Context, token string) (uint, error)
+	SetMFAPolicy(ctx context.Context, token string, permissions uint) error
+	BeginRegistration(ctx context.Context, token string, ID string) (webauthn.CreationOptions, error)
+	FinishRegistration(ctx context.Context, token string, ID string, name string, response webauthn.RegistrationResponse) (Passkey, error)
+	Passkeys(ctx context.Context, token string, ID string) ([]Passkey, error)
+	DeletePasskey(ctx context.Context, token string, ID string, passkey string) error
+	BeginPasskeyLogin(ctx context.Context, login string) (webauthn.RequestOptions, error)
+	FinishPasskeyLogin(ctx context.Context, response webauthn.AssertionResponse) (Token, error)
+	CreatePersonalToken(ctx context.Context, token string, ID string, request PersonalToken) (PersonalToken, string, error)
+	PersonalTokens(ctx context.Context, token string, ID string) ([]PersonalToken, error)
+	RevokePersonalToken(ctx context.Context, token string, ID string, personal string) error
+	ClientCredentials(ctx context.Context, clientID string, secret string, scope string) (OAuthToken, error)
+	CreateServiceAccount(ctx context.Context, token string, account ServiceAccount) (ServiceAccount, string, error)
+	ServiceAccounts(ctx context.Context, token string) ([]ServiceAccount, error)
+	ServiceAccount(ctx context.Context, token string, clientID string) (ServiceAccount, error)
+	EditServiceAccount(ctx context.Context, token string, clientID string, patch ServiceAccountPatch) (ServiceAccount, error)
+	RotateServiceSecret(ctx context.Context, token string, clientID string) (string, error)
+	Authenticate(ctx context.Context, access string) (Principal, error)
 }
 
 type Store interface {
-	LoadUsers(ctx context.Context) ([]User, error)
-	CheckUser(ctx context.Context, user User) (string, error)
+	LoadUsers(ctx context.Context, query UserQuery) ([]User, error)
+	UserByLogin(ctx context.Context, login string) (User, error)
 	SaveUser(ctx context.Context, user User) (string, error)
 	User(ctx context.Context, ID string) (User, error)
 	PopUser(ctx context.Context, ID string) error
 	ChangeUser(ctx context.Context, user User) (User, error)
-	SetPermission(ctx context.Context, ID string, Permissions uint) error
+	SetPermission(ctx context.Context, ID string, Permissions uint, version int64) (int64, error)
+	SetPassword(ctx context.Context, ID string, password string) error
+	EffectivePermissions(ctx context.Context, ID string) (uint, error)
+	VerifyEmail(ctx context.Context, ID string, email string) error
+
+	SaveActionToken(ctx context.Context, token ActionToken) error
+	ActionToken(ctx context.Context, hash string, purpose string) (ActionToken, error)
+	ConsumeActionToken(ctx context.Context, hash string, purpose string) (ActionToken, error)
+	PopActionTokens(ctx context.Context, ID string, purpose string) error
+
+	TOTP(ctx context.Context, ID string) (TOTPEnrollment, error)
+	SaveTOTP(ctx context.Context, ID string, secret string) error
+	ConfirmTOTP(ctx context.Context, ID string, step int64) error
+	UseTOTPStep(ctx context.Context, ID string, step int64) error
+	PopTOTP(ctx context.Context, ID string) error
+	SaveRecoveryCodes(ctx context.Context, ID string, hashes []string) error
+	UseRecoveryCode(ctx context.Context, ID string, hash string) error
+	CountRecoveryCodes(ctx context.Context, ID string) (int, error)
+	FamilyMFA(ctx context.Context, family string) (bool, error)
+	MFAPolicy(ctx context.Context) (uint, error)
+	SetMFAPolicy(ctx context.Context, permissions uint) error
+
+	SavePasskey(ctx context.Context, passkey Passkey) error
+	Passkeys(ctx context.Context, ID string) ([]Passkey, error)
+	Passkey(ctx context.Context, passkey string) (Passkey, error)
+	UsePasskey(ctx context.Context, passkey string, signCount uint32) error
+	PopPasskey(ctx context.Context, ID string, passkey string) error
+
+	SavePersonalToken(ctx context.Context, token PersonalToken) error
+	PersonalTokens(ctx context.Context, ID string) ([]PersonalToken, error)
+	UsePersonalToken(ctx context.Context, hash string) (PersonalToken, error)
+	PopPersonalToken(ctx context.Context, ID string, token string) error
+	PopPersonalTokens(ctx context.Context, ID string) error
+
+	SaveServiceAccount(ctx context.Context, account ServiceAccount) error
+	ServiceAccounts(ctx context.Context) ([]ServiceAccount, error)
+	ServiceAccount(ctx context.Context, clientID string) (ServiceAccount, error)
+	ChangeServiceAccount(ctx context.Context, account ServiceAccount) error
+	SaveServiceToken(ctx context.Context, token ServiceToken) error
+	ServiceToken(ctx context.Context, hash string) (ServiceToken, error)
+	PopServiceTokens(ctx context.Context, clientID string) error
+
+	LoadRoles(ctx context.Context) ([]Role, error)
+	Role(ctx context.Context, name string) (Role, error)
+	SaveRole(ctx context.Context, role Role) error
+	ChangeRole(ctx context.Context, role Role) error
+	PopRole(ctx context.Context, name string) error
+	AssignRole(ctx context.Context, ID string, role string) error
+	UnassignRole(ctx context.Context, ID string, role string) error
 
 	SaveToken(ctx context.Context, token Token, ID string) (err error)
 	TokenExpired(ctx context.Context, access string) (bool, error)
 	PopToken(ctx context.Context, access string) error
 	CheckToken(ctx context.Context, access string) (Token, error)
 	LoadTokens(ctx context.Context) ([]Token, error)
+	CreateFamily(ctx context.Context, ID string, client ClientInfo) (string, error)
+	TouchFamily(ctx context.Context, family string) error
+	Sessions(ctx context.Context, ID string) ([]Session, error)
+	TokenByRefresh(ctx context.Context, refresh string) (Token, string, error)
+	ConsumeRefresh(ctx context.Context, refresh string) error
+	RevokeFamily(ctx context.Context, family string) error
+	RevokeUserTokens(ctx context.Context, ID string) error
+	Introspect(ctx context.Context, access string) (Token, User, error)
 
 	GetSessionID(ctx context.Context, access string) (string, error)
 }
@@ -0,0 +1,178 @@
+package memory
+
+import (
+	"context"
+	"sort"
+
+	users "github.com/mipt-kp-2024-go-beer/user-service/internal"
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/oops"
+)
+
+// Load all roles ordered by name
+// @param ctx context.Context for managing the scope of the operation.
+func (s *Storage) LoadRoles(ctx context.Context) ([]users.Role, error) {
+	s.Roles.mux.RLock()
+	defer s.Roles.mux.RUnlock()
+
+	output := make([]users.Role, 0, len(s.Roles.Roles))
+	for _, v := range s.Roles.Roles {
+		output = append(output, v)
+	}
+
+	sort.Slice(output, func(i, j int) bool {
+		return output[i].Name < output[j].Name
+	})
+
+	return output, nil
+}
+
+// get role by name
+// @param ctx context.Context for managing the scope of the operation.
+// @param name string role name
+func (s *Storage) Role(ctx context.Context, name string) (users.Role, error) {
+	s.Roles.mux.RLock()
+	defer s.Roles.mux.RUnlock()
+
+	role, ok := s.Roles.Roles[name]
+	if !ok {
+		return users.Role{}, oops.ErrNoRole
+	}
+
+	return role, nil
+}
+
+// Save role if it is not in the storage
+// @param ctx context.Context for managing the scope of the operation.
+// @param role users.Role role to be added
+func (s *Storage) SaveRole(ctx context.Context, role users.Role) error {
+	s.Roles.mux.Lock()
+	defer s.Roles.mux.Unlock()
+
+	if _, ok := s.Roles.Roles[role.Name]; ok {
+		return oops.ErrDuplicateRole
+	}
+
+	s.Roles.Roles[role.Name] = role
+	return nil
+}
+
+// change description and permissions of role
+// @param ctx context.Context for managing the scope of the operation.
+// @param role users.Role role to be changed
+func (s *Storage) ChangeRole(ctx context.Context, role users.Role) error {
+	s.Roles.mux.Lock()
+	defer s.Roles.mux.Unlock()
+
+	if _, ok := s.Roles.Roles[role.Name]; !ok {
+		return oops.ErrNoRole
+	}
+
+	s.Roles.Roles[role.Name] = role
+	return nil
+}
+
+// delete role and its assignments
+// @param ctx context.Context for managing the scope of the operation.
+// @param name string role name
+func (s *Storage) PopRole(ctx context.Context, name string) error {
+	s.Roles.mux.Lock()
+	if _, ok := s.Roles.Roles[name]; !ok {
+		s.Roles.mux.Unlock()
+		return oops.ErrNoRole
+	}
+
+	delete(s.Roles.Roles, name)
+	var members []string
+	for ID, assigned := range s.Roles.Assigned {
+		if assigned[name] {
+			members = append(members, ID)
+			delete(assigned, name)
+		}
+	}
+	s.Roles.mux.Unlock()
+
+	for _, ID := range members {
+		s.touchUser(ID)
+	}
+	return nil
+}
+
+// give role to user
+// @param ctx context.Context for managing the scope of the operation.
+// @param ID string user ID
+// @param role string role name
+func (s *Storage) AssignRole(ctx context.Context, ID string, role string) error {
+	if _, err := s.User(ctx, ID); err != nil {
+		return err
+	}
+
+	s.Roles.mux.Lock()
+	if _, ok := s.Roles.Roles[role]; !ok {
+		s.Roles.mux.Unlock()
+		return oops.ErrNoRole
+	}
+
+	if s.Roles.Assigned[ID] == nil {
+		s.Roles.Assigned[ID] = make(map[string]bool)
+	}
+	assigned := s.Roles.Assigned[ID][role]
+	s.Roles.Assigned[ID][role] = true
+	s.Roles.mux.Unlock()
+
+	if !assigned {
+		s.touchUser(ID)
+	}
+	return nil
+}
+
+// take role from user
+// @param ctx context.Context for managing the scope of the operation.
+// @param ID string user ID
+// @param role string role name
+func (s *Storage) UnassignRole(ctx context.Context, ID string, role string) error {
+	s.Roles.mux.Lock()
+	if !s.Roles.Assigned[ID][role] {
+		s.Roles.mux.Unlock()
+		return oops.ErrNoRole
+	}
+
+	delete(s.Roles.Assigned[ID], role)
+	s.Roles.mux.Unlock()
+
+	s.touchUser(ID)
+	return nil
+}
+
+// get direct permissions of user combined with permissions of its roles
+// @param ctx context.Context for managing the scope of the operation.
+// @param ID string user ID
+func (s *Storage) EffectivePermissions(ctx context.Context, ID string) (uint, error) {
+	user, err := s.User(ctx, ID)
+	if err != nil {
+		return 0, err
+	}
+
+	s.Roles.mux.RLock()
+	defer s.Roles.mux.RUnlock()
+
+	permissions := user.Permissions
+	for _, role := range user.Roles {
+		permissions |= s.Roles.Roles[role].Permissions
+	}
+
+	return permissions, nil
+}
+
+// userRoles lists the sorted role names of user
+func (s *Storage) userRoles(ID string) []string {
+	s.Roles.mux.RLock()
+	defer s.Roles.mux.RUnlock()
+
+	roles := make([]string, 0, len(s.Roles.Assigned[ID]))
+	for role := range s.Roles.Assigned[ID] {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+
+	return roles
+}
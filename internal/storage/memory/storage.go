@@ -2,8 +2,13 @@ package memory
 
 import (
 	"context"
-	"fmt"
+	"crypto/rand"
+	"encoding/hex"
+	"maps"
+	"slices"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -11,39 +16,131 @@ import (
 	"github.com/mipt-kp-2024-go-beer/user-service/internal/oops"
 )
 
-// UserValues holds the information for a user, including their ID, password, and permissions.
+// UserValues holds the information for a user, including their login, password, and permissions.
 type UserValues struct {
-	ID          string
-	Password    string
-	Permissions uint
+	Login         string
+	Password      string
+	Permissions   uint
+	Status        string
+	Version       int64
+	Email         string
+	EmailVerified bool
+	DisplayName   string
+	Attributes    map[string]string
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
 }
 
-// UserDb is a thread-safe structure that stores user information indexed by their login.
+// UserDb is a thread-safe structure that stores user information indexed by their ID.
 type UserDb struct {
 	mux sync.RWMutex
-	// user login is used as a key
-	// as we need to generate ID for every person
+	// user ID is used as a key
 	Users map[string]UserValues
+	// login is used as a key, value is the user ID
+	Logins map[string]string
+	// normalized email is used as a key, value is the user ID
+	Emails map[string]string
 }
 
 // Token represents an authentication token associated with a user.
 type Token struct {
 	// acess token is used as a key
-	refresh    string
-	expiration time.Time
-	user       string
+	refresh           string
+	issuedAt          time.Time
+	expiration        time.Time
+	refreshExpiration time.Time
+	family            string
+	consumed          bool
+	user              string
 }
 
 // TokenDb is a thread-safe structure that stores tokens indexed by their access tokens.
 type TokenDb struct {
 	mux    sync.RWMutex
 	Tokens map[string]Token
+	// token family ID is used as a key
+	Families map[string]Family
 }
 
-// Storage combines UserDb and TokenDb to provide a unified storage solution for users and tokens.
+// Family represents a token family, the session started by one login.
+type Family struct {
+	user    string
+	session users.Session
+}
+
+// export converts the stored token to users.Token
+func (t Token) export(access string) users.Token {
+	return users.Token{
+		Access:            access,
+		Refresh:           t.refresh,
+		IssuedAt:          t.issuedAt,
+		Expiration:        t.expiration,
+		RefreshExpiration: t.refreshExpiration,
+		Family:            t.family,
+		Consumed:          t.consumed,
+	}
+}
+
+// RoleDb is a thread-safe structure that stores roles indexed by name and their assignments.
+type RoleDb struct {
+	mux   sync.RWMutex
+	Roles map[string]users.Role
+	// user ID is used as a key, value is the set of assigned role names
+	Assigned map[string]map[string]bool
+}
+
+// ActionDb is a thread-safe structure that stores action tokens indexed by their hash.
+type ActionDb struct {
+	mux    sync.Mutex
+	Tokens map[string]users.ActionToken
+}
+
+// AttemptDb is a thread-safe structure that stores failed login attempts indexed by their key.
+type AttemptDb struct {
+	mux      sync.Mutex
+	Attempts map[string]users.Attempts
+}
+
+// MFADb is a thread-safe structure that stores second factors indexed by user ID and the MFA policy.
+type MFADb struct {
+	mux  sync.Mutex
+	TOTP map[string]users.TOTPEnrollment
+	// user ID is used as a key, value is the set of unused recovery code hashes
+	Recovery map[string]map[string]bool
+	Policy   uint
+}
+
+// PasskeyDb is a thread-safe structure that stores passkeys indexed by their credential ID.
+type PasskeyDb struct {
+	mux      sync.Mutex
+	Passkeys map[string]users.Passkey
+}
+
+// PersonalDb is a thread-safe structure that stores personal access tokens indexed by the hash of their secret.
+type PersonalDb struct {
+	mux    sync.Mutex
+	Tokens map[string]users.PersonalToken
+}
+
+// ServiceDb is a thread-safe structure that stores service accounts indexed by client ID
+// and their access tokens indexed by hash.
+type ServiceDb struct {
+	mux      sync.Mutex
+	Accounts map[string]users.ServiceAccount
+	Tokens   map[string]users.ServiceToken
+}
+
+// Storage combines UserDb, TokenDb, RoleDb, ActionDb, AttemptDb, MFADb, PasskeyDb, PersonalDb and ServiceDb to provide a unified storage solution for users and tokens.
 type Storage struct {
-	Users  UserDb
-	Tokens TokenDb
+	Users    UserDb
+	Tokens   TokenDb
+	Roles    RoleDb
+	Actions  ActionDb
+	Failures AttemptDb
+	MFA      MFADb
+	Keys     PasskeyDb
+	Personal PersonalDb
+	Services ServiceDb
 }
 
 // curID is a global variable for generating unique IDs.
@@ -51,44 +148,141 @@ var curID = 0
 
 // Storage constructor
 func NewStorage() *Storage {
-	return &Storage{UserDb{Users: make(map[string]UserValues)}, TokenDb{Tokens: make(map[string]Token)}}
+	storage := &Storage{
+		Users:    UserDb{Users: make(map[string]UserValues), Logins: make(map[string]string), Emails: make(map[string]string)},
+		Tokens:   TokenDb{Tokens: make(map[string]Token), Families: make(map[string]Family)},
+		Roles:    RoleDb{Roles: make(map[string]users.Role), Assigned: make(map[string]map[string]bool)},
+		Actions:  ActionDb{Tokens: make(map[string]users.ActionToken)},
+		Failures: AttemptDb{Attempts: make(map[string]users.Attempts)},
+		MFA:      MFADb{TOTP: make(map[string]users.TOTPEnrollment), Recovery: make(map[string]map[string]bool)},
+		Keys:     PasskeyDb{Passkeys: make(map[string]users.Passkey)},
+		Personal: PersonalDb{Tokens: make(map[string]users.PersonalToken)},
+		Services: ServiceDb{Accounts: make(map[string]users.ServiceAccount), Tokens: make(map[string]users.ServiceToken)},
+	}
+
+	for _, role := range users.DefaultRoles {
+		storage.Roles.Roles[role.Name] = role
+	}
+
+	return storage
 }
 
-// Load users table to user by user with corresponding permissions
+// Load one page of users matching the query
 // @param ctx context.Context for managing the scope of the operation.
-func (s *Storage) LoadUsers(ctx context.Context) ([]users.User, error) {
+// @param query users.UserQuery filters, order and position of the page
+func (s *Storage) LoadUsers(ctx context.Context, query users.UserQuery) ([]users.User, error) {
+	byID := strings.TrimPrefix(query.Sort, "-") == users.SortID
+	desc := strings.HasPrefix(query.Sort, "-")
+
+	// precedes tells whether user a comes before user b in the order of the query, ID breaks ties
+	precedes := func(aKey, aID, bKey, bID string) bool {
+		if desc {
+			aKey, aID, bKey, bID = bKey, bID, aKey, aID
+		}
+		if !byID && aKey != bKey {
+			return aKey < bKey
+		}
+		return compareIDs(aID, bID) < 0
+	}
+
+	type candidate struct {
+		ID    string
+		Login string
+	}
+
 	s.Users.mux.RLock()
 	defer s.Users.mux.RUnlock()
-	output := make([]users.User, len(s.Users.Users))
 
-	idx := 0
-	for i, v := range s.Users.Users {
-		output[idx].Login = i
-		output[idx].ID = v.ID
-		output[idx].Password = v.Password
-		output[idx].Permissions = v.Permissions
-		idx++
+	// the page is kept sorted and never grows beyond the limit, the rest of the users is not copied
+	page := make([]candidate, 0, max(query.Limit, 0)+1)
+	s.Roles.mux.RLock()
+	for ID, v := range s.Users.Users {
+		if !strings.HasPrefix(v.Login, query.LoginPrefix) {
+			continue
+		}
+		if query.Status != "" && v.Status != query.Status {
+			continue
+		}
+		if query.Email != "" && v.Email != query.Email {
+			continue
+		}
+		if query.Role != "" && !s.Roles.Assigned[ID][query.Role] {
+			continue
+		}
+		if query.Permission != 0 {
+			permissions := v.Permissions
+			for role := range s.Roles.Assigned[ID] {
+				permissions |= s.Roles.Roles[role].Permissions
+			}
+			if permissions&query.Permission != query.Permission {
+				continue
+			}
+		}
+		if query.After != nil && !precedes(query.After.Key, query.After.ID, v.Login, ID) {
+			continue
+		}
+
+		i := sort.Search(len(page), func(i int) bool { return precedes(v.Login, ID, page[i].Login, page[i].ID) })
+		if i >= query.Limit {
+			continue
+		}
+		page = slices.Insert(page, i, candidate{ID: ID, Login: v.Login})
+		if len(page) > query.Limit {
+			page = page[:query.Limit]
+		}
+	}
+	s.Roles.mux.RUnlock()
+
+	output := make([]users.User, 0, len(page))
+	for _, c := range page {
+		output = append(output, s.exportUser(c.ID, s.Users.Users[c.ID]))
 	}
 
 	return output, nil
 }
 
-// Check if user is present in current project
-// @param ctx context.Context for managing the scope of the operation.
-// @param user users.User user to be checked
-func (s *Storage) CheckUser(ctx context.Context, user users.User) (id string, err error) {
-	s.Users.mux.Lock()
-	defer s.Users.mux.Unlock()
-	val, ok := s.Users.Users[user.Login]
-	if !ok {
-		return val.ID, oops.ErrNoUser
+// compareIDs orders numeric IDs by value
+func compareIDs(a string, b string) int {
+	x, errA := strconv.Atoi(a)
+	y, errB := strconv.Atoi(b)
+	if errA != nil || errB != nil {
+		return strings.Compare(a, b)
 	}
 
-	if val.Password != user.Password {
-		return val.ID, oops.ErrNoUser
+	return x - y
+}
+
+// exportUser converts the stored user to users.User, the users lock must be held
+func (s *Storage) exportUser(ID string, v UserValues) users.User {
+	return users.User{
+		ID:            ID,
+		Login:         v.Login,
+		Password:      v.Password,
+		Permissions:   v.Permissions,
+		Roles:         s.userRoles(ID),
+		Status:        v.Status,
+		Version:       v.Version,
+		Email:         v.Email,
+		EmailVerified: v.EmailVerified,
+		DisplayName:   v.DisplayName,
+		Attributes:    maps.Clone(v.Attributes),
+		CreatedAt:     v.CreatedAt,
+		UpdatedAt:     v.UpdatedAt,
+	}
+}
+
+// Get user by login, password is returned as stored
+// @param ctx context.Context for managing the scope of the operation.
+// @param login string user login
+func (s *Storage) UserByLogin(ctx context.Context, login string) (users.User, error) {
+	s.Users.mux.RLock()
+	defer s.Users.mux.RUnlock()
+	ID, ok := s.Users.Logins[login]
+	if !ok {
+		return users.User{}, oops.ErrNoUser
 	}
 
-	return val.ID, nil
+	return s.exportUser(ID, s.Users.Users[ID]), nil
 }
 
 // Check if token is present in current project
@@ -100,11 +294,9 @@ func (s *Storage) CheckToken(ctx context.Context, access string) (users.Token, e
 	val, ok := s.Tokens.Tokens[access]
 
 	if ok {
-		return users.Token{Access: access, Refresh: val.refresh, Expiration: val.expiration}, oops.ErrDupAccess
+		return val.export(access), oops.ErrDupAccess
 	}
 
-	delete(s.Tokens.Tokens, access)
-
 	return users.Token{}, nil
 }
 
@@ -114,31 +306,34 @@ func (s *Storage) CheckToken(ctx context.Context, access string) (users.Token, e
 func (s *Storage) SaveUser(ctx context.Context, user users.User) (id string, err error) {
 	s.Users.mux.Lock()
 	defer s.Users.mux.Unlock()
-	fmt.Printf("we got here")
-	_, ok := s.Users.Users[user.Login]
-	if ok {
-		return user.ID, oops.ErrDuplicateUser
+	if ID, ok := s.Users.Logins[user.Login]; ok {
+		return ID, oops.ErrDuplicateUser
+	}
+	if _, ok := s.Users.Emails[user.Email]; ok && user.Email != "" {
+		return "", oops.ErrDuplicateEmail
 	}
 
 	curID++
 	ID := strconv.Itoa(curID)
-	s.Users.Users[user.Login] = UserValues{ID: ID, Password: user.Password, Permissions: user.Permissions}
+	now := time.Now()
+	s.Users.Users[ID] = UserValues{Login: user.Login, Password: user.Password, Permissions: user.Permissions, Status: user.Status, Version: 1,
+		Email: user.Email, DisplayName: user.DisplayName, Attributes: maps.Clone(user.Attributes), CreatedAt: now, UpdatedAt: now}
+	s.Users.Logins[user.Login] = ID
+	if user.Email != "" {
+		s.Users.Emails[user.Email] = ID
+	}
 	return ID, nil
 }
 
-// Save user if it is not in the d
+// Load all stored tokens
 // @param ctx context.Context for managing the scope of the operation.
 func (s *Storage) LoadTokens(ctx context.Context) ([]users.Token, error) {
 	s.Tokens.mux.RLock()
 	defer s.Tokens.mux.RUnlock()
-	output := make([]users.Token, len(s.Users.Users))
+	output := make([]users.Token, 0, len(s.Tokens.Tokens))
 
-	idx := 0
 	for i, v := range s.Tokens.Tokens {
-		output[idx].Refresh = v.refresh
-		output[idx].Access = i
-		output[idx].Expiration = v.expiration
-		idx++
+		output = append(output, v.export(i))
 	}
 
 	return output, nil
@@ -167,8 +362,160 @@ func (s *Storage) GetSessionID(ctx context.Context, access string) (string, erro
 // @param token users.Token token to be saved
 // @param ID string related user ID
 func (s *Storage) SaveToken(ctx context.Context, token users.Token, ID string) (err error) {
+	s.Tokens.mux.Lock()
+	defer s.Tokens.mux.Unlock()
+
+	if _, ok := s.Tokens.Families[token.Family]; !ok {
+		return oops.ErrTokenExistance
+	}
+
+	s.Tokens.Tokens[token.Access] = Token{
+		refresh:           token.Refresh,
+		issuedAt:          token.IssuedAt,
+		expiration:        token.Expiration,
+		refreshExpiration: token.RefreshExpiration,
+		family:            token.Family,
+		user:              ID,
+	}
+	return nil
+}
+
+// start a new token family
+// @param ctx context.Context for managing the scope of the operation.
+// @param ID string related user ID
+// @param client users.ClientInfo client the session is created for
+func (s *Storage) CreateFamily(ctx context.Context, ID string, client users.ClientInfo) (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	family := hex.EncodeToString(buf)
+	now := time.Now()
+
+	s.Tokens.mux.Lock()
+	defer s.Tokens.mux.Unlock()
+	s.Tokens.Families[family] = Family{user: ID, session: users.Session{
+		ID:         family,
+		CreatedAt:  now,
+		LastUsedAt: now,
+		IP:         client.IP,
+		UserAgent:  client.UserAgent,
+		Device:     client.Device,
+		MFA:        client.MFA,
+	}}
+
+	return family, nil
+}
+
+// update last usage time of token family, at most once per users.SessionTouchInterval
+// @param ctx context.Context for managing the scope of the operation.
+// @param family string token family ID
+func (s *Storage) TouchFamily(ctx context.Context, family string) error {
+	now := time.Now()
+
+	// readers do not wait for each other while the usage is recent
+	s.Tokens.mux.RLock()
+	val, ok := s.Tokens.Families[family]
+	s.Tokens.mux.RUnlock()
+	if !ok || now.Sub(val.session.LastUsedAt) < users.SessionTouchInterval {
+		return nil
+	}
+
+	s.Tokens.mux.Lock()
+	defer s.Tokens.mux.Unlock()
+
+	if val, ok := s.Tokens.Families[family]; ok && now.Sub(val.session.LastUsedAt) >= users.SessionTouchInterval {
+		val.session.LastUsedAt = now
+		s.Tokens.Families[family] = val
+	}
+
+	return nil
+}
+
+// list token families of the user with a usable refresh token
+// @param ctx context.Context for managing the scope of the operation.
+// @param ID string user ID
+func (s *Storage) Sessions(ctx context.Context, ID string) ([]users.Session, error) {
+	s.Tokens.mux.RLock()
+	defer s.Tokens.mux.RUnlock()
+
+	now := time.Now()
+	active := make(map[string]bool)
+	for _, v := range s.Tokens.Tokens {
+		if v.user == ID && !v.consumed && v.refreshExpiration.After(now) {
+			active[v.family] = true
+		}
+	}
+
+	var sessions []users.Session
+	for family := range active {
+		if val, ok := s.Tokens.Families[family]; ok {
+			sessions = append(sessions, val.session)
+		}
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt)
+	})
+
+	return sessions, nil
+}
+
+// find token pair by its refresh token
+// @param ctx context.Context for managing the scope of the operation.
+// @param refresh string refresh token
+func (s *Storage) TokenByRefresh(ctx context.Context, refresh string) (users.Token, string, error) {
+	s.Tokens.mux.RLock()
+	defer s.Tokens.mux.RUnlock()
+
+	for i, v := range s.Tokens.Tokens {
+		if v.refresh == refresh {
+			return v.export(i), v.user, nil
+		}
+	}
+
+	return users.Token{}, "", oops.ErrNoRefresh
+}
+
+// mark refresh token as used, its access token expires immediately
+// @param ctx context.Context for managing the scope of the operation.
+// @param refresh string refresh token
+func (s *Storage) ConsumeRefresh(ctx context.Context, refresh string) error {
+	s.Tokens.mux.Lock()
+	defer s.Tokens.mux.Unlock()
+
+	for i, v := range s.Tokens.Tokens {
+		if v.refresh == refresh {
+			if v.consumed {
+				return oops.ErrRefreshReused
+			}
+
+			v.consumed = true
+			if now := time.Now(); v.expiration.After(now) {
+				v.expiration = now
+			}
+			s.Tokens.Tokens[i] = v
+			return nil
+		}
+	}
+
+	return oops.ErrRefreshReused
+}
+
+// delete token family with all of its tokens
+// @param ctx context.Context for managing the scope of the operation.
+// @param family string token family ID
+func (s *Storage) RevokeFamily(ctx context.Context, family string) error {
+	s.Tokens.mux.Lock()
+	defer s.Tokens.mux.Unlock()
+
+	for i, v := range s.Tokens.Tokens {
+		if v.family == family {
+			delete(s.Tokens.Tokens, i)
+		}
+	}
+	delete(s.Tokens.Families, family)
 
-	s.Tokens.Tokens[token.Access] = Token{refresh: token.Refresh, expiration: token.Expiration, user: ID}
 	return nil
 }
 
@@ -177,6 +524,9 @@ func (s *Storage) SaveToken(ctx context.Context, token users.Token, ID string) (
 // @param token users.Token token to be saved
 // @param ID string related user ID
 func (s *Storage) TokenExpired(ctx context.Context, access string) (bool, error) {
+	s.Tokens.mux.RLock()
+	defer s.Tokens.mux.RUnlock()
+
 	val, ok := s.Tokens.Tokens[access]
 	if !ok {
 		return false, oops.ErrTokenExistance
@@ -189,11 +539,67 @@ func (s *Storage) TokenExpired(ctx context.Context, access string) (bool, error)
 	return false, nil
 }
 
+// delete every token family of the user
+// @param ctx context.Context for managing the scope of the operation.
+// @param ID string user ID
+func (s *Storage) RevokeUserTokens(ctx context.Context, ID string) error {
+	s.Tokens.mux.Lock()
+	defer s.Tokens.mux.Unlock()
+
+	for i, v := range s.Tokens.Tokens {
+		if v.user == ID {
+			delete(s.Tokens.Tokens, i)
+		}
+	}
+	for family, val := range s.Tokens.Families {
+		if val.user == ID {
+			delete(s.Tokens.Families, family)
+		}
+	}
+
+	return nil
+}
+
+// get token together with its user in one lookup, permissions of the user include its roles
+// @param ctx context.Context for managing the scope of the operation.
+// @param access string access token
+func (s *Storage) Introspect(ctx context.Context, access string) (users.Token, users.User, error) {
+	s.Tokens.mux.RLock()
+	defer s.Tokens.mux.RUnlock()
+
+	s.Users.mux.RLock()
+	defer s.Users.mux.RUnlock()
+
+	val, ok := s.Tokens.Tokens[access]
+	if !ok {
+		return users.Token{}, users.User{}, oops.ErrTokenExistance
+	}
+
+	v, ok := s.Users.Users[val.user]
+	if !ok {
+		return users.Token{}, users.User{}, oops.ErrNoUser
+	}
+
+	user := s.exportUser(val.user, v)
+	user.Password = ""
+
+	s.Roles.mux.RLock()
+	for _, role := range user.Roles {
+		user.Permissions |= s.Roles.Roles[role].Permissions
+	}
+	s.Roles.mux.RUnlock()
+
+	return val.export(access), user, nil
+}
+
 // delete token
 // @param ctx context.Context for managing the scope of the operation.
 // @param acess string token to be deleted
 func (s *Storage) PopToken(ctx context.Context, access string) error {
-	delete(s.Users.Users, access)
+	s.Tokens.mux.Lock()
+	defer s.Tokens.mux.Unlock()
+
+	delete(s.Tokens.Tokens, access)
 	return nil
 }
 
@@ -201,13 +607,14 @@ func (s *Storage) PopToken(ctx context.Context, access string) error {
 // @param ctx context.Context for managing the scope of the operation.
 // @param ID string user ID
 func (s *Storage) User(ctx context.Context, ID string) (users.User, error) {
-	for i, v := range s.Users.Users {
-		if v.ID == ID {
-			return users.User{ID: v.ID, Login: i, Password: v.Password, Permissions: v.Permissions}, nil
-		}
+	s.Users.mux.RLock()
+	defer s.Users.mux.RUnlock()
+	v, ok := s.Users.Users[ID]
+	if !ok {
+		return users.User{}, oops.ErrNoUser
 	}
 
-	return users.User{}, oops.ErrNoUser
+	return s.exportUser(ID, v), nil
 }
 
 // delete User from storage
@@ -216,45 +623,723 @@ func (s *Storage) User(ctx context.Context, ID string) (users.User, error) {
 func (s *Storage) PopUser(ctx context.Context, ID string) error {
 	s.Users.mux.Lock()
 	defer s.Users.mux.Unlock()
-	for i, v := range s.Users.Users {
-		if v.ID == ID {
-			delete(s.Users.Users, i)
-			return nil
+	v, ok := s.Users.Users[ID]
+	if !ok {
+		return oops.ErrNoUser
+	}
+
+	delete(s.Users.Users, ID)
+	delete(s.Users.Logins, v.Login)
+	delete(s.Users.Emails, v.Email)
+
+	s.Roles.mux.Lock()
+	delete(s.Roles.Assigned, ID)
+	s.Roles.mux.Unlock()
+
+	s.Actions.mux.Lock()
+	for hash, token := range s.Actions.Tokens {
+		if token.UserID == ID {
+			delete(s.Actions.Tokens, hash)
 		}
 	}
+	s.Actions.mux.Unlock()
+
+	s.MFA.mux.Lock()
+	delete(s.MFA.TOTP, ID)
+	delete(s.MFA.Recovery, ID)
+	s.MFA.mux.Unlock()
 
-	return oops.ErrNoUser
+	s.Keys.mux.Lock()
+	for key, passkey := range s.Keys.Passkeys {
+		if passkey.UserID == ID {
+			delete(s.Keys.Passkeys, key)
+		}
+	}
+	s.Keys.mux.Unlock()
+
+	s.Personal.mux.Lock()
+	for hash, token := range s.Personal.Tokens {
+		if token.UserID == ID {
+			delete(s.Personal.Tokens, hash)
+		}
+	}
+	s.Personal.mux.Unlock()
+	return nil
 }
 
-// delete User from storage
+// change login, password, permissions, status and profile of user if its version still matches
 // @param ctx context.Context for managing the scope of the operation.
-// @param user users.User user to be changed
+// @param user users.User user to be changed, Version is the version the change is based on
 func (s *Storage) ChangeUser(ctx context.Context, user users.User) (users.User, error) {
 	s.Users.mux.Lock()
 	defer s.Users.mux.Unlock()
-	for i, v := range s.Users.Users {
-		if v.ID == user.ID {
-			Permissions := v.Permissions
-			delete(s.Users.Users, i)
-			s.Users.Users[user.Login] = UserValues{ID: user.ID, Password: user.Password, Permissions: Permissions}
-			return user, nil
-		}
+	v, ok := s.Users.Users[user.ID]
+	if !ok {
+		return users.User{}, oops.ErrNoUser
+	}
+	if v.Version != user.Version {
+		return users.User{}, oops.ErrVersionMismatch
+	}
+	if other, ok := s.Users.Logins[user.Login]; ok && other != user.ID {
+		return users.User{}, oops.ErrDuplicateUser
+	}
+	if other, ok := s.Users.Emails[user.Email]; ok && other != user.ID && user.Email != "" {
+		return users.User{}, oops.ErrDuplicateEmail
 	}
 
-	return users.User{}, oops.ErrNoUser
+	delete(s.Users.Logins, v.Login)
+	s.Users.Logins[user.Login] = user.ID
+	delete(s.Users.Emails, v.Email)
+	if user.Email != "" {
+		s.Users.Emails[user.Email] = user.ID
+	}
+
+	v.Login = user.Login
+	v.Password = user.Password
+	v.Permissions = user.Permissions
+	v.Status = user.Status
+	v.Email = user.Email
+	v.EmailVerified = user.EmailVerified
+	v.DisplayName = user.DisplayName
+	v.Attributes = maps.Clone(user.Attributes)
+	v.UpdatedAt = time.Now()
+	v.Version++
+	s.Users.Users[user.ID] = v
+	return s.exportUser(user.ID, v), nil
 }
 
-// delete User from storage
+// set direct permissions of user if its version still matches
 // @param ctx context.Context for managing the scope of the operation.
 // @param ID string user ID
 // @param Permission uint user Permission
-func (s *Storage) SetPermission(ctx context.Context, ID string, Permissions uint) error {
-	for i, v := range s.Users.Users {
-		if v.ID == ID {
-			s.Users.Users[i] = UserValues{ID: v.ID, Password: v.Password, Permissions: Permissions}
+// @param version int64 version the change is based on
+func (s *Storage) SetPermission(ctx context.Context, ID string, Permissions uint, version int64) (int64, error) {
+	s.Users.mux.Lock()
+	defer s.Users.mux.Unlock()
+	v, ok := s.Users.Users[ID]
+	if !ok {
+		return 0, oops.ErrNoUser
+	}
+	if v.Version != version {
+		return 0, oops.ErrVersionMismatch
+	}
+
+	v.Permissions = Permissions
+	v.UpdatedAt = time.Now()
+	v.Version++
+	s.Users.Users[ID] = v
+	return v.Version, nil
+}
+
+// replace stored password of user
+// @param ctx context.Context for managing the scope of the operation.
+// @param ID string user ID
+// @param password string encoded password hash
+func (s *Storage) SetPassword(ctx context.Context, ID string, password string) error {
+	s.Users.mux.Lock()
+	defer s.Users.mux.Unlock()
+	v, ok := s.Users.Users[ID]
+	if !ok {
+		return oops.ErrNoUser
+	}
+
+	v.Password = password
+	v.UpdatedAt = time.Now()
+	v.Version++
+	s.Users.Users[ID] = v
+	return nil
+}
+
+// record a change of user made outside of its row, such as its roles
+// Roles.mux must not be held, it is taken after Users.mux elsewhere
+// @param ID string user ID
+func (s *Storage) touchUser(ID string) {
+	s.Users.mux.Lock()
+	defer s.Users.mux.Unlock()
+	v, ok := s.Users.Users[ID]
+	if !ok {
+		return
+	}
+
+	v.UpdatedAt = time.Now()
+	v.Version++
+	s.Users.Users[ID] = v
+}
+
+// mark email of user as verified if it is still the given one
+// @param ctx context.Context for managing the scope of the operation.
+// @param ID string user ID
+// @param email string address that was verified
+func (s *Storage) VerifyEmail(ctx context.Context, ID string, email string) error {
+	s.Users.mux.Lock()
+	defer s.Users.mux.Unlock()
+	v, ok := s.Users.Users[ID]
+	if !ok || v.Email != email {
+		return oops.ErrNoUser
+	}
+
+	v.EmailVerified = true
+	v.UpdatedAt = time.Now()
+	v.Version++
+	s.Users.Users[ID] = v
+	return nil
+}
+
+// save action token
+// @param ctx context.Context for managing the scope of the operation.
+// @param token users.ActionToken token to be saved, keyed by its hash
+func (s *Storage) SaveActionToken(ctx context.Context, token users.ActionToken) error {
+	s.Actions.mux.Lock()
+	defer s.Actions.mux.Unlock()
+
+	now := time.Now()
+	for hash, stored := range s.Actions.Tokens {
+		if now.After(stored.ExpiresAt) {
+			delete(s.Actions.Tokens, hash)
+		}
+	}
+
+	s.Actions.Tokens[token.Hash] = token
+	return nil
+}
+
+// remove and return action token, so that it can be used once
+// @param ctx context.Context for managing the scope of the operation.
+// @param hash string hash of the token
+// @param purpose string purpose the token is presented for
+func (s *Storage) ConsumeActionToken(ctx context.Context, hash string, purpose string) (users.ActionToken, error) {
+	s.Actions.mux.Lock()
+	defer s.Actions.mux.Unlock()
+
+	token, ok := s.Actions.Tokens[hash]
+	if !ok || token.Purpose != purpose {
+		return users.ActionToken{}, oops.ErrActionToken
+	}
+
+	delete(s.Actions.Tokens, hash)
+	return token, nil
+}
+
+// get action token without consuming it
+// @param ctx context.Context for managing the scope of the operation.
+// @param hash string hash of the token
+// @param purpose string purpose the token is presented for
+func (s *Storage) ActionToken(ctx context.Context, hash string, purpose string) (users.ActionToken, error) {
+	s.Actions.mux.Lock()
+	defer s.Actions.mux.Unlock()
+
+	token, ok := s.Actions.Tokens[hash]
+	if !ok || token.Purpose != purpose {
+		return users.ActionToken{}, oops.ErrActionToken
+	}
+
+	return token, nil
+}
+
+// remove pending action tokens of user with the purpose
+// @param ctx context.Context for managing the scope of the operation.
+// @param ID string user ID
+// @param purpose string purpose of the tokens
+func (s *Storage) PopActionTokens(ctx context.Context, ID string, purpose string) error {
+	s.Actions.mux.Lock()
+	defer s.Actions.mux.Unlock()
+
+	for hash, token := range s.Actions.Tokens {
+		if token.UserID == ID && token.Purpose == purpose {
+			delete(s.Actions.Tokens, hash)
+		}
+	}
+	return nil
+}
+
+// get failed login attempts of key
+// @param ctx context.Context for managing the scope of the operation.
+// @param key string login or client address key
+func (s *Storage) Attempts(ctx context.Context, key string) (users.Attempts, error) {
+	s.Failures.mux.Lock()
+	defer s.Failures.mux.Unlock()
+
+	return s.Failures.Attempts[key], nil
+}
+
+// add failed login attempt to key if it still has seen failures, forgetting its failures older than window
+// @param ctx context.Context for managing the scope of the operation.
+// @param key string login or client address key
+// @param seen int failures the caller checked
+// @param window time.Duration time after which failures are forgotten
+func (s *Storage) ReserveAttempt(ctx context.Context, key string, seen int, window time.Duration) (users.Attempts, bool, error) {
+	s.Failures.mux.Lock()
+	defer s.Failures.mux.Unlock()
+
+	attempts := s.Failures.Attempts[key]
+	if attempts.Failures != seen {
+		return attempts, false, nil
+	}
+
+	now := time.Now()
+	if now.Sub(attempts.Last) > window {
+		attempts.Failures = 0
+	}
+	attempts.Failures++
+	attempts.Last = now
+	s.Failures.Attempts[key] = attempts
+	return attempts, true, nil
+}
+
+// take back a failed login attempt reserved for correct credentials
+// @param ctx context.Context for managing the scope of the operation.
+// @param key string login or client address key
+func (s *Storage) ReleaseAttempt(ctx context.Context, key string) error {
+	s.Failures.mux.Lock()
+	defer s.Failures.mux.Unlock()
+
+	attempts, ok := s.Failures.Attempts[key]
+	if !ok {
+		return nil
+	}
+
+	if attempts.Failures <= 1 {
+		delete(s.Failures.Attempts, key)
+		return nil
+	}
+	attempts.Failures--
+	s.Failures.Attempts[key] = attempts
+	return nil
+}
+
+// forget failed login attempts of key
+// @param ctx context.Context for managing the scope of the operation.
+// @param key string login or client address key
+func (s *Storage) ResetAttempts(ctx context.Context, key string) error {
+	s.Failures.mux.Lock()
+	defer s.Failures.mux.Unlock()
+
+	delete(s.Failures.Attempts, key)
+	return nil
+}
+
+// get TOTP enrollment of user
+// @param ctx context.Context for managing the scope of the operation.
+// @param ID string user ID
+func (s *Storage) TOTP(ctx context.Context, ID string) (users.TOTPEnrollment, error) {
+	s.MFA.mux.Lock()
+	defer s.MFA.mux.Unlock()
+
+	enrollment, ok := s.MFA.TOTP[ID]
+	if !ok {
+		return users.TOTPEnrollment{}, oops.ErrNoTOTP
+	}
+
+	return enrollment, nil
+}
+
+// save unconfirmed TOTP secret of user, replacing a previous one
+// @param ctx context.Context for managing the scope of the operation.
+// @param ID string user ID
+// @param secret string base32 secret
+func (s *Storage) SaveTOTP(ctx context.Context, ID string, secret string) error {
+	s.MFA.mux.Lock()
+	defer s.MFA.mux.Unlock()
+
+	s.MFA.TOTP[ID] = users.TOTPEnrollment{Secret: secret}
+	return nil
+}
+
+// confirm TOTP enrollment of user with the step of the code that confirmed it
+// @param ctx context.Context for managing the scope of the operation.
+// @param ID string user ID
+// @param step int64 time step of the accepted code
+func (s *Storage) ConfirmTOTP(ctx context.Context, ID string, step int64) error {
+	s.MFA.mux.Lock()
+	defer s.MFA.mux.Unlock()
+
+	enrollment, ok := s.MFA.TOTP[ID]
+	if !ok {
+		return oops.ErrNoTOTP
+	}
+
+	enrollment.Confirmed = true
+	enrollment.LastStep = step
+	s.MFA.TOTP[ID] = enrollment
+	return nil
+}
+
+// accept TOTP code of the step if no code of the same or a later step was accepted before
+// @param ctx context.Context for managing the scope of the operation.
+// @param ID string user ID
+// @param step int64 time step of the code
+func (s *Storage) UseTOTPStep(ctx context.Context, ID string, step int64) error {
+	s.MFA.mux.Lock()
+	defer s.MFA.mux.Unlock()
+
+	enrollment, ok := s.MFA.TOTP[ID]
+	if !ok || !enrollment.Confirmed || enrollment.LastStep >= step {
+		return oops.ErrMFACode
+	}
+
+	enrollment.LastStep = step
+	s.MFA.TOTP[ID] = enrollment
+	return nil
+}
+
+// delete TOTP enrollment and recovery codes of user
+// @param ctx context.Context for managing the scope of the operation.
+// @param ID string user ID
+func (s *Storage) PopTOTP(ctx context.Context, ID string) error {
+	s.MFA.mux.Lock()
+	defer s.MFA.mux.Unlock()
+
+	if _, ok := s.MFA.TOTP[ID]; !ok {
+		return oops.ErrNoTOTP
+	}
+
+	delete(s.MFA.TOTP, ID)
+	delete(s.MFA.Recovery, ID)
+	return nil
+}
+
+// replace recovery codes of user
+// @param ctx context.Context for managing the scope of the operation.
+// @param ID string user ID
+// @param hashes []string hashes of the new codes
+func (s *Storage) SaveRecoveryCodes(ctx context.Context, ID string, hashes []string) error {
+	s.MFA.mux.Lock()
+	defer s.MFA.mux.Unlock()
+
+	codes := make(map[string]bool, len(hashes))
+	for _, hash := range hashes {
+		codes[hash] = true
+	}
+	s.MFA.Recovery[ID] = codes
+	return nil
+}
+
+// remove recovery code of user, so that it can be used once
+// @param ctx context.Context for managing the scope of the operation.
+// @param ID string user ID
+// @param hash string hash of the code
+func (s *Storage) UseRecoveryCode(ctx context.Context, ID string, hash string) error {
+	s.MFA.mux.Lock()
+	defer s.MFA.mux.Unlock()
+
+	if !s.MFA.Recovery[ID][hash] {
+		return oops.ErrMFACode
+	}
+
+	delete(s.MFA.Recovery[ID], hash)
+	return nil
+}
+
+// count unused recovery codes of user
+// @param ctx context.Context for managing the scope of the operation.
+// @param ID string user ID
+func (s *Storage) CountRecoveryCodes(ctx context.Context, ID string) (int, error) {
+	s.MFA.mux.Lock()
+	defer s.MFA.mux.Unlock()
+
+	return len(s.MFA.Recovery[ID]), nil
+}
+
+// tell whether token family was started with a second factor
+// @param ctx context.Context for managing the scope of the operation.
+// @param family string token family ID
+func (s *Storage) FamilyMFA(ctx context.Context, family string) (bool, error) {
+	s.Tokens.mux.RLock()
+	defer s.Tokens.mux.RUnlock()
+
+	return s.Tokens.Families[family].session.MFA, nil
+}
+
+// get permissions requiring a second factor
+// @param ctx context.Context for managing the scope of the operation.
+func (s *Storage) MFAPolicy(ctx context.Context) (uint, error) {
+	s.MFA.mux.Lock()
+	defer s.MFA.mux.Unlock()
+
+	return s.MFA.Policy, nil
+}
+
+// set permissions requiring a second factor
+// @param ctx context.Context for managing the scope of the operation.
+// @param permissions uint permission mask
+func (s *Storage) SetMFAPolicy(ctx context.Context, permissions uint) error {
+	s.MFA.mux.Lock()
+	defer s.MFA.mux.Unlock()
+
+	s.MFA.Policy = permissions
+	return nil
+}
+
+// save passkey of user
+// @param ctx context.Context for managing the scope of the operation.
+// @param passkey users.Passkey passkey to be saved, keyed by its credential ID
+func (s *Storage) SavePasskey(ctx context.Context, passkey users.Passkey) error {
+	s.Keys.mux.Lock()
+	defer s.Keys.mux.Unlock()
+
+	if _, ok := s.Keys.Passkeys[passkey.ID]; ok {
+		return oops.ErrDuplicatePasskey
+	}
+
+	s.Keys.Passkeys[passkey.ID] = passkey
+	return nil
+}
+
+// list passkeys of user, oldest first
+// @param ctx context.Context for managing the scope of the operation.
+// @param ID string user ID
+func (s *Storage) Passkeys(ctx context.Context, ID string) ([]users.Passkey, error) {
+	s.Keys.mux.Lock()
+	defer s.Keys.mux.Unlock()
+
+	passkeys := []users.Passkey{}
+	for _, passkey := range s.Keys.Passkeys {
+		if passkey.UserID == ID {
+			passkeys = append(passkeys, passkey)
+		}
+	}
+
+	sort.Slice(passkeys, func(i, j int) bool {
+		return passkeys[i].CreatedAt.Before(passkeys[j].CreatedAt)
+	})
+
+	return passkeys, nil
+}
+
+// get passkey by its credential ID
+// @param ctx context.Context for managing the scope of the operation.
+// @param passkey string credential ID
+func (s *Storage) Passkey(ctx context.Context, passkey string) (users.Passkey, error) {
+	s.Keys.mux.Lock()
+	defer s.Keys.mux.Unlock()
+
+	val, ok := s.Keys.Passkeys[passkey]
+	if !ok {
+		return users.Passkey{}, oops.ErrNoPasskey
+	}
+
+	return val, nil
+}
+
+// record login with passkey if its sign count grew, authenticators without a counter always send zero
+// @param ctx context.Context for managing the scope of the operation.
+// @param passkey string credential ID
+// @param signCount uint32 sign count of the assertion
+func (s *Storage) UsePasskey(ctx context.Context, passkey string, signCount uint32) error {
+	s.Keys.mux.Lock()
+	defer s.Keys.mux.Unlock()
+
+	val, ok := s.Keys.Passkeys[passkey]
+	if !ok {
+		return oops.ErrNoPasskey
+	}
+
+	if signCount <= val.SignCount && (signCount != 0 || val.SignCount != 0) {
+		return oops.ErrSignCount
+	}
+
+	val.SignCount = signCount
+	val.LastUsedAt = time.Now()
+	s.Keys.Passkeys[passkey] = val
+	return nil
+}
+
+// delete passkey of user
+// @param ctx context.Context for managing the scope of the operation.
+// @param ID string user ID
+// @param passkey string credential ID
+func (s *Storage) PopPasskey(ctx context.Context, ID string, passkey string) error {
+	s.Keys.mux.Lock()
+	defer s.Keys.mux.Unlock()
+
+	if val, ok := s.Keys.Passkeys[passkey]; !ok || val.UserID != ID {
+		return oops.ErrNoPasskey
+	}
+
+	delete(s.Keys.Passkeys, passkey)
+	return nil
+}
+
+// save personal access token of user
+// @param ctx context.Context for managing the scope of the operation.
+// @param token users.PersonalToken token to be saved, keyed by the hash of its secret
+func (s *Storage) SavePersonalToken(ctx context.Context, token users.PersonalToken) error {
+	s.Personal.mux.Lock()
+	defer s.Personal.mux.Unlock()
+
+	s.Personal.Tokens[token.Hash] = token
+	return nil
+}
+
+// list personal access tokens of user, oldest first
+// @param ctx context.Context for managing the scope of the operation.
+// @param ID string user ID
+func (s *Storage) PersonalTokens(ctx context.Context, ID string) ([]users.PersonalToken, error) {
+	s.Personal.mux.Lock()
+	defer s.Personal.mux.Unlock()
+
+	tokens := []users.PersonalToken{}
+	for _, token := range s.Personal.Tokens {
+		if token.UserID == ID {
+			tokens = append(tokens, token)
+		}
+	}
+
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].CreatedAt.Before(tokens[j].CreatedAt)
+	})
+
+	return tokens, nil
+}
+
+// get personal access token by the hash of its secret and record its use
+// @param ctx context.Context for managing the scope of the operation.
+// @param hash string hash of the secret
+func (s *Storage) UsePersonalToken(ctx context.Context, hash string) (users.PersonalToken, error) {
+	s.Personal.mux.Lock()
+	defer s.Personal.mux.Unlock()
+
+	val, ok := s.Personal.Tokens[hash]
+	if !ok {
+		return users.PersonalToken{}, oops.ErrNoPersonalToken
+	}
+
+	val.LastUsedAt = time.Now()
+	s.Personal.Tokens[hash] = val
+	return val, nil
+}
+
+// delete personal access token of user
+// @param ctx context.Context for managing the scope of the operation.
+// @param ID string user ID
+// @param token string ID of the token
+func (s *Storage) PopPersonalToken(ctx context.Context, ID string, token string) error {
+	s.Personal.mux.Lock()
+	defer s.Personal.mux.Unlock()
+
+	for hash, val := range s.Personal.Tokens {
+		if val.ID == token && val.UserID == ID {
+			delete(s.Personal.Tokens, hash)
 			return nil
 		}
 	}
 
-	return oops.ErrNoUser
+	return oops.ErrNoPersonalToken
+}
+
+// delete every personal access token of user
+// @param ctx context.Context for managing the scope of the operation.
+// @param ID string user ID
+func (s *Storage) PopPersonalTokens(ctx context.Context, ID string) error {
+	s.Personal.mux.Lock()
+	defer s.Personal.mux.Unlock()
+
+	for hash, val := range s.Personal.Tokens {
+		if val.UserID == ID {
+			delete(s.Personal.Tokens, hash)
+		}
+	}
+
+	return nil
+}
+
+// save new service account
+// @param ctx context.Context for managing the scope of the operation.
+// @param account users.ServiceAccount account to be saved, keyed by its client ID
+func (s *Storage) SaveServiceAccount(ctx context.Context, account users.ServiceAccount) error {
+	s.Services.mux.Lock()
+	defer s.Services.mux.Unlock()
+
+	s.Services.Accounts[account.ClientID] = account
+	return nil
+}
+
+// list service accounts, oldest first
+// @param ctx context.Context for managing the scope of the operation.
+func (s *Storage) ServiceAccounts(ctx context.Context) ([]users.ServiceAccount, error) {
+	s.Services.mux.Lock()
+	defer s.Services.mux.Unlock()
+
+	accounts := []users.ServiceAccount{}
+	for _, account := range s.Services.Accounts {
+		accounts = append(accounts, account)
+	}
+
+	sort.Slice(accounts, func(i, j int) bool {
+		return accounts[i].CreatedAt.Before(accounts[j].CreatedAt)
+	})
+
+	return accounts, nil
+}
+
+// get service account by client ID
+// @param ctx context.Context for managing the scope of the operation.
+// @param clientID string client ID
+func (s *Storage) ServiceAccount(ctx context.Context, clientID string) (users.ServiceAccount, error) {
+	s.Services.mux.Lock()
+	defer s.Services.mux.Unlock()
+
+	val, ok := s.Services.Accounts[clientID]
+	if !ok {
+		return users.ServiceAccount{}, oops.ErrNoServiceAccount
+	}
+
+	return val, nil
+}
+
+// change name, secret, permissions and status of service account
+// @param ctx context.Context for managing the scope of the operation.
+// @param account users.ServiceAccount account with the changes
+func (s *Storage) ChangeServiceAccount(ctx context.Context, account users.ServiceAccount) error {
+	s.Services.mux.Lock()
+	defer s.Services.mux.Unlock()
+
+	if _, ok := s.Services.Accounts[account.ClientID]; !ok {
+		return oops.ErrNoServiceAccount
+	}
+
+	s.Services.Accounts[account.ClientID] = account
+	return nil
+}
+
+// save access token of service account
+// @param ctx context.Context for managing the scope of the operation.
+// @param token users.ServiceToken token to be saved, keyed by its hash
+func (s *Storage) SaveServiceToken(ctx context.Context, token users.ServiceToken) error {
+	s.Services.mux.Lock()
+	defer s.Services.mux.Unlock()
+
+	s.Services.Tokens[token.Hash] = token
+	return nil
+}
+
+// get access token of service account by its hash
+// @param ctx context.Context for managing the scope of the operation.
+// @param hash string hash of the token
+func (s *Storage) ServiceToken(ctx context.Context, hash string) (users.ServiceToken, error) {
+	s.Services.mux.Lock()
+	defer s.Services.mux.Unlock()
+
+	val, ok := s.Services.Tokens[hash]
+	if !ok {
+		return users.ServiceToken{}, oops.ErrTokenExistance
+	}
+
+	return val, nil
+}
+
+// delete every access token of service account
+// @param ctx context.Context for managing the scope of the operation.
+// @param clientID string client ID
+func (s *Storage) PopServiceTokens(ctx context.Context, clientID string) error {
+	s.Services.mux.Lock()
+	defer s.Services.mux.Unlock()
+
+	for hash, token := range s.Services.Tokens {
+		if token.ClientID == clientID {
+			delete(s.Services.Tokens, hash)
+		}
+	}
+
+	return nil
 }
@@ -0,0 +1,12 @@
+package memory_test
+
+import (
+	"testing"
+
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/storage/memory"
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/storage/storagetest"
+)
+
+func TestVersions(t *testing.T) {
+	storagetest.Versions(t, memory.NewStorage())
+}
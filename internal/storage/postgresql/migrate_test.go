@@ -0,0 +1,130 @@
+package database
+
+import (
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestMigrationsEmbedded(t *testing.T) {
+	migrations, err := Migrations()
+	if err != nil {
+		t.Fatalf("Migrations() error = %v", err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("Migrations() returned no migrations")
+	}
+
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2*len(migrations) {
+		t.Errorf("%d embedded files for %d migrations, want an up and a down file each", len(entries), len(migrations))
+	}
+
+	for i, m := range migrations {
+		// versions are applied in order, a gap usually means a lost file
+		if m.Version != i+1 {
+			t.Errorf("migration %d_%s has version %d, want %d", m.Version, m.Name, m.Version, i+1)
+		}
+		if !strings.HasSuffix(strings.TrimSpace(m.Up), ";") {
+			t.Errorf("migration %d_%s up does not end with a statement", m.Version, m.Name)
+		}
+		if strings.TrimSpace(m.Down) == "" {
+			t.Errorf("migration %d_%s down is empty", m.Version, m.Name)
+		}
+	}
+}
+
+func TestReadMigrations(t *testing.T) {
+	file := func(body string) *fstest.MapFile {
+		return &fstest.MapFile{Data: []byte(body)}
+	}
+
+	tests := []struct {
+		name    string
+		files   fstest.MapFS
+		want    []int
+		wantErr bool
+	}{
+		{
+			name: "paired and sorted",
+			files: fstest.MapFS{
+				"migrations/0002_b.up.sql":   file("SELECT 2;"),
+				"migrations/0002_b.down.sql": file("SELECT 2;"),
+				"migrations/0001_a.up.sql":   file("SELECT 1;"),
+				"migrations/0001_a.down.sql": file("SELECT 1;"),
+			},
+			want: []int{1, 2},
+		},
+		{
+			name: "missing down",
+			files: fstest.MapFS{
+				"migrations/0001_a.up.sql": file("SELECT 1;"),
+			},
+			wantErr: true,
+		},
+		{
+			name: "missing up",
+			files: fstest.MapFS{
+				"migrations/0001_a.down.sql": file("SELECT 1;"),
+			},
+			wantErr: true,
+		},
+		{
+			name: "version used twice",
+			files: fstest.MapFS{
+				"migrations/0001_a.up.sql":   file("SELECT 1;"),
+				"migrations/0001_b.down.sql": file("SELECT 1;"),
+			},
+			wantErr: true,
+		},
+		{
+			name: "no version",
+			files: fstest.MapFS{
+				"migrations/init.up.sql": file("SELECT 1;"),
+			},
+			wantErr: true,
+		},
+		{
+			name: "bad version",
+			files: fstest.MapFS{
+				"migrations/one_a.up.sql": file("SELECT 1;"),
+			},
+			wantErr: true,
+		},
+		{
+			name: "unexpected file",
+			files: fstest.MapFS{
+				"migrations/README.md": file("notes"),
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			migrations, err := readMigrations(tt.files)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("readMigrations() error = nil, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readMigrations() error = %v", err)
+			}
+
+			if len(migrations) != len(tt.want) {
+				t.Fatalf("readMigrations() returned %d migrations, want %d", len(migrations), len(tt.want))
+			}
+			for i, m := range migrations {
+				if m.Version != tt.want[i] {
+					t.Errorf("migration %d has version %d, want %d", i, m.Version, tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,3 @@
+-- 0001 adopts the users and tokens tables of deployments that predate migrations,
+-- so rolling it back keeps them: dropping would delete data this migration never created.
+-- Drop them by hand to remove the schema completely.
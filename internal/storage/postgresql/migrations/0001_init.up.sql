@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS users (
+    id          SERIAL PRIMARY KEY,
+    login       TEXT   NOT NULL UNIQUE,
+    password    TEXT   NOT NULL,
+    permissions BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS tokens (
+    access_token  TEXT        PRIMARY KEY,
+    refresh_token TEXT        NOT NULL,
+    expiration    TIMESTAMPTZ NOT NULL,
+    user_id       INTEGER     NOT NULL REFERENCES users (id) ON DELETE CASCADE
+);
@@ -0,0 +1,9 @@
+DROP INDEX IF EXISTS tokens_family_id_idx;
+DROP INDEX IF EXISTS tokens_refresh_token_idx;
+
+ALTER TABLE tokens
+    DROP COLUMN consumed,
+    DROP COLUMN refresh_expiration,
+    DROP COLUMN family_id;
+
+DROP TABLE token_families;
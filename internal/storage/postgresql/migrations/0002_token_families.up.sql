@@ -0,0 +1,17 @@
+-- a family links every token pair descending from one login
+CREATE TABLE token_families (
+    id         TEXT        PRIMARY KEY,
+    user_id    INTEGER     NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- tokens issued before families existed cannot take part in rotation
+DELETE FROM tokens;
+
+ALTER TABLE tokens
+    ADD COLUMN family_id          TEXT        NOT NULL REFERENCES token_families (id) ON DELETE CASCADE,
+    ADD COLUMN refresh_expiration TIMESTAMPTZ NOT NULL,
+    ADD COLUMN consumed           BOOLEAN     NOT NULL DEFAULT false;
+
+CREATE UNIQUE INDEX tokens_refresh_token_idx ON tokens (refresh_token);
+CREATE INDEX tokens_family_id_idx ON tokens (family_id);
@@ -0,0 +1 @@
+ALTER TABLE tokens ADD COLUMN issued_at TIMESTAMPTZ NOT NULL DEFAULT now();
@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS token_families_user_id_idx;
+
+ALTER TABLE token_families
+    DROP COLUMN device,
+    DROP COLUMN user_agent,
+    DROP COLUMN ip,
+    DROP COLUMN last_used_at;
@@ -0,0 +1,7 @@
+ALTER TABLE token_families
+    ADD COLUMN last_used_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    ADD COLUMN ip           TEXT        NOT NULL DEFAULT '',
+    ADD COLUMN user_agent   TEXT        NOT NULL DEFAULT '',
+    ADD COLUMN device       TEXT        NOT NULL DEFAULT '';
+
+CREATE INDEX token_families_user_id_idx ON token_families (user_id);
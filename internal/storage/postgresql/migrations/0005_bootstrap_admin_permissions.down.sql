@@ -0,0 +1,2 @@
+-- the dropped bits granted nothing, so the masked permissions are equivalent and kept
+SELECT 1;
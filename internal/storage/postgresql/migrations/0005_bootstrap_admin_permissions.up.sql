@@ -0,0 +1,4 @@
+-- the bootstrap admin used to get 0x1111111, setting bits no permission is defined for;
+-- they never granted anything, but they block grants as undefined flags, so drop them.
+-- 511 is the union of the defined flags, the defined bits of every user are kept as they are
+UPDATE users SET permissions = permissions & 511 WHERE permissions & ~511 <> 0;
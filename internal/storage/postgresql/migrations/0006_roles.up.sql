@@ -0,0 +1,20 @@
+CREATE TABLE roles (
+    name        TEXT   PRIMARY KEY,
+    description TEXT   NOT NULL DEFAULT '',
+    permissions BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE TABLE user_roles (
+    user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    role    TEXT    NOT NULL REFERENCES roles (name) ON DELETE CASCADE ON UPDATE CASCADE,
+    PRIMARY KEY (user_id, role)
+);
+
+-- manage_books = 1, query_total_stock = 2, change_total_stock = 4, query_users = 8,
+-- manage_users = 16, grant_permissions = 32, loan_books = 64,
+-- query_available_stock = 128, query_reservations = 256
+INSERT INTO roles (name, description, permissions) VALUES
+    ('reader',       'Looks up books and reservations',              384),
+    ('librarian',    'Manages the catalogue and registers loans',    451),
+    ('stock-keeper', 'Keeps track of the total stock',               134),
+    ('admin',        'Every permission',                             511);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS users_login_pattern_idx;
+
+ALTER TABLE users DROP COLUMN status;
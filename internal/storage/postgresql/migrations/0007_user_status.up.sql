@@ -0,0 +1,5 @@
+ALTER TABLE users ADD COLUMN status TEXT NOT NULL DEFAULT 'active'
+    CONSTRAINT users_status_check CHECK (status IN ('active', 'disabled'));
+
+-- prefix search on login
+CREATE INDEX users_login_pattern_idx ON users (login text_pattern_ops);
@@ -0,0 +1,2 @@
+-- incremented by every change of the user, compared against If-Match
+ALTER TABLE users ADD COLUMN version BIGINT NOT NULL DEFAULT 1;
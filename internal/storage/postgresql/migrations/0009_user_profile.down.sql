@@ -0,0 +1,6 @@
+ALTER TABLE users
+    DROP COLUMN email,
+    DROP COLUMN display_name,
+    DROP COLUMN attributes,
+    DROP COLUMN created_at,
+    DROP COLUMN updated_at;
@@ -0,0 +1,7 @@
+-- emails are normalized to lower case by the service, NULL when the user has none
+ALTER TABLE users
+    ADD COLUMN email        TEXT        CONSTRAINT users_email_key UNIQUE,
+    ADD COLUMN display_name TEXT        NOT NULL DEFAULT '',
+    ADD COLUMN attributes   JSONB       NOT NULL DEFAULT '{}',
+    ADD COLUMN created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+    ADD COLUMN updated_at   TIMESTAMPTZ NOT NULL DEFAULT now();
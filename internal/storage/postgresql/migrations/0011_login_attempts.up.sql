@@ -0,0 +1,6 @@
+-- failed logins per "login:<login>" and "ip:<address>" key, shared by the replicas
+CREATE TABLE login_attempts (
+    key          TEXT        PRIMARY KEY,
+    failures     INTEGER     NOT NULL,
+    last_failure TIMESTAMPTZ NOT NULL
+);
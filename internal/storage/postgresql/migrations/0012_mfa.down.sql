@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS mfa_policy;
+DROP TABLE IF EXISTS recovery_codes;
+DROP TABLE IF EXISTS totp;
+
+ALTER TABLE token_families DROP COLUMN mfa;
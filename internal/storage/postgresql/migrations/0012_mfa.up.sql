@@ -0,0 +1,24 @@
+ALTER TABLE token_families ADD COLUMN mfa BOOLEAN NOT NULL DEFAULT false;
+
+-- TOTP secrets, unconfirmed until the user proves its app generates the codes
+CREATE TABLE totp (
+    user_id   INTEGER PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+    secret    TEXT    NOT NULL,
+    confirmed BOOLEAN NOT NULL DEFAULT false,
+    last_step BIGINT  NOT NULL DEFAULT 0
+);
+
+-- single-use recovery codes, only the SHA-256 of the code is stored
+CREATE TABLE recovery_codes (
+    user_id   INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    code_hash TEXT    NOT NULL,
+    PRIMARY KEY (user_id, code_hash)
+);
+
+-- permissions only granted to sessions confirmed with a second factor
+CREATE TABLE mfa_policy (
+    id          BOOLEAN PRIMARY KEY DEFAULT true CHECK (id),
+    permissions BIGINT  NOT NULL DEFAULT 0
+);
+
+INSERT INTO mfa_policy (id) VALUES (true);
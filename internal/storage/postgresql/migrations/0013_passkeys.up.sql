@@ -0,0 +1,12 @@
+-- WebAuthn credentials, only the COSE public key is stored
+CREATE TABLE passkeys (
+    id           TEXT        PRIMARY KEY,
+    user_id      INTEGER     NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    name         TEXT        NOT NULL,
+    public_key   BYTEA       NOT NULL,
+    sign_count   BIGINT      NOT NULL DEFAULT 0,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+    last_used_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX passkeys_user_idx ON passkeys (user_id);
@@ -0,0 +1,14 @@
+-- long-lived access tokens for scripts, only the SHA-256 of the secret is stored
+CREATE TABLE personal_tokens (
+    id           TEXT        PRIMARY KEY,
+    user_id      INTEGER     NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    name         TEXT        NOT NULL,
+    hash         TEXT        NOT NULL UNIQUE,
+    permissions  BIGINT      NOT NULL DEFAULT 0,
+    mfa          BOOLEAN     NOT NULL DEFAULT false,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at   TIMESTAMPTZ NOT NULL,
+    last_used_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX personal_tokens_user_idx ON personal_tokens (user_id);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS service_tokens;
+DROP TABLE IF EXISTS service_accounts;
@@ -0,0 +1,21 @@
+-- identities of other services, only the SHA-256 of the client secret is stored
+CREATE TABLE service_accounts (
+    client_id   TEXT        PRIMARY KEY,
+    name        TEXT        NOT NULL,
+    secret_hash TEXT        NOT NULL,
+    permissions BIGINT      NOT NULL DEFAULT 0,
+    status      TEXT        NOT NULL DEFAULT 'active' CHECK (status IN ('active', 'disabled')),
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+    rotated_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- access tokens issued by the client credentials grant, only the SHA-256 of the token is stored
+CREATE TABLE service_tokens (
+    hash        TEXT        PRIMARY KEY,
+    client_id   TEXT        NOT NULL REFERENCES service_accounts (client_id) ON DELETE CASCADE,
+    permissions BIGINT      NOT NULL DEFAULT 0,
+    issued_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at  TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX service_tokens_client_idx ON service_tokens (client_id);
@@ -0,0 +1,174 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+	users "github.com/mipt-kp-2024-go-beer/user-service/internal"
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/oops"
+)
+
+// effectivePermissions is the SQL expression of the permissions of users row u, direct grants and roles combined.
+const effectivePermissions = `(u.permissions | COALESCE((
+	SELECT bit_or(r.permissions) FROM user_roles ur JOIN roles r ON r.name = ur.role WHERE ur.user_id = u.id
+), 0))`
+
+func (s *Storage) LoadRoles(ctx context.Context) ([]users.Role, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT name, description, permissions FROM roles ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var output []users.Role
+	for rows.Next() {
+		var role users.Role
+		if err := rows.Scan(&role.Name, &role.Description, &role.Permissions); err != nil {
+			return nil, err
+		}
+		output = append(output, role)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return output, nil
+}
+
+func (s *Storage) Role(ctx context.Context, name string) (users.Role, error) {
+	var role users.Role
+	err := s.db.QueryRowContext(ctx, "SELECT name, description, permissions FROM roles WHERE name = $1", name).
+		Scan(&role.Name, &role.Description, &role.Permissions)
+
+	if err == sql.ErrNoRows {
+		return users.Role{}, oops.ErrNoRole
+	} else if err != nil {
+		return users.Role{}, err
+	}
+
+	return role, nil
+}
+
+func (s *Storage) SaveRole(ctx context.Context, role users.Role) error {
+	_, err := s.db.ExecContext(ctx, "INSERT INTO roles (name, description, permissions) VALUES ($1, $2, $3)",
+		role.Name, role.Description, role.Permissions)
+
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" { // unique_violation
+		return oops.ErrDuplicateRole
+	} else if err != nil {
+		return fmt.Errorf("failed to save role: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Storage) ChangeRole(ctx context.Context, role users.Role) error {
+	res, err := s.db.ExecContext(ctx, "UPDATE roles SET description = $1, permissions = $2 WHERE name = $3",
+		role.Description, role.Permissions, role.Name)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return oops.ErrNoRole
+	}
+
+	return nil
+}
+
+func (s *Storage) PopRole(ctx context.Context, name string) error {
+	// the members lose the role with the cascade, their version changes with it
+	res, err := s.db.ExecContext(ctx, `
+		WITH members AS (
+			UPDATE users SET version = version + 1, updated_at = now()
+			WHERE id IN (SELECT user_id FROM user_roles WHERE role = $1)
+		)
+		DELETE FROM roles WHERE name = $1`, name)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return oops.ErrNoRole
+	}
+
+	return nil
+}
+
+func (s *Storage) AssignRole(ctx context.Context, ID string, role string) error {
+	id, err := userID(ID)
+	if err != nil {
+		return err
+	}
+
+	// the version changes only if the role was not assigned yet
+	_, err = s.db.ExecContext(ctx, `
+		WITH assigned AS (
+			INSERT INTO user_roles (user_id, role) VALUES ($1, $2) ON CONFLICT DO NOTHING RETURNING user_id
+		)
+		UPDATE users SET version = version + 1, updated_at = now() WHERE id IN (SELECT user_id FROM assigned)`, id, role)
+
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23503" { // foreign_key_violation
+		if pqErr.Constraint == "user_roles_role_fkey" {
+			return oops.ErrNoRole
+		}
+		return oops.ErrNoUser
+	}
+
+	return err
+}
+
+func (s *Storage) UnassignRole(ctx context.Context, ID string, role string) error {
+	id, err := userID(ID)
+	if err != nil {
+		return err
+	}
+
+	res, err := s.db.ExecContext(ctx, `
+		WITH unassigned AS (
+			DELETE FROM user_roles WHERE user_id = $1 AND role = $2 RETURNING user_id
+		)
+		UPDATE users SET version = version + 1, updated_at = now() WHERE id IN (SELECT user_id FROM unassigned)`, id, role)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return oops.ErrNoRole
+	}
+
+	return nil
+}
+
+func (s *Storage) EffectivePermissions(ctx context.Context, ID string) (uint, error) {
+	id, err := userID(ID)
+	if err != nil {
+		return 0, err
+	}
+
+	var permissions uint
+	err = s.db.QueryRowContext(ctx, "SELECT "+effectivePermissions+" FROM users u WHERE u.id = $1", id).Scan(&permissions)
+
+	if err == sql.ErrNoRows {
+		return 0, oops.ErrNoUser
+	} else if err != nil {
+		return 0, err
+	}
+
+	return permissions, nil
+}
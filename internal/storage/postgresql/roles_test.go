@@ -0,0 +1,54 @@
+package database
+
+import (
+	"regexp"
+	"strconv"
+	"testing"
+
+	users "github.com/mipt-kp-2024-go-beer/user-service/internal"
+)
+
+// seededRole matches a row of the INSERT INTO roles statement: ('name', 'description', permissions)
+var seededRole = regexp.MustCompile(`\(\s*'([^']*)',\s*'([^']*)',\s*(\d+)\s*\)`)
+
+// The roles migration hard-codes the masks, so that it keeps creating the same roles when the flags change.
+// This keeps them in step with users.DefaultRoles, which the memory store seeds.
+func TestRolesMigrationMatchesDefaultRoles(t *testing.T) {
+	migrations, err := Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var up string
+	for _, m := range migrations {
+		if m.Name == "roles" {
+			up = m.Up
+		}
+	}
+	if up == "" {
+		t.Fatal("no roles migration")
+	}
+
+	seeded := make(map[string]users.Role)
+	for _, row := range seededRole.FindAllStringSubmatch(up, -1) {
+		permissions, err := strconv.ParseUint(row[3], 10, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seeded[row[1]] = users.Role{Name: row[1], Description: row[2], Permissions: uint(permissions)}
+	}
+
+	if len(seeded) != len(users.DefaultRoles) {
+		t.Errorf("roles migration seeds %d roles, DefaultRoles has %d", len(seeded), len(users.DefaultRoles))
+	}
+	for _, want := range users.DefaultRoles {
+		got, ok := seeded[want.Name]
+		if !ok {
+			t.Errorf("roles migration does not seed %q", want.Name)
+			continue
+		}
+		if got != want {
+			t.Errorf("roles migration seeds %+v, DefaultRoles has %+v", got, want)
+		}
+	}
+}
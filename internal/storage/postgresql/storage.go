@@ -2,12 +2,16 @@ package database
 
 import (
 	"context"
+	"crypto/rand"
 	"database/sql"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
-	_ "github.com/lib/pq" // PostgreSQL driver import
+	"github.com/lib/pq" // PostgreSQL driver import
 	users "github.com/mipt-kp-2024-go-beer/user-service/internal"
 	"github.com/mipt-kp-2024-go-beer/user-service/internal/oops"
 )
@@ -16,6 +20,53 @@ type Storage struct {
 	db *sql.DB
 }
 
+// userColumns are the columns read by scanUser, the users row must be aliased as u.
+const userColumns = `u.id, u.login, u.password, u.permissions, u.status, u.version,
+	COALESCE(u.email, ''), u.email_verified, u.display_name, u.attributes, u.created_at, u.updated_at,
+	ARRAY(SELECT role FROM user_roles WHERE user_id = u.id ORDER BY role)`
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanUser(row scanner) (users.User, error) {
+	var user users.User
+	var attributes []byte
+	err := row.Scan(&user.ID, &user.Login, &user.Password, &user.Permissions, &user.Status, &user.Version,
+		&user.Email, &user.EmailVerified, &user.DisplayName, &attributes, &user.CreatedAt, &user.UpdatedAt, pq.Array(&user.Roles))
+	if err != nil {
+		return user, err
+	}
+	return user, json.Unmarshal(attributes, &user.Attributes)
+}
+
+// duplicate translates a unique_violation into the duplicate error of the violated column, nil for other errors.
+func duplicate(err error) error {
+	pqErr, ok := err.(*pq.Error)
+	if !ok || pqErr.Code != "23505" {
+		return nil
+	}
+	if pqErr.Constraint == "users_email_key" {
+		return oops.ErrDuplicateEmail
+	}
+	return oops.ErrDuplicateUser
+}
+
+// userID parses a user ID for the SERIAL id column. IDs that are not numbers, such as a mistyped path
+// or the client ID of a service account, name no user and are refused before Postgres fails to cast them.
+func userID(ID string) (int32, error) {
+	id, err := strconv.ParseInt(ID, 10, 32)
+	if err != nil {
+		return 0, oops.ErrNoUser
+	}
+	return int32(id), nil
+}
+
+// escapeLike escapes the LIKE wildcards of a literal pattern prefix.
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(value)
+}
+
 func NewStorage(dataSourceName string) (*Storage, error) {
 	db, err := sql.Open("postgres", dataSourceName)
 	if err != nil {
@@ -29,8 +80,58 @@ func NewStorage(dataSourceName string) (*Storage, error) {
 	return &Storage{db: db}, nil
 }
 
-func (s *Storage) LoadUsers(ctx context.Context) ([]users.User, error) {
-	rows, err := s.db.QueryContext(ctx, "SELECT id, login, password, permissions FROM users")
+func (s *Storage) LoadUsers(ctx context.Context, query users.UserQuery) ([]users.User, error) {
+	var where []string
+	var args []any
+	arg := func(v any) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if query.LoginPrefix != "" {
+		where = append(where, "u.login LIKE "+arg(escapeLike(query.LoginPrefix)+"%"))
+	}
+	if query.Status != "" {
+		where = append(where, "u.status = "+arg(query.Status))
+	}
+	if query.Email != "" {
+		where = append(where, "u.email = "+arg(query.Email))
+	}
+	if query.Role != "" {
+		where = append(where, "EXISTS (SELECT 1 FROM user_roles ur WHERE ur.user_id = u.id AND ur.role = "+arg(query.Role)+")")
+	}
+	if query.Permission != 0 {
+		p := arg(query.Permission)
+		where = append(where, fmt.Sprintf("(%s & %s) = %s", effectivePermissions, p, p))
+	}
+
+	column, direction, compare := "u.login", "ASC", ">"
+	if strings.TrimPrefix(query.Sort, "-") == users.SortID {
+		column = "u.id"
+	}
+	if strings.HasPrefix(query.Sort, "-") {
+		direction, compare = "DESC", "<"
+	}
+
+	if query.After != nil {
+		after, err := userID(query.After.ID)
+		if err != nil {
+			return nil, fmt.Errorf("%w: malformed cursor", oops.ErrInvalidQuery)
+		}
+		if column == "u.id" {
+			where = append(where, fmt.Sprintf("u.id %s %s", compare, arg(after)))
+		} else {
+			where = append(where, fmt.Sprintf("(u.login, u.id) %s (%s, %s)", compare, arg(query.After.Key), arg(after)))
+		}
+	}
+
+	sqlQuery := "SELECT " + userColumns + " FROM users u"
+	if len(where) > 0 {
+		sqlQuery += " WHERE " + strings.Join(where, " AND ")
+	}
+	sqlQuery += fmt.Sprintf(" ORDER BY %s %s, u.id %s LIMIT %s", column, direction, direction, arg(query.Limit))
+
+	rows, err := s.db.QueryContext(ctx, sqlQuery, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -39,8 +140,8 @@ func (s *Storage) LoadUsers(ctx context.Context) ([]users.User, error) {
 	var output []users.User
 
 	for rows.Next() {
-		var user users.User
-		if err := rows.Scan(&user.ID, &user.Login, &user.Password, &user.Permissions); err != nil {
+		user, err := scanUser(rows)
+		if err != nil {
 			return nil, err
 		}
 		output = append(output, user)
@@ -53,33 +154,32 @@ func (s *Storage) LoadUsers(ctx context.Context) ([]users.User, error) {
 	return output, nil
 }
 
-func (s *Storage) CheckUser(ctx context.Context, user users.User) (string, error) {
-	var id string
-	err := s.db.QueryRowContext(ctx, "SELECT id FROM users WHERE login = $1 AND password = $2", user.Login, user.Password).Scan(&id)
+func (s *Storage) UserByLogin(ctx context.Context, login string) (users.User, error) {
+	user, err := scanUser(s.db.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users u WHERE u.login = $1", login))
 
 	if err == sql.ErrNoRows {
-		return "", oops.ErrNoUser
+		return users.User{}, oops.ErrNoUser
 	} else if err != nil {
-		return "", err
+		return users.User{}, err
 	}
 
-	return id, nil
+	return user, nil
 }
 
 func (s *Storage) CheckToken(ctx context.Context, access string) (users.Token, error) {
-	var token users.Token
-	bytes := []byte(access)
-	err := s.db.QueryRowContext(ctx, "SELECT refresh_token, expiration FROM tokens WHERE access_token = $1", hex.EncodeToString(bytes)).Scan(&token.Refresh, &token.Expiration)
-
-	fmt.Printf("%s", err)
+	token := users.Token{Access: access}
+	err := s.db.QueryRowContext(ctx,
+		"SELECT refresh_token, issued_at, expiration, refresh_expiration, family_id, consumed FROM tokens WHERE access_token = $1", access).
+		Scan(&token.Refresh, &token.IssuedAt, &token.Expiration, &token.RefreshExpiration, &token.Family, &token.Consumed)
 
+	// nil error means the token is not taken
 	if err == sql.ErrNoRows {
 		return users.Token{}, nil
 	} else if err != nil {
 		return users.Token{}, err
 	}
 
-	return token, nil
+	return token, oops.ErrDupAccess
 }
 
 func (s *Storage) Close() error {
@@ -95,9 +195,18 @@ func (s *Storage) SaveUser(ctx context.Context, user users.User) (id string, err
 		return "", err
 	}
 
+	attributes, err := json.Marshal(user.Attributes)
+	if err != nil {
+		return "", err
+	}
+
 	err = s.db.QueryRowContext(ctx,
-		"INSERT INTO users (login, password, permissions) VALUES ($1, $2, $3) RETURNING id",
-		user.Login, user.Password, user.Permissions).Scan(&id)
+		`INSERT INTO users (login, password, permissions, status, email, display_name, attributes)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6, $7) RETURNING id`,
+		user.Login, user.Password, user.Permissions, user.Status, user.Email, user.DisplayName, attributes).Scan(&id)
+	if dup := duplicate(err); dup != nil {
+		return "", dup
+	}
 	if err != nil {
 		return "", fmt.Errorf("failed to save user: %w", err)
 	}
@@ -106,7 +215,7 @@ func (s *Storage) SaveUser(ctx context.Context, user users.User) (id string, err
 }
 
 func (s *Storage) LoadTokens(ctx context.Context) ([]users.Token, error) {
-	rows, err := s.db.QueryContext(ctx, "SELECT access_token, refresh_token, expiration FROM tokens")
+	rows, err := s.db.QueryContext(ctx, "SELECT access_token, refresh_token, issued_at, expiration, refresh_expiration, family_id, consumed FROM tokens")
 	if err != nil {
 		return nil, err
 	}
@@ -115,7 +224,7 @@ func (s *Storage) LoadTokens(ctx context.Context) ([]users.Token, error) {
 	var tokens []users.Token
 	for rows.Next() {
 		var token users.Token
-		if err := rows.Scan(&token.Access, &token.Refresh, &token.Expiration); err != nil {
+		if err := rows.Scan(&token.Access, &token.Refresh, &token.IssuedAt, &token.Expiration, &token.RefreshExpiration, &token.Family, &token.Consumed); err != nil {
 			return nil, err
 		}
 		tokens = append(tokens, token)
@@ -142,13 +251,106 @@ func (s *Storage) GetSessionID(ctx context.Context, access string) (string, erro
 }
 
 func (s *Storage) SaveToken(ctx context.Context, token users.Token, ID string) error {
-	bytes_access := []byte(token.Access)
-	bytes_refresh := []byte(token.Refresh)
 	_, err := s.db.ExecContext(ctx,
-		"INSERT INTO tokens (access_token, refresh_token, expiration, user_id) VALUES ($1, $2, $3, $4)",
-		hex.EncodeToString(bytes_access), hex.EncodeToString(bytes_refresh), token.Expiration, ID)
+		"INSERT INTO tokens (access_token, refresh_token, issued_at, expiration, refresh_expiration, family_id, user_id) VALUES ($1, $2, $3, $4, $5, $6, $7)",
+		token.Access, token.Refresh, token.IssuedAt, token.Expiration, token.RefreshExpiration, token.Family, ID)
+	return err
+}
+
+func (s *Storage) CreateFamily(ctx context.Context, ID string, client users.ClientInfo) (string, error) {
+	family, err := newFamilyID()
+	if err != nil {
+		return "", err
+	}
+
+	_, err = s.db.ExecContext(ctx, "INSERT INTO token_families (id, user_id, ip, user_agent, device, mfa) VALUES ($1, $2, $3, $4, $5, $6)",
+		family, ID, client.IP, client.UserAgent, client.Device, client.MFA)
+	if err != nil {
+		return "", fmt.Errorf("failed to create token family: %w", err)
+	}
+
+	return family, nil
+}
 
-	fmt.Printf("%s", err)
+func (s *Storage) TouchFamily(ctx context.Context, family string) error {
+	// busy sessions are written once per interval
+	_, err := s.db.ExecContext(ctx, "UPDATE token_families SET last_used_at = now() WHERE id = $1 AND last_used_at < $2",
+		family, time.Now().Add(-users.SessionTouchInterval))
+	return err
+}
+
+func (s *Storage) Sessions(ctx context.Context, ID string) ([]users.Session, error) {
+	id, err := userID(ID)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT f.id, f.created_at, f.last_used_at, f.ip, f.user_agent, f.device, f.mfa
+		FROM token_families f
+		WHERE f.user_id = $1 AND EXISTS (
+			SELECT 1 FROM tokens t WHERE t.family_id = f.id AND NOT t.consumed AND t.refresh_expiration > now()
+		)
+		ORDER BY f.last_used_at DESC`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []users.Session
+	for rows.Next() {
+		var session users.Session
+		if err := rows.Scan(&session.ID, &session.CreatedAt, &session.LastUsedAt, &session.IP, &session.UserAgent, &session.Device, &session.MFA); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+func (s *Storage) TokenByRefresh(ctx context.Context, refresh string) (users.Token, string, error) {
+	token := users.Token{Refresh: refresh}
+	var userID string
+	err := s.db.QueryRowContext(ctx,
+		"SELECT access_token, issued_at, expiration, refresh_expiration, family_id, consumed, user_id FROM tokens WHERE refresh_token = $1", refresh).
+		Scan(&token.Access, &token.IssuedAt, &token.Expiration, &token.RefreshExpiration, &token.Family, &token.Consumed, &userID)
+
+	if err == sql.ErrNoRows {
+		return users.Token{}, "", oops.ErrNoRefresh
+	} else if err != nil {
+		return users.Token{}, "", err
+	}
+
+	return token, userID, nil
+}
+
+func (s *Storage) ConsumeRefresh(ctx context.Context, refresh string) error {
+	// the access token of a rotated pair dies together with its refresh token
+	res, err := s.db.ExecContext(ctx,
+		"UPDATE tokens SET consumed = true, expiration = LEAST(expiration, now()) WHERE refresh_token = $1 AND NOT consumed", refresh)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return oops.ErrRefreshReused
+	}
+
+	return nil
+}
+
+func (s *Storage) RevokeFamily(ctx context.Context, family string) error {
+	// tokens of the family are removed by the cascade
+	_, err := s.db.ExecContext(ctx, "DELETE FROM token_families WHERE id = $1", family)
 	return err
 }
 
@@ -165,14 +367,49 @@ func (s *Storage) TokenExpired(ctx context.Context, access string) (bool, error)
 	return time.Now().After(expiration), nil
 }
 
+func (s *Storage) RevokeUserTokens(ctx context.Context, ID string) error {
+	id, err := userID(ID)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.ExecContext(ctx, "DELETE FROM token_families WHERE user_id = $1", id)
+	return err
+}
+
+// Introspect returns the token with its user, whose permissions include those of its roles.
+func (s *Storage) Introspect(ctx context.Context, access string) (users.Token, users.User, error) {
+	token := users.Token{Access: access}
+	var user users.User
+	err := s.db.QueryRowContext(ctx, `
+		SELECT t.refresh_token, t.issued_at, t.expiration, t.refresh_expiration, t.family_id, t.consumed,
+		       u.id, u.login, `+effectivePermissions+`
+		FROM tokens t JOIN users u ON u.id = t.user_id
+		WHERE t.access_token = $1`, access).
+		Scan(&token.Refresh, &token.IssuedAt, &token.Expiration, &token.RefreshExpiration, &token.Family, &token.Consumed,
+			&user.ID, &user.Login, &user.Permissions)
+
+	if err == sql.ErrNoRows {
+		return users.Token{}, users.User{}, oops.ErrTokenExistance
+	} else if err != nil {
+		return users.Token{}, users.User{}, err
+	}
+
+	return token, user, nil
+}
+
 func (s *Storage) PopToken(ctx context.Context, access string) error {
 	_, err := s.db.ExecContext(ctx, "DELETE FROM tokens WHERE access_token = $1", access)
 	return err
 }
 
 func (s *Storage) User(ctx context.Context, ID string) (users.User, error) {
-	var user users.User
-	err := s.db.QueryRowContext(ctx, "SELECT id, login, password, permissions FROM users WHERE id = $1", ID).Scan(&user.ID, &user.Login, &user.Password, &user.Permissions)
+	id, err := userID(ID)
+	if err != nil {
+		return users.User{}, err
+	}
+
+	user, err := scanUser(s.db.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users u WHERE u.id = $1", id))
 
 	if err == sql.ErrNoRows {
 		return users.User{}, oops.ErrNoUser
@@ -184,7 +421,12 @@ func (s *Storage) User(ctx context.Context, ID string) (users.User, error) {
 }
 
 func (s *Storage) PopUser(ctx context.Context, ID string) error {
-	res, err := s.db.ExecContext(ctx, "DELETE FROM users WHERE id = $1", ID)
+	id, err := userID(ID)
+	if err != nil {
+		return err
+	}
+
+	res, err := s.db.ExecContext(ctx, "DELETE FROM users WHERE id = $1", id)
 	if err != nil {
 		return err
 	}
@@ -201,19 +443,100 @@ func (s *Storage) PopUser(ctx context.Context, ID string) error {
 }
 
 func (s *Storage) ChangeUser(ctx context.Context, user users.User) (users.User, error) {
-	_, err := s.db.ExecContext(ctx, "UPDATE users SET login = $1, password = $2, permissions = $3 WHERE id = $4",
-		user.Login, user.Password, user.Permissions, user.ID)
+	id, err := userID(user.ID)
+	if err != nil {
+		return users.User{}, err
+	}
+
+	attributes, err := json.Marshal(user.Attributes)
+	if err != nil {
+		return users.User{}, err
+	}
+
+	err = s.db.QueryRowContext(ctx, `UPDATE users SET login = $1, password = $2, permissions = $3, status = $4,
+		email = NULLIF($5, ''), email_verified = $6, display_name = $7, attributes = $8, updated_at = now(), version = version + 1
+		WHERE id = $9 AND version = $10 RETURNING version, updated_at`,
+		user.Login, user.Password, user.Permissions, user.Status, user.Email, user.EmailVerified, user.DisplayName, attributes,
+		id, user.Version).Scan(&user.Version, &user.UpdatedAt)
+	if dup := duplicate(err); dup != nil {
+		return users.User{}, dup
+	}
+	if err == sql.ErrNoRows {
+		return users.User{}, s.versionConflict(ctx, user.ID)
+	}
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return users.User{}, oops.ErrNoUser
-		}
 		return users.User{}, fmt.Errorf("failed to update user: %w", err)
 	}
 	return user, nil
 }
 
-func (s *Storage) SetPermission(ctx context.Context, ID string, Permissions uint) error {
-	res, err := s.db.ExecContext(ctx, "UPDATE users SET permissions = $1 WHERE id = $2", Permissions, ID)
+func (s *Storage) SetPermission(ctx context.Context, ID string, Permissions uint, version int64) (int64, error) {
+	id, err := userID(ID)
+	if err != nil {
+		return 0, err
+	}
+
+	err = s.db.QueryRowContext(ctx, `UPDATE users SET permissions = $1, updated_at = now(), version = version + 1
+		WHERE id = $2 AND version = $3 RETURNING version`, Permissions, id, version).Scan(&version)
+	if err == sql.ErrNoRows {
+		return 0, s.versionConflict(ctx, ID)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+// versionConflict tells a stale version from a missing user after a versioned update matched no row.
+func (s *Storage) versionConflict(ctx context.Context, ID string) error {
+	var exists bool
+	if err := s.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM users WHERE id = $1)", ID).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return oops.ErrVersionMismatch
+	}
+	return oops.ErrNoUser
+}
+
+func (s *Storage) SetPassword(ctx context.Context, ID string, password string) error {
+	id, err := userID(ID)
+	if err != nil {
+		return err
+	}
+
+	res, err := s.db.ExecContext(ctx, "UPDATE users SET password = $1, updated_at = now(), version = version + 1 WHERE id = $2", password, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return oops.ErrNoUser
+	}
+	return nil
+}
+
+func newFamilyID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(id), nil
+}
+
+func (s *Storage) VerifyEmail(ctx context.Context, ID string, email string) error {
+	id, err := userID(ID)
+	if err != nil {
+		return err
+	}
+
+	res, err := s.db.ExecContext(ctx, `UPDATE users SET email_verified = true, updated_at = now(), version = version + 1
+		WHERE id = $1 AND email = $2`, id, email)
 	if err != nil {
 		return err
 	}
@@ -227,3 +550,479 @@ func (s *Storage) SetPermission(ctx context.Context, ID string, Permissions uint
 	}
 	return nil
 }
+
+func (s *Storage) SaveActionToken(ctx context.Context, token users.ActionToken) error {
+	// expired tokens are never consumed, drop them while at it
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM action_tokens WHERE expires_at < now()"); err != nil {
+		return err
+	}
+
+	_, err := s.db.ExecContext(ctx,
+		"INSERT INTO action_tokens (token_hash, user_id, purpose, email, expires_at) VALUES ($1, $2, $3, $4, $5)",
+		token.Hash, token.UserID, token.Purpose, token.Email, token.ExpiresAt)
+	return err
+}
+
+// ConsumeActionToken deletes the token so that concurrent requests cannot both use it.
+func (s *Storage) ConsumeActionToken(ctx context.Context, hash string, purpose string) (users.ActionToken, error) {
+	token := users.ActionToken{Hash: hash, Purpose: purpose}
+	err := s.db.QueryRowContext(ctx,
+		"DELETE FROM action_tokens WHERE token_hash = $1 AND purpose = $2 RETURNING user_id, email, expires_at", hash, purpose).
+		Scan(&token.UserID, &token.Email, &token.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return users.ActionToken{}, oops.ErrActionToken
+	} else if err != nil {
+		return users.ActionToken{}, err
+	}
+
+	return token, nil
+}
+
+func (s *Storage) ActionToken(ctx context.Context, hash string, purpose string) (users.ActionToken, error) {
+	token := users.ActionToken{Hash: hash, Purpose: purpose}
+	err := s.db.QueryRowContext(ctx,
+		"SELECT user_id, email, expires_at FROM action_tokens WHERE token_hash = $1 AND purpose = $2", hash, purpose).
+		Scan(&token.UserID, &token.Email, &token.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return users.ActionToken{}, oops.ErrActionToken
+	} else if err != nil {
+		return users.ActionToken{}, err
+	}
+
+	return token, nil
+}
+
+func (s *Storage) PopActionTokens(ctx context.Context, ID string, purpose string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM action_tokens WHERE user_id = $1 AND purpose = $2", ID, purpose)
+	return err
+}
+
+func (s *Storage) Attempts(ctx context.Context, key string) (users.Attempts, error) {
+	var attempts users.Attempts
+	err := s.db.QueryRowContext(ctx, "SELECT failures, last_failure FROM login_attempts WHERE key = $1", key).
+		Scan(&attempts.Failures, &attempts.Last)
+	if err == sql.ErrNoRows {
+		return users.Attempts{}, nil
+	}
+	return attempts, err
+}
+
+// ReserveAttempt counts the failure in a single statement, compared against the failures the caller saw,
+// so that concurrent attempts on replicas cannot all pass the check. Stale counts of the key start over,
+// other keys are not touched.
+func (s *Storage) ReserveAttempt(ctx context.Context, key string, seen int, window time.Duration) (users.Attempts, bool, error) {
+	var attempts users.Attempts
+	err := s.db.QueryRowContext(ctx, `
+		INSERT INTO login_attempts (key, failures, last_failure) VALUES ($1, 1, now())
+		ON CONFLICT (key) DO UPDATE SET
+			failures = CASE WHEN login_attempts.last_failure < now() - make_interval(secs => $2)
+				THEN 1 ELSE login_attempts.failures + 1 END,
+			last_failure = now()
+		WHERE login_attempts.failures = $3
+		RETURNING failures, last_failure`, key, window.Seconds(), seen).
+		Scan(&attempts.Failures, &attempts.Last)
+	if err == sql.ErrNoRows {
+		return users.Attempts{}, false, nil
+	}
+	return attempts, err == nil, err
+}
+
+func (s *Storage) ReleaseAttempt(ctx context.Context, key string) error {
+	_, err := s.db.ExecContext(ctx,
+		"UPDATE login_attempts SET failures = failures - 1 WHERE key = $1 AND failures > 0", key)
+	return err
+}
+
+func (s *Storage) ResetAttempts(ctx context.Context, key string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM login_attempts WHERE key = $1", key)
+	return err
+}
+
+func (s *Storage) TOTP(ctx context.Context, ID string) (users.TOTPEnrollment, error) {
+	id, err := userID(ID)
+	if err != nil {
+		return users.TOTPEnrollment{}, err
+	}
+
+	var enrollment users.TOTPEnrollment
+	err = s.db.QueryRowContext(ctx, "SELECT secret, confirmed, last_step FROM totp WHERE user_id = $1", id).
+		Scan(&enrollment.Secret, &enrollment.Confirmed, &enrollment.LastStep)
+	if err == sql.ErrNoRows {
+		return users.TOTPEnrollment{}, oops.ErrNoTOTP
+	} else if err != nil {
+		return users.TOTPEnrollment{}, err
+	}
+
+	return enrollment, nil
+}
+
+func (s *Storage) SaveTOTP(ctx context.Context, ID string, secret string) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO totp (user_id, secret) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET secret = EXCLUDED.secret, confirmed = false, last_step = 0`, ID, secret)
+	return err
+}
+
+func (s *Storage) ConfirmTOTP(ctx context.Context, ID string, step int64) error {
+	res, err := s.db.ExecContext(ctx, "UPDATE totp SET confirmed = true, last_step = $2 WHERE user_id = $1", ID, step)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return oops.ErrNoTOTP
+	}
+	return nil
+}
+
+// UseTOTPStep advances the last accepted step, so that concurrent requests cannot both use a code.
+func (s *Storage) UseTOTPStep(ctx context.Context, ID string, step int64) error {
+	res, err := s.db.ExecContext(ctx,
+		"UPDATE totp SET last_step = $2 WHERE user_id = $1 AND confirmed AND last_step < $2", ID, step)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return oops.ErrMFACode
+	}
+	return nil
+}
+
+func (s *Storage) PopTOTP(ctx context.Context, ID string) error {
+	id, err := userID(ID)
+	if err != nil {
+		return err
+	}
+
+	res, err := s.db.ExecContext(ctx, `WITH codes AS (DELETE FROM recovery_codes WHERE user_id = $1)
+		DELETE FROM totp WHERE user_id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return oops.ErrNoTOTP
+	}
+	return nil
+}
+
+func (s *Storage) SaveRecoveryCodes(ctx context.Context, ID string, hashes []string) error {
+	_, err := s.db.ExecContext(ctx, `WITH old AS (DELETE FROM recovery_codes WHERE user_id = $1)
+		INSERT INTO recovery_codes (user_id, code_hash) SELECT $1, unnest($2::TEXT[])`, ID, pq.Array(hashes))
+	return err
+}
+
+// UseRecoveryCode deletes the code so that concurrent requests cannot both use it.
+func (s *Storage) UseRecoveryCode(ctx context.Context, ID string, hash string) error {
+	res, err := s.db.ExecContext(ctx, "DELETE FROM recovery_codes WHERE user_id = $1 AND code_hash = $2", ID, hash)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return oops.ErrMFACode
+	}
+	return nil
+}
+
+func (s *Storage) CountRecoveryCodes(ctx context.Context, ID string) (int, error) {
+	id, err := userID(ID)
+	if err != nil {
+		return 0, err
+	}
+
+	var count int
+	err = s.db.QueryRowContext(ctx, "SELECT count(*) FROM recovery_codes WHERE user_id = $1", id).Scan(&count)
+	return count, err
+}
+
+func (s *Storage) FamilyMFA(ctx context.Context, family string) (bool, error) {
+	var mfa bool
+	err := s.db.QueryRowContext(ctx, "SELECT mfa FROM token_families WHERE id = $1", family).Scan(&mfa)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return mfa, err
+}
+
+func (s *Storage) MFAPolicy(ctx context.Context) (uint, error) {
+	var permissions uint
+	err := s.db.QueryRowContext(ctx, "SELECT permissions FROM mfa_policy").Scan(&permissions)
+	return permissions, err
+}
+
+func (s *Storage) SetMFAPolicy(ctx context.Context, permissions uint) error {
+	_, err := s.db.ExecContext(ctx, "UPDATE mfa_policy SET permissions = $1", permissions)
+	return err
+}
+
+const passkeyColumns = "id, user_id, name, public_key, sign_count, created_at, last_used_at"
+
+func scanPasskey(row scanner) (users.Passkey, error) {
+	var passkey users.Passkey
+	err := row.Scan(&passkey.ID, &passkey.UserID, &passkey.Name, &passkey.PublicKey, &passkey.SignCount,
+		&passkey.CreatedAt, &passkey.LastUsedAt)
+	return passkey, err
+}
+
+func (s *Storage) SavePasskey(ctx context.Context, passkey users.Passkey) error {
+	_, err := s.db.ExecContext(ctx, "INSERT INTO passkeys ("+passkeyColumns+") VALUES ($1, $2, $3, $4, $5, $6, $7)",
+		passkey.ID, passkey.UserID, passkey.Name, passkey.PublicKey, passkey.SignCount, passkey.CreatedAt, passkey.LastUsedAt)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		return oops.ErrDuplicatePasskey
+	}
+	return err
+}
+
+func (s *Storage) Passkeys(ctx context.Context, ID string) ([]users.Passkey, error) {
+	id, err := userID(ID)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, "SELECT "+passkeyColumns+" FROM passkeys WHERE user_id = $1 ORDER BY created_at", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	passkeys := []users.Passkey{}
+	for rows.Next() {
+		passkey, err := scanPasskey(rows)
+		if err != nil {
+			return nil, err
+		}
+		passkeys = append(passkeys, passkey)
+	}
+
+	return passkeys, rows.Err()
+}
+
+func (s *Storage) Passkey(ctx context.Context, passkey string) (users.Passkey, error) {
+	val, err := scanPasskey(s.db.QueryRowContext(ctx, "SELECT "+passkeyColumns+" FROM passkeys WHERE id = $1", passkey))
+	if err == sql.ErrNoRows {
+		return users.Passkey{}, oops.ErrNoPasskey
+	}
+	return val, err
+}
+
+// UsePasskey only accepts a growing sign count, so that concurrent logins cannot replay one assertion.
+// Authenticators without a counter always send zero.
+func (s *Storage) UsePasskey(ctx context.Context, passkey string, signCount uint32) error {
+	res, err := s.db.ExecContext(ctx, `UPDATE passkeys SET sign_count = $2, last_used_at = now()
+		WHERE id = $1 AND (sign_count < $2 OR (sign_count = 0 AND $2 = 0))`, passkey, signCount)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		if _, err := s.Passkey(ctx, passkey); err != nil {
+			return err
+		}
+		return oops.ErrSignCount
+	}
+	return nil
+}
+
+func (s *Storage) PopPasskey(ctx context.Context, ID string, passkey string) error {
+	id, err := userID(ID)
+	if err != nil {
+		return err
+	}
+
+	res, err := s.db.ExecContext(ctx, "DELETE FROM passkeys WHERE id = $1 AND user_id = $2", passkey, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return oops.ErrNoPasskey
+	}
+	return nil
+}
+
+const personalTokenColumns = "id, user_id, name, hash, permissions, mfa, created_at, expires_at, last_used_at"
+
+func scanPersonalToken(row scanner) (users.PersonalToken, error) {
+	var token users.PersonalToken
+	err := row.Scan(&token.ID, &token.UserID, &token.Name, &token.Hash, &token.Permissions, &token.MFA,
+		&token.CreatedAt, &token.ExpiresAt, &token.LastUsedAt)
+	return token, err
+}
+
+func (s *Storage) SavePersonalToken(ctx context.Context, token users.PersonalToken) error {
+	_, err := s.db.ExecContext(ctx, "INSERT INTO personal_tokens ("+personalTokenColumns+") VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)",
+		token.ID, token.UserID, token.Name, token.Hash, token.Permissions, token.MFA, token.CreatedAt, token.ExpiresAt, token.LastUsedAt)
+	return err
+}
+
+func (s *Storage) PersonalTokens(ctx context.Context, ID string) ([]users.PersonalToken, error) {
+	id, err := userID(ID)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, "SELECT "+personalTokenColumns+" FROM personal_tokens WHERE user_id = $1 ORDER BY created_at", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []users.PersonalToken{}
+	for rows.Next() {
+		token, err := scanPersonalToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+
+	return tokens, rows.Err()
+}
+
+func (s *Storage) UsePersonalToken(ctx context.Context, hash string) (users.PersonalToken, error) {
+	token, err := scanPersonalToken(s.db.QueryRowContext(ctx,
+		"UPDATE personal_tokens SET last_used_at = now() WHERE hash = $1 RETURNING "+personalTokenColumns, hash))
+	if err == sql.ErrNoRows {
+		return users.PersonalToken{}, oops.ErrNoPersonalToken
+	}
+	return token, err
+}
+
+func (s *Storage) PopPersonalToken(ctx context.Context, ID string, token string) error {
+	id, err := userID(ID)
+	if err != nil {
+		return err
+	}
+
+	res, err := s.db.ExecContext(ctx, "DELETE FROM personal_tokens WHERE id = $1 AND user_id = $2", token, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return oops.ErrNoPersonalToken
+	}
+	return nil
+}
+
+func (s *Storage) PopPersonalTokens(ctx context.Context, ID string) error {
+	id, err := userID(ID)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.ExecContext(ctx, "DELETE FROM personal_tokens WHERE user_id = $1", id)
+	return err
+}
+
+const serviceAccountColumns = "client_id, name, secret_hash, permissions, status, created_at, rotated_at"
+
+func scanServiceAccount(row scanner) (users.ServiceAccount, error) {
+	var account users.ServiceAccount
+	err := row.Scan(&account.ClientID, &account.Name, &account.SecretHash, &account.Permissions, &account.Status,
+		&account.CreatedAt, &account.RotatedAt)
+	return account, err
+}
+
+func (s *Storage) SaveServiceAccount(ctx context.Context, account users.ServiceAccount) error {
+	_, err := s.db.ExecContext(ctx, "INSERT INTO service_accounts ("+serviceAccountColumns+") VALUES ($1, $2, $3, $4, $5, $6, $7)",
+		account.ClientID, account.Name, account.SecretHash, account.Permissions, account.Status, account.CreatedAt, account.RotatedAt)
+	return err
+}
+
+func (s *Storage) ServiceAccounts(ctx context.Context) ([]users.ServiceAccount, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT "+serviceAccountColumns+" FROM service_accounts ORDER BY created_at")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	accounts := []users.ServiceAccount{}
+	for rows.Next() {
+		account, err := scanServiceAccount(rows)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, account)
+	}
+
+	return accounts, rows.Err()
+}
+
+func (s *Storage) ServiceAccount(ctx context.Context, clientID string) (users.ServiceAccount, error) {
+	account, err := scanServiceAccount(s.db.QueryRowContext(ctx,
+		"SELECT "+serviceAccountColumns+" FROM service_accounts WHERE client_id = $1", clientID))
+	if err == sql.ErrNoRows {
+		return users.ServiceAccount{}, oops.ErrNoServiceAccount
+	}
+	return account, err
+}
+
+func (s *Storage) ChangeServiceAccount(ctx context.Context, account users.ServiceAccount) error {
+	res, err := s.db.ExecContext(ctx, `UPDATE service_accounts
+		SET name = $2, secret_hash = $3, permissions = $4, status = $5, rotated_at = $6 WHERE client_id = $1`,
+		account.ClientID, account.Name, account.SecretHash, account.Permissions, account.Status, account.RotatedAt)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return oops.ErrNoServiceAccount
+	}
+	return nil
+}
+
+func (s *Storage) SaveServiceToken(ctx context.Context, token users.ServiceToken) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO service_tokens (hash, client_id, permissions, issued_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5)`, token.Hash, token.ClientID, token.Permissions, token.IssuedAt, token.ExpiresAt)
+	return err
+}
+
+func (s *Storage) ServiceToken(ctx context.Context, hash string) (users.ServiceToken, error) {
+	var token users.ServiceToken
+	err := s.db.QueryRowContext(ctx, `SELECT hash, client_id, permissions, issued_at, expires_at
+		FROM service_tokens WHERE hash = $1`, hash).
+		Scan(&token.Hash, &token.ClientID, &token.Permissions, &token.IssuedAt, &token.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return users.ServiceToken{}, oops.ErrTokenExistance
+	}
+	return token, err
+}
+
+func (s *Storage) PopServiceTokens(ctx context.Context, clientID string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM service_tokens WHERE client_id = $1", clientID)
+	return err
+}
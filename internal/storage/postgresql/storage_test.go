@@ -0,0 +1,70 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	users "github.com/mipt-kp-2024-go-beer/user-service/internal"
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/oops"
+)
+
+func TestUserID(t *testing.T) {
+	if id, err := userID("42"); err != nil || id != 42 {
+		t.Errorf("userID(42) = %d, %v, want 42", id, err)
+	}
+
+	for _, ID := range []string{"", "abc", "1.5", " 1", "svc_0123456789abcdef", "2147483648"} {
+		if _, err := userID(ID); !errors.Is(err, oops.ErrNoUser) {
+			t.Errorf("userID(%q) error = %v, want ErrNoUser", ID, err)
+		}
+	}
+}
+
+// TestMalformedIDsSkipQuery runs without a database: malformed IDs must be refused before a query is sent.
+func TestMalformedIDsSkipQuery(t *testing.T) {
+	ctx := context.Background()
+	s := &Storage{}
+
+	for _, ID := range []string{"abc", "svc_0123456789abcdef"} {
+		for name, call := range map[string]func() error{
+			"User":                 func() error { _, err := s.User(ctx, ID); return err },
+			"ChangeUser":           func() error { _, err := s.ChangeUser(ctx, users.User{ID: ID}); return err },
+			"PopUser":              func() error { return s.PopUser(ctx, ID) },
+			"SetPermission":        func() error { _, err := s.SetPermission(ctx, ID, 0, 1); return err },
+			"EffectivePermissions": func() error { _, err := s.EffectivePermissions(ctx, ID); return err },
+			"AssignRole":           func() error { return s.AssignRole(ctx, ID, "reader") },
+			"Sessions":             func() error { _, err := s.Sessions(ctx, ID); return err },
+			"RevokeUserTokens":     func() error { return s.RevokeUserTokens(ctx, ID) },
+			"PersonalTokens":       func() error { _, err := s.PersonalTokens(ctx, ID); return err },
+			"PopPersonalTokens":    func() error { return s.PopPersonalTokens(ctx, ID) },
+		} {
+			if err := call(); !errors.Is(err, oops.ErrNoUser) {
+				t.Errorf("%s(%q) error = %v, want ErrNoUser", name, ID, err)
+			}
+		}
+	}
+
+	for _, sort := range []string{users.SortLogin, users.SortID} {
+		query := users.UserQuery{Sort: sort, Limit: 10, After: &users.UserCursor{Sort: sort, Key: "alice", ID: "abc"}}
+		if _, err := s.LoadUsers(ctx, query); !errors.Is(err, oops.ErrInvalidQuery) {
+			t.Errorf("LoadUsers() sorted by %s after a malformed cursor error = %v, want ErrInvalidQuery", sort, err)
+		}
+	}
+}
+
+func TestEscapeLike(t *testing.T) {
+	for value, want := range map[string]string{
+		"alice":   "alice",
+		"a_b":     `a\_b`,
+		"100%":    `100\%`,
+		`back\`:   `back\\`,
+		`\_%`:     `\\\_\%`,
+		"":        "",
+		"ünïcode": "ünïcode",
+	} {
+		if got := escapeLike(value); got != want {
+			t.Errorf("escapeLike(%q) = %q, want %q", value, got, want)
+		}
+	}
+}
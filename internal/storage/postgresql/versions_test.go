@@ -0,0 +1,36 @@
+package database
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/storage/storagetest"
+)
+
+// testStore connects to the database named by USER_SERVICE_TEST_DSN and migrates it,
+// the test is skipped without one. Tests leave no rows behind so the database can be reused.
+func testStore(t *testing.T) *Storage {
+	t.Helper()
+
+	dsn := os.Getenv("USER_SERVICE_TEST_DSN")
+	if dsn == "" {
+		t.Skip("USER_SERVICE_TEST_DSN is not set")
+	}
+
+	store, err := NewStorage(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	if err := store.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// TestVersions covers the conditional UPDATE ... WHERE version = $n of the database.
+func TestVersions(t *testing.T) {
+	storagetest.Versions(t, testStore(t))
+}
@@ -0,0 +1,111 @@
+// Package storagetest holds scenarios every implementation of users.Store must pass,
+// so that the memory store used in tests and the database behave alike.
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	users "github.com/mipt-kp-2024-go-beer/user-service/internal"
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/oops"
+)
+
+// unique suffixes names so that the scenario can run against a database that is not empty.
+func unique(name string) string {
+	return name + "-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+}
+
+// Versions checks that every change of a user increments its version and that a change
+// based on an older version is refused with oops.ErrVersionMismatch instead of being applied.
+func Versions(t *testing.T, store users.Store) {
+	ctx := context.Background()
+
+	ID, err := store.SaveUser(ctx, users.User{Login: unique("versions"), Password: "hash", Status: users.StatusActive})
+	if err != nil {
+		t.Fatal(err)
+	}
+	role := users.Role{Name: unique("versions"), Permissions: users.PermQueryUsers}
+	if err := store.SaveRole(ctx, role); err != nil {
+		t.Fatal(err)
+	}
+
+	read := func() users.User {
+		t.Helper()
+		user, err := store.User(ctx, ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return user
+	}
+	changes := func(what string, change func() error) {
+		t.Helper()
+		before := read().Version
+		if err := change(); err != nil {
+			t.Fatalf("%s error = %v", what, err)
+		}
+		if after := read().Version; after <= before {
+			t.Errorf("%s left the version at %d, want it above %d", what, after, before)
+		}
+	}
+
+	stale := read()
+	version, err := store.SetPermission(ctx, ID, users.PermQueryUsers, stale.Version)
+	if err != nil {
+		t.Fatalf("SetPermission() error = %v", err)
+	}
+	if version <= stale.Version || read().Version != version {
+		t.Errorf("SetPermission() = version %d, want the stored version above %d", version, stale.Version)
+	}
+
+	// the conditional writes refuse the version read before
+	if _, err := store.SetPermission(ctx, ID, 0, stale.Version); !errors.Is(err, oops.ErrVersionMismatch) {
+		t.Errorf("SetPermission() with a stale version error = %v, want ErrVersionMismatch", err)
+	}
+	stale.DisplayName = "lost update"
+	if _, err := store.ChangeUser(ctx, stale); !errors.Is(err, oops.ErrVersionMismatch) {
+		t.Errorf("ChangeUser() with a stale version error = %v, want ErrVersionMismatch", err)
+	}
+	if user := read(); user.Permissions != users.PermQueryUsers || user.DisplayName != "" {
+		t.Errorf("user after refused changes = %+v, want them not applied", user)
+	}
+	if _, err := store.SetPermission(ctx, unique("missing"), 0, 1); !errors.Is(err, oops.ErrNoUser) {
+		t.Errorf("SetPermission() of a missing user error = %v, want ErrNoUser", err)
+	}
+
+	current := read()
+	current.DisplayName = "Versions"
+	changed, err := store.ChangeUser(ctx, current)
+	if err != nil {
+		t.Fatalf("ChangeUser() error = %v", err)
+	}
+	if changed.Version <= current.Version {
+		t.Errorf("ChangeUser() = version %d, want above %d", changed.Version, current.Version)
+	}
+
+	// changes outside of the user row are changes of its representation too
+	changes("AssignRole()", func() error { return store.AssignRole(ctx, ID, role.Name) })
+	before := read().Version
+	if err := store.AssignRole(ctx, ID, role.Name); err != nil {
+		t.Fatal(err)
+	}
+	if after := read().Version; after != before {
+		t.Errorf("AssignRole() of an assigned role changed the version from %d to %d", before, after)
+	}
+	changes("UnassignRole()", func() error { return store.UnassignRole(ctx, ID, role.Name) })
+	changes("SetPassword()", func() error { return store.SetPassword(ctx, ID, "rehashed") })
+
+	if err := store.AssignRole(ctx, ID, role.Name); err != nil {
+		t.Fatal(err)
+	}
+	changes("PopRole() of an assigned role", func() error { return store.PopRole(ctx, role.Name) })
+	if roles := read().Roles; len(roles) != 0 {
+		t.Errorf("roles after PopRole() = %v, want none", roles)
+	}
+
+	if err := store.PopUser(ctx, ID); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,229 @@
+package users
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/oops"
+)
+
+// Attempts are the failed logins recorded under one key.
+type Attempts struct {
+	Failures int
+	Last     time.Time // time of the last failure
+}
+
+// AttemptStore counts failed logins per key. Backed by the database it is shared by every replica.
+type AttemptStore interface {
+	// Attempts returns the failures recorded for the key, zero if there are none.
+	Attempts(ctx context.Context, key string) (Attempts, error)
+	// ReserveAttempt atomically adds a failure to the key if it still has seen failures, failures older than
+	// window are forgotten first. It reports false, recording nothing, when another attempt came in between.
+	ReserveAttempt(ctx context.Context, key string, seen int, window time.Duration) (Attempts, bool, error)
+	// ReleaseAttempt takes back a failure reserved for an attempt that turned out to be correct.
+	ReleaseAttempt(ctx context.Context, key string) error
+	// ResetAttempts forgets the failures of the key.
+	ResetAttempts(ctx context.Context, key string) error
+}
+
+// ThrottlePolicy limits failed logins. After every failure of a login or of a client IP the next attempt
+// is delayed by BaseDelay doubled per failure up to MaxDelay, and a login failing Threshold times
+// is locked for Lockout. Failures are forgotten Lockout after the last one.
+type ThrottlePolicy struct {
+	Threshold int
+	Lockout   time.Duration
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+// DefaultThrottle is the policy used for the zero fields of a configured one.
+var DefaultThrottle = ThrottlePolicy{Threshold: 10, Lockout: 15 * time.Minute, BaseDelay: time.Second, MaxDelay: time.Minute}
+
+// ThrottleError rejects a login attempt made too early.
+type ThrottleError struct {
+	Err        error // oops.ErrTooManyAttempts or oops.ErrAccountLocked
+	RetryAfter time.Duration
+}
+
+func (e *ThrottleError) Error() string {
+	return fmt.Sprintf("%s, retry after %d seconds", e.Err, e.Seconds())
+}
+
+// Seconds rounds the wait up to whole seconds as sent in the Retry-After header.
+func (e *ThrottleError) Seconds() int {
+	return max(int(math.Ceil(e.RetryAfter.Seconds())), 1)
+}
+
+func (e *ThrottleError) Unwrap() error {
+	return e.Err
+}
+
+// WithAttempts enables login throttling with the counters kept in the store, zero policy fields keep the default.
+func WithAttempts(store AttemptStore, policy ThrottlePolicy) Option {
+	return func(s *AppService) {
+		if policy.Threshold <= 0 {
+			policy.Threshold = DefaultThrottle.Threshold
+		}
+		if policy.Lockout <= 0 {
+			policy.Lockout = DefaultThrottle.Lockout
+		}
+		if policy.BaseDelay <= 0 {
+			policy.BaseDelay = DefaultThrottle.BaseDelay
+		}
+		if policy.MaxDelay <= 0 {
+			policy.MaxDelay = DefaultThrottle.MaxDelay
+		}
+		s.attempts = store
+		s.throttle = policy
+	}
+}
+
+// loginKey is the attempt counter of a login, kept for unknown logins too so that locks do not reveal which exist.
+func loginKey(login string) string {
+	return "login:" + login
+}
+
+// ipKey is the attempt counter of a client address.
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+// blockedUntil tells when the next attempt is allowed after the recorded failures.
+// @param attempts Attempts recorded for the key.
+// @param lockable bool whether the key is locked after Threshold failures.
+// @return time.Time of the next allowed attempt and whether the key is locked rather than delayed.
+func (p ThrottlePolicy) blockedUntil(attempts Attempts, lockable bool) (time.Time, bool) {
+	if attempts.Failures == 0 {
+		return time.Time{}, false
+	}
+
+	if lockable && attempts.Failures >= p.Threshold {
+		return attempts.Last.Add(p.Lockout), true
+	}
+
+	delay := p.MaxDelay
+	if shift := attempts.Failures - 1; shift < 32 && p.BaseDelay<<shift < p.MaxDelay {
+		delay = p.BaseDelay << shift
+	}
+	return attempts.Last.Add(delay), false
+}
+
+// reserveLogin rejects a login attempt while the login or the client address is delayed or locked,
+// and otherwise counts the attempt as a failure before the credentials are checked. Concurrent guesses
+// therefore see each other: of a burst only the first gets through, the others are delayed.
+// Correct credentials give the reservation back with releaseLogin.
+// @param ctx context.Context carrying the ClientInfo of the request.
+// @param login string login being tried.
+// @return error *ThrottleError if the attempt is made too early.
+func (s *AppService) reserveLogin(ctx context.Context, login string) error {
+	if s.attempts == nil {
+		return nil
+	}
+
+	keys := []string{loginKey(login)}
+	if ip := ClientInfoFrom(ctx).IP; ip != "" {
+		keys = append(keys, ipKey(ip))
+	}
+
+	for i, key := range keys {
+		// a single client address may be shared by many users, so only logins are locked
+		if err := s.reserveKey(ctx, key, i == 0); err != nil {
+			// the attempt is not made, the reservations taken so far are given back
+			for _, reserved := range keys[:i] {
+				if err := s.attempts.ReleaseAttempt(ctx, reserved); err != nil {
+					return err
+				}
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+// reserveKey checks the failures of one key and reserves the attempt on it.
+// @param ctx context.Context for managing the scope of the operation.
+// @param key string attempt counter of a login or client address.
+// @param lockable bool whether the key is locked after Threshold failures.
+// @return error *ThrottleError if the key is delayed or locked.
+func (s *AppService) reserveKey(ctx context.Context, key string, lockable bool) error {
+	const retries = 3
+
+	for range retries {
+		attempts, err := s.attempts.Attempts(ctx, key)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		if until, locked := s.throttle.blockedUntil(attempts, lockable); now.Before(until) {
+			if locked {
+				return &ThrottleError{Err: oops.ErrAccountLocked, RetryAfter: until.Sub(now)}
+			}
+			return &ThrottleError{Err: oops.ErrTooManyAttempts, RetryAfter: until.Sub(now)}
+		}
+
+		// the failures read above may have changed meanwhile, then they are checked again
+		if _, ok, err := s.attempts.ReserveAttempt(ctx, key, attempts.Failures, s.throttle.Lockout); err != nil || ok {
+			return err
+		}
+	}
+
+	return &ThrottleError{Err: oops.ErrTooManyAttempts, RetryAfter: s.throttle.BaseDelay}
+}
+
+// releaseLogin gives back the attempt reserved by reserveLogin once the credentials are correct.
+// The earlier failures of the login are kept while a second factor is pending and forgotten after it.
+// @param ctx context.Context carrying the ClientInfo of the request.
+// @param login string login that was tried.
+// @param forget bool whether the user is fully authenticated, forgetting the failures of the login.
+// @return error if the counters cannot be updated.
+func (s *AppService) releaseLogin(ctx context.Context, login string, forget bool) error {
+	if s.attempts == nil {
+		return nil
+	}
+
+	release := s.attempts.ReleaseAttempt
+	if forget {
+		release = s.attempts.ResetAttempts
+	}
+	if err := release(ctx, loginKey(login)); err != nil {
+		return err
+	}
+
+	if ip := ClientInfoFrom(ctx).IP; ip != "" {
+		return s.attempts.ReleaseAttempt(ctx, ipKey(ip))
+	}
+
+	return nil
+}
+
+// Unlock forgets the failed logins of the user, lifting its lockout, requires PermManageUsers.
+// @param ctx context.Context for managing the scope of the operation.
+// @param token string containing the access token of the caller.
+// @param ID string representing the user ID.
+// @return error indicating if the operation was successful or if an error occurred.
+func (s *AppService) Unlock(ctx context.Context, token string, ID string) error {
+	_, permissions, err := s.caller(ctx, token)
+	if err != nil {
+		return err
+	}
+
+	if permissions&PermManageUsers == 0 {
+		return &PermissionError{Err: oops.ErrWrongPermissions, Missing: PermManageUsers,
+			Detail: "unlocking users requires manage_users"}
+	}
+
+	user, err := s.store.User(ctx, ID)
+	if err != nil {
+		return err
+	}
+
+	if s.attempts == nil {
+		return nil
+	}
+
+	return s.attempts.ResetAttempts(ctx, loginKey(user.Login))
+}
@@ -0,0 +1,175 @@
+package users_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	users "github.com/mipt-kp-2024-go-beer/user-service/internal"
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/oops"
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/storage/memory"
+)
+
+// throttleEnv is a test environment counting failed logins in a memory AttemptStore.
+func throttleEnv(t *testing.T, policy users.ThrottlePolicy) *testEnv {
+	t.Helper()
+	return newTestEnv(t, users.WithAttempts(memory.NewStorage(), policy))
+}
+
+// retryAfter asserts that the login is refused with the error and returns the wait.
+func retryAfter(t *testing.T, err error, want error) time.Duration {
+	t.Helper()
+
+	var throttled *users.ThrottleError
+	if !errors.As(err, &throttled) || !errors.Is(err, want) {
+		t.Fatalf("CreateToken() error = %v, want *ThrottleError of %v", err, want)
+	}
+	return throttled.RetryAfter
+}
+
+func TestThrottleBackoff(t *testing.T) {
+	ctx := context.Background()
+	base := 250 * time.Millisecond
+	env := throttleEnv(t, users.ThrottlePolicy{BaseDelay: base, MaxDelay: 2 * base})
+	env.user(t, "alice", 0)
+
+	for _, want := range []time.Duration{base, 2 * base, 2 * base} {
+		if _, err := env.service.CreateToken(ctx, "alice", "wrong"); !errors.Is(err, oops.ErrInvalidCredentials) {
+			t.Fatalf("CreateToken() with a wrong password error = %v, want ErrInvalidCredentials", err)
+		}
+
+		// even the right password waits for the delay
+		wait := retryAfter(t, fail(env.service.CreateToken(ctx, "alice", "alice-password")), oops.ErrTooManyAttempts)
+		if wait <= 0 || wait > want {
+			t.Errorf("RetryAfter = %v, want at most %v", wait, want)
+		}
+		time.Sleep(want)
+	}
+
+	if _, err := env.service.CreateToken(ctx, "alice", "alice-password"); err != nil {
+		t.Fatalf("CreateToken() after the delay error = %v", err)
+	}
+
+	// a successful login forgets the failures, the next delay starts over
+	env.service.CreateToken(ctx, "alice", "wrong")
+	if wait := retryAfter(t, fail(env.service.CreateToken(ctx, "alice", "wrong")), oops.ErrTooManyAttempts); wait > base {
+		t.Errorf("RetryAfter after a successful login = %v, want at most %v", wait, base)
+	}
+}
+
+func TestThrottleLockout(t *testing.T) {
+	ctx := context.Background()
+	env := throttleEnv(t, users.ThrottlePolicy{Threshold: 3, Lockout: time.Minute, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond})
+	ID, _ := env.user(t, "alice", 0)
+	_, manager := env.user(t, "manager", users.PermQueryUsers|users.PermManageUsers)
+	_, reader := env.user(t, "reader", users.PermQueryUsers)
+
+	for _, login := range []string{"alice", "ghost"} {
+		for i := 0; i < 3; i++ {
+			env.service.CreateToken(ctx, login, "wrong")
+			time.Sleep(2 * time.Millisecond)
+		}
+		// unknown logins are locked alike so that locks do not reveal which logins exist
+		if wait := retryAfter(t, fail(env.service.CreateToken(ctx, login, login+"-password")), oops.ErrAccountLocked); wait <= 59*time.Second {
+			t.Errorf("RetryAfter of a locked login %s = %v, want about a minute", login, wait)
+		}
+	}
+
+	login := newRequest(t, env.public, http.MethodPost, "/v1/sessions", "", map[string]string{"login": "alice", "password": "alice-password"})
+	resp, err := env.public.Client().Do(login)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if seconds, _ := strconv.Atoi(resp.Header.Get("Retry-After")); resp.StatusCode != http.StatusLocked || seconds < 59 {
+		t.Errorf("POST /v1/sessions of a locked login = %d with Retry-After %q, want 423 after about a minute",
+			resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+
+	if status := call(t, env.public, http.MethodDelete, "/v1/users/"+ID+"/lockout", reader.Access, nil, nil); status != http.StatusForbidden {
+		t.Errorf("DELETE /v1/users/{id}/lockout without manage_users = %d, want 403", status)
+	}
+	if status := call(t, env.public, http.MethodDelete, "/v1/users/"+ID+"/lockout", manager.Access, nil, nil); status != http.StatusNoContent {
+		t.Fatalf("DELETE /v1/users/{id}/lockout = %d, want 204", status)
+	}
+
+	if _, err := env.service.CreateToken(ctx, "alice", "alice-password"); err != nil {
+		t.Errorf("CreateToken() after unlocking error = %v", err)
+	}
+}
+
+func TestThrottleClientAddress(t *testing.T) {
+	env := throttleEnv(t, users.ThrottlePolicy{Threshold: 1, Lockout: time.Minute, BaseDelay: time.Minute, MaxDelay: time.Minute})
+	env.user(t, "alice", 0)
+	env.user(t, "bob", 0)
+	env.user(t, "carol", 0)
+
+	from := func(ip string) context.Context {
+		return users.WithClientInfo(context.Background(), users.ClientInfo{IP: ip})
+	}
+
+	// correct credentials give the reserved attempt back, others behind the address are not delayed
+	if _, err := env.service.CreateToken(from("198.51.100.1"), "carol", "carol-password"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.service.CreateToken(from("198.51.100.1"), "bob", "bob-password"); err != nil {
+		t.Fatalf("CreateToken() after a successful login from the address error = %v", err)
+	}
+
+	if _, err := env.service.CreateToken(from("203.0.113.7"), "alice", "wrong"); !errors.Is(err, oops.ErrInvalidCredentials) {
+		t.Fatalf("CreateToken() with a wrong password error = %v, want ErrInvalidCredentials", err)
+	}
+
+	// the address is delayed for every login, but never locked
+	retryAfter(t, fail(env.service.CreateToken(from("203.0.113.7"), "bob", "bob-password")), oops.ErrTooManyAttempts)
+
+	// the login is locked from every address
+	retryAfter(t, fail(env.service.CreateToken(from("198.51.100.1"), "alice", "alice-password")), oops.ErrAccountLocked)
+
+	if _, err := env.service.CreateToken(from("198.51.100.1"), "bob", "bob-password"); err != nil {
+		t.Errorf("CreateToken() of another login from another address error = %v", err)
+	}
+}
+
+func TestThrottleConcurrentGuesses(t *testing.T) {
+	env := throttleEnv(t, users.ThrottlePolicy{Threshold: 3, BaseDelay: time.Minute})
+	env.user(t, "alice", 0)
+
+	const guesses = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, guesses)
+	for i := 0; i < guesses; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := env.service.CreateToken(context.Background(), "alice", "guess-"+strconv.Itoa(i))
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	// the attempt is counted before the password is checked, so the burst cannot pass the check together
+	checked := 0
+	for err := range errs {
+		var throttled *users.ThrottleError
+		switch {
+		case errors.Is(err, oops.ErrInvalidCredentials):
+			checked++
+		case !errors.As(err, &throttled):
+			t.Errorf("CreateToken() error = %v, want ErrInvalidCredentials or *ThrottleError", err)
+		}
+	}
+	if checked != 1 {
+		t.Errorf("%d of %d concurrent guesses were checked, want 1", checked, guesses)
+	}
+}
+
+// fail drops the token of a login expected to fail.
+func fail(_ users.Token, err error) error {
+	return err
+}
@@ -0,0 +1,129 @@
+// Package totp implements the time-based one-time passwords of RFC 6238 as used by authenticator apps:
+// HMAC-SHA1, 6 digits and a 30 second step.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Parameters of the generated codes, the only ones every authenticator app supports.
+const (
+	Digits     = 6
+	Period     = 30 * time.Second
+	SecretSize = 20 // bytes, the HMAC-SHA1 block recommended by RFC 4226
+)
+
+var ErrMalformedSecret = errors.New("malformed totp secret")
+
+// encoding is the unpadded base32 used for secrets in otpauth URIs.
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret returns a new random secret in its base32 form.
+func GenerateSecret() (string, error) {
+	secret := make([]byte, SecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+
+	return encoding.EncodeToString(secret), nil
+}
+
+// decode parses a base32 secret, ignoring case, spaces and padding as typed by users.
+func decode(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.TrimRight(strings.ReplaceAll(secret, " ", ""), "="))
+	key, err := encoding.DecodeString(secret)
+	if err != nil || len(key) == 0 {
+		return nil, ErrMalformedSecret
+	}
+
+	return key, nil
+}
+
+// Step returns the time step the moment falls into.
+func Step(t time.Time) int64 {
+	return t.Unix() / int64(Period/time.Second)
+}
+
+// hotp computes the RFC 4226 code of the counter.
+func hotp(key []byte, counter int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	// dynamic truncation
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", Digits, value%1_000_000)
+}
+
+// Code returns the code of the secret at the given time.
+// @param secret string base32 secret.
+// @param t time.Time moment of the code.
+// @return string code and ErrMalformedSecret if the secret cannot be decoded.
+func Code(secret string, t time.Time) (string, error) {
+	key, err := decode(secret)
+	if err != nil {
+		return "", err
+	}
+
+	return hotp(key, Step(t)), nil
+}
+
+// Validate checks a code against the steps around the given time to tolerate clock drift.
+// The matched step is returned so that callers can refuse a code used before.
+// @param secret string base32 secret.
+// @param code string code typed by the user.
+// @param t time.Time moment of the check.
+// @param skew int number of steps accepted before and after the current one.
+// @return int64 matched step, bool whether the code matched and ErrMalformedSecret if the secret cannot be decoded.
+func Validate(secret string, code string, t time.Time, skew int) (int64, bool, error) {
+	key, err := decode(secret)
+	if err != nil {
+		return 0, false, err
+	}
+
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) != Digits {
+		return 0, false, nil
+	}
+
+	current := Step(t)
+	for delta := -int64(skew); delta <= int64(skew); delta++ {
+		if subtle.ConstantTimeCompare([]byte(hotp(key, current+delta)), []byte(code)) == 1 {
+			return current + delta, true, nil
+		}
+	}
+
+	return 0, false, nil
+}
+
+// URI builds the otpauth:// URI shown as a QR code to enroll the secret in an authenticator app.
+// @param issuer string name of the service shown by the app.
+// @param account string name of the account, usually the login.
+// @param secret string base32 secret.
+// @return string otpauth URI.
+func URI(issuer string, account string, secret string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(Digits))
+	query.Set("period", fmt.Sprint(int(Period/time.Second)))
+
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
@@ -0,0 +1,145 @@
+package totp
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA-1 seed of RFC 6238 appendix B, "12345678901234567890" in base32.
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCodeRFC6238(t *testing.T) {
+	// appendix B lists 8 digit codes, 6 digit codes are their last 6 digits
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, tt := range tests {
+		got, err := Code(rfcSecret, time.Unix(tt.unix, 0))
+		if err != nil {
+			t.Fatalf("Code(%d) error = %v", tt.unix, err)
+		}
+		if got != tt.want {
+			t.Errorf("Code(%d) = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestValidateSkew(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := Step(now)
+
+	codeAt := func(delta int64) string {
+		code, err := Code(rfcSecret, now.Add(time.Duration(delta)*Period))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code
+	}
+
+	tests := []struct {
+		name  string
+		code  string
+		skew  int
+		ok    bool
+		delta int64
+	}{
+		{"current step", codeAt(0), 1, true, 0},
+		{"previous step", codeAt(-1), 1, true, -1},
+		{"next step", codeAt(1), 1, true, 1},
+		{"two steps behind", codeAt(-2), 1, false, 0},
+		{"two steps ahead", codeAt(2), 1, false, 0},
+		{"previous step without skew", codeAt(-1), 0, false, 0},
+		{"spaces typed by the user", codeAt(0)[:3] + " " + codeAt(0)[3:], 1, true, 0},
+		{"too short", codeAt(0)[:5], 1, false, 0},
+		{"too long", codeAt(0) + "0", 1, false, 0},
+		{"wrong code", "000000", 1, false, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			matched, ok, err := Validate(rfcSecret, tt.code, now, tt.skew)
+			if err != nil {
+				t.Fatalf("Validate() error = %v", err)
+			}
+			if ok != tt.ok {
+				t.Fatalf("Validate() ok = %v, want %v", ok, tt.ok)
+			}
+			// the matched step is what replay protection records
+			if ok && matched != step+tt.delta {
+				t.Errorf("Validate() step = %d, want %d", matched, step+tt.delta)
+			}
+		})
+	}
+}
+
+func TestSecretFormats(t *testing.T) {
+	now := time.Unix(59, 0)
+	for _, secret := range []string{
+		strings.ToLower(rfcSecret),
+		"GEZD GNBV GY3T QOJQ GEZD GNBV GY3T QOJQ",
+		rfcSecret + "====",
+	} {
+		if code, err := Code(secret, now); err != nil || code != "287082" {
+			t.Errorf("Code(%q) = %q, %v, want 287082", secret, code, err)
+		}
+	}
+
+	for _, secret := range []string{"", "not base32!", "1"} {
+		if _, err := Code(secret, now); err != ErrMalformedSecret {
+			t.Errorf("Code(%q) error = %v, want ErrMalformedSecret", secret, err)
+		}
+		if _, _, err := Validate(secret, "287082", now, 1); err != ErrMalformedSecret {
+			t.Errorf("Validate(%q) error = %v, want ErrMalformedSecret", secret, err)
+		}
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	first, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first == second {
+		t.Error("GenerateSecret() returned the same secret twice")
+	}
+	key, err := decode(first)
+	if err != nil || len(key) != SecretSize {
+		t.Errorf("GenerateSecret() = %q, want %d bytes of base32", first, SecretSize)
+	}
+}
+
+func TestURI(t *testing.T) {
+	uri, err := url.Parse(URI("Beer Library", "alice@example.org", rfcSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if uri.Scheme != "otpauth" || uri.Host != "totp" || uri.Path != "/Beer Library:alice@example.org" {
+		t.Errorf("URI() = %s, want otpauth://totp/<issuer>:<account>", uri)
+	}
+
+	query := uri.Query()
+	for key, want := range map[string]string{
+		"secret": rfcSecret, "issuer": "Beer Library", "algorithm": "SHA1", "digits": "6", "period": "30",
+	} {
+		if got := query.Get(key); got != want {
+			t.Errorf("URI() %s = %q, want %q", key, got, want)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package users
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/mail"
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/oops"
+)
+
+// Purposes of action tokens, a token is only accepted for the purpose it was issued for.
+const (
+	PurposeVerifyEmail   = "verify_email"
+	PurposeResetPassword = "reset_password"
+	PurposeMFAChallenge  = "mfa_challenge"
+	PurposePasskeyCreate = "passkey_create"
+	PurposePasskeyLogin  = "passkey_login"
+)
+
+// VerificationExpiration is the lifetime of email verification tokens.
+const VerificationExpiration = 24 * time.Hour
+
+// newActionSecret generates the secret mailed to the user and the hash stored in its place.
+// @return string secret, string hash and an error if the random source fails.
+func newActionSecret() (string, string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", err
+	}
+
+	secret := base64.RawURLEncoding.EncodeToString(raw)
+	return secret, hashActionSecret(secret), nil
+}
+
+// hashActionSecret hashes an action token secret, the secrets are random so a fast hash suffices.
+func hashActionSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// actionLink appends the secret to the page of the frontend, the bare secret is returned if there is none.
+// @param page string URL of the page, may be empty.
+// @param secret string action token secret.
+// @return string link or secret to be mailed and an error if the page is not a valid URL.
+func actionLink(page string, secret string) (string, error) {
+	if page == "" {
+		return secret, nil
+	}
+
+	link, err := url.Parse(page)
+	if err != nil {
+		return "", err
+	}
+	query := link.Query()
+	query.Set("token", secret)
+	link.RawQuery = query.Encode()
+
+	return link.String(), nil
+}
+
+// issueAction replaces the pending tokens of the user for the purpose with a new one sent to its email.
+// @param ctx context.Context for managing the scope of the operation.
+// @param user User the token is issued to.
+// @param purpose string one of the Purpose* constants.
+// @param ttl time.Duration lifetime of the token.
+// @return string secret to be mailed and an error if the token cannot be saved.
+func (s *AppService) issueAction(ctx context.Context, user User, purpose string, ttl time.Duration) (string, error) {
+	if err := s.store.PopActionTokens(ctx, user.ID, purpose); err != nil {
+		return "", err
+	}
+
+	secret, hash, err := newActionSecret()
+	if err != nil {
+		return "", err
+	}
+
+	err = s.store.SaveActionToken(ctx, ActionToken{
+		Hash:      hash,
+		UserID:    user.ID,
+		Purpose:   purpose,
+		Email:     user.Email,
+		ExpiresAt: time.Now().Add(ttl),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return secret, nil
+}
+
+// issueVerification replaces the pending verification tokens of the user and mails a new one.
+// Nothing is mailed if the user has no email or it is already verified.
+// @param ctx context.Context for managing the scope of the operation.
+// @param user User whose email is to be verified.
+// @return error if the token cannot be saved or mailed.
+func (s *AppService) issueVerification(ctx context.Context, user User) error {
+	if user.Email == "" || user.EmailVerified {
+		return s.store.PopActionTokens(ctx, user.ID, PurposeVerifyEmail)
+	}
+
+	secret, err := s.issueAction(ctx, user, PurposeVerifyEmail, VerificationExpiration)
+	if err != nil {
+		return err
+	}
+
+	link, err := actionLink(s.verifyURL, secret)
+	if err != nil {
+		return err
+	}
+
+	return s.mailer.Send(ctx, mail.Message{
+		To:      user.Email,
+		Subject: "Confirm your email address",
+		Body: fmt.Sprintf("Confirm that %s belongs to your account %q:\n\n%s\n\n"+
+			"The confirmation expires in %d hours. If you did not expect this message, ignore it.",
+			user.Email, user.Login, link, int(VerificationExpiration.Hours())),
+	})
+}
+
+// logVerification issues a verification after a change that is already saved, a failure only delays the verification.
+func (s *AppService) logVerification(ctx context.Context, user User) {
+	if err := s.issueVerification(ctx, user); err != nil {
+		log.Printf("email verification of user %s: %v", user.ID, err)
+	}
+}
+
+// SendVerification mails a new verification token to the unverified email of the user,
+// by the user itself or by user with corresponding permissions.
+// @param ctx context.Context for managing the scope of the operation.
+// @param token string containing the access token of the caller.
+// @param ID string representing the user ID.
+// @return error if the user has no email or the token cannot be mailed, nil if the email is already verified.
+func (s *AppService) SendVerification(ctx context.Context, token string, ID string) error {
+	callerID, permissions, err := s.caller(ctx, token)
+	if err != nil {
+		return err
+	}
+
+	if callerID != ID && permissions&PermManageUsers == 0 {
+		return oops.ErrWrongPermissions
+	}
+
+	user, err := s.store.User(ctx, ID)
+	if err != nil {
+		return err
+	}
+
+	if user.Email == "" {
+		return oops.ErrNoEmail
+	}
+
+	return s.issueVerification(ctx, user)
+}
+
+// VerifyEmail consumes a verification token and marks the email it was sent to as verified.
+// @param ctx context.Context for managing the scope of the operation.
+// @param secret string token from the verification message.
+// @return error oops.ErrActionToken if the token is unknown, expired, used or the email has changed since.
+func (s *AppService) VerifyEmail(ctx context.Context, secret string) error {
+	token, err := s.store.ConsumeActionToken(ctx, hashActionSecret(secret), PurposeVerifyEmail)
+	if err != nil {
+		return err
+	}
+
+	if time.Now().After(token.ExpiresAt) {
+		return oops.ErrActionToken
+	}
+
+	// the store only verifies the email if it is still the one the token was sent to
+	err = s.store.VerifyEmail(ctx, token.UserID, token.Email)
+	if errors.Is(err, oops.ErrNoUser) {
+		return oops.ErrActionToken
+	}
+
+	return err
+}
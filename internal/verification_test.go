@@ -0,0 +1,171 @@
+package users_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	users "github.com/mipt-kp-2024-go-beer/user-service/internal"
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/mail"
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/oops"
+)
+
+// outbox is a mailer keeping the messages for the test to read.
+type outbox chan mail.Message
+
+func (o outbox) Send(ctx context.Context, msg mail.Message) error {
+	o <- msg
+	return nil
+}
+
+// link matches the action link of a message sent with the frontend pages of mailEnv.
+var link = regexp.MustCompile(`https://library\.example\.org/\S+`)
+
+// mailEnv is a test environment delivering the messages into the outbox.
+func mailEnv(t *testing.T) (*testEnv, outbox) {
+	t.Helper()
+
+	sent := make(outbox, 16)
+	env := newTestEnv(t, users.WithMailer(sent),
+		users.WithVerifyURL("https://library.example.org/verify"), users.WithResetURL("https://library.example.org/reset"))
+	return env, sent
+}
+
+// receive waits for the next message to the address and returns the token of its link.
+func (o outbox) receive(t *testing.T, to string) string {
+	t.Helper()
+
+	select {
+	case msg := <-o:
+		if msg.To != to {
+			t.Fatalf("message sent to %q, want %q", msg.To, to)
+		}
+		found, err := url.Parse(link.FindString(msg.Body))
+		if err != nil || found.Query().Get("token") == "" {
+			t.Fatalf("message has no link with a token: %q", msg.Body)
+		}
+		return found.Query().Get("token")
+	case <-time.After(time.Second):
+		t.Fatalf("no message sent to %q", to)
+		return ""
+	}
+}
+
+// empty asserts that no message was sent.
+func (o outbox) empty(t *testing.T, why string) {
+	t.Helper()
+
+	select {
+	case msg := <-o:
+		t.Errorf("message to %q sent %s", msg.To, why)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// expiredAction stores an action token that has already expired and returns its secret.
+func expiredAction(t *testing.T, env *testEnv, ID string, email string, purpose string) string {
+	t.Helper()
+
+	secret := "expired-" + purpose
+	sum := sha256.Sum256([]byte(secret))
+	err := env.store.SaveActionToken(context.Background(), users.ActionToken{
+		Hash: hex.EncodeToString(sum[:]), UserID: ID, Purpose: purpose, Email: email, ExpiresAt: time.Now().Add(-time.Second),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return secret
+}
+
+func TestVerifyEmail(t *testing.T) {
+	ctx := context.Background()
+	env, sent := mailEnv(t)
+
+	ID, err := env.service.NewUser(ctx, users.User{Login: "alice", Password: "alice-password", Email: "alice@example.org"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := sent.receive(t, "alice@example.org")
+	session, err := env.service.CreateToken(ctx, "alice", "alice-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	verified := func() bool {
+		t.Helper()
+		user, err := env.store.User(ctx, ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return user.EmailVerified
+	}
+
+	// a fresh token replaces the pending one
+	if err := env.service.SendVerification(ctx, session.Access, ID); err != nil {
+		t.Fatal(err)
+	}
+	second := sent.receive(t, "alice@example.org")
+	if err := env.service.VerifyEmail(ctx, first); !errors.Is(err, oops.ErrActionToken) {
+		t.Errorf("VerifyEmail() with a replaced token error = %v, want ErrActionToken", err)
+	}
+	if err := env.service.VerifyEmail(ctx, expiredAction(t, env, ID, "alice@example.org", users.PurposeVerifyEmail)); !errors.Is(err, oops.ErrActionToken) {
+		t.Errorf("VerifyEmail() with an expired token error = %v, want ErrActionToken", err)
+	}
+	if verified() {
+		t.Fatal("refused tokens verified the email")
+	}
+
+	if err := env.service.VerifyEmail(ctx, second); err != nil {
+		t.Fatalf("VerifyEmail() error = %v", err)
+	}
+	if !verified() {
+		t.Error("VerifyEmail() did not mark the email as verified")
+	}
+	if err := env.service.VerifyEmail(ctx, second); !errors.Is(err, oops.ErrActionToken) {
+		t.Errorf("VerifyEmail() with a used token error = %v, want ErrActionToken", err)
+	}
+
+	// nothing to send for a verified email
+	if err := env.service.SendVerification(ctx, session.Access, ID); err != nil {
+		t.Errorf("SendVerification() of a verified email error = %v", err)
+	}
+	sent.empty(t, "for a verified email")
+}
+
+func TestVerifyChangedEmail(t *testing.T) {
+	ctx := context.Background()
+	env, sent := mailEnv(t)
+	ID, session := env.user(t, "alice", 0)
+	_, other := env.user(t, "bob", 0)
+
+	if err := env.service.SendVerification(ctx, session.Access, ID); !errors.Is(err, oops.ErrNoEmail) {
+		t.Errorf("SendVerification() without an email error = %v, want ErrNoEmail", err)
+	}
+	if err := env.service.SendVerification(ctx, other.Access, ID); !errors.Is(err, oops.ErrWrongPermissions) {
+		t.Errorf("SendVerification() for another user error = %v, want ErrWrongPermissions", err)
+	}
+
+	email := "alice@example.org"
+	if _, err := env.service.EditUser(ctx, session.Access, ID, users.UserPatch{Email: &email}); err != nil {
+		t.Fatal(err)
+	}
+	stale := sent.receive(t, email)
+
+	// a token sent to the previous email is invalidated by the change
+	email = "alice@example.net"
+	if _, err := env.service.EditUser(ctx, session.Access, ID, users.UserPatch{Email: &email}); err != nil {
+		t.Fatal(err)
+	}
+	current := sent.receive(t, email)
+	if err := env.service.VerifyEmail(ctx, stale); !errors.Is(err, oops.ErrActionToken) {
+		t.Errorf("VerifyEmail() with the token of the previous email error = %v, want ErrActionToken", err)
+	}
+	if err := env.service.VerifyEmail(ctx, current); err != nil {
+		t.Errorf("VerifyEmail() of the current email error = %v", err)
+	}
+}
@@ -0,0 +1,164 @@
+package webauthn
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// maxCBORDepth bounds the nesting of decoded items, WebAuthn structures are at most three levels deep.
+const maxCBORDepth = 8
+
+// CBOR major types.
+const (
+	cborUint   = 0
+	cborNegint = 1
+	cborBytes  = 2
+	cborText   = 3
+	cborArray  = 4
+	cborMap    = 5
+	cborSimple = 7
+)
+
+// decodeCBOR decodes the first CBOR data item (RFC 8949) of data and returns the remaining bytes.
+// Only the subset used by WebAuthn is supported: integers as int64, byte strings as []byte,
+// text strings as string, arrays as []any, maps as map[any]any keyed by int64 or string,
+// booleans and null. Indefinite lengths, tags and floats are rejected.
+// @param data []byte encoded item, possibly followed by other data.
+// @return any decoded item, []byte remaining data and an error wrapping ErrMalformed.
+func decodeCBOR(data []byte) (any, []byte, error) {
+	return decodeItem(data, 0)
+}
+
+// decodeItem decodes one item at the given nesting depth.
+func decodeItem(data []byte, depth int) (any, []byte, error) {
+	if depth > maxCBORDepth {
+		return nil, nil, fmt.Errorf("%w: cbor nested too deep", ErrMalformed)
+	}
+
+	major, arg, rest, err := decodeHead(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch major {
+	case cborUint:
+		if arg > math.MaxInt64 {
+			return nil, nil, fmt.Errorf("%w: cbor integer overflows", ErrMalformed)
+		}
+		return int64(arg), rest, nil
+
+	case cborNegint:
+		if arg > math.MaxInt64 {
+			return nil, nil, fmt.Errorf("%w: cbor integer overflows", ErrMalformed)
+		}
+		return -1 - int64(arg), rest, nil
+
+	case cborBytes, cborText:
+		if arg > uint64(len(rest)) {
+			return nil, nil, fmt.Errorf("%w: cbor string is truncated", ErrMalformed)
+		}
+		value := rest[:arg]
+		if major == cborText {
+			return string(value), rest[arg:], nil
+		}
+		return append([]byte(nil), value...), rest[arg:], nil
+
+	case cborArray:
+		// every item takes at least one byte
+		if arg > uint64(len(rest)) {
+			return nil, nil, fmt.Errorf("%w: cbor array is truncated", ErrMalformed)
+		}
+		items := make([]any, arg)
+		for i := range items {
+			if items[i], rest, err = decodeItem(rest, depth+1); err != nil {
+				return nil, nil, err
+			}
+		}
+		return items, rest, nil
+
+	case cborMap:
+		if arg > uint64(len(rest))/2 {
+			return nil, nil, fmt.Errorf("%w: cbor map is truncated", ErrMalformed)
+		}
+		items := make(map[any]any, arg)
+		for range arg {
+			var key, value any
+			if key, rest, err = decodeItem(rest, depth+1); err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, fmt.Errorf("%w: cbor map key of type %T", ErrMalformed, key)
+			}
+			if _, ok := items[key]; ok {
+				return nil, nil, fmt.Errorf("%w: duplicate cbor map key %v", ErrMalformed, key)
+			}
+			if value, rest, err = decodeItem(rest, depth+1); err != nil {
+				return nil, nil, err
+			}
+			items[key] = value
+		}
+		return items, rest, nil
+
+	case cborSimple:
+		switch arg {
+		case 20:
+			return false, rest, nil
+		case 21:
+			return true, rest, nil
+		case 22:
+			return nil, rest, nil
+		}
+	}
+
+	return nil, nil, fmt.Errorf("%w: unsupported cbor item of major type %d", ErrMalformed, major)
+}
+
+// decodeHead splits the initial byte and argument of an item.
+// @param data []byte encoded item.
+// @return major type, argument, remaining data and an error wrapping ErrMalformed.
+func decodeHead(data []byte) (byte, uint64, []byte, error) {
+	if len(data) == 0 {
+		return 0, 0, nil, fmt.Errorf("%w: cbor item is truncated", ErrMalformed)
+	}
+
+	major, info := data[0]>>5, data[0]&0x1f
+	data = data[1:]
+
+	size := 0
+	switch {
+	case info < 24:
+		return major, uint64(info), data, nil
+	case info == 24:
+		size = 1
+	case info == 25:
+		size = 2
+	case info == 26:
+		size = 4
+	case info == 27:
+		size = 8
+	default:
+		// 28-30 are reserved, 31 is an indefinite length
+		return 0, 0, nil, fmt.Errorf("%w: unsupported cbor length encoding %d", ErrMalformed, info)
+	}
+
+	if len(data) < size {
+		return 0, 0, nil, fmt.Errorf("%w: cbor item is truncated", ErrMalformed)
+	}
+
+	var arg uint64
+	switch size {
+	case 1:
+		arg = uint64(data[0])
+	case 2:
+		arg = uint64(binary.BigEndian.Uint16(data))
+	case 4:
+		arg = uint64(binary.BigEndian.Uint32(data))
+	case 8:
+		arg = binary.BigEndian.Uint64(data)
+	}
+
+	return major, arg, data[size:], nil
+}
@@ -0,0 +1,129 @@
+package webauthn
+
+import "time"
+
+// The JSON forms of the ceremony options and responses, as produced by PublicKeyCredential.toJSON()
+// and accepted by PublicKeyCredential.parseCreationOptionsFromJSON() in browsers.
+// Binary values are base64url without padding.
+
+const credentialType = "public-key"
+
+// RelyingParty names the relying party to the authenticator.
+type RelyingParty struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// UserEntity names the account a credential is created for.
+type UserEntity struct {
+	ID          string `json:"id"` // user handle, returned by discoverable credentials at login
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+// CredentialParameter is an accepted credential algorithm.
+type CredentialParameter struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+// CredentialDescriptor refers to an existing credential.
+type CredentialDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+// AuthenticatorSelection states the requirements on the authenticator.
+type AuthenticatorSelection struct {
+	ResidentKey      string `json:"residentKey,omitempty"`
+	UserVerification string `json:"userVerification,omitempty"`
+}
+
+// CreationOptions start a registration ceremony.
+type CreationOptions struct {
+	Challenge              string                 `json:"challenge"`
+	RP                     RelyingParty           `json:"rp"`
+	User                   UserEntity             `json:"user"`
+	PubKeyCredParams       []CredentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout"` // milliseconds
+	ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection AuthenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                 `json:"attestation"`
+}
+
+// RequestOptions start an assertion ceremony.
+type RequestOptions struct {
+	Challenge        string                 `json:"challenge"`
+	Timeout          int64                  `json:"timeout"` // milliseconds
+	RPID             string                 `json:"rpId"`
+	AllowCredentials []CredentialDescriptor `json:"allowCredentials"` // empty lets the user pick a discoverable credential
+	UserVerification string                 `json:"userVerification"`
+}
+
+// RegistrationResponse is the result of navigator.credentials.create().
+type RegistrationResponse struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AttestationObject string `json:"attestationObject"`
+	} `json:"response"`
+}
+
+// AssertionResponse is the result of navigator.credentials.get().
+type AssertionResponse struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature         string `json:"signature"`
+		UserHandle        string `json:"userHandle,omitempty"`
+	} `json:"response"`
+}
+
+// descriptors lists credential IDs as descriptors.
+func descriptors(ids []string) []CredentialDescriptor {
+	list := make([]CredentialDescriptor, len(ids))
+	for i, id := range ids {
+		list[i] = CredentialDescriptor{Type: credentialType, ID: id}
+	}
+	return list
+}
+
+// CreationOptions builds the options of a registration ceremony for ES256 passkeys without attestation.
+// @param challenge string issued for the ceremony, base64url without padding.
+// @param user UserEntity the credential is created for.
+// @param exclude []string IDs of the credentials the user already has.
+// @param timeout time.Duration of the ceremony.
+// @return CreationOptions to be passed to the browser.
+func (c Config) CreationOptions(challenge string, user UserEntity, exclude []string, timeout time.Duration) CreationOptions {
+	return CreationOptions{
+		Challenge:          challenge,
+		RP:                 RelyingParty{ID: c.RPID, Name: c.RPName},
+		User:               user,
+		PubKeyCredParams:   []CredentialParameter{{Type: credentialType, Alg: AlgES256}},
+		Timeout:            timeout.Milliseconds(),
+		ExcludeCredentials: descriptors(exclude),
+		AuthenticatorSelection: AuthenticatorSelection{
+			ResidentKey:      "preferred",
+			UserVerification: "preferred",
+		},
+		Attestation: "none",
+	}
+}
+
+// RequestOptions builds the options of an assertion ceremony.
+// @param challenge string issued for the ceremony, base64url without padding.
+// @param allow []string IDs of the credentials of the user, empty for discoverable credentials.
+// @param timeout time.Duration of the ceremony.
+// @return RequestOptions to be passed to the browser.
+func (c Config) RequestOptions(challenge string, allow []string, timeout time.Duration) RequestOptions {
+	return RequestOptions{
+		Challenge:        challenge,
+		Timeout:          timeout.Milliseconds(),
+		RPID:             c.RPID,
+		AllowCredentials: descriptors(allow),
+		UserVerification: "preferred",
+	}
+}
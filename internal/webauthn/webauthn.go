@@ -0,0 +1,321 @@
+// Package webauthn verifies the registration and assertion ceremonies of WebAuthn Level 2 relying parties.
+// It supports what passkeys need: attestation "none" and ES256 (ECDSA P-256 with SHA-256) credentials.
+package webauthn
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+)
+
+// Ceremony types found in the client data.
+const (
+	TypeCreate = "webauthn.create"
+	TypeGet    = "webauthn.get"
+)
+
+// AlgES256 is the COSE identifier of ECDSA P-256 with SHA-256, the only supported algorithm.
+const AlgES256 = -7
+
+// Flags of the authenticator data.
+const (
+	FlagUserPresent  = 0x01
+	FlagUserVerified = 0x04
+	FlagAttested     = 0x40 // attested credential data follows
+	FlagExtensions   = 0x80 // extension data follows
+)
+
+var (
+	ErrMalformed   = errors.New("malformed webauthn data")
+	ErrVerify      = errors.New("webauthn verification failed")
+	ErrUnsupported = errors.New("unsupported webauthn credential")
+)
+
+// Config identifies the relying party.
+type Config struct {
+	RPID    string   `yaml:"rpid"`    // effective domain, e.g. "library.example.org"
+	RPName  string   `yaml:"rpname"`  // name shown by authenticators
+	Origins []string `yaml:"origins"` // origins of the pages running the ceremonies, e.g. "https://library.example.org"
+}
+
+// ClientData is the part of the client data JSON that is verified.
+type ClientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"` // base64url without padding
+	Origin    string `json:"origin"`
+}
+
+// ParseClientData decodes the client data JSON, the challenge is only returned not checked.
+// @param clientDataJSON []byte as sent by the browser.
+// @return ClientData and an error wrapping ErrMalformed.
+func ParseClientData(clientDataJSON []byte) (ClientData, error) {
+	var data ClientData
+	if err := json.Unmarshal(clientDataJSON, &data); err != nil {
+		return ClientData{}, fmt.Errorf("%w: client data: %v", ErrMalformed, err)
+	}
+
+	return data, nil
+}
+
+// AuthenticatorData is the decoded authenticator data.
+type AuthenticatorData struct {
+	RPIDHash     []byte
+	Flags        byte
+	SignCount    uint32
+	CredentialID []byte // only with FlagAttested
+	PublicKey    []byte // COSE key, only with FlagAttested
+}
+
+// UserVerified tells whether the authenticator verified the user with a PIN or biometrics.
+func (d AuthenticatorData) UserVerified() bool {
+	return d.Flags&FlagUserVerified != 0
+}
+
+// ParseAuthenticatorData decodes the authenticator data.
+// @param data []byte raw authenticator data.
+// @return AuthenticatorData and an error wrapping ErrMalformed.
+func ParseAuthenticatorData(data []byte) (AuthenticatorData, error) {
+	// rpIdHash(32) flags(1) signCount(4)
+	if len(data) < 37 {
+		return AuthenticatorData{}, fmt.Errorf("%w: authenticator data is too short", ErrMalformed)
+	}
+
+	parsed := AuthenticatorData{
+		RPIDHash:  data[:32],
+		Flags:     data[32],
+		SignCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	rest := data[37:]
+
+	if parsed.Flags&FlagAttested != 0 {
+		// aaguid(16) credentialIdLength(2) credentialId publicKey
+		if len(rest) < 18 {
+			return AuthenticatorData{}, fmt.Errorf("%w: attested credential data is too short", ErrMalformed)
+		}
+		length := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if length == 0 || len(rest) < length {
+			return AuthenticatorData{}, fmt.Errorf("%w: credential ID is truncated", ErrMalformed)
+		}
+		parsed.CredentialID = rest[:length]
+		rest = rest[length:]
+
+		// the key is followed by the extensions, its length is only known once decoded
+		_, after, err := decodeCBOR(rest)
+		if err != nil {
+			return AuthenticatorData{}, err
+		}
+		parsed.PublicKey = rest[:len(rest)-len(after)]
+		rest = after
+	}
+
+	if parsed.Flags&FlagExtensions != 0 {
+		_, after, err := decodeCBOR(rest)
+		if err != nil {
+			return AuthenticatorData{}, err
+		}
+		rest = after
+	}
+
+	if len(rest) != 0 {
+		return AuthenticatorData{}, fmt.Errorf("%w: trailing bytes after authenticator data", ErrMalformed)
+	}
+
+	return parsed, nil
+}
+
+// ParsePublicKey decodes an ES256 COSE key.
+// @param key []byte COSE_Key as stored at registration.
+// @return *ecdsa.PublicKey and an error wrapping ErrMalformed or ErrUnsupported.
+func ParsePublicKey(key []byte) (*ecdsa.PublicKey, error) {
+	item, rest, err := decodeCBOR(key)
+	if err != nil {
+		return nil, err
+	}
+	fields, ok := item.(map[any]any)
+	if !ok || len(rest) != 0 {
+		return nil, fmt.Errorf("%w: public key is not a cose map", ErrMalformed)
+	}
+
+	// kty 2 (EC2), alg -7 (ES256), crv 1 (P-256)
+	if fields[int64(1)] != int64(2) || fields[int64(3)] != int64(AlgES256) || fields[int64(-1)] != int64(1) {
+		return nil, fmt.Errorf("%w: only ES256 keys on P-256 are supported", ErrUnsupported)
+	}
+
+	x, okX := fields[int64(-2)].([]byte)
+	y, okY := fields[int64(-3)].([]byte)
+	if !okX || !okY || len(x) != 32 || len(y) != 32 {
+		return nil, fmt.Errorf("%w: public key coordinates", ErrMalformed)
+	}
+
+	// rejects points off the curve
+	point := append(append([]byte{4}, x...), y...)
+	if _, err := ecdh.P256().NewPublicKey(point); err != nil {
+		return nil, fmt.Errorf("%w: public key is not on the curve", ErrMalformed)
+	}
+
+	return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+}
+
+// Credential is a public key credential created by a registration ceremony.
+type Credential struct {
+	ID           []byte
+	PublicKey    []byte // COSE key
+	SignCount    uint32
+	UserVerified bool
+}
+
+// Assertion is the signed result of an assertion ceremony.
+type Assertion struct {
+	SignCount    uint32
+	UserVerified bool
+}
+
+// verifyClientData checks the ceremony type, the challenge and the origin of the client data.
+func (c Config) verifyClientData(clientDataJSON []byte, kind string, challenge string) error {
+	data, err := ParseClientData(clientDataJSON)
+	if err != nil {
+		return err
+	}
+
+	if data.Type != kind {
+		return fmt.Errorf("%w: client data type %q, expected %q", ErrVerify, data.Type, kind)
+	}
+	if subtle.ConstantTimeCompare([]byte(data.Challenge), []byte(challenge)) != 1 {
+		return fmt.Errorf("%w: challenge does not match", ErrVerify)
+	}
+	if !slices.Contains(c.Origins, data.Origin) {
+		return fmt.Errorf("%w: origin %q is not allowed", ErrVerify, data.Origin)
+	}
+
+	return nil
+}
+
+// verifyAuthenticatorData checks that the data was produced for this relying party with the user present.
+func (c Config) verifyAuthenticatorData(data AuthenticatorData) error {
+	hash := sha256.Sum256([]byte(c.RPID))
+	if !bytes.Equal(data.RPIDHash, hash[:]) {
+		return fmt.Errorf("%w: relying party ID does not match", ErrVerify)
+	}
+	if data.Flags&FlagUserPresent == 0 {
+		return fmt.Errorf("%w: user was not present", ErrVerify)
+	}
+
+	return nil
+}
+
+// VerifyRegistration verifies the response of a registration ceremony with attestation "none".
+// @param challenge string issued for the ceremony, base64url without padding.
+// @param clientDataJSON []byte from the response.
+// @param attestationObject []byte from the response.
+// @return Credential to be stored and an error wrapping ErrMalformed, ErrVerify or ErrUnsupported.
+func (c Config) VerifyRegistration(challenge string, clientDataJSON []byte, attestationObject []byte) (Credential, error) {
+	if err := c.verifyClientData(clientDataJSON, TypeCreate, challenge); err != nil {
+		return Credential{}, err
+	}
+
+	item, rest, err := decodeCBOR(attestationObject)
+	if err != nil {
+		return Credential{}, err
+	}
+	object, ok := item.(map[any]any)
+	if !ok || len(rest) != 0 {
+		return Credential{}, fmt.Errorf("%w: attestation object is not a map", ErrMalformed)
+	}
+
+	if format, _ := object["fmt"].(string); format != "none" {
+		return Credential{}, fmt.Errorf("%w: attestation format %q, only \"none\" is accepted", ErrUnsupported, format)
+	}
+	if statement, ok := object["attStmt"].(map[any]any); !ok || len(statement) != 0 {
+		return Credential{}, fmt.Errorf("%w: attestation statement of format none must be empty", ErrMalformed)
+	}
+	raw, ok := object["authData"].([]byte)
+	if !ok {
+		return Credential{}, fmt.Errorf("%w: attestation object has no authenticator data", ErrMalformed)
+	}
+
+	data, err := ParseAuthenticatorData(raw)
+	if err != nil {
+		return Credential{}, err
+	}
+	if err := c.verifyAuthenticatorData(data); err != nil {
+		return Credential{}, err
+	}
+	if data.Flags&FlagAttested == 0 {
+		return Credential{}, fmt.Errorf("%w: no attested credential data", ErrMalformed)
+	}
+
+	if _, err := ParsePublicKey(data.PublicKey); err != nil {
+		return Credential{}, err
+	}
+
+	return Credential{
+		ID:           data.CredentialID,
+		PublicKey:    data.PublicKey,
+		SignCount:    data.SignCount,
+		UserVerified: data.UserVerified(),
+	}, nil
+}
+
+// VerifyAssertion verifies the response of an assertion ceremony against a stored credential.
+// The sign count is only returned, the caller compares it with the stored one.
+// @param challenge string issued for the ceremony, base64url without padding.
+// @param publicKey []byte COSE key of the credential.
+// @param clientDataJSON []byte from the response.
+// @param authenticatorData []byte from the response.
+// @param signature []byte ASN.1 ECDSA signature from the response.
+// @return Assertion and an error wrapping ErrMalformed or ErrVerify.
+func (c Config) VerifyAssertion(challenge string, publicKey []byte, clientDataJSON []byte, authenticatorData []byte, signature []byte) (Assertion, error) {
+	if err := c.verifyClientData(clientDataJSON, TypeGet, challenge); err != nil {
+		return Assertion{}, err
+	}
+
+	data, err := ParseAuthenticatorData(authenticatorData)
+	if err != nil {
+		return Assertion{}, err
+	}
+	if err := c.verifyAuthenticatorData(data); err != nil {
+		return Assertion{}, err
+	}
+
+	key, err := ParsePublicKey(publicKey)
+	if err != nil {
+		return Assertion{}, err
+	}
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := sha256.Sum256(append(append([]byte(nil), authenticatorData...), clientDataHash[:]...))
+	if !ecdsa.VerifyASN1(key, signed[:], signature) {
+		return Assertion{}, fmt.Errorf("%w: signature does not match", ErrVerify)
+	}
+
+	return Assertion{SignCount: data.SignCount, UserVerified: data.UserVerified()}, nil
+}
+
+// EncodeID encodes credential IDs, user handles and challenges as in the JSON of the ceremonies.
+func EncodeID(id []byte) string {
+	return base64.RawURLEncoding.EncodeToString(id)
+}
+
+// DecodeID decodes base64url values of the ceremonies, padding is tolerated.
+// @param id string base64url value.
+// @return []byte and an error wrapping ErrMalformed.
+func DecodeID(id string) ([]byte, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(id, "="))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+
+	return raw, nil
+}
@@ -0,0 +1,278 @@
+package webauthn_test
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/webauthn"
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/webauthn/webauthntest"
+)
+
+const origin = "https://library.example.org"
+
+var config = webauthn.Config{RPID: "library.example.org", RPName: "Library", Origins: []string{origin}}
+
+var user = webauthn.UserEntity{ID: webauthn.EncodeID([]byte("42")), Name: "alice", DisplayName: "Alice"}
+
+func newChallenge(t *testing.T) string {
+	t.Helper()
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		t.Fatal(err)
+	}
+	return webauthn.EncodeID(raw)
+}
+
+func decode(t *testing.T, value string) []byte {
+	t.Helper()
+	raw, err := webauthn.DecodeID(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+// register runs a registration ceremony of the relying party rp and verifies it with config.
+func register(t *testing.T, a *webauthntest.Authenticator, rp webauthn.Config, challenge string) (webauthn.RegistrationResponse, webauthn.Credential, error) {
+	t.Helper()
+
+	response, err := a.Register(rp.CreationOptions(challenge, user, nil, time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	credential, err := config.VerifyRegistration(challenge,
+		decode(t, response.Response.ClientDataJSON), decode(t, response.Response.AttestationObject))
+	return response, credential, err
+}
+
+// verify checks an assertion response against the public key with config.
+func verify(t *testing.T, response webauthn.AssertionResponse, challenge string, publicKey []byte) (webauthn.Assertion, error) {
+	t.Helper()
+
+	return config.VerifyAssertion(challenge, publicKey,
+		decode(t, response.Response.ClientDataJSON),
+		decode(t, response.Response.AuthenticatorData),
+		decode(t, response.Response.Signature))
+}
+
+func TestRegistration(t *testing.T) {
+	challenge := newChallenge(t)
+	options := config.CreationOptions(challenge, user, nil, time.Minute)
+	if options.Attestation != "none" || len(options.PubKeyCredParams) != 1 || options.PubKeyCredParams[0].Alg != webauthn.AlgES256 {
+		t.Fatalf("CreationOptions() = %+v, want ES256 with attestation none", options)
+	}
+
+	response, credential, err := register(t, webauthntest.New(origin), config, challenge)
+	if err != nil {
+		t.Fatalf("VerifyRegistration() error = %v", err)
+	}
+
+	if webauthn.EncodeID(credential.ID) != response.ID {
+		t.Errorf("credential ID = %s, want %s", webauthn.EncodeID(credential.ID), response.ID)
+	}
+	if credential.SignCount != 0 || !credential.UserVerified {
+		t.Errorf("credential = %+v, want sign count 0 and a verified user", credential)
+	}
+	if _, err := webauthn.ParsePublicKey(credential.PublicKey); err != nil {
+		t.Errorf("ParsePublicKey() of the registered key error = %v", err)
+	}
+}
+
+func TestRegistrationRejects(t *testing.T) {
+	challenge := newChallenge(t)
+	evil := webauthn.Config{RPID: "evil.example", Origins: []string{origin}}
+
+	t.Run("other challenge", func(t *testing.T) {
+		a := webauthntest.New(origin)
+		response, err := a.Register(config.CreationOptions(newChallenge(t), user, nil, time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = config.VerifyRegistration(challenge,
+			decode(t, response.Response.ClientDataJSON), decode(t, response.Response.AttestationObject))
+		if !errors.Is(err, webauthn.ErrVerify) {
+			t.Errorf("VerifyRegistration() error = %v, want ErrVerify", err)
+		}
+	})
+
+	t.Run("wrong origin", func(t *testing.T) {
+		_, _, err := register(t, webauthntest.New("https://evil.example"), config, challenge)
+		if !errors.Is(err, webauthn.ErrVerify) {
+			t.Errorf("VerifyRegistration() error = %v, want ErrVerify", err)
+		}
+	})
+
+	t.Run("wrong rpIdHash", func(t *testing.T) {
+		_, _, err := register(t, webauthntest.New(origin), evil, challenge)
+		if !errors.Is(err, webauthn.ErrVerify) {
+			t.Errorf("VerifyRegistration() error = %v, want ErrVerify", err)
+		}
+	})
+
+	t.Run("assertion client data", func(t *testing.T) {
+		response, err := webauthntest.New(origin).Register(config.CreationOptions(challenge, user, nil, time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		clientData, _ := json.Marshal(webauthn.ClientData{Type: webauthn.TypeGet, Challenge: challenge, Origin: origin})
+
+		_, err = config.VerifyRegistration(challenge, clientData, decode(t, response.Response.AttestationObject))
+		if !errors.Is(err, webauthn.ErrVerify) {
+			t.Errorf("VerifyRegistration() error = %v, want ErrVerify", err)
+		}
+	})
+
+	t.Run("malformed attestation", func(t *testing.T) {
+		clientData, _ := json.Marshal(webauthn.ClientData{Type: webauthn.TypeCreate, Challenge: challenge, Origin: origin})
+
+		_, err := config.VerifyRegistration(challenge, clientData, []byte("not cbor"))
+		if !errors.Is(err, webauthn.ErrMalformed) {
+			t.Errorf("VerifyRegistration() error = %v, want ErrMalformed", err)
+		}
+	})
+
+	t.Run("excluded credential", func(t *testing.T) {
+		a := webauthntest.New(origin)
+		first, _, err := register(t, a, config, challenge)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = a.Register(config.CreationOptions(newChallenge(t), user, []string{first.ID}, time.Minute))
+		if !errors.Is(err, webauthntest.ErrExcluded) {
+			t.Errorf("Register() error = %v, want ErrExcluded", err)
+		}
+	})
+}
+
+func TestAssertion(t *testing.T) {
+	a := webauthntest.New(origin)
+	registered, credential, err := register(t, a, config, newChallenge(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for want := uint32(1); want <= 2; want++ {
+		challenge := newChallenge(t)
+		response, err := a.Login(config.RequestOptions(challenge, []string{registered.ID}, time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.ID != registered.ID || response.Response.UserHandle != user.ID {
+			t.Fatalf("Login() answered with credential %s of %s, want %s of %s", response.ID, response.Response.UserHandle, registered.ID, user.ID)
+		}
+
+		assertion, err := verify(t, response, challenge, credential.PublicKey)
+		if err != nil {
+			t.Fatalf("VerifyAssertion() error = %v", err)
+		}
+		if assertion.SignCount != want || !assertion.UserVerified {
+			t.Errorf("VerifyAssertion() = %+v, want sign count %d and a verified user", assertion, want)
+		}
+	}
+
+	// discoverable credentials answer without a list of allowed credentials
+	challenge := newChallenge(t)
+	a.UserVerified = false
+	response, err := a.Login(config.RequestOptions(challenge, nil, time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertion, err := verify(t, response, challenge, credential.PublicKey)
+	if err != nil {
+		t.Fatalf("VerifyAssertion() of a discoverable credential error = %v", err)
+	}
+	if assertion.UserVerified {
+		t.Error("VerifyAssertion() reports a verified user the authenticator did not verify")
+	}
+}
+
+func TestAssertionRejects(t *testing.T) {
+	a := webauthntest.New(origin)
+	registered, credential, err := register(t, a, config, newChallenge(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, other, err := register(t, webauthntest.New(origin), config, newChallenge(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	login := func(a *webauthntest.Authenticator, rp webauthn.Config, id string) (webauthn.AssertionResponse, string) {
+		challenge := newChallenge(t)
+		response, err := a.Login(rp.RequestOptions(challenge, []string{id}, time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response, challenge
+	}
+
+	t.Run("other challenge", func(t *testing.T) {
+		response, _ := login(a, config, registered.ID)
+		if _, err := verify(t, response, newChallenge(t), credential.PublicKey); !errors.Is(err, webauthn.ErrVerify) {
+			t.Errorf("VerifyAssertion() error = %v, want ErrVerify", err)
+		}
+	})
+
+	t.Run("wrong origin", func(t *testing.T) {
+		a.Origin = "https://evil.example"
+		defer func() { a.Origin = origin }()
+
+		response, challenge := login(a, config, registered.ID)
+		if _, err := verify(t, response, challenge, credential.PublicKey); !errors.Is(err, webauthn.ErrVerify) {
+			t.Errorf("VerifyAssertion() error = %v, want ErrVerify", err)
+		}
+	})
+
+	t.Run("wrong rpIdHash", func(t *testing.T) {
+		// a credential of another relying party, presented through an allowed origin
+		evil := webauthn.Config{RPID: "evil.example", Origins: []string{origin}}
+		phished := webauthntest.New(origin)
+		challenge := newChallenge(t)
+		registration, err := phished.Register(evil.CreationOptions(challenge, user, nil, time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		stolen, err := evil.VerifyRegistration(challenge,
+			decode(t, registration.Response.ClientDataJSON), decode(t, registration.Response.AttestationObject))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		response, challenge := login(phished, evil, registration.ID)
+		if _, err := verify(t, response, challenge, stolen.PublicKey); !errors.Is(err, webauthn.ErrVerify) {
+			t.Errorf("VerifyAssertion() error = %v, want ErrVerify", err)
+		}
+	})
+
+	t.Run("key of another credential", func(t *testing.T) {
+		response, challenge := login(a, config, registered.ID)
+		if _, err := verify(t, response, challenge, other.PublicKey); !errors.Is(err, webauthn.ErrVerify) {
+			t.Errorf("VerifyAssertion() error = %v, want ErrVerify", err)
+		}
+	})
+
+	t.Run("tampered authenticator data", func(t *testing.T) {
+		response, challenge := login(a, config, registered.ID)
+		data := decode(t, response.Response.AuthenticatorData)
+		data[36]++ // sign count
+		response.Response.AuthenticatorData = webauthn.EncodeID(data)
+
+		if _, err := verify(t, response, challenge, credential.PublicKey); !errors.Is(err, webauthn.ErrVerify) {
+			t.Errorf("VerifyAssertion() error = %v, want ErrVerify", err)
+		}
+	})
+
+	t.Run("registration client data", func(t *testing.T) {
+		response, challenge := login(a, config, registered.ID)
+		clientData, _ := json.Marshal(webauthn.ClientData{Type: webauthn.TypeCreate, Challenge: challenge, Origin: origin})
+		response.Response.ClientDataJSON = webauthn.EncodeID(clientData)
+
+		if _, err := verify(t, response, challenge, credential.PublicKey); !errors.Is(err, webauthn.ErrVerify) {
+			t.Errorf("VerifyAssertion() error = %v, want ErrVerify", err)
+		}
+	})
+}
@@ -0,0 +1,180 @@
+// Package webauthntest is a software authenticator producing the responses of a platform authenticator,
+// so that the WebAuthn ceremonies can be exercised offline without a browser.
+package webauthntest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"github.com/mipt-kp-2024-go-beer/user-service/internal/webauthn"
+)
+
+var (
+	ErrExcluded     = errors.New("a credential of the user is already registered")
+	ErrNoCredential = errors.New("no credential matches the options")
+)
+
+// credential is a key pair created by the authenticator.
+type credential struct {
+	key       *ecdsa.PrivateKey
+	rpID      string
+	user      string // user handle
+	signCount uint32
+}
+
+// Authenticator is a software authenticator bound to the origin of the page using it.
+// Its credentials are discoverable and it counts signatures per credential.
+type Authenticator struct {
+	Origin       string
+	UserVerified bool // report user verification, as after a PIN or biometrics
+
+	mux         sync.Mutex
+	credentials map[string]*credential // base64url credential ID is used as a key
+}
+
+// New creates an authenticator used from pages of the origin, verifying users.
+func New(origin string) *Authenticator {
+	return &Authenticator{Origin: origin, UserVerified: true, credentials: make(map[string]*credential)}
+}
+
+// clientData encodes the client data JSON as a browser does.
+func (a *Authenticator) clientData(kind string, challenge string) []byte {
+	data, _ := json.Marshal(webauthn.ClientData{Type: kind, Challenge: challenge, Origin: a.Origin})
+	return data
+}
+
+// authenticatorData encodes the authenticator data, attested is the credential data of a registration.
+func (a *Authenticator) authenticatorData(rpID string, signCount uint32, attested []byte) []byte {
+	hash := sha256.Sum256([]byte(rpID))
+	flags := byte(webauthn.FlagUserPresent)
+	if a.UserVerified {
+		flags |= webauthn.FlagUserVerified
+	}
+	if attested != nil {
+		flags |= webauthn.FlagAttested
+	}
+
+	data := append(hash[:], flags)
+	data = binary.BigEndian.AppendUint32(data, signCount)
+	return append(data, attested...)
+}
+
+// Register answers a registration ceremony with a new ES256 credential and attestation "none".
+// @param options webauthn.CreationOptions from the relying party.
+// @return webauthn.RegistrationResponse to be sent back and ErrExcluded if a listed credential is held.
+func (a *Authenticator) Register(options webauthn.CreationOptions) (webauthn.RegistrationResponse, error) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	for _, excluded := range options.ExcludeCredentials {
+		if _, ok := a.credentials[excluded.ID]; ok {
+			return webauthn.RegistrationResponse{}, ErrExcluded
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return webauthn.RegistrationResponse{}, err
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return webauthn.RegistrationResponse{}, err
+	}
+
+	// COSE_Key: kty EC2, alg ES256, crv P-256, x, y
+	publicKey := encodeMap([][2]any{
+		{1, 2}, {3, webauthn.AlgES256}, {-1, 1},
+		{-2, key.PublicKey.X.FillBytes(make([]byte, 32))},
+		{-3, key.PublicKey.Y.FillBytes(make([]byte, 32))},
+	})
+
+	// aaguid(16) credentialIdLength(2) credentialId publicKey
+	attested := make([]byte, 16)
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(id)))
+	attested = append(append(attested, id...), publicKey...)
+
+	attestation := encodeMap([][2]any{
+		{"fmt", "none"},
+		{"attStmt", [][2]any{}},
+		{"authData", a.authenticatorData(options.RP.ID, 0, attested)},
+	})
+
+	encodedID := webauthn.EncodeID(id)
+	a.credentials[encodedID] = &credential{key: key, rpID: options.RP.ID, user: options.User.ID}
+
+	var response webauthn.RegistrationResponse
+	response.ID = encodedID
+	response.Type = "public-key"
+	response.Response.ClientDataJSON = webauthn.EncodeID(a.clientData(webauthn.TypeCreate, options.Challenge))
+	response.Response.AttestationObject = webauthn.EncodeID(attestation)
+	return response, nil
+}
+
+// Login answers an assertion ceremony with the first allowed credential,
+// or with any credential of the relying party if none are listed.
+// @param options webauthn.RequestOptions from the relying party.
+// @return webauthn.AssertionResponse to be sent back and ErrNoCredential if no credential matches.
+func (a *Authenticator) Login(options webauthn.RequestOptions) (webauthn.AssertionResponse, error) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	id, cred := a.pick(options)
+	if cred == nil {
+		return webauthn.AssertionResponse{}, ErrNoCredential
+	}
+
+	cred.signCount++
+	authData := a.authenticatorData(cred.rpID, cred.signCount, nil)
+	clientData := a.clientData(webauthn.TypeGet, options.Challenge)
+
+	clientDataHash := sha256.Sum256(clientData)
+	signed := sha256.Sum256(append(append([]byte(nil), authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, cred.key, signed[:])
+	if err != nil {
+		return webauthn.AssertionResponse{}, err
+	}
+
+	var response webauthn.AssertionResponse
+	response.ID = id
+	response.Type = "public-key"
+	response.Response.ClientDataJSON = webauthn.EncodeID(clientData)
+	response.Response.AuthenticatorData = webauthn.EncodeID(authData)
+	response.Response.Signature = webauthn.EncodeID(signature)
+	response.Response.UserHandle = cred.user
+	return response, nil
+}
+
+// pick finds the credential answering the options.
+func (a *Authenticator) pick(options webauthn.RequestOptions) (string, *credential) {
+	if len(options.AllowCredentials) == 0 {
+		for id, cred := range a.credentials {
+			if cred.rpID == options.RPID {
+				return id, cred
+			}
+		}
+		return "", nil
+	}
+
+	for _, allowed := range options.AllowCredentials {
+		if cred, ok := a.credentials[allowed.ID]; ok && cred.rpID == options.RPID {
+			return allowed.ID, cred
+		}
+	}
+	return "", nil
+}
+
+// SetSignCount overrides the signature counter of a credential, e.g. to imitate a cloned authenticator.
+func (a *Authenticator) SetSignCount(id string, count uint32) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	if cred, ok := a.credentials[id]; ok {
+		cred.signCount = count
+	}
+}
@@ -0,0 +1,50 @@
+package webauthntest
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// encodeHead encodes the initial byte and argument of a CBOR item in the shortest form.
+func encodeHead(major byte, arg uint64) []byte {
+	switch {
+	case arg < 24:
+		return []byte{major<<5 | byte(arg)}
+	case arg <= 0xff:
+		return []byte{major<<5 | 24, byte(arg)}
+	case arg <= 0xffff:
+		return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(arg))
+	case arg <= 0xffffffff:
+		return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(arg))
+	}
+	return binary.BigEndian.AppendUint64([]byte{major<<5 | 27}, arg)
+}
+
+// encode encodes the values the authenticator produces: integers, byte and text strings and maps
+// given as ordered key-value pairs, so that keys keep the canonical order CTAP2 requires.
+func encode(value any) []byte {
+	switch v := value.(type) {
+	case int:
+		if v < 0 {
+			return encodeHead(1, uint64(-1-v))
+		}
+		return encodeHead(0, uint64(v))
+	case []byte:
+		return append(encodeHead(2, uint64(len(v))), v...)
+	case string:
+		return append(encodeHead(3, uint64(len(v))), v...)
+	case [][2]any:
+		return encodeMap(v)
+	}
+	panic(fmt.Sprintf("webauthntest: cannot encode %T", value))
+}
+
+// encodeMap encodes a map from its ordered key-value pairs.
+func encodeMap(pairs [][2]any) []byte {
+	data := encodeHead(5, uint64(len(pairs)))
+	for _, pair := range pairs {
+		data = append(data, encode(pair[0])...)
+		data = append(data, encode(pair[1])...)
+	}
+	return data
+}
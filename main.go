@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"log"
+	"os"
 
 	"github.com/mipt-kp-2024-go-beer/user-service/internal/app"
 )
@@ -20,6 +21,14 @@ func main() {
 		log.Fatal(err)
 	}
 
+	// user-service migrate [up|down [n]]
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err = app.Migrate(ctx, os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	if err = app.Setup(ctx, config.DB); err != nil {
 		log.Fatal(err)
 	}